@@ -2,16 +2,32 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"image"
 	"image/color"
 	"io"
+	"io/fs"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"gioui.org/app"
 	"gioui.org/font/gofont"
+	"gioui.org/io/key"
+	"gioui.org/io/pointer"
 	"gioui.org/io/system"
 	"gioui.org/layout"
 	"gioui.org/op"
@@ -21,129 +37,2779 @@ import (
 	"gioui.org/unit"
 	"gioui.org/widget"
 	"gioui.org/widget/material"
-	"github.com/lucas-clemente/quic-go/http3"
 )
 
 type Command struct {
-	Operation  string            `json:"operation"`
+	Operation  string            `json:"action"`
 	Parameters map[string]string `json:"parameters"`
 	Timestamp  time.Time         `json:"timestamp"`
+	// IdempotencyKey is sent in the Idempotency-Key header. sendCommand
+	// gives a command without one a new key; a retry sends the command
+	// again with the key it already has.
+	IdempotencyKey string `json:"-"`
 }
 
 type Response struct {
-	Status  string `json:"status"`
-	Data    string `json:"data"`
-	Message string `json:"message"`
+	Status  string            `json:"status"`
+	Data    json.RawMessage   `json:"data"`
+	Message string            `json:"message"`
+	Code    string            `json:"code"`
+	Details map[string]string `json:"details"`
+}
+
+// Err returns the failure described by an error response.
+func (r Response) Err() *ServerError {
+	return &ServerError{Code: r.Code, Message: r.Message, Details: r.Details}
+}
+
+// ServerError is a failed operation as reported by the server. Code is the
+// server's machine-readable error code and may be empty for older servers.
+type ServerError struct {
+	Code    string
+	Message string
+	Details map[string]string
+}
+
+func (e *ServerError) Error() string {
+	if e.Code == "" {
+		return e.Message
+	}
+	return fmt.Sprintf("%s [%s]", e.Message, e.Code)
 }
 
 type Terminal struct {
-	theme           *material.Theme
-	output          []string
-	directoryInput  widget.Editor
-	filterInput     widget.Editor
-	tokenInput      widget.Editor
-	clientIDInput   widget.Editor
-	serverURLInput  widget.Editor
-	executeButton   widget.Clickable
-	outputList      widget.List
-	outputEditor    widget.Editor
-	client          *http.Client
+	window         *app.Window
+	theme          *material.Theme
+	output         []string
+	directoryInput widget.Editor
+	filterInput    widget.Editor
+	searchInput    widget.Editor
+	tokenInput     widget.Editor
+	authScheme     widget.Enum
+	apiKeyHeader   widget.Editor
+	certFileInput  widget.Editor
+	keyFileInput   widget.Editor
+	certs          *clientCertificate
+	authError      string
+	clientIDInput  widget.Editor
+	lockInput      widget.Editor
+	unlockInput    widget.Editor
+	unlockButton   widget.Clickable
+	lock           *sessionLock
+	lockError      string
+	inputMarks     []int
+	serverURLInput widget.Editor
+	contentInput   widget.Editor
+	uploadInput    widget.Editor
+	downloadInput  widget.Editor
+	scriptInput    widget.Editor
+	execInput      widget.Editor
+	varsInput      widget.Editor
+	transformInput widget.Editor
+	transforms     []transform
+	transformError string
+	operation      widget.Enum
+	operationSet   bool
+	language       widget.Enum
+	executeButton  widget.Clickable
+	uploadButton   widget.Clickable
+	downloadButton widget.Clickable
+	folderButton   widget.Clickable
+	archiveChoice  widget.Enum
+	refreshButton  widget.Clickable
+	searchButton   widget.Clickable
+	exportButton   widget.Clickable
+	scriptButton   widget.Clickable
+	execButton     widget.Clickable
+	retryButton    widget.Clickable
+	retryCommand   *Command
+	execMu         sync.Mutex
+	configPath     widget.Editor
+	configText     widget.Editor
+	configOpen     widget.Clickable
+	configFormat   widget.Clickable
+	configReview   widget.Clickable
+	configSave     widget.Clickable
+	configCancel   widget.Clickable
+	configEdit     configEdit
+	configDiff     string
+	configError    string
+	followPath     widget.Editor
+	followButton   widget.Clickable
+	followJump     widget.Clickable
+	followList     widget.List
+	followMu       sync.Mutex
+	follow         *followView
+	followStop     context.CancelFunc
+	execOut        execOutput
+	stopOnError    widget.Bool
+	diagButton     widget.Clickable
+	showDiag       bool
+	watchPath      widget.Bool
+	paths          *pathWatcher
+	formatButton   widget.Clickable
+	jsonMode       widget.Bool
+	vimKeys        widget.Bool
+	browser        *browserModel
+	browserClick   widget.Clickable
+	browserFocus   bool
+	uploadProgress float32
+	uploadMu       sync.Mutex
+	uploadRate     *transferRate
+	uploadTotal    int64
+	folderProgress float32
+	maxFileSize    int64
+	diskGauge      float32
+	diskSummary    string
+	serverVersion  string
+	lastTiming     requestTiming
+	latencies      *latencyWindow
+	listings       *listingCache
+	downloads      *downloadManager
+	downloadCtrls  map[string]*downloadControls
+	recentPaths    []string
+	bookmarks      *bookmarkStore
+	bookmarkLabel  widget.Editor
+	bookmarkAdd    widget.Clickable
+	bookmarkCtrls  []bookmarkControls
+	paletteOpen    bool
+	paletteInput   widget.Editor
+	paletteClicks  []widget.Clickable
+	paletteMatches []paletteCommand
+	contentWarning string
+	searchResults  []searchMatch
+	lastListing    []string
+	lastResults    string
+	jsonError      string
+	varError       string
+	outputList     widget.List
+	outputEditor   widget.Editor
+	outputLines    []int
+	minimapTag     bool
+	client         *http.Client
+	conns          *connTracker
+	queue          *commandQueue
+	capabilities   atomic.Pointer[serverCapabilities]
+	helpOpen       bool
+	helpList       widget.List
+	helpClose      widget.Clickable
+}
+
+func newTerminal() *Terminal {
+	conns := &connTracker{}
+	certs := &clientCertificate{}
+	t := &Terminal{
+		theme:     material.NewTheme(gofont.Collection()),
+		latencies: newLatencyWindow(30),
+		listings:  newListingCache(time.Minute),
+		client: &http.Client{
+			Transport: newTransport(loadTransportSettings(transportSettingsPath()), conns, certs),
+			Timeout:   30 * time.Second,
+		},
+		conns:         conns,
+		certs:         certs,
+		browser:       newBrowserModel(),
+		paths:         newPathWatcher(udpPathProbe{}),
+		lock:          newSessionLock(time.Now()),
+		downloadCtrls: make(map[string]*downloadControls),
+	}
+	t.downloads = newDownloadManager(downloadStatePath(), t.downloadFile, t.appendOutput, t.invalidate)
+	t.bookmarks = loadBookmarks(bookmarksPath())
+	t.queue = newCommandQueue(t.invalidate)
+	go t.queue.Work()
+
+	// Set default values
+	t.serverURLInput.SetText("https://your-server-address/api/operation")
+	t.directoryInput.SetText("/allowed/path")
+	t.filterInput.SetText("*.txt")
+	t.tokenInput.SetText("YOUR_AUTH_TOKEN")
+	t.clientIDInput.SetText("YOUR_CLIENT_ID")
+	t.apiKeyHeader.SetText(defaultAPIKeyHeader)
+
+	t.operation.Value = "list_files"
+	t.language.Value = defaultLocale
+	t.authScheme.Value = string(authBearer)
+	t.archiveChoice.Value = string(archiveTarGz)
+
+	t.contentInput.SingleLine = false
+	t.uploadInput.SingleLine = false
+	t.scriptInput.SingleLine = false
+	t.varsInput.SingleLine = false
+	t.transformInput.SingleLine = false
+	t.stopOnError.Value = true
+	t.outputEditor.SingleLine = false
+	t.outputEditor.Submit = false
+	t.outputList.Axis = layout.Vertical
+	t.paletteInput.SingleLine = true
+	t.execInput.SingleLine = true
+	t.configPath.SingleLine = true
+	t.configText.SingleLine = false
+	t.followPath.SingleLine = true
+	t.bookmarkLabel.SingleLine = true
+	t.followList.Axis = layout.Vertical
+	t.helpList.Axis = layout.Vertical
+	t.followList.ScrollToEnd = true
+	t.lockInput.SingleLine = true
+	t.apiKeyHeader.SingleLine = true
+	t.certFileInput.SingleLine = true
+	t.keyFileInput.SingleLine = true
+	t.unlockInput.SingleLine = true
+	t.unlockInput.Submit = true
+	t.unlockInput.Mask = '•'
+	t.paletteInput.Submit = true
+
+	return t
+}
+
+func (t *Terminal) appendOutput(text string) {
+	t.output = append(t.output, text)
+	t.outputLines = append(t.outputLines, lineLengths(text)...)
+	var builder strings.Builder
+	for _, line := range t.output {
+		builder.WriteString(line)
+		builder.WriteString("\n")
+	}
+	t.outputEditor.SetText(builder.String())
+	t.invalidate()
+}
+
+// invalidate asks the window to redraw after state changed outside of a
+// frame, e.g. from an operation goroutine.
+func (t *Terminal) invalidate() {
+	if t.window != nil {
+		t.window.Invalidate()
+	}
+}
+
+// focusOrder lists the editors that Tab and Shift+Tab cycle through, in the
+// order they are laid out.
+func (t *Terminal) focusOrder() []*widget.Editor {
+	return []*widget.Editor{
+		&t.serverURLInput,
+		&t.directoryInput,
+		&t.filterInput,
+		&t.tokenInput,
+		&t.clientIDInput,
+		&t.contentInput,
+		&t.execInput,
+		&t.uploadInput,
+		&t.downloadInput,
+	}
+}
+
+// nextFocus returns the index that follows current in a cycle of n fields,
+// or precedes it when backward is set. With nothing focused (current < 0)
+// it starts from the first or last field.
+func nextFocus(current, n int, backward bool) int {
+	if n == 0 {
+		return -1
+	}
+	if current < 0 {
+		if backward {
+			return n - 1
+		}
+		return 0
+	}
+	if backward {
+		return (current - 1 + n) % n
+	}
+	return (current + 1) % n
+}
+
+func (t *Terminal) cycleFocus(backward bool) {
+	order := t.focusOrder()
+	current := -1
+	for i, ed := range order {
+		if ed.Focused() {
+			current = i
+			break
+		}
+	}
+	if next := nextFocus(current, len(order), backward); next >= 0 {
+		order[next].Focus()
+	}
+}
+
+// editorMarks sums up the length and caret of every input field, so a
+// keystroke in any of them shows as a change between frames.
+func (t *Terminal) editorMarks() []int {
+	editors := append(t.focusOrder(), &t.searchInput, &t.scriptInput, &t.varsInput, &t.transformInput, &t.lockInput, &t.followPath)
+	marks := make([]int, 0, 2*len(editors))
+	for _, ed := range editors {
+		start, _ := ed.Selection()
+		marks = append(marks, ed.Len(), start)
+	}
+	return marks
+}
+
+// trackInput counts pointer input anywhere in the window and typing in
+// any field as activity for the session lock. The pointer handler lets
+// events through to the widgets below it.
+func (t *Terminal) trackInput(gtx layout.Context) {
+	now := time.Now()
+	for _, e := range gtx.Events(t.lock) {
+		if _, ok := e.(pointer.Event); ok {
+			t.lock.Touch(now)
+		}
+	}
+	if marks := t.editorMarks(); !slices.Equal(marks, t.inputMarks) {
+		t.inputMarks = marks
+		t.lock.Touch(now)
+	}
+
+	pass := pointer.PassOp{}.Push(gtx.Ops)
+	area := clip.Rect{Max: gtx.Constraints.Max}.Push(gtx.Ops)
+	pointer.InputOp{Tag: t.lock, Types: pointer.Press | pointer.Move | pointer.Scroll}.Add(gtx.Ops)
+	area.Pop()
+	pass.Pop()
+}
+
+// handleLock applies the Lock after field, keeps the token field empty
+// while locked and unlocks once a token is entered on the lock screen.
+func (t *Terminal) handleLock() {
+	now := time.Now()
+	for _, e := range t.lockInput.Events() {
+		if _, ok := e.(widget.ChangeEvent); ok {
+			idle, err := parseIdleMinutes(t.lockInput.Text())
+			t.lockError = ""
+			if err != nil {
+				t.lockError = err.Error()
+			}
+			t.lock.SetIdle(idle, now)
+		}
+	}
+
+	if !t.lock.Locked() {
+		return
+	}
+	if t.tokenInput.Len() > 0 {
+		t.tokenInput.SetText("")
+	}
+	unlock := t.unlockButton.Clicked()
+	for _, e := range t.unlockInput.Events() {
+		if _, ok := e.(widget.SubmitEvent); ok {
+			unlock = true
+		}
+	}
+	if !unlock {
+		return
+	}
+	if err := t.lock.Unlock(t.unlockInput.Text(), now); err != nil {
+		t.lockError = err.Error()
+		return
+	}
+	t.tokenInput.SetText(t.unlockInput.Text())
+	t.unlockInput.SetText("")
+	t.lockError = ""
+	t.appendOutput("$ Session unlocked")
+}
+
+// watchLock locks the session once it has been idle too long, checking
+// every few seconds so it locks even while no frames are drawn.
+func (t *Terminal) watchLock() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		if t.lock.Check(now) {
+			t.appendOutput("$ Session locked after inactivity")
+		}
+	}
+}
+
+// layoutLocked draws the lock screen in place of the terminal.
+func (t *Terminal) layoutLocked(gtx layout.Context) layout.Dimensions {
+	paint.Fill(gtx.Ops, color.NRGBA{R: 40, G: 44, B: 52, A: 255})
+	return layout.UniformInset(unit.Dp(20)).Layout(gtx, func(gtx layout.Context) layout.Dimensions {
+		rows := []layout.FlexChild{
+			layout.Rigid(material.Label(t.theme, unit.Sp(16), "Session locked after inactivity.").Layout),
+			layout.Rigid(layout.Spacer{Height: unit.Dp(10)}.Layout),
+			layout.Rigid(material.Label(t.theme, unit.Sp(14), "Auth Token:").Layout),
+			layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+				ed := material.Editor(t.theme, &t.unlockInput, "")
+				ed.Font.Style = text.Mono
+				return ed.Layout(gtx)
+			}),
+			layout.Rigid(layout.Spacer{Height: unit.Dp(10)}.Layout),
+			layout.Rigid(material.Button(t.theme, &t.unlockButton, "Unlock").Layout),
+		}
+		if t.lockError != "" {
+			lbl := material.Label(t.theme, unit.Sp(12), t.lockError)
+			lbl.Color = color.NRGBA{R: 229, G: 192, B: 123, A: 255}
+			rows = append(rows, layout.Rigid(lbl.Layout))
+		}
+		return layout.Flex{Axis: layout.Vertical}.Layout(gtx, rows...)
+	})
+}
+
+// handleKeys runs the window-wide shortcuts: Ctrl+Enter executes the
+// command, Tab/Shift+Tab move between fields and Ctrl+P opens the command
+// palette, which Escape closes. F1, or "?" outside the input fields,
+// toggles the help overlay, which Escape closes too. Otherwise Escape
+// cancels the running operation and Shift+Escape drops the queued ones. Plain Enter is left to
+// the editors so multiline fields still get new lines.
+func (t *Terminal) handleKeys(gtx layout.Context) {
+	for _, e := range gtx.Events(t) {
+		ke, ok := e.(key.Event)
+		if !ok || ke.State != key.Press {
+			continue
+		}
+		switch ke.Name {
+		case key.NameReturn, key.NameEnter:
+			if ke.Modifiers.Contain(key.ModShortcut) {
+				t.executeCommand()
+			}
+		case key.NameTab:
+			t.cycleFocus(ke.Modifiers.Contain(key.ModShift))
+		case "P":
+			t.togglePalette()
+		case key.NameF1, "?":
+			t.toggleHelp()
+		case key.NameEscape:
+			switch {
+			case t.paletteOpen:
+				t.togglePalette()
+			case t.helpOpen:
+				t.toggleHelp()
+			case ke.Modifiers.Contain(key.ModShift):
+				t.clearPending()
+			default:
+				t.cancelCurrent()
+			}
+		}
+	}
+
+	keys := "Short-[" + key.NameReturn + "," + key.NameEnter + "]|(Shift)-" + key.NameTab + "|Short-P|(Shift)-" + key.NameEscape + "|" + key.NameF1
+	if !t.typing() {
+		// Taken only outside the fields, where it would otherwise be
+		// typed.
+		keys += "|(Shift)-?"
+	}
+	key.InputOp{Tag: t, Keys: key.Set(keys)}.Add(gtx.Ops)
+}
+
+// typing reports whether one of the input fields has keyboard focus.
+func (t *Terminal) typing() bool {
+	editors := append(t.focusOrder(), &t.searchInput, &t.scriptInput, &t.varsInput, &t.transformInput, &t.lockInput, &t.unlockInput,
+		&t.followPath, &t.apiKeyHeader, &t.certFileInput, &t.keyFileInput, &t.configPath, &t.configText, &t.bookmarkLabel, &t.paletteInput, &t.outputEditor)
+	for _, ed := range editors {
+		if ed.Focused() {
+			return true
+		}
+	}
+	return false
+}
+
+// toggleHelp opens or closes the help overlay. Opening it before the
+// server's capabilities are known fetches them, and the overlay narrows to
+// that server once they arrive.
+func (t *Terminal) toggleHelp() {
+	t.helpOpen = !t.helpOpen
+	if t.helpOpen && t.capabilities.Load() == nil {
+		go func() {
+			if t.fetchCapabilities() == nil {
+				t.invalidate()
+			}
+		}()
+	}
+	t.invalidate()
+}
+
+// layoutHelp draws the help overlay over the window, one scrolling line of
+// helpContent per row.
+func (t *Terminal) layoutHelp(gtx layout.Context) layout.Dimensions {
+	if t.helpClose.Clicked() {
+		t.helpOpen = false
+	}
+	if !t.helpOpen {
+		return layout.Dimensions{}
+	}
+	lines := strings.Split(helpContent(t.capabilities.Load()), "\n")
+
+	return layout.UniformInset(unit.Dp(40)).Layout(gtx, func(gtx layout.Context) layout.Dimensions {
+		gtx.Constraints.Min = gtx.Constraints.Max
+		return layout.Stack{}.Layout(gtx,
+			layout.Expanded(func(gtx layout.Context) layout.Dimensions {
+				paint.FillShape(gtx.Ops, color.NRGBA{R: 50, G: 55, B: 65, A: 255}, clip.Rect{Max: gtx.Constraints.Min}.Op())
+				return layout.Dimensions{Size: gtx.Constraints.Min}
+			}),
+			layout.Stacked(func(gtx layout.Context) layout.Dimensions {
+				return layout.UniformInset(unit.Dp(10)).Layout(gtx, func(gtx layout.Context) layout.Dimensions {
+					return layout.Flex{Axis: layout.Vertical}.Layout(gtx,
+						layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+							return layout.Flex{Alignment: layout.Middle}.Layout(gtx,
+								layout.Flexed(1, material.Label(t.theme, unit.Sp(16), "Help (F1 or Esc to close)").Layout),
+								layout.Rigid(material.Button(t.theme, &t.helpClose, "Close").Layout),
+							)
+						}),
+						layout.Flexed(1, func(gtx layout.Context) layout.Dimensions {
+							return material.List(t.theme, &t.helpList).Layout(gtx, len(lines), func(gtx layout.Context, i int) layout.Dimensions {
+								lbl := material.Label(t.theme, unit.Sp(13), lines[i])
+								lbl.Font.Style = text.Mono
+								return lbl.Layout(gtx)
+							})
+						}),
+					)
+				})
+			}),
+		)
+	})
+}
+
+func (t *Terminal) togglePalette() {
+	t.paletteOpen = !t.paletteOpen
+	if t.paletteOpen {
+		t.paletteInput.SetText("")
+		t.paletteInput.Focus()
+	}
+	t.invalidate()
+}
+
+// updatePaletteMatches re-ranks the palette entries for the current query.
+func (t *Terminal) updatePaletteMatches() {
+	commands := paletteCommands(t.recentPaths, t.bookmarks.List())
+	labels := make([]string, len(commands))
+	for i, c := range commands {
+		labels[i] = c.Label
+	}
+
+	t.paletteMatches = t.paletteMatches[:0]
+	for _, i := range rankCandidates(t.paletteInput.Text(), labels) {
+		t.paletteMatches = append(t.paletteMatches, commands[i])
+	}
+	if len(t.paletteClicks) < len(t.paletteMatches) {
+		t.paletteClicks = make([]widget.Clickable, len(t.paletteMatches))
+	}
+}
+
+// handlePalette runs the entry the user picked: Enter takes the best match.
+func (t *Terminal) handlePalette() {
+	if !t.paletteOpen {
+		return
+	}
+	for _, e := range t.paletteInput.Events() {
+		if _, ok := e.(widget.SubmitEvent); ok && len(t.paletteMatches) > 0 {
+			t.choosePaletteCommand(t.paletteMatches[0])
+			return
+		}
+	}
+	for i := range t.paletteMatches {
+		if t.paletteClicks[i].Clicked() {
+			t.choosePaletteCommand(t.paletteMatches[i])
+			return
+		}
+	}
+}
+
+// choosePaletteCommand fills the operation and directory fields from cmd
+// and runs it.
+func (t *Terminal) choosePaletteCommand(cmd paletteCommand) {
+	t.operation.Value = cmd.Operation
+	t.operationSet = true
+	if cmd.Path != "" {
+		t.directoryInput.SetText(cmd.Path)
+	}
+	t.togglePalette()
+	t.executeCommand()
+}
+
+// layoutPalette draws the command palette over the top of the window.
+func (t *Terminal) layoutPalette(gtx layout.Context) layout.Dimensions {
+	if !t.paletteOpen {
+		return layout.Dimensions{}
+	}
+	t.updatePaletteMatches()
+
+	return layout.Inset{Top: unit.Dp(40), Left: unit.Dp(80), Right: unit.Dp(80)}.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
+		return layout.Stack{}.Layout(gtx,
+			layout.Expanded(func(gtx layout.Context) layout.Dimensions {
+				paint.FillShape(gtx.Ops, color.NRGBA{R: 50, G: 55, B: 65, A: 255}, clip.Rect{Max: gtx.Constraints.Min}.Op())
+				return layout.Dimensions{Size: gtx.Constraints.Min}
+			}),
+			layout.Stacked(func(gtx layout.Context) layout.Dimensions {
+				return layout.UniformInset(unit.Dp(10)).Layout(gtx, func(gtx layout.Context) layout.Dimensions {
+					rows := []layout.FlexChild{
+						layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+							ed := material.Editor(t.theme, &t.paletteInput, "Type an operation or path")
+							ed.Font.Style = text.Mono
+							return ed.Layout(gtx)
+						}),
+					}
+					for i, cmd := range t.paletteMatches {
+						if i == 8 {
+							break
+						}
+						i, label := i, cmd.Label
+						rows = append(rows, layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+							return t.paletteClicks[i].Layout(gtx, func(gtx layout.Context) layout.Dimensions {
+								return layout.Inset{Top: unit.Dp(4)}.Layout(gtx, material.Label(t.theme, unit.Sp(14), label).Layout)
+							})
+						}))
+					}
+					return layout.Flex{Axis: layout.Vertical}.Layout(gtx, rows...)
+				})
+			}),
+		)
+	})
+}
+
+// browserVisibleRows is how many file browser rows are shown at once.
+const browserVisibleRows = 12
+
+// handleBrowserKeys feeds key presses to the file browser while vim keys
+// are on. The browser takes keyboard focus when it is clicked.
+func (t *Terminal) handleBrowserKeys(gtx layout.Context) {
+	if t.browserClick.Clicked() {
+		t.browserFocus = true
+	}
+	if !t.vimKeys.Value {
+		return
+	}
+	for _, e := range gtx.Events(t.browser) {
+		switch e := e.(type) {
+		case key.Event:
+			if e.State != key.Press {
+				continue
+			}
+			if p := t.browser.HandleKey(e.Name); p != "" {
+				go t.openEntry(p)
+			}
+		case key.EditEvent:
+			t.browser.Type(e.Text)
+		}
+	}
+}
+
+// layoutBrowser draws the file browser: the listed tree, scrolled to keep
+// the selected row in view, and the search being typed.
+func (t *Terminal) layoutBrowser(gtx layout.Context) layout.Dimensions {
+	rows := t.browser.Rows()
+	if len(rows) == 0 {
+		return layout.Dimensions{}
+	}
+	selected := t.browser.Selected()
+	query, searching := t.browser.Search()
+
+	if t.vimKeys.Value {
+		key.InputOp{
+			Tag:  t.browser,
+			Keys: key.Set(key.NameReturn + "|" + key.NameEnter + "|" + key.NameEscape + "|" + key.NameDeleteBackward + "|" + key.NameUpArrow + "|" + key.NameDownArrow),
+		}.Add(gtx.Ops)
+		if t.browserFocus {
+			key.FocusOp{Tag: t.browser}.Add(gtx.Ops)
+			t.browserFocus = false
+		}
+	}
+
+	first := max(0, min(selected-browserVisibleRows/2, len(rows)-browserVisibleRows))
+	last := min(len(rows), first+browserVisibleRows)
+
+	return t.browserClick.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
+		lines := []layout.FlexChild{
+			layout.Rigid(layout.Spacer{Height: unit.Dp(10)}.Layout),
+			layout.Rigid(material.Label(t.theme, unit.Sp(14), "Files:").Layout),
+		}
+		for i := first; i < last; i++ {
+			row := rows[i]
+			marker := "  "
+			switch {
+			case row.Expanded:
+				marker = "▾ "
+			case row.Loaded:
+				marker = "▸ "
+			}
+			cursor := "  "
+			if i == selected {
+				cursor = "> "
+			}
+			line := cursor + strings.Repeat("  ", row.Depth) + marker + path.Base(row.Path)
+			lines = append(lines, layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+				lbl := material.Label(t.theme, unit.Sp(13), line)
+				lbl.Font.Style = text.Mono
+				if i == selected {
+					lbl.Color = color.NRGBA{R: 97, G: 175, B: 239, A: 255}
+				}
+				return lbl.Layout(gtx)
+			}))
+		}
+		if searching {
+			lines = append(lines, layout.Rigid(material.Label(t.theme, unit.Sp(13), "/"+query).Layout))
+		}
+		return layout.Flex{Axis: layout.Vertical}.Layout(gtx, lines...)
+	})
+}
+
+// execVisibleLines is how many of the last output lines of an exec the
+// panel shows; the output pane gets only the exit code.
+const execVisibleLines = 15
+
+// serverConfigStore is the configStore of the Edit Config flow: it loads
+// files through /api/file, which reports their ETag, and saves them with
+// write_file under if_match.
+type serverConfigStore struct {
+	t *Terminal
+}
+
+func (s serverConfigStore) Load(path string) (string, string, error) {
+	endpoint, err := s.t.apiURL("/api/file")
+	if err != nil {
+		return "", "", err
+	}
+	req, err := http.NewRequest("GET", endpoint+"?"+url.Values{"path": {path}}.Encode(), nil)
+	if err != nil {
+		return "", "", err
+	}
+	s.t.authorize(req)
+	resp, err := s.t.client.Do(req)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := readResponseBody(resp)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var response Response
+		if json.Unmarshal(body, &response) == nil && response.Message != "" {
+			return "", "", response.Err()
+		}
+		return "", "", fmt.Errorf("server returned %s", resp.Status)
+	}
+	return string(body), resp.Header.Get("ETag"), nil
+}
+
+func (s serverConfigStore) Save(path, content, etag string) error {
+	cmd := Command{
+		Operation:  "write_file",
+		Parameters: map[string]string{"path": path, "if_match": etag},
+	}
+	setContent(cmd, content)
+	response, err := s.t.sendCommand(cmd)
+	if err != nil {
+		return err
+	}
+	if response.Status != "success" {
+		return response.Err()
+	}
+	return nil
+}
+
+// handleConfigEdit runs the Edit Config buttons: Open loads the file,
+// Review shows the diff against the file as loaded, and Save, offered
+// only after a review, writes it back.
+func (t *Terminal) handleConfigEdit() {
+	if t.configOpen.Clicked() {
+		go t.openConfigFile(strings.TrimSpace(t.configPath.Text()))
+	}
+	for _, e := range t.configText.Events() {
+		if _, ok := e.(widget.ChangeEvent); ok {
+			// The reviewed diff no longer matches what would be saved.
+			t.configDiff = ""
+			t.configError = ""
+			if err := validateJSON(t.configText.Text()); err != nil {
+				t.configError = "Invalid JSON: " + err.Error()
+			}
+		}
+	}
+	if t.configFormat.Clicked() {
+		if formatted, err := formatJSON(t.configText.Text()); err != nil {
+			t.configError = "Invalid JSON: " + err.Error()
+		} else {
+			t.configText.SetText(formatted)
+			t.configDiff = ""
+		}
+	}
+	if t.configReview.Clicked() {
+		text := t.configText.Text()
+		switch err := validateJSON(text); {
+		case err != nil:
+			t.configError = "Invalid JSON: " + err.Error()
+		case text == t.configEdit.Original:
+			t.configError = "No changes to save"
+		default:
+			t.configError = ""
+			t.configDiff = formatDiff(diffLines(t.configEdit.Original, text))
+		}
+	}
+	if t.configCancel.Clicked() {
+		t.configDiff = ""
+	}
+	if t.configSave.Clicked() && t.configDiff != "" {
+		t.configDiff = ""
+		go t.saveConfigFile(t.configText.Text())
+	}
+}
+
+func (t *Terminal) openConfigFile(path string) {
+	e, err := openConfig(serverConfigStore{t}, path)
+	if err != nil {
+		t.appendOutput(fmt.Sprintf("$ Error: open %s: %v", path, err))
+		return
+	}
+	t.configEdit = e
+	t.configDiff = ""
+	t.configError = ""
+	if err := validateJSON(e.Original); err != nil {
+		t.configError = "Invalid JSON: " + err.Error()
+	}
+	t.configText.SetText(e.Original)
+	t.appendOutput(fmt.Sprintf("$ Opened %s for editing", path))
+}
+
+func (t *Terminal) saveConfigFile(text string) {
+	e, err := saveConfig(serverConfigStore{t}, t.configEdit, text)
+	if err != nil {
+		t.configError = err.Error()
+		t.appendOutput(fmt.Sprintf("$ Error: save %s: %v", t.configEdit.Path, err))
+		return
+	}
+	t.configEdit = e
+	t.configError = ""
+	t.configText.SetText(e.Original)
+	t.appendOutput(fmt.Sprintf("$ Saved %s", e.Path))
+}
+
+// layoutConfigEdit draws the file open in the Edit Config flow, its
+// validation error and, once reviewed, the diff to confirm.
+func (t *Terminal) layoutConfigEdit(gtx layout.Context) layout.Dimensions {
+	if t.configEdit.Path == "" {
+		return layout.Dimensions{}
+	}
+	children := []layout.FlexChild{
+		layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+			ed := material.Editor(t.theme, &t.configText, "")
+			ed.Font.Style = text.Mono
+			return ed.Layout(gtx)
+		}),
+	}
+	if t.configError != "" {
+		lbl := material.Label(t.theme, unit.Sp(12), t.configError)
+		lbl.Color = color.NRGBA{R: 229, G: 192, B: 123, A: 255}
+		children = append(children, layout.Rigid(lbl.Layout))
+	}
+	if t.configDiff == "" {
+		children = append(children, layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+			return layout.Flex{Alignment: layout.Middle}.Layout(gtx,
+				layout.Rigid(material.Button(t.theme, &t.configFormat, "Format").Layout),
+				layout.Rigid(layout.Spacer{Width: unit.Dp(10)}.Layout),
+				layout.Rigid(material.Button(t.theme, &t.configReview, "Review Changes").Layout),
+			)
+		}))
+		return layout.Flex{Axis: layout.Vertical}.Layout(gtx, children...)
+	}
+
+	for _, line := range strings.Split(strings.TrimSuffix(t.configDiff, "\n"), "\n") {
+		lbl := material.Label(t.theme, unit.Sp(12), line)
+		lbl.Font.Style = text.Mono
+		switch {
+		case strings.HasPrefix(line, "- "):
+			lbl.Color = color.NRGBA{R: 224, G: 108, B: 117, A: 255}
+		case strings.HasPrefix(line, "+ "):
+			lbl.Color = color.NRGBA{R: 80, G: 160, B: 80, A: 255}
+		}
+		children = append(children, layout.Rigid(lbl.Layout))
+	}
+	children = append(children, layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+		return layout.Flex{Alignment: layout.Middle}.Layout(gtx,
+			layout.Rigid(material.Button(t.theme, &t.configSave, "Save").Layout),
+			layout.Rigid(layout.Spacer{Width: unit.Dp(10)}.Layout),
+			layout.Rigid(material.Button(t.theme, &t.configCancel, "Keep Editing").Layout),
+		)
+	}))
+	return layout.Flex{Axis: layout.Vertical}.Layout(gtx, children...)
+}
+
+// layoutExec draws the output of the last exec, stderr in red.
+func (t *Terminal) layoutExec(gtx layout.Context) layout.Dimensions {
+	t.execMu.Lock()
+	out := t.execOut.Lines[max(0, len(t.execOut.Lines)-execVisibleLines):]
+	t.execMu.Unlock()
+	if len(out) == 0 {
+		return layout.Dimensions{}
+	}
+	lines := make([]layout.FlexChild, 0, len(out))
+	for _, line := range out {
+		lbl := material.Label(t.theme, unit.Sp(13), line.Text)
+		lbl.Font.Style = text.Mono
+		if line.Stream == execStderr {
+			lbl.Color = color.NRGBA{R: 224, G: 108, B: 117, A: 255}
+		}
+		lines = append(lines, layout.Rigid(lbl.Layout))
+	}
+	return layout.Flex{Axis: layout.Vertical}.Layout(gtx, lines...)
+}
+
+// layoutMinimap draws an overview of a long output beside it: one bar
+// per group of lines, as long as the longest of them. Pressing or
+// dragging on it moves the output to the line under the pointer.
+func (t *Terminal) layoutMinimap(gtx layout.Context) layout.Dimensions {
+	lengths := t.outputLines
+	if len(lengths) < minimapMinLines {
+		return layout.Dimensions{}
+	}
+	width, height := gtx.Dp(unit.Dp(48)), gtx.Constraints.Max.Y
+
+	for _, e := range gtx.Events(&t.minimapTag) {
+		if pe, ok := e.(pointer.Event); ok && (pe.Type == pointer.Press || pe.Type == pointer.Drag) {
+			offset := lineOffset(lengths, minimapLine(pe.Position.Y, float32(height), len(lengths)))
+			t.outputEditor.SetCaret(offset, offset)
+		}
+	}
+
+	area := clip.Rect{Max: image.Pt(width, height)}.Push(gtx.Ops)
+	pointer.InputOp{Tag: &t.minimapTag, Types: pointer.Press | pointer.Drag}.Add(gtx.Ops)
+	area.Pop()
+
+	paint.FillShape(gtx.Ops, color.NRGBA{R: 36, G: 40, B: 47, A: 255}, clip.Rect{Max: image.Pt(width, height)}.Op())
+	const rowHeight = 2
+	bar := color.NRGBA{R: 92, G: 99, B: 112, A: 255}
+	for row, fraction := range minimapRows(lengths, height/rowHeight) {
+		if fraction == 0 {
+			continue
+		}
+		w := max(1, int(fraction*float32(width-4)))
+		rect := clip.Rect{Min: image.Pt(2, row*rowHeight), Max: image.Pt(2+w, (row+1)*rowHeight)}
+		paint.FillShape(gtx.Ops, bar, rect.Op())
+	}
+	return layout.Dimensions{Size: image.Pt(width, height)}
+}
+
+// layoutDiagnostics draws the connection details of the last request when
+// the diagnostics panel is open.
+func (t *Terminal) layoutDiagnostics(gtx layout.Context) layout.Dimensions {
+	if !t.showDiag {
+		return layout.Dimensions{}
+	}
+	lines := []layout.FlexChild{
+		layout.Rigid(layout.Spacer{Height: unit.Dp(10)}.Layout),
+		layout.Rigid(material.Label(t.theme, unit.Sp(14), "Connection:").Layout),
+	}
+	diag := collectDiagnostics(t.conns).Lines(time.Now())
+	lines = append(lines, layout.Rigid(material.CheckBox(t.theme, &t.watchPath, "Watch network path").Layout))
+	if t.watchPath.Value {
+		current, changes := t.paths.Current()
+		if current == "" {
+			current = "(not sampled yet)"
+		}
+		diag = append(diag, "Local address: "+current)
+		for _, c := range changes {
+			diag = append(diag, "Path change:  "+c.String())
+		}
+	}
+	for _, line := range diag {
+		lbl := material.Label(t.theme, unit.Sp(13), line)
+		lbl.Font.Style = text.Mono
+		lines = append(lines, layout.Rigid(lbl.Layout))
+	}
+	return layout.Flex{Axis: layout.Vertical}.Layout(gtx, lines...)
+}
+
+// sendCommand posts cmd to the configured server and decodes the reply.
+func (t *Terminal) sendCommand(cmd Command) (Response, error) {
+	return t.sendCommandContext(context.Background(), cmd)
+}
+
+// sendCommandContext is sendCommand with the request bound to ctx, so
+// cancelling ctx abandons it.
+func (t *Terminal) sendCommandContext(ctx context.Context, cmd Command) (Response, error) {
+	cmd = withIdempotencyKey(cmd)
+	cmd.Timestamp = time.Now()
+
+	jsonData, err := json.Marshal(cmd)
+	if err != nil {
+		return Response{}, fmt.Errorf("failed to marshal command: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(
+		ctx,
+		"POST",
+		t.serverURLInput.Text(),
+		bytes.NewBuffer(jsonData),
+	)
+	if err != nil {
+		return Response{}, fmt.Errorf("failed to create request: %v", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(idempotencyHeader, cmd.IdempotencyKey)
+
+	// Connection setup is only reported when the transport fires the
+	// httptrace hooks; otherwise the whole duration counts as request time.
+	var timing requestTiming
+	start := time.Now()
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if !info.Reused {
+				timing.Connect = time.Since(start)
+			}
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	var response Response
+	reused, err := t.conns.track(func() (err error) {
+		response, err = t.do(req)
+		return err
+	})
+	timing.Total = time.Since(start)
+	timing.Reused = reused
+	t.lastTiming = timing
+	t.latencies.Add(timing.Total)
+	if t.watchPath.Value && err == nil {
+		if change, ok := t.paths.Sample(req.URL.Host, reused, time.Now()); ok {
+			t.appendOutput("$ Network path changed: " + change.String())
+		}
+	}
+	// Even a failed mutation may have changed something, so the cached
+	// listings it touches are dropped either way.
+	for _, dir := range mutatedDirs(cmd) {
+		t.listings.Invalidate(dir)
+	}
+	return response, err
+}
+
+// listingCache keeps list_files results per directory and filter for ttl,
+// so navigating back to a directory does not cost another round trip.
+type listingCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	now     func() time.Time
+	entries map[listingKey]listingEntry
+}
+
+type listingKey struct {
+	dir    string
+	filter string
+}
+
+type listingEntry struct {
+	data   json.RawMessage
+	stored time.Time
+}
+
+func newListingCache(ttl time.Duration) *listingCache {
+	return &listingCache{
+		ttl:     ttl,
+		now:     time.Now,
+		entries: make(map[listingKey]listingEntry),
+	}
+}
+
+// Get returns the cached listing of dir with filter if it has not expired.
+func (c *listingCache) Get(dir, filter string) (json.RawMessage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := listingKey{path.Clean(dir), filter}
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if c.now().Sub(e.stored) >= c.ttl {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return e.data, true
+}
+
+// Put stores the listing of dir with filter.
+func (c *listingCache) Put(dir, filter string, data json.RawMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[listingKey{path.Clean(dir), filter}] = listingEntry{data: data, stored: c.now()}
+}
+
+// Invalidate drops every cached listing of dir, whatever its filter.
+func (c *listingCache) Invalidate(dir string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	dir = path.Clean(dir)
+	for key := range c.entries {
+		if key.dir == dir {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// mutatedDirs returns the directories whose listing cmd may change.
+func mutatedDirs(cmd Command) []string {
+	switch cmd.Operation {
+	case "write_file", "create_folder", "rotate", "retype":
+		return []string{path.Dir(path.Clean(cmd.Parameters["path"]))}
+	case "copy_dir":
+		return []string{path.Dir(path.Clean(cmd.Parameters["destination"]))}
+	case "swap", "move":
+		return []string{
+			path.Dir(path.Clean(cmd.Parameters["path"])),
+			path.Dir(path.Clean(cmd.Parameters["destination"])),
+		}
+	}
+	return nil
+}
+
+// requestTiming splits the wall-clock time of one operation and records
+// whether it reused the open connection.
+type requestTiming struct {
+	Connect time.Duration
+	Total   time.Duration
+	Reused  bool
+}
+
+func (rt requestTiming) String() string {
+	if rt.Connect == 0 {
+		return rt.Total.Round(time.Millisecond).String()
+	}
+	return fmt.Sprintf("%s (connect %s, request %s)",
+		rt.Total.Round(time.Millisecond),
+		rt.Connect.Round(time.Millisecond),
+		(rt.Total - rt.Connect).Round(time.Millisecond))
+}
+
+// latencyWindow is a fixed-size ring of the most recent operation latencies.
+type latencyWindow struct {
+	samples []time.Duration
+	next    int
+	full    bool
+}
+
+func newLatencyWindow(size int) *latencyWindow {
+	return &latencyWindow{samples: make([]time.Duration, size)}
+}
+
+// Add records d, overwriting the oldest sample once the window is full.
+func (w *latencyWindow) Add(d time.Duration) {
+	w.samples[w.next] = d
+	w.next = (w.next + 1) % len(w.samples)
+	if w.next == 0 {
+		w.full = true
+	}
+}
+
+// Values returns the samples from oldest to newest.
+func (w *latencyWindow) Values() []time.Duration {
+	if !w.full {
+		return append([]time.Duration(nil), w.samples[:w.next]...)
+	}
+	return append(append([]time.Duration(nil), w.samples[w.next:]...), w.samples[:w.next]...)
+}
+
+// Average returns the mean of the samples in the window, or 0 when empty.
+func (w *latencyWindow) Average() time.Duration {
+	values := w.Values()
+	if len(values) == 0 {
+		return 0
+	}
+	var sum time.Duration
+	for _, v := range values {
+		sum += v
+	}
+	return sum / time.Duration(len(values))
+}
+
+var sparkLevels = []rune("▁▂▃▄▅▆▇█")
+
+// sparkline scales values between their minimum and maximum onto block
+// characters, one per value. Equal values all render at the lowest level.
+func sparkline(values []time.Duration) string {
+	if len(values) == 0 {
+		return ""
+	}
+
+	lo, hi := values[0], values[0]
+	for _, v := range values {
+		if v < lo {
+			lo = v
+		}
+		if v > hi {
+			hi = v
+		}
+	}
+
+	out := make([]rune, len(values))
+	for i, v := range values {
+		level := 0
+		if hi > lo {
+			level = int(int64(v-lo) * int64(len(sparkLevels)-1) / int64(hi-lo))
+		}
+		out[i] = sparkLevels[level]
+	}
+	return string(out)
+}
+
+// do sends req with the client's credentials and decodes the reply.
+func (t *Terminal) do(req *http.Request) (Response, error) {
+	t.authorize(req)
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return Response{}, fmt.Errorf("failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+	t.conns.observe(resp)
+
+	body, err := readResponseBody(resp)
+	if err != nil {
+		return Response{}, fmt.Errorf("failed to read response: %w", err)
+	}
+	// The server streams large reads as the raw file instead of a JSON
+	// Response.
+	if resp.StatusCode == http.StatusOK && resp.Header.Get("X-Read-Mode") == "stream" {
+		data, err := json.Marshal(string(body))
+		if err != nil {
+			return Response{}, fmt.Errorf("failed to read response: %v", err)
+		}
+		return Response{Status: "success", Data: data}, nil
+	}
+
+	response, err := decodeResponse(body, resp.Status)
+	if err != nil {
+		return Response{}, fmt.Errorf("failed to parse response: %w", err)
+	}
+	// The server refuses writes with 503 while in maintenance mode.
+	if resp.StatusCode == http.StatusServiceUnavailable {
+		if after := resp.Header.Get("Retry-After"); after != "" {
+			response.Message += fmt.Sprintf(" (retry in %s seconds)", after)
+		}
+	}
+	return response, nil
+}
+
+// authorize adds the client's credentials to req. A scheme whose settings
+// are invalid adds none; the error is shown under the settings.
+func (t *Terminal) authorize(req *http.Request) {
+	if h, err := authHeaders(t.authSettings()); err == nil {
+		for name, values := range h {
+			req.Header[name] = values
+		}
+	}
+	req.Header.Set("X-Client-ID", t.clientIDInput.Text())
+}
+
+func (t *Terminal) authSettings() authSettings {
+	return authSettings{
+		Scheme:     authScheme(t.authScheme.Value),
+		Token:      t.tokenInput.Text(),
+		HeaderName: t.apiKeyHeader.Text(),
+		CertFile:   strings.TrimSpace(t.certFileInput.Text()),
+		KeyFile:    strings.TrimSpace(t.keyFileInput.Text()),
+	}
+}
+
+// handleAuthChanges checks the auth settings after every change and, for
+// mTLS, loads the certificate the transport presents.
+func (t *Terminal) handleAuthChanges() {
+	changed := t.authScheme.Changed()
+	for _, ed := range []*widget.Editor{&t.apiKeyHeader, &t.certFileInput, &t.keyFileInput} {
+		for _, e := range ed.Events() {
+			if _, ok := e.(widget.ChangeEvent); ok {
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return
+	}
+
+	s := t.authSettings()
+	t.authError = ""
+	if _, err := authHeaders(s); err != nil {
+		t.authError = err.Error()
+	}
+	if s.Scheme != authMTLS {
+		t.certs.Clear()
+		return
+	}
+	if s.CertFile == "" || s.KeyFile == "" {
+		t.certs.Clear()
+		t.authError = "mTLS needs a certificate and a key file"
+		return
+	}
+	if err := t.certs.Load(s.CertFile, s.KeyFile); err != nil {
+		t.certs.Clear()
+		t.authError = err.Error()
+	}
+}
+
+// layoutAuth draws the fields of the selected auth scheme.
+func (t *Terminal) layoutAuth(gtx layout.Context) layout.Dimensions {
+	field := func(label string, editor *widget.Editor) []layout.FlexChild {
+		return []layout.FlexChild{
+			layout.Rigid(material.Label(t.theme, unit.Sp(12), label).Layout),
+			layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+				ed := material.Editor(t.theme, editor, "")
+				ed.Font.Style = text.Mono
+				return ed.Layout(gtx)
+			}),
+		}
+	}
+
+	var fields []layout.FlexChild
+	switch authScheme(t.authScheme.Value) {
+	case authAPIKey:
+		fields = append(field("Header name:", &t.apiKeyHeader), field("API key:", &t.tokenInput)...)
+	case authMTLS:
+		fields = append(field("Certificate file (PEM):", &t.certFileInput), field("Key file (PEM):", &t.keyFileInput)...)
+	default:
+		fields = field("Auth Token:", &t.tokenInput)
+	}
+	return layout.Flex{Axis: layout.Vertical}.Layout(gtx, fields...)
+}
+
+// apiURL returns the server endpoint at path, on the same host as the
+// configured operation URL.
+func (t *Terminal) apiURL(path string) (string, error) {
+	u, err := url.Parse(t.serverURLInput.Text())
+	if err != nil {
+		return "", err
+	}
+	u.Path = path
+	u.RawQuery = ""
+	return u.String(), nil
+}
+
+// fetchCapabilities loads the server limits the client checks input
+// against before sending it.
+func (t *Terminal) fetchCapabilities() error {
+	endpoint, err := t.apiURL("/api/capabilities")
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := t.do(req)
+	if err != nil {
+		return err
+	}
+	if response.Status != "success" {
+		return response.Err()
+	}
+
+	var caps serverCapabilities
+	if err := json.Unmarshal(response.Data, &caps); err != nil {
+		return fmt.Errorf("failed to parse capabilities: %v", err)
+	}
+	t.maxFileSize = caps.MaxFileSize
+	t.capabilities.Store(&caps)
+	return nil
+}
+
+// fetchVersion reads the server's /version endpoint for the status bar.
+func (t *Terminal) fetchVersion() error {
+	endpoint, err := t.apiURL("/version")
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := t.do(req)
+	if err != nil {
+		return err
+	}
+
+	var info struct {
+		Version   string `json:"version"`
+		GitCommit string `json:"git_commit"`
+		GoVersion string `json:"go_version"`
+	}
+	if err := json.Unmarshal(response.Data, &info); err != nil {
+		return fmt.Errorf("failed to parse version: %v", err)
+	}
+
+	commit := info.GitCommit
+	if len(commit) > 12 {
+		commit = commit[:12]
+	}
+	t.serverVersion = fmt.Sprintf("Server %s (%s, %s)", info.Version, commit, info.GoVersion)
+	t.invalidate()
+	return nil
+}
+
+// checkContentSize rejects content larger than the server's MaxFileSize.
+// A limit of zero means the limit is not known yet and nothing is rejected.
+func checkContentSize(content string, limit int64) error {
+	if limit > 0 && int64(len(content)) > limit {
+		return fmt.Errorf("content is %d bytes, server limit is %d bytes", len(content), limit)
+	}
+	return nil
+}
+
+// handleContentChanges re-checks the content field after every edit, so an
+// oversized paste or broken JSON is flagged as soon as it lands rather than
+// when sending.
+func (t *Terminal) handleContentChanges() {
+	changed := t.jsonMode.Changed()
+	for _, e := range t.contentInput.Events() {
+		if _, ok := e.(widget.ChangeEvent); ok {
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+
+	if t.maxFileSize == 0 {
+		go func() {
+			if err := t.fetchCapabilities(); err == nil {
+				t.checkContent()
+			}
+		}()
+	}
+	t.checkContent()
+}
+
+// pathFields returns the Directory and Filter fields with their ${NAME}
+// variables expanded from the Variables field and the built-ins.
+func (t *Terminal) pathFields() (dir, filter string, err error) {
+	vars, err := parseVarDefs(t.varsInput.Text(), builtinVars(time.Now()))
+	if err != nil {
+		return "", "", err
+	}
+	if dir, err = expandVars(t.directoryInput.Text(), vars); err != nil {
+		return "", "", fmt.Errorf("directory: %v", err)
+	}
+	if filter, err = expandVars(t.filterInput.Text(), vars); err != nil {
+		return "", "", fmt.Errorf("filter: %v", err)
+	}
+	return dir, filter, nil
+}
+
+// handleVariableChanges re-checks the path fields whenever they or the
+// variables change, so an unresolved variable shows under them at once.
+// An edited directory also preselects the operation.
+func (t *Terminal) handleVariableChanges() {
+	changed, dirChanged := false, false
+	for _, ed := range []*widget.Editor{&t.directoryInput, &t.filterInput, &t.varsInput} {
+		for _, e := range ed.Events() {
+			if _, ok := e.(widget.ChangeEvent); ok {
+				changed = true
+				dirChanged = dirChanged || ed == &t.directoryInput
+			}
+		}
+	}
+	if !changed {
+		return
+	}
+	t.varError = ""
+	dir, _, err := t.pathFields()
+	if err != nil {
+		t.varError = err.Error()
+		dir = t.directoryInput.Text()
+	}
+	if dirChanged {
+		t.suggestOperation(dir, t.browser.IsDir(dir))
+	}
+}
+
+// suggestOperation preselects list_files or read_file for the path p, as
+// inferOperation sees it. An operation the user chose by hand is kept
+// until the Directory field is cleared.
+func (t *Terminal) suggestOperation(p string, isDir bool) {
+	if t.operation.Changed() {
+		t.operationSet = true
+	}
+	if strings.TrimSpace(p) == "" {
+		t.operationSet = false
+		return
+	}
+	if t.operationSet {
+		return
+	}
+	if op := inferOperation(p, isDir); op != "" {
+		t.operation.Value = op
+		t.invalidate()
+	}
+}
+
+// handleTransformChanges re-reads the Transforms field after every edit.
+// While it has an error the transforms from before the edit stay in use.
+func (t *Terminal) handleTransformChanges() {
+	changed := false
+	for _, e := range t.transformInput.Events() {
+		if _, ok := e.(widget.ChangeEvent); ok {
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+	transforms, err := parseTransforms(t.transformInput.Text())
+	if err != nil {
+		t.transformError = err.Error()
+		return
+	}
+	t.transformError = ""
+	t.transforms = transforms
+}
+
+// formatResult returns response data as it is displayed, after the
+// transforms.
+func (t *Terminal) formatResult(data json.RawMessage) string {
+	out, err := applyTransforms(string(data), t.transforms)
+	if err != nil {
+		return fmt.Sprintf("%s\n(transform failed: %v)", out, err)
+	}
+	return out
+}
+
+func (t *Terminal) checkContent() {
+	t.contentWarning = ""
+	if err := checkContentSize(t.contentInput.Text(), t.maxFileSize); err != nil {
+		t.contentWarning = "Warning: " + err.Error()
+	}
+	t.jsonError = ""
+	if t.jsonMode.Value {
+		if err := validateJSON(t.contentInput.Text()); err != nil {
+			t.jsonError = "Invalid JSON: " + err.Error()
+		}
+	}
+	t.invalidate()
+}
+
+// formatContent pretty-prints the content field in JSON mode. Invalid JSON
+// is left as typed; its error is already shown.
+func (t *Terminal) formatContent() {
+	if !t.jsonMode.Value {
+		return
+	}
+	formatted, err := formatJSON(t.contentInput.Text())
+	if err != nil {
+		return
+	}
+	t.contentInput.SetText(formatted)
+	t.checkContent()
+}
+
+// contentBlocked reports whether a write must wait for the JSON editor's
+// content to parse.
+func (t *Terminal) contentBlocked() bool {
+	return t.operation.Value == "write_file" && t.jsonMode.Value && t.jsonError != ""
+}
+
+func (t *Terminal) executeCommand() {
+	if t.contentBlocked() {
+		t.appendOutput("$ Error: " + t.jsonError)
+		return
+	}
+	t.queueOperation(t.operation.Value, false)
+}
+
+// refresh lists the directory again, bypassing the listing cache.
+func (t *Terminal) refresh() {
+	t.queueOperation("list_files", true)
+}
+
+// queueOperation queues operation on the Directory field, and for
+// list_files the Filter field, as they are now, so editing them while it
+// waits does not change it. The content of a write_file is taken now too.
+func (t *Terminal) queueOperation(operation string, bypassCache bool) {
+	dir, filter, err := t.pathFields()
+	if err != nil {
+		t.appendOutput(fmt.Sprintf("$ Error: %v", err))
+		return
+	}
+	var content string
+	if operation == "write_file" {
+		content = t.contentInput.Text()
+	}
+	label := operation + " " + dir
+	if current, _ := t.queue.Status(); current != "" {
+		t.appendOutput(fmt.Sprintf("$ Queued behind %s: %s", current, label))
+	}
+	t.queue.Push(label, func(ctx context.Context) {
+		t.run(ctx, operation, dir, filter, content, bypassCache)
+	})
+}
+
+// retry queues cmd again as it was sent, idempotency key and all.
+func (t *Terminal) retry(cmd Command) {
+	t.queue.Push("retry "+cmd.Operation+" "+cmd.Parameters["path"], func(ctx context.Context) {
+		t.runCommand(ctx, cmd)
+	})
+}
+
+// cancelCurrent cancels the running operation. Its request is abandoned;
+// one that had already reached the server may still have taken effect.
+func (t *Terminal) cancelCurrent() {
+	label, ok := t.queue.CancelCurrent()
+	if !ok {
+		t.appendOutput("$ Nothing to cancel")
+		return
+	}
+	t.appendOutput(fmt.Sprintf("$ Cancelled: %s", label))
+}
+
+// clearPending drops the queued operations that have not started.
+func (t *Terminal) clearPending() {
+	labels := t.queue.ClearPending()
+	if len(labels) == 0 {
+		t.appendOutput("$ No queued operations to clear")
+		return
+	}
+	t.appendOutput(fmt.Sprintf("$ Cleared %d queued operations:\n  %s", len(labels), strings.Join(labels, "\n  ")))
+	t.invalidate()
+}
+
+// keepListing remembers a list_files result of dir for Export CSV and
+// adds it to the file browser.
+func (t *Terminal) keepListing(dir string, data json.RawMessage) {
+	var paths []string
+	if err := json.Unmarshal(data, &paths); err == nil {
+		t.lastListing = paths
+		t.lastResults = "listing"
+		t.browser.SetChildren(dir, paths)
+	}
+}
+
+// openEntry opens a file browser entry that has not been listed yet. The
+// server is asked to list it; if that fails it is not a directory and is
+// read instead.
+func (t *Terminal) openEntry(p string) {
+	t.directoryInput.SetText(p)
+	response, err := t.sendCommand(Command{
+		Operation:  "list_files",
+		Parameters: map[string]string{"path": p, "filter": ""},
+	})
+	if err == nil && response.Status == "success" {
+		t.listings.Put(p, "", response.Data)
+		t.keepListing(p, response.Data)
+		t.suggestOperation(p, true)
+		t.invalidate()
+		return
+	}
+	t.suggestOperation(p, false)
+	t.queueOperation("read_file", false)
+}
+
+// exportResults saves the most recent listing or search results as CSV.
+func (t *Terminal) exportResults() {
+	var data []byte
+	var err error
+	switch t.lastResults {
+	case "listing":
+		data, err = listingCSV(t.lastListing)
+	case "search":
+		data, err = searchCSV(t.searchResults)
+	default:
+		t.appendOutput("$ Error: nothing to export; list a directory or search first")
+		return
+	}
+	if err != nil {
+		t.appendOutput(fmt.Sprintf("$ Error: %v", err))
+		return
+	}
+
+	target := exportPath(strings.TrimSpace(t.downloadInput.Text()), t.lastResults, time.Now())
+	if err := os.WriteFile(target, data, 0644); err != nil {
+		t.appendOutput(fmt.Sprintf("$ Error: %v", err))
+		return
+	}
+	t.appendOutput(fmt.Sprintf("$ Exported %s results to %s", t.lastResults, target))
+}
+
+// playScript parses the Script field and runs its steps in order,
+// printing each result as it arrives.
+func (t *Terminal) playScript() {
+	steps, err := parseScript(t.scriptInput.Text())
+	if err != nil {
+		t.appendOutput(fmt.Sprintf("$ Error: %v", err))
+		return
+	}
+
+	t.appendOutput(fmt.Sprintf("$ Running script: %d steps", len(steps)))
+	failed := 0
+	runScript(steps, t.sendCommand, t.stopOnError.Value, func(r scriptStepResult) {
+		prefix := fmt.Sprintf("[line %d] %s", r.Step.Line, r.Step.Operation)
+		switch {
+		case r.Skipped:
+			t.appendOutput(prefix + ": skipped")
+			return
+		case r.Err != nil:
+			t.appendOutput(fmt.Sprintf("%s: Error: %v", prefix, r.Err))
+		case r.Response.Status != "success":
+			t.appendOutput(fmt.Sprintf("%s: %s: %s", prefix, t.translate("op.failed"), t.describeError(r.Response.Err())))
+		default:
+			t.appendOutput(fmt.Sprintf("%s: %s\nResult: %s", prefix, t.translate("op.success"), t.formatResult(r.Response.Data)))
+			return
+		}
+		failed++
+	})
+	t.appendOutput(fmt.Sprintf("$ Script finished: %d of %d steps failed", failed, len(steps)))
+}
+
+// runExec runs the command in the Exec field on the server, in the
+// Directory field, and shows its output as it streams in. The first word
+// is the command and the rest its arguments, quoted as Go strings when
+// they hold spaces.
+func (t *Terminal) runExec() {
+	fields, err := splitScriptFields(t.execInput.Text())
+	if err != nil {
+		t.appendOutput(fmt.Sprintf("$ Error: exec: %v", err))
+		return
+	}
+	for i, f := range fields {
+		if strings.HasPrefix(f, `"`) {
+			if fields[i], err = strconv.Unquote(f); err != nil {
+				t.appendOutput(fmt.Sprintf("$ Error: exec: bad quoting in %s", f))
+				return
+			}
+		}
+	}
+	dir, _, err := t.pathFields()
+	if err != nil {
+		t.appendOutput(fmt.Sprintf("$ Error: %v", err))
+		return
+	}
+	args, err := json.Marshal(fields[1:])
+	if err != nil {
+		t.appendOutput(fmt.Sprintf("$ Error: %v", err))
+		return
+	}
+	cmd := Command{
+		Operation: "exec",
+		Parameters: map[string]string{
+			"command": fields[0],
+			"args":    string(args),
+			"path":    dir,
+		},
+		Timestamp: time.Now(),
+	}
+	jsonData, err := json.Marshal(cmd)
+	if err != nil {
+		t.appendOutput(fmt.Sprintf("$ Error: %v", err))
+		return
+	}
+	req, err := http.NewRequest("POST", t.serverURLInput.Text(), bytes.NewBuffer(jsonData))
+	if err != nil {
+		t.appendOutput(fmt.Sprintf("$ Error: %v", err))
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	t.authorize(req)
+
+	t.appendOutput(fmt.Sprintf("$ exec %s in %s", t.execInput.Text(), dir))
+	t.execMu.Lock()
+	t.execOut = execOutput{}
+	t.execMu.Unlock()
+	// The client's timeout would cut off a long-running command, so the
+	// request runs without one; the server enforces its own.
+	client := *t.client
+	client.Timeout = 0
+	resp, err := client.Do(req)
+	if err != nil {
+		t.appendOutput(fmt.Sprintf("$ Error: failed to send request: %v", err))
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var response Response
+		if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+			t.appendOutput(fmt.Sprintf("$ Unexpected response status: %s", resp.Status))
+			return
+		}
+		t.appendOutput(fmt.Sprintf("$ %s: %s", t.translate("op.failed"), t.describeError(response.Err())))
+		return
+	}
+
+	code, err := readExec(resp.Body, func(stream byte, payload []byte) {
+		t.execMu.Lock()
+		t.execOut.Add(stream, payload)
+		t.execMu.Unlock()
+		t.invalidate()
+	})
+	t.execMu.Lock()
+	t.execOut.Close()
+	t.execMu.Unlock()
+	if err != nil {
+		t.appendOutput(fmt.Sprintf("$ Error: %v", err))
+		return
+	}
+	t.appendOutput(fmt.Sprintf("$ %s exited with code %d", fields[0], code))
+}
+
+// following reports whether a follow is running.
+func (t *Terminal) following() bool {
+	t.followMu.Lock()
+	defer t.followMu.Unlock()
+	return t.followStop != nil
+}
+
+// toggleFollow stops the running follow, or starts following the path in
+// the Follow field.
+func (t *Terminal) toggleFollow() {
+	t.followMu.Lock()
+	defer t.followMu.Unlock()
+	if t.followStop != nil {
+		t.followStop()
+		return
+	}
+	p := strings.TrimSpace(t.followPath.Text())
+	if p == "" {
+		return
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	t.followStop = stop
+	t.follow = &followView{Path: p}
+	t.followList.Position = layout.Position{}
+	go t.runFollow(ctx, t.follow)
+}
+
+// runFollow streams the lines of view.Path into view until ctx is
+// cancelled or the server ends the follow.
+func (t *Terminal) runFollow(ctx context.Context, view *followView) {
+	defer func() {
+		t.followMu.Lock()
+		t.followStop()
+		t.followStop = nil
+		t.followMu.Unlock()
+		t.invalidate()
+	}()
+
+	endpoint, err := t.apiURL("/api/follow")
+	if err != nil {
+		t.appendOutput(fmt.Sprintf("$ Error: %v", err))
+		return
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint+"?"+url.Values{"path": {view.Path}}.Encode(), nil)
+	if err != nil {
+		t.appendOutput(fmt.Sprintf("$ Error: %v", err))
+		return
+	}
+	t.authorize(req)
+
+	t.appendOutput(fmt.Sprintf("$ Following %s", view.Path))
+	// A follow runs until it is stopped, so like exec it goes without the
+	// client's timeout.
+	client := *t.client
+	client.Timeout = 0
+	resp, err := client.Do(req)
+	if err != nil {
+		t.appendOutput(fmt.Sprintf("$ Error: failed to send request: %v", err))
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var response Response
+		if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+			t.appendOutput(fmt.Sprintf("$ Unexpected response status: %s", resp.Status))
+			return
+		}
+		t.appendOutput(fmt.Sprintf("$ %s: %s", t.translate("op.failed"), t.describeError(response.Err())))
+		return
+	}
+
+	err = readFollowEvents(resp.Body, func(event, data string) {
+		switch event {
+		case "":
+			t.followMu.Lock()
+			view.Add(data, time.Now())
+			t.followMu.Unlock()
+			t.invalidate()
+		case "rotated":
+			t.followMu.Lock()
+			view.Add(fmt.Sprintf("--- file %s, following from its start ---", data), time.Now())
+			t.followMu.Unlock()
+			t.invalidate()
+		case "end":
+			t.appendOutput(fmt.Sprintf("$ Follow of %s ended: %s", view.Path, data))
+		}
+	})
+	if err != nil && ctx.Err() == nil {
+		t.appendOutput(fmt.Sprintf("$ Error: follow: %v", err))
+		return
+	}
+	if ctx.Err() != nil {
+		t.appendOutput(fmt.Sprintf("$ Stopped following %s", view.Path))
+	}
+}
+
+// layoutFollow draws the lines of the current follow in a list that
+// keeps to the newest line until it is scrolled up, with the line rate
+// and, while paused, how many lines came in and a jump back to the
+// bottom.
+func (t *Terminal) layoutFollow(gtx layout.Context) layout.Dimensions {
+	t.followMu.Lock()
+	defer t.followMu.Unlock()
+	view := t.follow
+	if view == nil {
+		return layout.Dimensions{}
+	}
+
+	if t.followJump.Clicked() {
+		view.Scroll.Jump()
+		t.followList.Position.BeforeEnd = false
+	}
+	if n := view.TakeDropped(); n > 0 && view.Scroll.Paused() {
+		t.followList.Position.First = max(0, t.followList.Position.First-n)
+	}
+
+	status := fmt.Sprintf("%s   %.1f lines/s", view.Path, view.Rate.Rate(time.Now()))
+	if t.followStop == nil {
+		status += "   stopped"
+	}
+	if view.Scroll.Paused() {
+		status += fmt.Sprintf("   paused, %d new lines", view.Scroll.Unseen())
+	}
+	lines := view.Lines
+	return layout.Flex{Axis: layout.Vertical}.Layout(gtx,
+		layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+			return layout.Flex{Alignment: layout.Middle}.Layout(gtx,
+				layout.Rigid(material.Label(t.theme, unit.Sp(12), status).Layout),
+				layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+					if !view.Scroll.Paused() {
+						return layout.Dimensions{}
+					}
+					return layout.Inset{Left: unit.Dp(10)}.Layout(gtx, material.Button(t.theme, &t.followJump, "Jump to bottom").Layout)
+				}),
+			)
+		}),
+		layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+			gtx.Constraints.Max.Y = gtx.Dp(unit.Dp(200))
+			dims := material.List(t.theme, &t.followList).Layout(gtx, len(lines), func(gtx layout.Context, i int) layout.Dimensions {
+				lbl := material.Label(t.theme, unit.Sp(13), lines[i])
+				lbl.Font.Style = text.Mono
+				return lbl.Layout(gtx)
+			})
+			if len(lines) > 0 {
+				view.Scroll.Observe(!t.followList.Position.BeforeEnd)
+			}
+			return dims
+		}),
+	)
+}
+
+// searchMatch is one matching line reported by /api/search.
+type searchMatch struct {
+	Path string `json:"path"`
+	Line int    `json:"line"`
+	Text string `json:"text"`
+}
+
+// search greps the Directory field's tree for the search pattern and
+// prints matches as the server streams them in.
+func (t *Terminal) search() {
+	endpoint, err := t.apiURL("/api/search")
+	if err != nil {
+		t.appendOutput(fmt.Sprintf("$ Error: %v", err))
+		return
+	}
+	dir, _, err := t.pathFields()
+	if err != nil {
+		t.appendOutput(fmt.Sprintf("$ Error: %v", err))
+		return
+	}
+	query := url.Values{"path": {dir}, "pattern": {t.searchInput.Text()}}
+	req, err := http.NewRequest("GET", endpoint+"?"+query.Encode(), nil)
+	if err != nil {
+		t.appendOutput(fmt.Sprintf("$ Error: %v", err))
+		return
+	}
+	t.authorize(req)
+
+	t.appendOutput(fmt.Sprintf("$ Searching %s for %s", query.Get("path"), query.Get("pattern")))
+	t.searchResults = nil
+	t.lastResults = "search"
+	resp, err := t.client.Do(req)
+	if err != nil {
+		t.appendOutput(fmt.Sprintf("$ Error: failed to send request: %v", err))
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var response Response
+		if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+			t.appendOutput(fmt.Sprintf("$ Unexpected response status: %s", resp.Status))
+			return
+		}
+		t.appendOutput(fmt.Sprintf("$ %s: %s", t.translate("op.failed"), t.describeError(response.Err())))
+		return
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var line struct {
+			searchMatch
+			Truncated bool   `json:"truncated"`
+			Error     string `json:"error"`
+		}
+		if err := dec.Decode(&line); err == io.EOF {
+			break
+		} else if err != nil {
+			t.appendOutput(fmt.Sprintf("$ Error: %v", err))
+			return
+		}
+		switch {
+		case line.Error != "":
+			t.appendOutput(fmt.Sprintf("$ Error: search stopped: %s", line.Error))
+			return
+		case line.Truncated:
+			t.appendOutput(fmt.Sprintf("$ More matches not shown; first %d listed", len(t.searchResults)))
+		default:
+			t.searchResults = append(t.searchResults, line.searchMatch)
+			t.appendOutput(fmt.Sprintf("%s:%d: %s", line.Path, line.Line, line.Text))
+		}
+	}
+	t.appendOutput(fmt.Sprintf("$ %d matches", len(t.searchResults)))
+}
+
+// run sends operation for the current inputs. list_files results are
+// served from the listing cache unless bypassCache is set.
+func (t *Terminal) run(ctx context.Context, operation, dir, filter, content string, bypassCache bool) {
+	cmd := Command{
+		Operation: operation,
+		Parameters: map[string]string{
+			"path": dir,
+		},
+	}
+
+	switch operation {
+	case "list_files":
+		cmd.Parameters["filter"] = filter
+	case "write_file":
+		if t.maxFileSize == 0 {
+			if err := t.fetchCapabilities(); err != nil {
+				t.appendOutput(fmt.Sprintf("$ Warning: could not fetch server limits: %v", err))
+			}
+		}
+		if err := checkContentSize(content, t.maxFileSize); err != nil {
+			t.appendOutput(fmt.Sprintf("$ Error: %v", err))
+			return
+		}
+		setContent(cmd, content)
+	}
+
+	t.appendOutput(fmt.Sprintf("$ Executing command...\nURL: %s\nOperation: %s\nDirectory: %s\nFilter: %s",
+		t.serverURLInput.Text(), operation, dir, filter))
+
+	if operation == "list_files" && !bypassCache {
+		if data, ok := t.listings.Get(cmd.Parameters["path"], cmd.Parameters["filter"]); ok {
+			t.appendOutput(fmt.Sprintf("$ %s (%s)", t.translate("op.success"), t.translate("op.cached")))
+			t.appendOutput(fmt.Sprintf("Result: %s", t.formatResult(data)))
+			t.keepListing(cmd.Parameters["path"], data)
+			return
+		}
+	}
+
+	t.runCommand(ctx, withIdempotencyKey(cmd))
+}
+
+// runCommand sends cmd and shows the outcome. When the response was cut
+// off on the way, cmd is kept for the Retry button, which sends it again
+// with the same idempotency key, so the server does not run a mutation
+// twice. A command cancelled through ctx ends quietly; cancelCurrent has
+// already said so.
+func (t *Terminal) runCommand(ctx context.Context, cmd Command) {
+	t.retryCommand = nil
+	response, err := t.sendCommandContext(ctx, cmd)
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		t.appendOutput(fmt.Sprintf("$ Error: %v", err))
+		if isTruncated(err) {
+			t.retryCommand = &cmd
+		}
+		return
+	}
+	if t.serverVersion == "" {
+		go t.fetchVersion()
+	}
+
+	switch response.Status {
+	case "success":
+		t.recentPaths = rememberPath(t.recentPaths, cmd.Parameters["path"])
+		t.appendOutput(fmt.Sprintf("$ %s (%s)", t.translate("op.success"), t.lastTiming))
+		t.appendOutput(fmt.Sprintf("Result: %s", t.formatResult(response.Data)))
+		switch cmd.Operation {
+		case "list_files":
+			t.listings.Put(cmd.Parameters["path"], cmd.Parameters["filter"], response.Data)
+			t.keepListing(cmd.Parameters["path"], response.Data)
+		case "disk_usage":
+			t.showDiskUsage(response.Data)
+		}
+	case "error":
+		t.appendOutput(fmt.Sprintf("$ %s: %s (%s)", t.translate("op.failed"), t.describeError(response.Err()), t.lastTiming))
+		t.handleErrorCode(cmd, response.Code)
+	default:
+		t.appendOutput(fmt.Sprintf("$ Unexpected response status: %s (%s)", response.Status, t.lastTiming))
+	}
+}
+
+// handleErrorCode reacts to error codes that mean the client's own state
+// is out of date.
+func (t *Terminal) handleErrorCode(cmd Command, code string) {
+	switch code {
+	case "too_large":
+		// The limit may have been lowered since it was fetched.
+		go t.fetchCapabilities()
+	case "not_found":
+		t.listings.Invalidate(path.Dir(path.Clean(cmd.Parameters["path"])))
+	}
+}
+
+// showDiskUsage updates the disk gauge from a disk_usage result.
+func (t *Terminal) showDiskUsage(data json.RawMessage) {
+	var usage struct {
+		Total uint64 `json:"total"`
+		Free  uint64 `json:"free"`
+		Used  uint64 `json:"used"`
+	}
+	if err := json.Unmarshal(data, &usage); err != nil || usage.Total == 0 {
+		return
+	}
+
+	t.diskGauge = float32(usage.Used) / float32(usage.Total)
+	t.diskSummary = fmt.Sprintf("Disk: %d of %d bytes used, %d free (%.0f%%)",
+		usage.Used, usage.Total, usage.Free, t.diskGauge*100)
+	t.invalidate()
+}
+
+// uploadStep is a single command of an upload plan. Local names the file
+// whose content is sent with a write_file step and is empty for the
+// create_folder steps that recreate a folder's structure.
+type uploadStep struct {
+	Local   string
+	Size    int64
+	Command Command
+}
+
+// uploadResult records the outcome of one uploadStep.
+type uploadResult struct {
+	Step uploadStep
+	Err  error
+}
+
+// planUploads turns the selected local files and folders into the commands
+// that recreate them under remoteDir. Folders are walked recursively and
+// keep their relative layout; each folder's create_folder step comes before
+// the files inside it. Anything that is not a regular file or a directory
+// is skipped.
+func planUploads(localPaths []string, remoteDir string) ([]uploadStep, error) {
+	var steps []uploadStep
+	for _, local := range localPaths {
+		local = strings.TrimSpace(local)
+		if local == "" {
+			continue
+		}
+
+		info, err := os.Stat(local)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			steps = append(steps, writeStep(local, info.Size(), path.Join(remoteDir, filepath.Base(local))))
+			continue
+		}
+
+		base := filepath.Base(filepath.Clean(local))
+		err = filepath.WalkDir(local, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(local, p)
+			if err != nil {
+				return err
+			}
+			remote := path.Join(remoteDir, base, filepath.ToSlash(rel))
+
+			switch {
+			case d.IsDir():
+				steps = append(steps, uploadStep{
+					Command: Command{
+						Operation:  "create_folder",
+						Parameters: map[string]string{"path": remote},
+					},
+				})
+			case d.Type().IsRegular():
+				info, err := d.Info()
+				if err != nil {
+					return err
+				}
+				steps = append(steps, writeStep(p, info.Size(), remote))
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return steps, nil
+}
+
+// setContent attaches content to a write_file command together with its
+// sha256, which the server checks before writing anything.
+func setContent(cmd Command, content string) {
+	sum := sha256.Sum256([]byte(content))
+	cmd.Parameters["content"] = content
+	cmd.Parameters["sha256"] = hex.EncodeToString(sum[:])
+}
+
+func writeStep(local string, size int64, remote string) uploadStep {
+	return uploadStep{
+		Local: local,
+		Size:  size,
+		Command: Command{
+			Operation:  "write_file",
+			Parameters: map[string]string{"path": remote},
+		},
+	}
+}
+
+// summarizeUploads reports how many steps succeeded and lists every failure
+// with its reason, so a partially failed upload shows exactly what is
+// missing on the server.
+func summarizeUploads(results []uploadResult) string {
+	var failed []uploadResult
+	for _, r := range results {
+		if r.Err != nil {
+			failed = append(failed, r)
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "$ Upload finished: %d of %d succeeded", len(results)-len(failed), len(results))
+	for _, r := range failed {
+		target := r.Step.Command.Parameters["path"]
+		if r.Step.Local != "" {
+			target = r.Step.Local + " -> " + target
+		}
+		fmt.Fprintf(&b, "\n  FAILED %s %s: %v", r.Step.Command.Operation, target, r.Err)
+	}
+	return b.String()
+}
+
+func (t *Terminal) uploadFiles() {
+	dir, _, err := t.pathFields()
+	if err != nil {
+		t.appendOutput(fmt.Sprintf("$ Error: %v", err))
+		return
+	}
+	steps, err := planUploads(strings.Split(t.uploadInput.Text(), "\n"), dir)
+	if err != nil {
+		t.appendOutput(fmt.Sprintf("$ Error: Failed to plan upload: %v", err))
+		return
+	}
+	if len(steps) == 0 {
+		t.appendOutput("$ Nothing to upload")
+		return
+	}
+
+	var totalBytes, doneBytes int64
+	for _, step := range steps {
+		totalBytes += step.Size
+	}
+	t.appendOutput(fmt.Sprintf("$ Uploading %d items (%d bytes) to %s", len(steps), totalBytes, dir))
+	rate := &transferRate{}
+	rate.Add(time.Now(), 0)
+	t.uploadMu.Lock()
+	t.uploadRate, t.uploadTotal = rate, totalBytes
+	t.uploadMu.Unlock()
+	defer func() {
+		t.uploadMu.Lock()
+		t.uploadRate = nil
+		t.uploadMu.Unlock()
+		t.invalidate()
+	}()
+
+	results := make([]uploadResult, 0, len(steps))
+	for i, step := range steps {
+		err := t.runUploadStep(step)
+		results = append(results, uploadResult{Step: step, Err: err})
+
+		doneBytes += step.Size
+		t.uploadMu.Lock()
+		rate.Add(time.Now(), doneBytes)
+		t.uploadMu.Unlock()
+		if totalBytes > 0 {
+			t.uploadProgress = float32(doneBytes) / float32(totalBytes)
+		} else {
+			t.uploadProgress = float32(i+1) / float32(len(steps))
+		}
+		t.invalidate()
+	}
+
+	t.appendOutput(summarizeUploads(results))
+}
+
+func (t *Terminal) runUploadStep(step uploadStep) error {
+	cmd := Command{
+		Operation:  step.Command.Operation,
+		Parameters: map[string]string{"path": step.Command.Parameters["path"]},
+	}
+	if step.Local != "" {
+		content, err := os.ReadFile(step.Local)
+		if err != nil {
+			return err
+		}
+		setContent(cmd, string(content))
+	}
+
+	response, err := t.sendCommand(cmd)
+	if err != nil {
+		return err
+	}
+	if response.Status != "success" {
+		return response.Err()
+	}
+	return nil
+}
+
+// downloadFile saves the remote file at remote to local. Bytes are written
+// to local+".part" first; if that file is left over from an interrupted
+// attempt, the download resumes after it with a Range request. The part
+// file is renamed to local once the body has been received completely.
+// progress is called with the bytes on disk and the full size as the body
+// arrives; cancelling ctx stops the download and keeps the part file.
+func (t *Terminal) downloadFile(ctx context.Context, remote, local string, progress func(received, total int64)) error {
+	partial := local + ".part"
+	f, err := os.OpenFile(partial, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	endpoint, err := t.apiURL("/api/file")
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint+"?"+url.Values{"path": {remote}}.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	t.authorize(req)
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var total int64
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		start, size, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil {
+			return err
+		}
+		if start != offset {
+			return fmt.Errorf("server resumed at byte %d, expected %d", start, offset)
+		}
+		total = size
+	case http.StatusOK:
+		// The server ignored the range; start over.
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		offset = 0
+		total = max(resp.ContentLength, 0)
+	case http.StatusRequestedRangeNotSatisfiable:
+		_, total, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil || total != offset {
+			// The remote file changed size; the partial data is useless.
+			f.Close()
+			os.Remove(partial)
+			return fmt.Errorf("remote file changed since the download started; retry to start over")
+		}
+		// Everything was already received before the interruption.
+		progress(total, total)
+		f.Close()
+		return os.Rename(partial, local)
+	default:
+		var response Response
+		body, _ := io.ReadAll(resp.Body)
+		if json.Unmarshal(body, &response) == nil && response.Message != "" {
+			return response.Err()
+		}
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	progress(offset, total)
+	n, err := io.Copy(&progressWriter{w: f, n: offset, total: total, report: progress}, resp.Body)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("interrupted after %d bytes, download again to resume: %v", offset+n, err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(partial, local)
 }
 
-func newTerminal() *Terminal {
-	t := &Terminal{
-		theme: material.NewTheme(gofont.Collection()),
-		client: &http.Client{
-			Transport: &http3.RoundTripper{},
-			Timeout:   30 * time.Second,
-		},
+// progressWriter reports the running byte count after each write.
+type progressWriter struct {
+	w      io.Writer
+	n      int64
+	total  int64
+	report func(received, total int64)
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.n += int64(n)
+	p.report(p.n, p.total)
+	return n, err
+}
+
+// parseContentRange reads the start offset and complete length from a
+// Content-Range header such as "bytes 100-199/1000" or "bytes */1000". The
+// start is -1 for the unsatisfied form.
+func parseContentRange(header string) (start, total int64, err error) {
+	spec, ok := strings.CutPrefix(header, "bytes ")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid Content-Range: %q", header)
+	}
+	rng, size, ok := strings.Cut(spec, "/")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid Content-Range: %q", header)
 	}
 
-	// Set default values
-	t.serverURLInput.SetText("https://your-server-address/api/operations")
-	t.directoryInput.SetText("/allowed/path")
-	t.filterInput.SetText("*.txt")
-	t.tokenInput.SetText("YOUR_AUTH_TOKEN")
-	t.clientIDInput.SetText("YOUR_CLIENT_ID")
+	total, err = strconv.ParseInt(size, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid Content-Range: %q", header)
+	}
+	if rng == "*" {
+		return -1, total, nil
+	}
 
-	t.outputEditor.SingleLine = false
-	t.outputEditor.Submit = false
-	t.outputList.Axis = layout.Vertical
+	first, _, ok := strings.Cut(rng, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid Content-Range: %q", header)
+	}
+	start, err = strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid Content-Range: %q", header)
+	}
+	return start, total, nil
+}
 
-	return t
+func (t *Terminal) download() {
+	remote, _, err := t.pathFields()
+	if err != nil {
+		t.appendOutput(fmt.Sprintf("$ Error: %v", err))
+		return
+	}
+	local := strings.TrimSpace(t.downloadInput.Text())
+	if local == "" {
+		local = path.Base(remote)
+	}
+
+	t.appendOutput(fmt.Sprintf("$ Downloading %s to %s", remote, local))
+	if err := t.downloads.Add(remote, local); err != nil {
+		t.appendOutput(fmt.Sprintf("$ Error: %v", err))
+	}
 }
 
-func (t *Terminal) appendOutput(text string) {
-	t.output = append(t.output, text)
-	var builder strings.Builder
-	for _, line := range t.output {
-		builder.WriteString(line)
-		builder.WriteString("\n")
+// downloadFolder saves the directory in the Directory field as a tar.gz or
+// zip archive, streamed by the server's tar_stream action.
+func (t *Terminal) downloadFolder() {
+	remote, _, err := t.pathFields()
+	if err != nil {
+		t.appendOutput(fmt.Sprintf("$ Error: %v", err))
+		return
 	}
-	t.outputEditor.SetText(builder.String())
+	local, format := archiveTarget(remote, strings.TrimSpace(t.downloadInput.Text()), archiveFormat(t.archiveChoice.Value))
+
+	t.appendOutput(fmt.Sprintf("$ Downloading folder %s to %s", remote, local))
+	t.folderProgress = 0
+	if err := t.fetchArchive(remote, local, format); err != nil {
+		t.appendOutput(fmt.Sprintf("$ Error: Folder download failed: %v", err))
+		return
+	}
+	t.appendOutput(fmt.Sprintf("$ Download complete: %s", local))
 }
 
-func (t *Terminal) executeCommand() {
+// fetchArchive writes the archive to a part file and renames it into place
+// once complete. An interrupted download deletes the part file, since a
+// stream cannot be resumed.
+func (t *Terminal) fetchArchive(remote, local string, format archiveFormat) error {
 	cmd := Command{
-		Operation: "list_files",
+		Operation: "tar_stream",
 		Parameters: map[string]string{
-			"directory": t.directoryInput.Text(),
-			"filter":    t.filterInput.Text(),
+			"path": remote,
+			"gzip": strconv.FormatBool(format == archiveTarGz),
 		},
 		Timestamp: time.Now(),
 	}
-
 	jsonData, err := json.Marshal(cmd)
 	if err != nil {
-		t.appendOutput(fmt.Sprintf("$ Error: Failed to marshal command: %v", err))
-		return
+		return err
 	}
-
-	req, err := http.NewRequest(
-		"POST",
-		t.serverURLInput.Text(),
-		bytes.NewBuffer(jsonData),
-	)
+	req, err := http.NewRequest("POST", t.serverURLInput.Text(), bytes.NewBuffer(jsonData))
 	if err != nil {
-		t.appendOutput(fmt.Sprintf("$ Error: Failed to create request: %v", err))
-		return
+		return err
 	}
-
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+t.tokenInput.Text())
-	req.Header.Set("X-Client-ID", t.clientIDInput.Text())
-
-	t.appendOutput(fmt.Sprintf("$ Executing command...\nURL: %s\nOperation: list_files\nDirectory: %s\nFilter: %s",
-		t.serverURLInput.Text(), t.directoryInput.Text(), t.filterInput.Text()))
+	t.authorize(req)
 
 	resp, err := t.client.Do(req)
 	if err != nil {
-		t.appendOutput(fmt.Sprintf("$ Error: Failed to send request: %v", err))
-		return
+		return fmt.Errorf("failed to send request: %v", err)
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var response Response
+		if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+			return fmt.Errorf("unexpected response status: %s", resp.Status)
+		}
+		return response.Err()
+	}
+	total, _ := strconv.ParseInt(resp.Header.Get("X-Archive-Size"), 10, 64)
 
-	body, err := io.ReadAll(resp.Body)
+	partial := local + ".part"
+	f, err := os.Create(partial)
 	if err != nil {
-		t.appendOutput(fmt.Sprintf("$ Error: Failed to read response: %v", err))
-		return
+		return err
+	}
+	err = saveArchive(resp.Body, f, format, func(done int64) {
+		if total > 0 {
+			t.folderProgress = float32(min(done, total)) / float32(total)
+			t.invalidate()
+		}
+	})
+	if cerr := f.Close(); err == nil {
+		err = cerr
 	}
+	if err != nil {
+		os.Remove(partial)
+		return err
+	}
+	t.folderProgress = 1
+	t.invalidate()
+	return os.Rename(partial, local)
+}
 
-	var response Response
-	if err := json.Unmarshal(body, &response); err != nil {
-		t.appendOutput(fmt.Sprintf("$ Error: Failed to parse response: %v", err))
-		return
+// downloadControls holds the buttons of one row in the downloads list.
+type downloadControls struct {
+	pause  widget.Clickable
+	resume widget.Clickable
+	cancel widget.Clickable
+}
+
+// controlsFor returns the buttons for the download saved at local, creating
+// them on first use.
+func (t *Terminal) controlsFor(local string) *downloadControls {
+	c, ok := t.downloadCtrls[local]
+	if !ok {
+		c = &downloadControls{}
+		t.downloadCtrls[local] = c
+	}
+	return c
+}
+
+// handleDownloadControls applies clicks on the downloads list.
+func (t *Terminal) handleDownloadControls() {
+	for local, c := range t.downloadCtrls {
+		if c.pause.Clicked() {
+			t.downloads.Pause(local)
+		}
+		if c.resume.Clicked() {
+			t.downloads.Resume(local)
+		}
+		if c.cancel.Clicked() {
+			t.downloads.Cancel(local)
+			delete(t.downloadCtrls, local)
+		}
 	}
+}
 
-	switch response.Status {
-	case "success":
-		t.appendOutput("$ Operation successful!")
-		t.appendOutput(fmt.Sprintf("Result: %s", response.Data))
-	case "error":
-		t.appendOutput(fmt.Sprintf("$ Operation failed: %s", response.Message))
-	default:
-		t.appendOutput(fmt.Sprintf("$ Unexpected response status: %s", response.Status))
+// formatProgress renders a byte count against a total that may be unknown.
+func formatProgress(received, total int64) string {
+	if total <= 0 {
+		return fmt.Sprintf("%d bytes", received)
+	}
+	return fmt.Sprintf("%d / %d bytes (%.0f%%)", received, total, 100*float64(received)/float64(total))
+}
+
+// bookmarkSidebarWidth is the width of the bookmarks sidebar.
+const bookmarkSidebarWidth = unit.Dp(180)
+
+// bookmarkControls are the buttons of one row of the bookmarks sidebar.
+type bookmarkControls struct {
+	open   widget.Clickable
+	up     widget.Clickable
+	down   widget.Clickable
+	remove widget.Clickable
+}
+
+// handleBookmarks applies clicks on the bookmarks sidebar. Opening a
+// bookmark puts its path in the Directory field and runs the selected
+// operation on it.
+func (t *Terminal) handleBookmarks() {
+	if t.bookmarkAdd.Clicked() {
+		dir := t.directoryInput.Text()
+		if added, err := t.bookmarks.Add(dir, t.bookmarkLabel.Text()); err != nil {
+			t.appendOutput(fmt.Sprintf("$ Error: Failed to save bookmark: %v", err))
+		} else if !added {
+			t.appendOutput(fmt.Sprintf("$ Already bookmarked: %s", cleanBookmarkPath(dir)))
+		}
+		t.bookmarkLabel.SetText("")
+	}
+
+	for i, b := range t.bookmarks.List() {
+		if i >= len(t.bookmarkCtrls) {
+			break
+		}
+		c := &t.bookmarkCtrls[i]
+		var err error
+		switch {
+		case c.open.Clicked():
+			t.directoryInput.SetText(b.Path)
+			t.executeCommand()
+		case c.up.Clicked():
+			err = t.bookmarks.Move(b.Path, -1)
+		case c.down.Clicked():
+			err = t.bookmarks.Move(b.Path, 1)
+		case c.remove.Clicked():
+			err = t.bookmarks.Remove(b.Path)
+		}
+		if err != nil {
+			t.appendOutput(fmt.Sprintf("$ Error: Failed to save bookmarks: %v", err))
+		}
+	}
+}
+
+// layoutBookmarks draws the bookmarks sidebar down the left of the
+// window: a field to label the path in the Directory field and a button
+// to bookmark it, then one row per bookmark.
+func (t *Terminal) layoutBookmarks(gtx layout.Context) layout.Dimensions {
+	list := t.bookmarks.List()
+	if len(t.bookmarkCtrls) < len(list) {
+		t.bookmarkCtrls = append(t.bookmarkCtrls, make([]bookmarkControls, len(list)-len(t.bookmarkCtrls))...)
+	}
+
+	gtx.Constraints.Max.X = gtx.Dp(bookmarkSidebarWidth)
+	gtx.Constraints.Min.X = gtx.Constraints.Max.X
+	return layout.Inset{Top: unit.Dp(20), Left: unit.Dp(10)}.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
+		rows := []layout.FlexChild{
+			layout.Rigid(material.Label(t.theme, unit.Sp(14), "Bookmarks:").Layout),
+			layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+				return material.Editor(t.theme, &t.bookmarkLabel, "Label (optional)").Layout(gtx)
+			}),
+			layout.Rigid(material.Button(t.theme, &t.bookmarkAdd, "Bookmark Directory").Layout),
+		}
+		for i, b := range list {
+			c := &t.bookmarkCtrls[i]
+			name := b.Name()
+			rows = append(rows, layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+				return layout.Inset{Top: unit.Dp(5)}.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
+					return layout.Flex{Alignment: layout.Middle}.Layout(gtx,
+						layout.Flexed(1, material.Button(t.theme, &c.open, name).Layout),
+						layout.Rigid(material.Button(t.theme, &c.up, "↑").Layout),
+						layout.Rigid(material.Button(t.theme, &c.down, "↓").Layout),
+						layout.Rigid(material.Button(t.theme, &c.remove, "x").Layout),
+					)
+				})
+			}))
+		}
+		return layout.Flex{Axis: layout.Vertical}.Layout(gtx, rows...)
+	})
+}
+
+// layoutQueue shows the running operation and how many wait behind it,
+// with the keys that cancel them.
+func (t *Terminal) layoutQueue(gtx layout.Context) layout.Dimensions {
+	current, pending := t.queue.Status()
+	if current == "" {
+		return layout.Dimensions{}
+	}
+	status := fmt.Sprintf("Running: %s (Esc cancels)", current)
+	if pending > 0 {
+		status += fmt.Sprintf("; %d queued (Shift+Esc clears)", pending)
 	}
+	return material.Label(t.theme, unit.Sp(12), status).Layout(gtx)
+}
+
+// layoutUploadRate shows the throughput and ETA of the running upload.
+// Progress is counted per uploaded file, so the rate moves in steps.
+func (t *Terminal) layoutUploadRate(gtx layout.Context) layout.Dimensions {
+	t.uploadMu.Lock()
+	rate, total := t.uploadRate, t.uploadTotal
+	var stat transferStat
+	if rate != nil {
+		stat = rate.Stats(total, gtx.Now)
+	}
+	t.uploadMu.Unlock()
+	if rate == nil {
+		return layout.Dimensions{}
+	}
+	op.InvalidateOp{At: gtx.Now.Add(time.Second)}.Add(gtx.Ops)
+	return material.Label(t.theme, unit.Sp(12), formatThroughput(stat)).Layout(gtx)
+}
+
+// layoutDownloads draws one row per download with the buttons that apply to
+// its status.
+func (t *Terminal) layoutDownloads(gtx layout.Context) layout.Dimensions {
+	list := t.downloads.List()
+	if len(list) == 0 {
+		return layout.Dimensions{}
+	}
+
+	rows := []layout.FlexChild{
+		layout.Rigid(layout.Spacer{Height: unit.Dp(10)}.Layout),
+		layout.Rigid(material.Label(t.theme, unit.Sp(14), "Downloads:").Layout),
+	}
+	for _, d := range list {
+		d := d
+		if d.Status == downloadActive {
+			// Redraw while running so the rate slows down and shows a
+			// stall even when no bytes arrive to trigger a frame.
+			op.InvalidateOp{At: gtx.Now.Add(time.Second)}.Add(gtx.Ops)
+		}
+		c := t.controlsFor(d.Local)
+		rows = append(rows, layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+			summary := fmt.Sprintf("%s  %s  %s", filepath.Base(d.Local), formatProgress(d.Received, d.Total), d.Status)
+			if d.Status == downloadActive {
+				if rate := formatThroughput(t.downloads.Throughput(d.Local, gtx.Now)); rate != "" {
+					summary += "  " + rate
+				}
+			}
+			if d.Error != "" {
+				summary += ": " + d.Error
+			}
+
+			buttons := []layout.FlexChild{
+				layout.Flexed(1, material.Label(t.theme, unit.Sp(12), summary).Layout),
+			}
+			switch d.Status {
+			case downloadActive:
+				buttons = append(buttons, layout.Rigid(material.Button(t.theme, &c.pause, "Pause").Layout))
+			case downloadPaused, downloadFailed:
+				buttons = append(buttons, layout.Rigid(material.Button(t.theme, &c.resume, "Resume").Layout))
+			}
+			label := "Cancel"
+			if d.Status == downloadDone {
+				label = "Clear"
+			}
+			buttons = append(buttons,
+				layout.Rigid(layout.Spacer{Width: unit.Dp(5)}.Layout),
+				layout.Rigid(material.Button(t.theme, &c.cancel, label).Layout),
+			)
+			return layout.Inset{Top: unit.Dp(5)}.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
+				return layout.Flex{Alignment: layout.Middle}.Layout(gtx, buttons...)
+			})
+		}))
+	}
+	return layout.Flex{Axis: layout.Vertical}.Layout(gtx, rows...)
 }
 
 func (t *Terminal) layout(gtx layout.Context) layout.Dimensions {
@@ -151,6 +2817,7 @@ func (t *Terminal) layout(gtx layout.Context) layout.Dimensions {
 	background := color.NRGBA{R: 40, G: 44, B: 52, A: 255}   // Dark background
 	textColor := color.NRGBA{R: 171, G: 178, B: 191, A: 255} // Light text
 	borderColor := color.NRGBA{R: 80, G: 84, B: 92, A: 255}  // Border color
+	warningColor := color.NRGBA{R: 229, G: 192, B: 123, A: 255}
 
 	// Set theme colors
 	t.theme.ContrastBg = background
@@ -162,7 +2829,9 @@ func (t *Terminal) layout(gtx layout.Context) layout.Dimensions {
 			return layout.Dimensions{Size: gtx.Constraints.Max}
 		}),
 		layout.Stacked(func(gtx layout.Context) layout.Dimensions {
-			return layout.UniformInset(unit.Dp(20)).Layout(gtx, func(gtx layout.Context) layout.Dimensions {
+			// The left inset leaves room for the bookmarks sidebar.
+			inset := layout.Inset{Top: unit.Dp(20), Bottom: unit.Dp(20), Right: unit.Dp(20), Left: unit.Dp(20) + bookmarkSidebarWidth}
+			return inset.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
 				return layout.Flex{Axis: layout.Vertical}.Layout(gtx,
 					layout.Rigid(func(gtx layout.Context) layout.Dimensions {
 						return layout.Flex{Axis: layout.Vertical}.Layout(gtx,
@@ -188,16 +2857,69 @@ func (t *Terminal) layout(gtx layout.Context) layout.Dimensions {
 								ed.Font.Style = text.Mono
 								return ed.Layout(gtx)
 							}),
+							layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+								if t.varError == "" {
+									return layout.Dimensions{}
+								}
+								lbl := material.Label(t.theme, unit.Sp(12), t.varError)
+								lbl.Color = warningColor
+								return lbl.Layout(gtx)
+							}),
+							layout.Rigid(layout.Spacer{Height: unit.Dp(10)}.Layout),
+
+							layout.Rigid(material.Label(t.theme, unit.Sp(14), "Variables (NAME=value per line; use as ${NAME}, built-in ${USER} ${HOME} ${DATE}):").Layout),
+							layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+								ed := material.Editor(t.theme, &t.varsInput, "")
+								ed.Font.Style = text.Mono
+								return ed.Layout(gtx)
+							}),
+							layout.Rigid(layout.Spacer{Height: unit.Dp(10)}.Layout),
+
+							layout.Rigid(material.Label(t.theme, unit.Sp(14), "Transforms (one per line: pretty_json, unquote, strip_ansi, replace PATTERN => TEXT):").Layout),
+							layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+								ed := material.Editor(t.theme, &t.transformInput, "")
+								ed.Font.Style = text.Mono
+								return ed.Layout(gtx)
+							}),
+							layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+								if t.transformError == "" {
+									return layout.Dimensions{}
+								}
+								lbl := material.Label(t.theme, unit.Sp(12), t.transformError)
+								lbl.Color = warningColor
+								return lbl.Layout(gtx)
+							}),
 							layout.Rigid(layout.Spacer{Height: unit.Dp(10)}.Layout),
 
-							layout.Rigid(material.Label(t.theme, unit.Sp(14), "Auth Token:").Layout),
+							layout.Rigid(material.Label(t.theme, unit.Sp(14), "Search (regular expression):").Layout),
 							layout.Rigid(func(gtx layout.Context) layout.Dimensions {
-								ed := material.Editor(t.theme, &t.tokenInput, "")
+								ed := material.Editor(t.theme, &t.searchInput, "")
 								ed.Font.Style = text.Mono
 								return ed.Layout(gtx)
 							}),
 							layout.Rigid(layout.Spacer{Height: unit.Dp(10)}.Layout),
 
+							layout.Rigid(material.Label(t.theme, unit.Sp(14), "Authentication:").Layout),
+							layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+								return layout.Flex{}.Layout(gtx,
+									layout.Rigid(material.RadioButton(t.theme, &t.authScheme, string(authBearer), "Bearer token").Layout),
+									layout.Rigid(material.RadioButton(t.theme, &t.authScheme, string(authAPIKey), "API key header").Layout),
+									layout.Rigid(material.RadioButton(t.theme, &t.authScheme, string(authMTLS), "mTLS").Layout),
+								)
+							}),
+							layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+								return t.layoutAuth(gtx)
+							}),
+							layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+								if t.authError == "" {
+									return layout.Dimensions{}
+								}
+								lbl := material.Label(t.theme, unit.Sp(12), t.authError)
+								lbl.Color = warningColor
+								return lbl.Layout(gtx)
+							}),
+							layout.Rigid(layout.Spacer{Height: unit.Dp(10)}.Layout),
+
 							layout.Rigid(material.Label(t.theme, unit.Sp(14), "Client ID:").Layout),
 							layout.Rigid(func(gtx layout.Context) layout.Dimensions {
 								ed := material.Editor(t.theme, &t.clientIDInput, "")
@@ -206,10 +2928,221 @@ func (t *Terminal) layout(gtx layout.Context) layout.Dimensions {
 							}),
 							layout.Rigid(layout.Spacer{Height: unit.Dp(10)}.Layout),
 
+							layout.Rigid(material.Label(t.theme, unit.Sp(14), "Lock after idle (minutes, 0 = never):").Layout),
+							layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+								ed := material.Editor(t.theme, &t.lockInput, "")
+								ed.Font.Style = text.Mono
+								return ed.Layout(gtx)
+							}),
+							layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+								if t.lockError == "" {
+									return layout.Dimensions{}
+								}
+								lbl := material.Label(t.theme, unit.Sp(12), t.lockError)
+								lbl.Color = warningColor
+								return lbl.Layout(gtx)
+							}),
+							layout.Rigid(layout.Spacer{Height: unit.Dp(10)}.Layout),
+
+							layout.Rigid(material.Label(t.theme, unit.Sp(14), "Language:").Layout),
+							layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+								options := make([]layout.FlexChild, len(locales))
+								for i, l := range locales {
+									options[i] = layout.Rigid(material.RadioButton(t.theme, &t.language, l.Code, l.Name).Layout)
+								}
+								return layout.Flex{}.Layout(gtx, options...)
+							}),
+							layout.Rigid(material.CheckBox(t.theme, &t.vimKeys, "Vim keys in file browser (j/k, Enter, /)").Layout),
+							layout.Rigid(layout.Spacer{Height: unit.Dp(10)}.Layout),
+
+							layout.Rigid(material.Label(t.theme, unit.Sp(14), "Operation:").Layout),
+							layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+								return layout.Flex{}.Layout(gtx,
+									layout.Rigid(material.RadioButton(t.theme, &t.operation, "list_files", "List").Layout),
+									layout.Rigid(material.RadioButton(t.theme, &t.operation, "read_file", "Read").Layout),
+									layout.Rigid(material.RadioButton(t.theme, &t.operation, "write_file", "Write").Layout),
+									layout.Rigid(material.RadioButton(t.theme, &t.operation, "create_folder", "Create Folder").Layout),
+									layout.Rigid(material.RadioButton(t.theme, &t.operation, "disk_usage", "Disk Usage").Layout),
+								)
+							}),
+							layout.Rigid(layout.Spacer{Height: unit.Dp(10)}.Layout),
+
+							layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+								return layout.Flex{Alignment: layout.Middle}.Layout(gtx,
+									layout.Rigid(material.Label(t.theme, unit.Sp(14), "Content (write_file):").Layout),
+									layout.Rigid(layout.Spacer{Width: unit.Dp(10)}.Layout),
+									layout.Rigid(material.CheckBox(t.theme, &t.jsonMode, "JSON").Layout),
+									layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+										if !t.jsonMode.Value {
+											return layout.Dimensions{}
+										}
+										return layout.UniformInset(unit.Dp(4)).Layout(gtx, material.Button(t.theme, &t.formatButton, "Format").Layout)
+									}),
+								)
+							}),
+							layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+								ed := material.Editor(t.theme, &t.contentInput, "")
+								ed.Font.Style = text.Mono
+								return ed.Layout(gtx)
+							}),
+							layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+								if t.jsonError == "" {
+									return layout.Dimensions{}
+								}
+								lbl := material.Label(t.theme, unit.Sp(12), t.jsonError)
+								lbl.Color = warningColor
+								return lbl.Layout(gtx)
+							}),
+							layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+								if t.contentWarning == "" {
+									return layout.Dimensions{}
+								}
+								lbl := material.Label(t.theme, unit.Sp(12), t.contentWarning)
+								lbl.Color = warningColor
+								return lbl.Layout(gtx)
+							}),
+							layout.Rigid(layout.Spacer{Height: unit.Dp(10)}.Layout),
+
+							layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+								return layout.Flex{}.Layout(gtx,
+									layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+										if t.contentBlocked() {
+											gtx = gtx.Disabled()
+										}
+										return material.Button(t.theme, &t.executeButton, "Execute Command").Layout(gtx)
+									}),
+									layout.Rigid(layout.Spacer{Width: unit.Dp(10)}.Layout),
+									layout.Rigid(material.Button(t.theme, &t.refreshButton, "Refresh").Layout),
+									layout.Rigid(layout.Spacer{Width: unit.Dp(10)}.Layout),
+									layout.Rigid(material.Button(t.theme, &t.searchButton, "Search").Layout),
+									layout.Rigid(layout.Spacer{Width: unit.Dp(10)}.Layout),
+									layout.Rigid(material.Button(t.theme, &t.exportButton, "Export CSV").Layout),
+									layout.Rigid(layout.Spacer{Width: unit.Dp(10)}.Layout),
+									layout.Rigid(material.Button(t.theme, &t.diagButton, "Diagnostics").Layout),
+									layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+										if t.retryCommand == nil {
+											return layout.Dimensions{}
+										}
+										return layout.Inset{Left: unit.Dp(10)}.Layout(gtx, material.Button(t.theme, &t.retryButton, "Retry").Layout)
+									}),
+								)
+							}),
+							layout.Rigid(t.layoutQueue),
+							layout.Rigid(layout.Spacer{Height: unit.Dp(10)}.Layout),
+
+							layout.Rigid(material.Label(t.theme, unit.Sp(14), "Script (one operation per line, e.g. create_folder path=/data/new):").Layout),
+							layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+								ed := material.Editor(t.theme, &t.scriptInput, "")
+								ed.Font.Style = text.Mono
+								return ed.Layout(gtx)
+							}),
+							layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+								return layout.Flex{Alignment: layout.Middle}.Layout(gtx,
+									layout.Rigid(material.Button(t.theme, &t.scriptButton, "Run Script").Layout),
+									layout.Rigid(layout.Spacer{Width: unit.Dp(10)}.Layout),
+									layout.Rigid(material.CheckBox(t.theme, &t.stopOnError, "Stop on error").Layout),
+								)
+							}),
+							layout.Rigid(layout.Spacer{Height: unit.Dp(10)}.Layout),
+
+							layout.Rigid(material.Label(t.theme, unit.Sp(14), "Exec (runs in Directory, e.g. tail -n 20 app.log):").Layout),
+							layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+								return layout.Flex{Alignment: layout.Middle}.Layout(gtx,
+									layout.Flexed(1, func(gtx layout.Context) layout.Dimensions {
+										ed := material.Editor(t.theme, &t.execInput, "")
+										ed.Font.Style = text.Mono
+										return ed.Layout(gtx)
+									}),
+									layout.Rigid(layout.Spacer{Width: unit.Dp(10)}.Layout),
+									layout.Rigid(material.Button(t.theme, &t.execButton, "Run").Layout),
+								)
+							}),
+							layout.Rigid(t.layoutExec),
+							layout.Rigid(layout.Spacer{Height: unit.Dp(10)}.Layout),
+
+							layout.Rigid(material.Label(t.theme, unit.Sp(14), "Edit Config (JSON file on the server):").Layout),
+							layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+								return layout.Flex{Alignment: layout.Middle}.Layout(gtx,
+									layout.Flexed(1, func(gtx layout.Context) layout.Dimensions {
+										ed := material.Editor(t.theme, &t.configPath, "")
+										ed.Font.Style = text.Mono
+										return ed.Layout(gtx)
+									}),
+									layout.Rigid(layout.Spacer{Width: unit.Dp(10)}.Layout),
+									layout.Rigid(material.Button(t.theme, &t.configOpen, "Open").Layout),
+								)
+							}),
+							layout.Rigid(t.layoutConfigEdit),
+							layout.Rigid(layout.Spacer{Height: unit.Dp(10)}.Layout),
+
+							layout.Rigid(material.Label(t.theme, unit.Sp(14), "Follow (file on the server, streams lines as they are appended):").Layout),
+							layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+								label := "Follow"
+								if t.following() {
+									label = "Stop"
+								}
+								return layout.Flex{Alignment: layout.Middle}.Layout(gtx,
+									layout.Flexed(1, func(gtx layout.Context) layout.Dimensions {
+										ed := material.Editor(t.theme, &t.followPath, "")
+										ed.Font.Style = text.Mono
+										return ed.Layout(gtx)
+									}),
+									layout.Rigid(layout.Spacer{Width: unit.Dp(10)}.Layout),
+									layout.Rigid(material.Button(t.theme, &t.followButton, label).Layout),
+								)
+							}),
+							layout.Rigid(t.layoutFollow),
+							layout.Rigid(layout.Spacer{Height: unit.Dp(10)}.Layout),
+
+							layout.Rigid(material.Label(t.theme, unit.Sp(14), "Upload (local files or folders, one per line):").Layout),
+							layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+								ed := material.Editor(t.theme, &t.uploadInput, "")
+								ed.Font.Style = text.Mono
+								return ed.Layout(gtx)
+							}),
+							layout.Rigid(layout.Spacer{Height: unit.Dp(10)}.Layout),
+
 							layout.Rigid(func(gtx layout.Context) layout.Dimensions {
-								btn := material.Button(t.theme, &t.executeButton, "Execute Command")
+								btn := material.Button(t.theme, &t.uploadButton, "Upload Files")
 								return btn.Layout(gtx)
 							}),
+							layout.Rigid(layout.Spacer{Height: unit.Dp(5)}.Layout),
+							layout.Rigid(material.ProgressBar(t.theme, t.uploadProgress).Layout),
+							layout.Rigid(t.layoutUploadRate),
+							layout.Rigid(layout.Spacer{Height: unit.Dp(10)}.Layout),
+
+							layout.Rigid(material.Label(t.theme, unit.Sp(14), "Download to (local path):").Layout),
+							layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+								ed := material.Editor(t.theme, &t.downloadInput, "")
+								ed.Font.Style = text.Mono
+								return ed.Layout(gtx)
+							}),
+							layout.Rigid(layout.Spacer{Height: unit.Dp(10)}.Layout),
+
+							layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+								return layout.Flex{Alignment: layout.Middle}.Layout(gtx,
+									layout.Rigid(material.Button(t.theme, &t.downloadButton, "Download").Layout),
+									layout.Rigid(layout.Spacer{Width: unit.Dp(10)}.Layout),
+									layout.Rigid(material.Button(t.theme, &t.folderButton, "Download Folder").Layout),
+									layout.Rigid(material.RadioButton(t.theme, &t.archiveChoice, string(archiveTarGz), "tar.gz").Layout),
+									layout.Rigid(material.RadioButton(t.theme, &t.archiveChoice, string(archiveZip), "zip").Layout),
+								)
+							}),
+							layout.Rigid(layout.Spacer{Height: unit.Dp(5)}.Layout),
+							layout.Rigid(material.ProgressBar(t.theme, t.folderProgress).Layout),
+							layout.Rigid(t.layoutDownloads),
+							layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+								if t.diskSummary == "" {
+									return layout.Dimensions{}
+								}
+								return layout.Flex{Axis: layout.Vertical}.Layout(gtx,
+									layout.Rigid(layout.Spacer{Height: unit.Dp(10)}.Layout),
+									layout.Rigid(material.Label(t.theme, unit.Sp(12), t.diskSummary).Layout),
+									layout.Rigid(material.ProgressBar(t.theme, t.diskGauge).Layout),
+								)
+							}),
+							layout.Rigid(t.layoutBrowser),
+							layout.Rigid(t.layoutDiagnostics),
 							layout.Rigid(layout.Spacer{Height: unit.Dp(20)}.Layout),
 						)
 					}),
@@ -235,21 +3168,48 @@ func (t *Terminal) layout(gtx layout.Context) layout.Dimensions {
 											return layout.Dimensions{Size: gtx.Constraints.Max}
 										}),
 										layout.Stacked(func(gtx layout.Context) layout.Dimensions {
-											return layout.UniformInset(unit.Dp(10)).Layout(gtx, func(gtx layout.Context) layout.Dimensions {
-												ed := material.Editor(t.theme, &t.outputEditor, "")
-												ed.Font.Style = text.Mono
-												ed.TextSize = unit.Sp(14)
-												return ed.Layout(gtx)
-											})
+											return layout.Flex{}.Layout(gtx,
+												layout.Flexed(1, func(gtx layout.Context) layout.Dimensions {
+													return layout.UniformInset(unit.Dp(10)).Layout(gtx, func(gtx layout.Context) layout.Dimensions {
+														ed := material.Editor(t.theme, &t.outputEditor, "")
+														ed.Font.Style = text.Mono
+														ed.TextSize = unit.Sp(14)
+														return ed.Layout(gtx)
+													})
+												}),
+												layout.Rigid(t.layoutMinimap),
+											)
 										}),
 									)
 								})
 							}),
 						)
 					}),
+					layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+						status := t.serverVersion
+						if status == "" {
+							status = "Server version unknown"
+						}
+						if values := t.latencies.Values(); len(values) > 0 {
+							status += fmt.Sprintf("   Latency %s last %s avg %s",
+								sparkline(values),
+								values[len(values)-1].Round(time.Millisecond),
+								t.latencies.Average().Round(time.Millisecond))
+							if t.lastTiming.Reused {
+								status += "   Connection reused"
+							} else {
+								status += "   New connection"
+							}
+						}
+						return layout.Inset{Top: unit.Dp(5)}.Layout(gtx,
+							material.Label(t.theme, unit.Sp(12), status).Layout)
+					}),
 				)
 			})
 		}),
+		layout.Stacked(t.layoutBookmarks),
+		layout.Stacked(t.layoutHelp),
+		layout.Stacked(t.layoutPalette),
 	)
 }
 
@@ -261,6 +3221,8 @@ func main() {
 		)
 
 		term := newTerminal()
+		term.window = w
+		go term.watchLock()
 		var ops op.Ops
 
 		for e := range w.Events() {
@@ -269,10 +3231,62 @@ func main() {
 				gtx := layout.NewContext(&ops, e)
 
 				if term.executeButton.Clicked() {
-					go term.executeCommand()
+					term.executeCommand()
+				}
+				if term.refreshButton.Clicked() {
+					term.refresh()
+				}
+				if term.searchButton.Clicked() {
+					go term.search()
+				}
+				if term.exportButton.Clicked() {
+					go term.exportResults()
+				}
+				if term.retryButton.Clicked() && term.retryCommand != nil {
+					term.retry(*term.retryCommand)
+				}
+				if term.diagButton.Clicked() {
+					term.showDiag = !term.showDiag
 				}
+				if term.formatButton.Clicked() {
+					term.formatContent()
+				}
+				if term.scriptButton.Clicked() {
+					go term.playScript()
+				}
+				if term.execButton.Clicked() {
+					go term.runExec()
+				}
+				if term.followButton.Clicked() {
+					term.toggleFollow()
+				}
+				if term.uploadButton.Clicked() {
+					go term.uploadFiles()
+				}
+				if term.downloadButton.Clicked() {
+					go term.download()
+				}
+				if term.folderButton.Clicked() {
+					go term.downloadFolder()
+				}
+				term.handlePalette()
+				term.handleDownloadControls()
+				term.handleBookmarks()
+				term.handleKeys(gtx)
+				term.handleBrowserKeys(gtx)
+				term.handleContentChanges()
+				term.handleVariableChanges()
+				term.handleLock()
+				term.handleTransformChanges()
+				term.handleAuthChanges()
+				term.handleConfigEdit()
 
-				term.layout(gtx)
+				if term.lock.Locked() {
+					term.layoutLocked(gtx)
+				} else {
+					term.layout(gtx)
+				}
+				term.trackInput(gtx)
 				e.Frame(gtx.Ops)
 
 			case system.DestroyEvent:
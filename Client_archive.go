@@ -0,0 +1,132 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// archiveFormat is the kind of file a folder download is saved as.
+type archiveFormat string
+
+const (
+	archiveTarGz archiveFormat = "tar.gz"
+	archiveZip   archiveFormat = "zip"
+)
+
+// archiveFileName returns the default local name for an archive of the
+// remote directory: its base name plus the format's extension.
+func archiveFileName(remoteDir string, format archiveFormat) string {
+	name := path.Base(path.Clean("/" + remoteDir))
+	if name == "/" {
+		name = "archive"
+	}
+	return name + "." + string(format)
+}
+
+// archiveTarget decides where a folder download goes and in which format.
+// An empty local path, or one naming an existing directory, gets the
+// default file name. A local name ending in .zip, .tar.gz or .tgz picks
+// that format over the selected one.
+func archiveTarget(remoteDir, local string, selected archiveFormat) (string, archiveFormat) {
+	lower := strings.ToLower(local)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return local, archiveZip
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return local, archiveTarGz
+	}
+
+	if local == "" {
+		return archiveFileName(remoteDir, selected), selected
+	}
+	if info, err := os.Stat(local); err == nil && info.IsDir() {
+		return filepath.Join(local, archiveFileName(remoteDir, selected)), selected
+	}
+	return local, selected
+}
+
+// saveArchive reads the server's tar stream from body and writes it to dst
+// in the given format. The stream is gzipped for tar.gz, which is saved as
+// received, and plain for zip, which is rebuilt entry by entry. progress
+// is called with the total bytes of file content seen so far.
+func saveArchive(body io.Reader, dst io.Writer, format archiveFormat, progress func(int64)) error {
+	var done int64
+	count := func(w io.Writer, r io.Reader) error {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := r.Read(buf)
+			if n > 0 {
+				if _, werr := w.Write(buf[:n]); werr != nil {
+					return werr
+				}
+				done += int64(n)
+				progress(done)
+			}
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	switch format {
+	case archiveTarGz:
+		// Save the bytes exactly as they arrive, reading the archive
+		// through them only to follow progress and catch truncation.
+		tee := io.TeeReader(body, dst)
+		zr, err := gzip.NewReader(tee)
+		if err != nil {
+			return err
+		}
+		tr := tar.NewReader(zr)
+		for {
+			if _, err := tr.Next(); err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+			if err := count(io.Discard, tr); err != nil {
+				return err
+			}
+		}
+		// Pass the gzip trailer through to dst as well.
+		_, err = io.Copy(io.Discard, zr)
+		return err
+
+	case archiveZip:
+		zw := zip.NewWriter(dst)
+		tr := tar.NewReader(body)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+			fh, err := zip.FileInfoHeader(hdr.FileInfo())
+			if err != nil {
+				return err
+			}
+			fh.Name = hdr.Name
+			fh.Method = zip.Deflate
+			w, err := zw.CreateHeader(fh)
+			if err != nil {
+				return err
+			}
+			if err := count(w, tr); err != nil {
+				return err
+			}
+		}
+		return zw.Close()
+	}
+	return errors.New("unknown archive format: " + string(format))
+}
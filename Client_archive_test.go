@@ -0,0 +1,135 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"path/filepath"
+	"testing"
+)
+
+func TestArchiveFileName(t *testing.T) {
+	tests := []struct {
+		dir    string
+		format archiveFormat
+		want   string
+	}{
+		{"/data/site", archiveTarGz, "site.tar.gz"},
+		{"/data/site/", archiveZip, "site.zip"},
+		{"logs", archiveZip, "logs.zip"},
+		{"/", archiveTarGz, "archive.tar.gz"},
+		{"", archiveZip, "archive.zip"},
+	}
+	for _, tt := range tests {
+		if got := archiveFileName(tt.dir, tt.format); got != tt.want {
+			t.Errorf("archiveFileName(%q, %s) = %q, want %q", tt.dir, tt.format, got, tt.want)
+		}
+	}
+}
+
+func TestArchiveTarget(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		local    string
+		selected archiveFormat
+		want     string
+		format   archiveFormat
+	}{
+		{"", archiveZip, "site.zip", archiveZip},
+		{dir, archiveTarGz, filepath.Join(dir, "site.tar.gz"), archiveTarGz},
+		{"backup.ZIP", archiveTarGz, "backup.ZIP", archiveZip},
+		{"backup.tgz", archiveZip, "backup.tgz", archiveTarGz},
+		{"backup.tar.gz", archiveZip, "backup.tar.gz", archiveTarGz},
+		{"backup", archiveZip, "backup", archiveZip},
+	}
+	for _, tt := range tests {
+		got, format := archiveTarget("/data/site", tt.local, tt.selected)
+		if got != tt.want || format != tt.format {
+			t.Errorf("archiveTarget(%q, %s) = %q, %s, want %q, %s", tt.local, tt.selected, got, format, tt.want, tt.format)
+		}
+	}
+}
+
+// tarOf builds a tar archive of files, in the given order.
+func tarOf(t *testing.T, names []string, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range names {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name]))}); err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(tw, files[name])
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestSaveArchive(t *testing.T) {
+	files := map[string]string{"a.txt": "alpha", "sub/b.txt": "bravo!"}
+	plain := tarOf(t, []string{"a.txt", "sub/b.txt"}, files)
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(plain)
+	zw.Close()
+
+	var saved bytes.Buffer
+	var seen int64
+	if err := saveArchive(bytes.NewReader(gz.Bytes()), &saved, archiveTarGz, func(n int64) { seen = n }); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(saved.Bytes(), gz.Bytes()) {
+		t.Error("tar.gz was not saved as received")
+	}
+	if seen != 11 {
+		t.Errorf("progress reached %d, want 11", seen)
+	}
+
+	saved.Reset()
+	if err := saveArchive(bytes.NewReader(plain), &saved, archiveZip, func(int64) {}); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(saved.Bytes()), int64(saved.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != len(files) {
+		t.Fatalf("zip holds %d files", len(zr.File))
+	}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		if string(data) != files[f.Name] {
+			t.Errorf("%s holds %q", f.Name, data)
+		}
+	}
+}
+
+func TestSaveArchiveTruncated(t *testing.T) {
+	plain := tarOf(t, []string{"a.txt"}, map[string]string{"a.txt": "alpha"})
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(plain)
+	zw.Close()
+
+	cut := gz.Bytes()[:gz.Len()/2]
+	if err := saveArchive(bytes.NewReader(cut), io.Discard, archiveTarGz, func(int64) {}); err == nil {
+		t.Error("truncated tar.gz was saved without an error")
+	}
+	// The cut falls inside a.txt, after its 512-byte header.
+	if err := saveArchive(bytes.NewReader(plain[:514]), io.Discard, archiveZip, func(int64) {}); err == nil {
+		t.Error("truncated stream was saved as a zip without an error")
+	}
+	if err := saveArchive(bytes.NewReader(plain), io.Discard, "rar", func(int64) {}); err == nil {
+		t.Error("unknown format was accepted")
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// authScheme is how the client proves who it is to the server.
+type authScheme string
+
+const (
+	// authBearer sends the token as "Authorization: Bearer <token>".
+	authBearer authScheme = "bearer"
+	// authAPIKey sends the token as the value of an API key header.
+	authAPIKey authScheme = "api_key"
+	// authMTLS presents a client certificate in the TLS handshake and
+	// sends no credential header.
+	authMTLS authScheme = "mtls"
+)
+
+// defaultAPIKeyHeader is the header an API key goes in when none is named.
+const defaultAPIKeyHeader = "X-API-Key"
+
+// authSettings are the credentials of one scheme. Token is the bearer
+// token or the API key; HeaderName the header the API key goes in;
+// CertFile and KeyFile the PEM files of the mTLS certificate.
+type authSettings struct {
+	Scheme     authScheme
+	Token      string
+	HeaderName string
+	CertFile   string
+	KeyFile    string
+}
+
+// authHeaders returns the headers s adds to every request.
+func authHeaders(s authSettings) (http.Header, error) {
+	h := make(http.Header)
+	switch s.Scheme {
+	case authBearer, "":
+		h.Set("Authorization", "Bearer "+s.Token)
+	case authAPIKey:
+		name := strings.TrimSpace(s.HeaderName)
+		if name == "" {
+			name = defaultAPIKeyHeader
+		}
+		if !validHeaderName(name) {
+			return nil, fmt.Errorf("invalid API key header name %q", name)
+		}
+		h.Set(name, s.Token)
+	case authMTLS:
+	default:
+		return nil, fmt.Errorf("unknown auth scheme %q", s.Scheme)
+	}
+	return h, nil
+}
+
+// validHeaderName reports whether name is an HTTP field name: one or more
+// token characters as RFC 9110 defines them.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case strings.ContainsRune("!#$%&'*+-.^_`|~", r):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// clientCertificate is the certificate the transport presents when the
+// server asks for one. It is only sent in the handshake, so a change takes
+// effect on the next connection.
+type clientCertificate struct {
+	cert atomic.Pointer[tls.Certificate]
+}
+
+// Load reads the certificate and key from PEM files.
+func (c *clientCertificate) Load(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("client certificate: %v", err)
+	}
+	c.cert.Store(&cert)
+	return nil
+}
+
+// Clear stops the certificate from being presented.
+func (c *clientCertificate) Clear() {
+	c.cert.Store(nil)
+}
+
+// get is the tls.Config GetClientCertificate hook. Without a certificate
+// it answers with an empty one, which tells the server there is none.
+func (c *clientCertificate) get(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	if cert := c.cert.Load(); cert != nil {
+		return cert, nil
+	}
+	return &tls.Certificate{}, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAuthHeaders(t *testing.T) {
+	tests := []struct {
+		name string
+		s    authSettings
+		want http.Header
+	}{
+		{"bearer", authSettings{Scheme: authBearer, Token: "tok"}, http.Header{"Authorization": {"Bearer tok"}}},
+		{"no scheme is bearer", authSettings{Token: "tok"}, http.Header{"Authorization": {"Bearer tok"}}},
+		{"api key", authSettings{Scheme: authAPIKey, Token: "key"}, http.Header{"X-Api-Key": {"key"}}},
+		{"api key named header", authSettings{Scheme: authAPIKey, Token: "key", HeaderName: " x-backend-key "}, http.Header{"X-Backend-Key": {"key"}}},
+		{"mtls", authSettings{Scheme: authMTLS, Token: "tok", CertFile: "c.pem", KeyFile: "k.pem"}, http.Header{}},
+	}
+	for _, tt := range tests {
+		got, err := authHeaders(tt.s)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: headers %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	for _, s := range []authSettings{
+		{Scheme: authAPIKey, Token: "key", HeaderName: "X API Key"},
+		{Scheme: authAPIKey, Token: "key", HeaderName: "X-Key:"},
+		{Scheme: "basic", Token: "tok"},
+	} {
+		if h, err := authHeaders(s); err == nil {
+			t.Errorf("authHeaders(%+v) = %v, want an error", s, h)
+		}
+	}
+}
+
+// writeTestCert writes a self-signed certificate and its key to PEM files
+// in a temporary directory and returns their paths.
+func writeTestCert(t *testing.T) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, "client.pem")
+	keyFile = filepath.Join(dir, "client.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestClientCertificate(t *testing.T) {
+	certFile, keyFile := writeTestCert(t)
+
+	var c clientCertificate
+	if cert, err := c.get(nil); err != nil || len(cert.Certificate) != 0 {
+		t.Fatalf("get before Load = %v, %v; want an empty certificate", cert, err)
+	}
+	if err := c.Load(certFile, filepath.Join(t.TempDir(), "missing.key")); err == nil {
+		t.Error("Load with a missing key succeeded")
+	}
+	if err := c.Load(keyFile, certFile); err == nil {
+		t.Error("Load with the files swapped succeeded")
+	}
+	if err := c.Load(certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	if cert, err := c.get(nil); err != nil || len(cert.Certificate) != 1 {
+		t.Fatalf("get after Load = %v, %v; want the certificate", cert, err)
+	}
+	c.Clear()
+	if cert, err := c.get(nil); err != nil || len(cert.Certificate) != 0 {
+		t.Fatalf("get after Clear = %v, %v; want an empty certificate", cert, err)
+	}
+}
+
+func TestClientCertificateHandshake(t *testing.T) {
+	certFile, keyFile := writeTestCert(t)
+	var c clientCertificate
+	if err := c.Load(certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+
+	var peer string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) > 0 {
+			peer = r.TLS.PeerCertificates[0].Subject.CommonName
+		}
+		if r.Header.Get("Authorization") != "" {
+			t.Errorf("mTLS request sent Authorization %q", r.Header.Get("Authorization"))
+		}
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		InsecureSkipVerify:   true,
+		GetClientCertificate: c.get,
+	}}}
+	req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := authHeaders(authSettings{Scheme: authMTLS, CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, values := range h {
+		req.Header[name] = values
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if peer != "client" {
+		t.Errorf("server saw client certificate %q, want %q", peer, "client")
+	}
+}
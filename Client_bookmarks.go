@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// bookmark is a saved server path with an optional label.
+type bookmark struct {
+	Path  string `json:"path"`
+	Label string `json:"label,omitempty"`
+}
+
+// Name is what the bookmark is shown as: its label, or its path without
+// one.
+func (b bookmark) Name() string {
+	if b.Label != "" {
+		return b.Label
+	}
+	return b.Path
+}
+
+// bookmarkStore is the user's bookmarks in the order they arranged them.
+// Every change is saved to path straight away, so bookmarks survive a
+// restart.
+type bookmarkStore struct {
+	path  string
+	items []bookmark
+}
+
+// bookmarksPath returns where the bookmarks are kept between runs.
+func bookmarksPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "bookmarks.json"
+	}
+	return filepath.Join(dir, "quic-ssh", "bookmarks.json")
+}
+
+// loadBookmarks returns the bookmarks saved at path. A missing or
+// unreadable file gives an empty store, which is saved over on the first
+// change.
+func loadBookmarks(path string) *bookmarkStore {
+	s := &bookmarkStore{path: path}
+	if data, err := os.ReadFile(path); err == nil {
+		json.Unmarshal(data, &s.items)
+	}
+	return s
+}
+
+func (s *bookmarkStore) save() error {
+	data, err := json.MarshalIndent(s.items, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(s.path, data, 0600)
+}
+
+// List returns a copy of the bookmarks, in order.
+func (s *bookmarkStore) List() []bookmark {
+	return slices.Clone(s.items)
+}
+
+// cleanBookmarkPath trims the space around p and any trailing separator,
+// so "/data/logs/" and "/data/logs" are the same bookmark. Roots such as
+// "/" and `C:\` keep theirs.
+func cleanBookmarkPath(p string) string {
+	p = strings.TrimSpace(p)
+	if trimmed := strings.TrimRight(p, `/\`); trimmed != "" && !strings.HasSuffix(trimmed, ":") {
+		return trimmed
+	}
+	return p
+}
+
+func (s *bookmarkStore) index(p string) int {
+	p = cleanBookmarkPath(p)
+	return slices.IndexFunc(s.items, func(b bookmark) bool { return b.Path == p })
+}
+
+// Add bookmarks p under label at the end of the list. A path that is
+// already bookmarked keeps its place; a new non-empty label replaces its
+// old one. added reports whether p was new.
+func (s *bookmarkStore) Add(p, label string) (added bool, err error) {
+	p, label = cleanBookmarkPath(p), strings.TrimSpace(label)
+	if p == "" {
+		return false, fmt.Errorf("path is required")
+	}
+	if i := s.index(p); i >= 0 {
+		if label == "" || label == s.items[i].Label {
+			return false, nil
+		}
+		s.items[i].Label = label
+		return false, s.save()
+	}
+	s.items = append(s.items, bookmark{Path: p, Label: label})
+	return true, s.save()
+}
+
+// Remove drops the bookmark for p, if there is one.
+func (s *bookmarkStore) Remove(p string) error {
+	i := s.index(p)
+	if i < 0 {
+		return nil
+	}
+	s.items = slices.Delete(s.items, i, i+1)
+	return s.save()
+}
+
+// Move shifts the bookmark for p by delta places, -1 being one up,
+// stopping at either end of the list.
+func (s *bookmarkStore) Move(p string, delta int) error {
+	i := s.index(p)
+	if i < 0 {
+		return nil
+	}
+	j := min(max(i+delta, 0), len(s.items)-1)
+	if i == j {
+		return nil
+	}
+	b := s.items[i]
+	s.items = slices.Delete(s.items, i, i+1)
+	s.items = slices.Insert(s.items, j, b)
+	return s.save()
+}
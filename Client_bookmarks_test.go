@@ -0,0 +1,111 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestBookmarkDuplicates(t *testing.T) {
+	s := loadBookmarks(filepath.Join(t.TempDir(), "bookmarks.json"))
+	steps := []struct {
+		path, label string
+		added       bool
+	}{
+		{"/data/logs", "", true},
+		{"/data/logs/", "", false},
+		{" /data/logs ", "Logs", false},
+		{"/data/logs", "", false},
+		{"/srv", "Site", true},
+		{"/", "", true},
+	}
+	for _, step := range steps {
+		added, err := s.Add(step.path, step.label)
+		if err != nil {
+			t.Fatalf("Add(%q, %q): %v", step.path, step.label, err)
+		}
+		if added != step.added {
+			t.Errorf("Add(%q, %q) added %v, want %v", step.path, step.label, added, step.added)
+		}
+	}
+	want := []bookmark{{Path: "/data/logs", Label: "Logs"}, {Path: "/srv", Label: "Site"}, {Path: "/"}}
+	if got := s.List(); !reflect.DeepEqual(got, want) {
+		t.Errorf("bookmarks %+v, want %+v", got, want)
+	}
+	if _, err := s.Add("  ", "nothing"); err == nil {
+		t.Error("an empty path was bookmarked")
+	}
+	if got := cleanBookmarkPath(`C:\`); got != `C:\` {
+		t.Errorf("cleanBookmarkPath(C:\\) = %q", got)
+	}
+	if got := (bookmark{Path: "/srv"}).Name(); got != "/srv" {
+		t.Errorf("unlabelled name %q", got)
+	}
+}
+
+func TestBookmarkReorderAndPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quic-ssh", "bookmarks.json")
+	s := loadBookmarks(path)
+	for _, p := range []string{"/a", "/b", "/c"} {
+		if _, err := s.Add(p, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	order := func(s *bookmarkStore) []string {
+		var paths []string
+		for _, b := range s.List() {
+			paths = append(paths, b.Path)
+		}
+		return paths
+	}
+
+	moves := []struct {
+		path  string
+		delta int
+		want  []string
+	}{
+		{"/c", -1, []string{"/a", "/c", "/b"}},
+		{"/c", -5, []string{"/c", "/a", "/b"}},
+		{"/c", -1, []string{"/c", "/a", "/b"}},
+		{"/a", 9, []string{"/c", "/b", "/a"}},
+		{"/missing", 1, []string{"/c", "/b", "/a"}},
+	}
+	for _, m := range moves {
+		if err := s.Move(m.path, m.delta); err != nil {
+			t.Fatal(err)
+		}
+		if got := order(s); !reflect.DeepEqual(got, m.want) {
+			t.Errorf("Move(%s, %d): %v, want %v", m.path, m.delta, got, m.want)
+		}
+	}
+	if err := s.Remove("/b/"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Remove("/missing"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every change was saved: a new store sees the same list.
+	if got := order(loadBookmarks(path)); !reflect.DeepEqual(got, []string{"/c", "/a"}) {
+		t.Errorf("reloaded %v, want [/c /a]", got)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("bookmarks file: %v, %v", info, err)
+	}
+
+	// A corrupt file loads as empty and is replaced on the next change.
+	if err := os.WriteFile(path, []byte("{not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s = loadBookmarks(path)
+	if len(s.List()) != 0 {
+		t.Errorf("corrupt file loaded as %v", s.List())
+	}
+	if _, err := s.Add("/new", ""); err != nil {
+		t.Fatal(err)
+	}
+	if got := order(loadBookmarks(path)); !reflect.DeepEqual(got, []string{"/new"}) {
+		t.Errorf("after replacing a corrupt file: %v", got)
+	}
+}
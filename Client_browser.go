@@ -0,0 +1,263 @@
+package main
+
+import (
+	"path"
+	"strings"
+	"sync"
+
+	"gioui.org/io/key"
+)
+
+// browserRow is one line of the file browser: an entry and how deep it
+// sits below the browser's root.
+type browserRow struct {
+	Path     string
+	Depth    int
+	Loaded   bool
+	Expanded bool
+}
+
+// browserModel is the navigation state of the file browser. It holds the
+// listings fetched so far as a tree, which of them are expanded and the
+// selected row, and is driven by key events when vim keys are on: j and k
+// move, Enter opens, / searches the loaded tree by name and n repeats the
+// last search.
+type browserModel struct {
+	mu        sync.Mutex
+	root      string
+	children  map[string][]string
+	expanded  map[string]bool
+	selected  int
+	searching bool
+	query     string
+	lastQuery string
+}
+
+func newBrowserModel() *browserModel {
+	return &browserModel{
+		children: make(map[string][]string),
+		expanded: make(map[string]bool),
+	}
+}
+
+// SetChildren records the listing of dir. A directory already in the tree
+// is expanded to show it; any other becomes the new root.
+func (b *browserModel) SetChildren(dir string, paths []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	dir = path.Clean(dir)
+	if dir != b.root && !b.contains(dir) {
+		b.root = dir
+		b.children = make(map[string][]string)
+		b.expanded = make(map[string]bool)
+		b.selected = 0
+	}
+	b.children[dir] = append([]string(nil), paths...)
+	if dir != b.root {
+		b.expanded[dir] = true
+	}
+	b.clamp()
+}
+
+// contains reports whether p is listed somewhere in the loaded tree.
+func (b *browserModel) contains(p string) bool {
+	for _, entries := range b.children {
+		for _, e := range entries {
+			if path.Clean(e) == p {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsDir reports whether p is known to be a directory: the root or an
+// entry that has been listed.
+func (b *browserModel) IsDir(p string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, listed := b.children[path.Clean(p)]
+	return listed
+}
+
+// Rows flattens the tree below the root, descending into expanded
+// directories only.
+func (b *browserModel) Rows() []browserRow {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rows()
+}
+
+func (b *browserModel) rows() []browserRow {
+	var rows []browserRow
+	var walk func(dir string, depth int)
+	walk = func(dir string, depth int) {
+		for _, p := range b.children[dir] {
+			key := path.Clean(p)
+			_, loaded := b.children[key]
+			rows = append(rows, browserRow{Path: p, Depth: depth, Loaded: loaded, Expanded: b.expanded[key]})
+			if b.expanded[key] {
+				walk(key, depth+1)
+			}
+		}
+	}
+	walk(b.root, 0)
+	return rows
+}
+
+// Selected returns the index of the selected row.
+func (b *browserModel) Selected() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.selected
+}
+
+// Search returns the query being typed and whether a search is under way.
+func (b *browserModel) Search() (string, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.query, b.searching
+}
+
+func (b *browserModel) clamp() {
+	n := len(b.rows())
+	b.selected = max(0, min(b.selected, n-1))
+}
+
+// HandleKey applies a named key press. It returns the path to open when
+// Enter lands on an entry that has not been listed yet; the caller lists
+// it if it is a directory or reads it otherwise. A listed directory is
+// expanded or collapsed in place.
+func (b *browserModel) HandleKey(name string) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.searching {
+		switch name {
+		case key.NameReturn, key.NameEnter:
+			b.searching = false
+			b.lastQuery = b.query
+			b.findNext(b.query, false)
+		case key.NameEscape:
+			b.searching = false
+			b.query = ""
+		case key.NameDeleteBackward:
+			if r := []rune(b.query); len(r) > 0 {
+				b.query = string(r[:len(r)-1])
+			}
+		}
+		return ""
+	}
+
+	switch name {
+	case key.NameDownArrow:
+		b.move(1)
+	case key.NameUpArrow:
+		b.move(-1)
+	case key.NameReturn, key.NameEnter:
+		rows := b.rows()
+		if len(rows) == 0 {
+			return ""
+		}
+		row := rows[b.selected]
+		if !row.Loaded {
+			return row.Path
+		}
+		b.expanded[path.Clean(row.Path)] = !row.Expanded
+		b.clamp()
+	}
+	return ""
+}
+
+// Type applies typed text. While searching it extends the query;
+// otherwise each character is a command: j and k move down and up, /
+// starts a search and n jumps to the next match of the last one.
+func (b *browserModel) Type(text string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.searching {
+		b.query += text
+		return
+	}
+	for _, r := range text {
+		switch r {
+		case 'j':
+			b.move(1)
+		case 'k':
+			b.move(-1)
+		case '/':
+			b.searching = true
+			b.query = ""
+		case 'n':
+			b.findNext(b.lastQuery, true)
+		}
+	}
+}
+
+func (b *browserModel) move(delta int) {
+	b.selected += delta
+	b.clamp()
+}
+
+// findNext selects the first loaded entry after the selection, wrapping
+// around, whose name contains query, ignoring case. The search covers
+// collapsed directories too; the ones above the match are expanded so it
+// shows. With skipCurrent unset the selected row itself may match.
+func (b *browserModel) findNext(query string, skipCurrent bool) {
+	if query == "" {
+		return
+	}
+	query = strings.ToLower(query)
+
+	// Walk the whole loaded tree in display order.
+	type entry struct {
+		path    string
+		parents []string
+	}
+	var all []entry
+	var walk func(dir string, parents []string)
+	walk = func(dir string, parents []string) {
+		for _, p := range b.children[dir] {
+			key := path.Clean(p)
+			all = append(all, entry{p, parents})
+			if _, ok := b.children[key]; ok {
+				walk(key, append(parents[:len(parents):len(parents)], key))
+			}
+		}
+	}
+	walk(b.root, nil)
+	if len(all) == 0 {
+		return
+	}
+
+	start := 0
+	if rows := b.rows(); b.selected < len(rows) {
+		for i, e := range all {
+			if e.path == rows[b.selected].Path {
+				start = i
+				break
+			}
+		}
+	}
+	if skipCurrent {
+		start++
+	}
+	for i := 0; i < len(all); i++ {
+		e := all[(start+i)%len(all)]
+		if !strings.Contains(strings.ToLower(path.Base(e.path)), query) {
+			continue
+		}
+		for _, p := range e.parents {
+			b.expanded[p] = true
+		}
+		for j, row := range b.rows() {
+			if row.Path == e.path {
+				b.selected = j
+				break
+			}
+		}
+		return
+	}
+}
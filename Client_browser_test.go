@@ -0,0 +1,161 @@
+package main
+
+import (
+	"testing"
+
+	"gioui.org/io/key"
+)
+
+// testBrowser loads /srv with a listed docs folder and an unlisted logs
+// folder:
+//
+//	/srv/docs/         (listed, collapsed)
+//	    guide.txt
+//	    readme.txt
+//	/srv/logs/
+//	/srv/notes.txt
+func testBrowser() *browserModel {
+	b := newBrowserModel()
+	b.SetChildren("/srv", []string{"/srv/docs/", "/srv/logs/", "/srv/notes.txt"})
+	b.SetChildren("/srv/docs", []string{"/srv/docs/guide.txt", "/srv/docs/readme.txt"})
+	b.HandleKey(key.NameReturn) // collapse docs
+	return b
+}
+
+func rowPaths(b *browserModel) []string {
+	var paths []string
+	for _, r := range b.Rows() {
+		paths = append(paths, r.Path)
+	}
+	return paths
+}
+
+func selectedPath(b *browserModel) string {
+	return b.Rows()[b.Selected()].Path
+}
+
+func TestBrowserMovesSelection(t *testing.T) {
+	b := testBrowser()
+	if got := rowPaths(b); len(got) != 3 {
+		t.Fatalf("collapsed tree shows %v", got)
+	}
+
+	b.Type("j")
+	if got := selectedPath(b); got != "/srv/logs/" {
+		t.Errorf("after j: %s", got)
+	}
+	b.Type("jjjj")
+	if got := selectedPath(b); got != "/srv/notes.txt" {
+		t.Errorf("j past the end: %s", got)
+	}
+	b.HandleKey(key.NameUpArrow)
+	b.Type("kkk")
+	if got := b.Selected(); got != 0 {
+		t.Errorf("k past the start: %d", got)
+	}
+	b.Type("x")
+	if got := b.Selected(); got != 0 {
+		t.Errorf("unbound key moved the selection: %d", got)
+	}
+}
+
+func TestBrowserEnterOpensOrToggles(t *testing.T) {
+	b := testBrowser()
+
+	// A listed directory expands in place.
+	if got := b.HandleKey(key.NameReturn); got != "" {
+		t.Errorf("Enter on a listed directory asked to open %q", got)
+	}
+	if got := rowPaths(b); len(got) != 5 || got[1] != "/srv/docs/guide.txt" {
+		t.Errorf("expanded tree shows %v", got)
+	}
+	if row := b.Rows()[0]; row.Depth != 0 || !row.Expanded || b.Rows()[1].Depth != 1 {
+		t.Errorf("rows %+v", b.Rows()[:2])
+	}
+
+	// Anything not yet listed is handed back to be opened.
+	b.Type("jjj")
+	if got := b.HandleKey(key.NameEnter); got != "/srv/logs/" {
+		t.Errorf("Enter on an unlisted directory: %q", got)
+	}
+	b.Type("j")
+	if got := b.HandleKey(key.NameReturn); got != "/srv/notes.txt" {
+		t.Errorf("Enter on a file: %q", got)
+	}
+
+	// Listing it expands it in place rather than making it the root.
+	b.SetChildren("/srv/logs", []string{"/srv/logs/app.log"})
+	if got := rowPaths(b); len(got) != 6 || got[4] != "/srv/logs/app.log" {
+		t.Errorf("after listing logs: %v", got)
+	}
+
+	// Collapsing above the selection keeps it in range.
+	b.Type("kk")
+	b.HandleKey(key.NameReturn)
+	if got := b.Selected(); got >= len(b.Rows()) {
+		t.Errorf("selection %d beyond %d rows", got, len(b.Rows()))
+	}
+}
+
+func TestBrowserSearchJumps(t *testing.T) {
+	b := testBrowser()
+
+	b.Type("/")
+	b.Type("READ")
+	if q, searching := b.Search(); !searching || q != "READ" {
+		t.Fatalf("search state %q, %v", q, searching)
+	}
+	b.Type("jk") // typed into the query, not moving
+	b.HandleKey(key.NameDeleteBackward)
+	b.HandleKey(key.NameDeleteBackward)
+	b.HandleKey(key.NameReturn)
+
+	// The match sits in a collapsed directory, which is expanded to show it.
+	if got := selectedPath(b); got != "/srv/docs/readme.txt" {
+		t.Errorf("search landed on %s", got)
+	}
+	if _, searching := b.Search(); searching {
+		t.Error("Enter did not end the search")
+	}
+
+	b.Type("/")
+	b.Type("t")
+	b.HandleKey(key.NameReturn)
+	if got := selectedPath(b); got != "/srv/docs/readme.txt" {
+		t.Errorf("search matching the selection moved to %s", got)
+	}
+	b.Type("n")
+	if got := selectedPath(b); got != "/srv/notes.txt" {
+		t.Errorf("n went to %s", got)
+	}
+	b.Type("n")
+	if got := selectedPath(b); got != "/srv/docs/guide.txt" {
+		t.Errorf("n did not wrap around: %s", got)
+	}
+
+	b.Type("/")
+	b.Type("zzz")
+	b.HandleKey(key.NameEscape)
+	b.Type("n")
+	if got := selectedPath(b); got != "/srv/docs/readme.txt" {
+		t.Errorf("cancelled search replaced the last one: %s", got)
+	}
+	b.Type("/")
+	b.Type("missing")
+	b.HandleKey(key.NameReturn)
+	if got := selectedPath(b); got != "/srv/docs/readme.txt" {
+		t.Errorf("search without a match moved to %s", got)
+	}
+}
+
+func TestBrowserNewRootResets(t *testing.T) {
+	b := testBrowser()
+	b.Type("jj")
+	b.SetChildren("/other", []string{"/other/x.txt"})
+	if got := rowPaths(b); len(got) != 1 || b.Selected() != 0 {
+		t.Errorf("new root shows %v, selection %d", got, b.Selected())
+	}
+	if b.IsDir("/srv/docs") || !b.IsDir("/other/") {
+		t.Error("IsDir kept the old tree")
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// configStore is what the Edit Config flow needs from the server: a read
+// that reports the version of the file, and a write that only succeeds
+// while the file is still at a given version.
+type configStore interface {
+	Load(path string) (content, etag string, err error)
+	Save(path, content, etag string) error
+}
+
+// configEdit is a file open in the Edit Config flow: its content and
+// version as they were loaded.
+type configEdit struct {
+	Path     string
+	ETag     string
+	Original string
+}
+
+// errConfigChanged is returned by saveConfig when the file was changed
+// by someone else since it was opened.
+var errConfigChanged = errors.New("the file was changed since it was opened; reopen it to see the other changes")
+
+// openConfig loads path for editing. The file need not be valid JSON
+// yet; validation happens as it is edited and before it is saved.
+func openConfig(store configStore, path string) (configEdit, error) {
+	if strings.TrimSpace(path) == "" {
+		return configEdit{}, fmt.Errorf("path is required")
+	}
+	content, etag, err := store.Load(path)
+	if err != nil {
+		return configEdit{}, err
+	}
+	if etag == "" {
+		return configEdit{}, fmt.Errorf("server did not report a version for %s", path)
+	}
+	return configEdit{Path: path, ETag: etag, Original: content}, nil
+}
+
+// saveConfig writes text back over the file e was opened from, as long as
+// it is valid JSON and the file has not changed since, and returns the
+// file as it is now, reloaded with its new version.
+func saveConfig(store configStore, e configEdit, text string) (configEdit, error) {
+	if err := validateJSON(text); err != nil {
+		return e, fmt.Errorf("invalid JSON: %v", err)
+	}
+	if err := store.Save(e.Path, text, e.ETag); err != nil {
+		var serverErr *ServerError
+		if errors.As(err, &serverErr) && serverErr.Code == "conflict" {
+			return e, errConfigChanged
+		}
+		return e, err
+	}
+	return openConfig(store, e.Path)
+}
+
+// diffLine is one line of a diff: Op is ' ' for a line both sides have,
+// '-' for one only the old side has and '+' for one only the new side has.
+type diffLine struct {
+	Op   byte
+	Text string
+}
+
+// maxDiffCells bounds the table diffLines fills. Past it the whole old
+// text is shown as removed and the whole new text as added.
+const maxDiffCells = 4_000_000
+
+// diffLines returns the lines of a and b as a line diff along their
+// longest common subsequence.
+func diffLines(a, b string) []diffLine {
+	x, y := strings.Split(a, "\n"), strings.Split(b, "\n")
+	if len(x)*len(y) > maxDiffCells {
+		out := make([]diffLine, 0, len(x)+len(y))
+		for _, line := range x {
+			out = append(out, diffLine{'-', line})
+		}
+		for _, line := range y {
+			out = append(out, diffLine{'+', line})
+		}
+		return out
+	}
+
+	// common[i][j] is the length of the longest common subsequence of
+	// x[i:] and y[j:].
+	common := make([][]int, len(x)+1)
+	for i := range common {
+		common[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				common[i][j] = common[i+1][j+1] + 1
+			} else {
+				common[i][j] = max(common[i+1][j], common[i][j+1])
+			}
+		}
+	}
+
+	var out []diffLine
+	i, j := 0, 0
+	for i < len(x) && j < len(y) {
+		switch {
+		case x[i] == y[j]:
+			out = append(out, diffLine{' ', x[i]})
+			i++
+			j++
+		case common[i+1][j] >= common[i][j+1]:
+			out = append(out, diffLine{'-', x[i]})
+			i++
+		default:
+			out = append(out, diffLine{'+', y[j]})
+			j++
+		}
+	}
+	for ; i < len(x); i++ {
+		out = append(out, diffLine{'-', x[i]})
+	}
+	for ; j < len(y); j++ {
+		out = append(out, diffLine{'+', y[j]})
+	}
+	return out
+}
+
+// diffContext is how many unchanged lines formatDiff keeps around each
+// change.
+const diffContext = 2
+
+// formatDiff renders a diff with each line prefixed by its Op, keeping
+// only the unchanged lines within diffContext of a change. Skipped runs
+// are marked with "...". A diff without changes renders as "".
+func formatDiff(lines []diffLine) string {
+	keep := make([]bool, len(lines))
+	changed := false
+	for i, l := range lines {
+		if l.Op == ' ' {
+			continue
+		}
+		changed = true
+		for k := max(0, i-diffContext); k <= min(len(lines)-1, i+diffContext); k++ {
+			keep[k] = true
+		}
+	}
+	if !changed {
+		return ""
+	}
+
+	var b strings.Builder
+	skipped := false
+	for i, l := range lines {
+		if !keep[i] {
+			skipped = true
+			continue
+		}
+		if skipped {
+			b.WriteString("...\n")
+			skipped = false
+		}
+		b.WriteByte(l.Op)
+		b.WriteByte(' ')
+		b.WriteString(l.Text)
+		b.WriteByte('\n')
+	}
+	if skipped {
+		b.WriteString("...\n")
+	}
+	return b.String()
+}
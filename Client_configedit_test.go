@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// stubConfigStore is a configStore over files in memory. Every save bumps
+// the file's version, and a save at another version fails the way the
+// server's if_match check does.
+type stubConfigStore struct {
+	files    map[string]string
+	versions map[string]int
+	saves    int
+}
+
+func newStubConfigStore(files map[string]string) *stubConfigStore {
+	s := &stubConfigStore{files: files, versions: make(map[string]int)}
+	for path := range files {
+		s.versions[path] = 1
+	}
+	return s
+}
+
+func (s *stubConfigStore) etag(path string) string {
+	return fmt.Sprintf(`"v%d"`, s.versions[path])
+}
+
+func (s *stubConfigStore) Load(path string) (string, string, error) {
+	content, ok := s.files[path]
+	if !ok {
+		return "", "", &ServerError{Code: "not_found", Message: "no such file: " + path}
+	}
+	return content, s.etag(path), nil
+}
+
+func (s *stubConfigStore) Save(path, content, etag string) error {
+	if etag != s.etag(path) {
+		return &ServerError{Code: "conflict", Message: "file has changed since it was read: " + path}
+	}
+	s.files[path] = content
+	s.versions[path]++
+	s.saves++
+	return nil
+}
+
+func TestConfigEditRoundTrip(t *testing.T) {
+	store := newStubConfigStore(map[string]string{"/etc/app.json": "{\n  \"port\": 80,\n  \"debug\": false\n}"})
+
+	e, err := openConfig(store, "/etc/app.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.ETag != `"v1"` || !strings.Contains(e.Original, `"port": 80`) {
+		t.Fatalf("opened %+v", e)
+	}
+
+	edited := "{\n  \"port\": 8080,\n  \"debug\": false\n}"
+	want := "  {\n-   \"port\": 80,\n+   \"port\": 8080,\n    \"debug\": false\n  }\n"
+	if got := formatDiff(diffLines(e.Original, edited)); got != want {
+		t.Errorf("diff:\n%s\nwant:\n%s", got, want)
+	}
+
+	saved, err := saveConfig(store, e, edited)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.files["/etc/app.json"] != edited {
+		t.Errorf("stored %q", store.files["/etc/app.json"])
+	}
+	// The reloaded file carries the new version, so the next save is not
+	// a conflict.
+	if saved.ETag != `"v2"` || saved.Original != edited {
+		t.Errorf("after save %+v", saved)
+	}
+	if _, err := saveConfig(store, saved, `{"port": 9090}`); err != nil {
+		t.Errorf("second save: %v", err)
+	}
+}
+
+func TestConfigEditConflict(t *testing.T) {
+	store := newStubConfigStore(map[string]string{"app.json": `{"port": 80}`})
+	mine, err := openConfig(store, "app.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	theirs, err := openConfig(store, "app.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := saveConfig(store, theirs, `{"port": 81}`); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := saveConfig(store, mine, `{"port": 82}`)
+	if err != errConfigChanged {
+		t.Fatalf("save over a concurrent edit: %v, want %v", err, errConfigChanged)
+	}
+	if store.files["app.json"] != `{"port": 81}` {
+		t.Errorf("the other edit was clobbered: %q", store.files["app.json"])
+	}
+	if got != mine {
+		t.Errorf("a failed save returned %+v, want the edit unchanged", got)
+	}
+}
+
+func TestConfigEditErrors(t *testing.T) {
+	store := newStubConfigStore(map[string]string{"app.json": "{}"})
+	if _, err := openConfig(store, "  "); err == nil {
+		t.Error("opened an empty path")
+	}
+	if _, err := openConfig(store, "missing.json"); err == nil {
+		t.Error("opened a missing file")
+	}
+
+	e, err := openConfig(store, "app.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := saveConfig(store, e, `{"port": }`); err == nil || !strings.HasPrefix(err.Error(), "invalid JSON") {
+		t.Errorf("saving invalid JSON: %v", err)
+	}
+	if store.saves != 0 {
+		t.Errorf("invalid JSON reached the store")
+	}
+
+	store.versions["app.json"] = 0
+	delete(store.files, "app.json")
+	if _, err := saveConfig(store, e, "{}"); err != errConfigChanged {
+		t.Errorf("save of a deleted file: %v, want %v", err, errConfigChanged)
+	}
+}
+
+func TestFormatDiff(t *testing.T) {
+	if got := formatDiff(diffLines("a\nb", "a\nb")); got != "" {
+		t.Errorf("diff of equal texts = %q", got)
+	}
+	old := "1\n2\n3\n4\n5\n6\n7\n8\n9"
+	got := formatDiff(diffLines(old, strings.Replace(old, "5", "five", 1)))
+	want := "...\n  3\n  4\n- 5\n+ five\n  6\n  7\n...\n"
+	if got != want {
+		t.Errorf("diff:\n%s\nwant:\n%s", got, want)
+	}
+	if got := formatDiff(diffLines("", "x")); got != "- \n+ x\n" {
+		t.Errorf("diff of an empty file = %q", got)
+	}
+}
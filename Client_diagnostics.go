@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"time"
+)
+
+// connStateSource reports what is known about the connection the last
+// request went over.
+type connStateSource interface {
+	// TLSState returns the negotiated TLS state, or nil before the first
+	// response.
+	TLSState() *tls.ConnectionState
+	// HandshakeRTT returns how long the last QUIC handshake took, which
+	// approximates the round trip time to the server.
+	HandshakeRTT() (time.Duration, bool)
+}
+
+// connDiagnostics is a snapshot of the connection for the diagnostics
+// panel.
+type connDiagnostics struct {
+	Connected   bool
+	ALPN        string
+	TLSVersion  string
+	CipherSuite string
+	PeerSubject string
+	PeerIssuer  string
+	PeerExpiry  time.Time
+	RTT         time.Duration
+	HaveRTT     bool
+}
+
+// collectDiagnostics reads a snapshot from src.
+func collectDiagnostics(src connStateSource) connDiagnostics {
+	var d connDiagnostics
+	d.RTT, d.HaveRTT = src.HandshakeRTT()
+
+	state := src.TLSState()
+	if state == nil {
+		return d
+	}
+	d.Connected = true
+	d.ALPN = state.NegotiatedProtocol
+	d.TLSVersion = tls.VersionName(state.Version)
+	d.CipherSuite = tls.CipherSuiteName(state.CipherSuite)
+	if len(state.PeerCertificates) > 0 {
+		leaf := state.PeerCertificates[0]
+		d.PeerSubject = leaf.Subject.String()
+		d.PeerIssuer = leaf.Issuer.String()
+		d.PeerExpiry = leaf.NotAfter
+	}
+	return d
+}
+
+// Lines formats the snapshot one field per line. The certificate expiry
+// is given as a date and as time left relative to now.
+func (d connDiagnostics) Lines(now time.Time) []string {
+	if !d.Connected {
+		return []string{"No connection yet; run a command first."}
+	}
+
+	orNone := func(s string) string {
+		if s == "" {
+			return "(none)"
+		}
+		return s
+	}
+	lines := []string{
+		"ALPN:         " + orNone(d.ALPN),
+		"TLS version:  " + d.TLSVersion,
+		"Cipher suite: " + d.CipherSuite,
+	}
+	if d.PeerSubject == "" {
+		lines = append(lines, "Certificate:  (none presented)")
+	} else {
+		left := d.PeerExpiry.Sub(now)
+		expiry := fmt.Sprintf("%s (in %d days)", d.PeerExpiry.UTC().Format("2006-01-02 15:04 MST"), int(left.Hours()/24))
+		if left <= 0 {
+			expiry = fmt.Sprintf("%s (expired)", d.PeerExpiry.UTC().Format("2006-01-02 15:04 MST"))
+		}
+		lines = append(lines,
+			"Subject:      "+d.PeerSubject,
+			"Issuer:       "+d.PeerIssuer,
+			"Expires:      "+expiry,
+		)
+	}
+	if d.HaveRTT {
+		lines = append(lines, "QUIC RTT:     "+d.RTT.Round(100*time.Microsecond).String()+" (handshake)")
+	} else {
+		lines = append(lines, "QUIC RTT:     unknown")
+	}
+	return lines
+}
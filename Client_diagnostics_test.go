@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"slices"
+	"testing"
+	"time"
+)
+
+type fakeConnState struct {
+	state *tls.ConnectionState
+	rtt   time.Duration
+}
+
+func (f fakeConnState) TLSState() *tls.ConnectionState { return f.state }
+
+func (f fakeConnState) HandshakeRTT() (time.Duration, bool) { return f.rtt, f.rtt > 0 }
+
+func TestDiagnosticsLines(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	leaf := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "files.example.com", Organization: []string{"Example"}},
+		Issuer:   pkix.Name{CommonName: "Example CA"},
+		NotAfter: now.Add(45*24*time.Hour + time.Hour),
+	}
+	src := fakeConnState{
+		state: &tls.ConnectionState{
+			Version:            tls.VersionTLS13,
+			CipherSuite:        tls.TLS_AES_128_GCM_SHA256,
+			NegotiatedProtocol: "h3",
+			PeerCertificates:   []*x509.Certificate{leaf},
+		},
+		rtt: 23456 * time.Microsecond,
+	}
+
+	want := []string{
+		"ALPN:         h3",
+		"TLS version:  TLS 1.3",
+		"Cipher suite: TLS_AES_128_GCM_SHA256",
+		"Subject:      CN=files.example.com,O=Example",
+		"Issuer:       CN=Example CA",
+		"Expires:      2024-07-16 13:00 UTC (in 45 days)",
+		"QUIC RTT:     23.5ms (handshake)",
+	}
+	if got := collectDiagnostics(src).Lines(now); !slices.Equal(got, want) {
+		t.Errorf("got\n%q\nwant\n%q", got, want)
+	}
+
+	leaf.NotAfter = now.Add(-time.Hour)
+	src.rtt = 0
+	got := collectDiagnostics(src).Lines(now)
+	if got[5] != "Expires:      2024-06-01 11:00 UTC (expired)" || got[6] != "QUIC RTT:     unknown" {
+		t.Errorf("expired certificate, no RTT: %q", got[5:])
+	}
+}
+
+func TestDiagnosticsWithoutCertificate(t *testing.T) {
+	d := collectDiagnostics(fakeConnState{state: &tls.ConnectionState{Version: tls.VersionTLS13, CipherSuite: tls.TLS_CHACHA20_POLY1305_SHA256}})
+	got := d.Lines(time.Now())
+	if got[0] != "ALPN:         (none)" || got[3] != "Certificate:  (none presented)" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestDiagnosticsBeforeFirstRequest(t *testing.T) {
+	d := collectDiagnostics(fakeConnState{})
+	if d.Connected {
+		t.Error("connected with no TLS state")
+	}
+	if got := d.Lines(time.Now()); !slices.Equal(got, []string{"No connection yet; run a command first."}) {
+		t.Errorf("got %q", got)
+	}
+}
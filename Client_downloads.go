@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// downloadStatus is where a download is in its lifecycle.
+type downloadStatus string
+
+const (
+	downloadActive   downloadStatus = "downloading"
+	downloadPaused   downloadStatus = "paused"
+	downloadDone     downloadStatus = "done"
+	downloadFailed   downloadStatus = "failed"
+	downloadCanceled downloadStatus = "canceled"
+)
+
+// downloadState is the saved record of one download, keyed by its local
+// path. It holds no widgets so it can be written to disk and restored on
+// the next start.
+type downloadState struct {
+	Remote   string         `json:"remote"`
+	Local    string         `json:"local"`
+	Received int64          `json:"received"`
+	Total    int64          `json:"total"`
+	Status   downloadStatus `json:"status"`
+	Error    string         `json:"error,omitempty"`
+}
+
+// resumeOffset returns the byte a download continues from given the size of
+// its part file and the total size learned earlier (zero if not known yet).
+// A part file longer than the remote file cannot be a prefix of it, so the
+// download starts over.
+func resumeOffset(partSize, total int64) int64 {
+	if partSize <= 0 || (total > 0 && partSize > total) {
+		return 0
+	}
+	return partSize
+}
+
+// fetchFunc downloads remote to local, resuming from local's part file and
+// reporting progress as bytes arrive.
+type fetchFunc func(ctx context.Context, remote, local string, progress func(received, total int64)) error
+
+// downloadManager runs downloads in the background and lets them be paused,
+// resumed and cancelled. Its state is saved to path whenever a download
+// changes status, so paused and interrupted downloads survive a restart.
+type downloadManager struct {
+	mu       sync.Mutex
+	path     string
+	items    []*downloadState
+	running  map[string]context.CancelFunc
+	rates    map[string]*transferRate
+	fetch    fetchFunc
+	report   func(string)
+	onChange func()
+}
+
+func newDownloadManager(path string, fetch fetchFunc, report func(string), onChange func()) *downloadManager {
+	m := &downloadManager{
+		path:     path,
+		running:  make(map[string]context.CancelFunc),
+		rates:    make(map[string]*transferRate),
+		fetch:    fetch,
+		report:   report,
+		onChange: onChange,
+	}
+	m.load()
+	return m
+}
+
+// downloadStatePath returns where the download list is kept between runs.
+func downloadStatePath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "downloads.json"
+	}
+	return filepath.Join(dir, "quic-ssh", "downloads.json")
+}
+
+// load restores the saved downloads. Anything that was running when the
+// app last exited comes back paused, with the byte count taken from its
+// part file.
+func (m *downloadManager) load() {
+	data, err := os.ReadFile(m.path)
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(data, &m.items); err != nil {
+		return
+	}
+	for _, d := range m.items {
+		if d.Status == downloadActive {
+			d.Status = downloadPaused
+		}
+		if d.Status == downloadPaused {
+			d.Received = 0
+			if info, err := os.Stat(d.Local + ".part"); err == nil {
+				d.Received = resumeOffset(info.Size(), d.Total)
+			}
+		}
+	}
+}
+
+// save writes the download list. Callers hold m.mu.
+func (m *downloadManager) save() {
+	data, err := json.MarshalIndent(m.items, "", "  ")
+	if err != nil {
+		return
+	}
+	os.MkdirAll(filepath.Dir(m.path), 0700)
+	os.WriteFile(m.path, data, 0600)
+}
+
+func (m *downloadManager) changed() {
+	if m.onChange != nil {
+		m.onChange()
+	}
+}
+
+// List returns a snapshot of every download for rendering.
+func (m *downloadManager) List() []downloadState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := make([]downloadState, len(m.items))
+	for i, d := range m.items {
+		list[i] = *d
+	}
+	return list
+}
+
+// Throughput returns how fast the download saved at local is going at now.
+// Only downloads running in this session have one.
+func (m *downloadManager) Throughput(local string, now time.Time) transferStat {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d, rate := m.find(local), m.rates[local]
+	if d == nil || rate == nil {
+		return transferStat{}
+	}
+	return rate.Stats(d.Total, now)
+}
+
+func (m *downloadManager) find(local string) *downloadState {
+	for _, d := range m.items {
+		if d.Local == local {
+			return d
+		}
+	}
+	return nil
+}
+
+// Add starts downloading remote to local. A finished or failed entry for
+// the same local path is replaced; a running or paused one is an error.
+func (m *downloadManager) Add(remote, local string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if d := m.find(local); d != nil {
+		if d.Status == downloadActive || d.Status == downloadPaused {
+			return fmt.Errorf("%s is already being downloaded", local)
+		}
+		*d = downloadState{Remote: remote, Local: local}
+		m.start(d)
+		return nil
+	}
+
+	d := &downloadState{Remote: remote, Local: local}
+	m.items = append(m.items, d)
+	m.start(d)
+	return nil
+}
+
+// Pause stops a running download, keeping its part file for Resume.
+func (m *downloadManager) Pause(local string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	d := m.find(local)
+	if d == nil || d.Status != downloadActive {
+		return
+	}
+	d.Status = downloadPaused
+	m.running[local]()
+	m.save()
+	m.changed()
+}
+
+// Resume restarts a paused or failed download from its part file.
+func (m *downloadManager) Resume(local string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	d := m.find(local)
+	if d == nil || (d.Status != downloadPaused && d.Status != downloadFailed) {
+		return
+	}
+	m.start(d)
+}
+
+// Cancel stops a download, deletes its part file and drops it from the
+// list. A completed download is only dropped from the list.
+func (m *downloadManager) Cancel(local string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	d := m.find(local)
+	if d == nil {
+		return
+	}
+	if d.Status == downloadActive {
+		// The download goroutine removes the part file once it has
+		// closed it.
+		d.Status = downloadCanceled
+		m.running[local]()
+	} else if d.Status != downloadDone {
+		os.Remove(local + ".part")
+	}
+
+	for i, item := range m.items {
+		if item == d {
+			m.items = append(m.items[:i], m.items[i+1:]...)
+			break
+		}
+	}
+	delete(m.rates, local)
+	m.save()
+	m.changed()
+}
+
+// start runs d in the background. Callers hold m.mu.
+func (m *downloadManager) start(d *downloadState) {
+	if _, ok := m.running[d.Local]; ok {
+		// A paused run has not let go of the part file yet.
+		m.report(fmt.Sprintf("$ Error: %s is still stopping, try again", d.Local))
+		if d.Status == "" {
+			d.Status = downloadPaused
+		}
+		return
+	}
+	if info, err := os.Stat(d.Local + ".part"); err == nil {
+		if resumeOffset(info.Size(), d.Total) == 0 {
+			os.Remove(d.Local + ".part")
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m.running[d.Local] = cancel
+	d.Status = downloadActive
+	d.Error = ""
+	rate := &transferRate{}
+	rate.Add(time.Now(), d.Received)
+	m.rates[d.Local] = rate
+	m.save()
+	m.changed()
+
+	remote, local := d.Remote, d.Local
+	go func() {
+		defer cancel()
+		err := m.fetch(ctx, remote, local, func(received, total int64) {
+			m.mu.Lock()
+			d.Received, d.Total = received, total
+			rate.Add(time.Now(), received)
+			m.mu.Unlock()
+			m.changed()
+		})
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.running, local)
+		switch d.Status {
+		case downloadPaused:
+			m.report(fmt.Sprintf("$ Download paused: %s", local))
+			return
+		case downloadCanceled:
+			os.Remove(local + ".part")
+			m.report(fmt.Sprintf("$ Download cancelled: %s", local))
+			return
+		}
+
+		if err != nil {
+			d.Status = downloadFailed
+			d.Error = err.Error()
+			m.report(fmt.Sprintf("$ Error: Download failed: %v", err))
+		} else {
+			d.Status = downloadDone
+			m.report(fmt.Sprintf("$ Download complete: %s", local))
+		}
+		m.save()
+		m.changed()
+	}()
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestResumeOffset(t *testing.T) {
+	tests := []struct {
+		part, total, want int64
+	}{
+		{0, 0, 0},
+		{0, 100, 0},
+		{40, 100, 40},
+		{40, 0, 40},
+		{100, 100, 100},
+		{150, 100, 0},
+		{-1, 100, 0},
+	}
+	for _, tt := range tests {
+		if got := resumeOffset(tt.part, tt.total); got != tt.want {
+			t.Errorf("resumeOffset(%d, %d) = %d, want %d", tt.part, tt.total, got, tt.want)
+		}
+	}
+}
+
+// waitFor polls cond until it holds, failing the test after a while.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// fakeFetch appends "12345" to the part file per run, reporting the offset
+// it resumed from on offsets, then waits to be cancelled or finished.
+func fakeFetch(offsets chan<- int64, finish <-chan struct{}) fetchFunc {
+	return func(ctx context.Context, remote, local string, progress func(received, total int64)) error {
+		part := local + ".part"
+		var offset int64
+		if info, err := os.Stat(part); err == nil {
+			offset = info.Size()
+		}
+		offsets <- offset
+
+		f, err := os.OpenFile(part, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		f.WriteString("12345")
+		f.Close()
+		progress(offset+5, 10)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-finish:
+			return os.Rename(part, local)
+		}
+	}
+}
+
+func downloadEntry(m *downloadManager, local string) downloadState {
+	for _, d := range m.List() {
+		if d.Local == local {
+			return d
+		}
+	}
+	return downloadState{}
+}
+
+func stopped(m *downloadManager, local string) func() bool {
+	return func() bool {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		_, running := m.running[local]
+		return !running
+	}
+}
+
+func TestDownloadManagerPauseResumeAcrossRestart(t *testing.T) {
+	dir := t.TempDir()
+	statePath, local := filepath.Join(dir, "downloads.json"), filepath.Join(dir, "file.bin")
+	offsets, finish := make(chan int64, 2), make(chan struct{})
+	report := func(string) {}
+
+	m := newDownloadManager(statePath, fakeFetch(offsets, finish), report, nil)
+	if err := m.Add("/data/file.bin", local); err != nil {
+		t.Fatal(err)
+	}
+	if off := <-offsets; off != 0 {
+		t.Errorf("new download started at %d", off)
+	}
+	waitFor(t, "progress", func() bool { return downloadEntry(m, local).Received == 5 })
+	m.Pause(local)
+	waitFor(t, "the paused download to stop", stopped(m, local))
+	if d := downloadEntry(m, local); d.Status != downloadPaused {
+		t.Fatalf("status after pause %q", d.Status)
+	}
+
+	// A new manager stands in for the next run of the app.
+	m = newDownloadManager(statePath, fakeFetch(offsets, finish), report, nil)
+	if d := downloadEntry(m, local); d.Status != downloadPaused || d.Received != 5 || d.Total != 10 {
+		t.Fatalf("restored %+v", d)
+	}
+	m.Resume(local)
+	if off := <-offsets; off != 5 {
+		t.Errorf("resumed at %d, want 5", off)
+	}
+	close(finish)
+	waitFor(t, "the download to finish", func() bool { return downloadEntry(m, local).Status == downloadDone })
+	if data, err := os.ReadFile(local); err != nil || string(data) != "1234512345" {
+		t.Errorf("downloaded %q, %v", data, err)
+	}
+}
+
+func TestDownloadManagerCancel(t *testing.T) {
+	dir := t.TempDir()
+	local := filepath.Join(dir, "file.bin")
+	offsets := make(chan int64, 1)
+	m := newDownloadManager(filepath.Join(dir, "downloads.json"), fakeFetch(offsets, make(chan struct{})), func(string) {}, nil)
+
+	if err := m.Add("/data/file.bin", local); err != nil {
+		t.Fatal(err)
+	}
+	<-offsets
+	if err := m.Add("/data/file.bin", local); err == nil {
+		t.Error("a running download was added twice")
+	}
+	waitFor(t, "progress", func() bool { return downloadEntry(m, local).Received == 5 })
+	m.Cancel(local)
+	waitFor(t, "the cancelled download to stop", stopped(m, local))
+	if len(m.List()) != 0 {
+		t.Errorf("cancelled download is still listed: %+v", m.List())
+	}
+	if _, err := os.Stat(local + ".part"); !os.IsNotExist(err) {
+		t.Errorf("part file left behind: %v", err)
+	}
+}
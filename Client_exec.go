@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Frame stream ids of an exec response, matching the server: stdout and
+// stderr carry output, exit the command's exit code.
+const (
+	execStdout byte = 1
+	execStderr byte = 2
+	execExit   byte = 3
+)
+
+// maxExecFrame bounds the payload of one frame, so a corrupt length
+// cannot make the client allocate without limit.
+const maxExecFrame = 16 << 20
+
+// execFrame is one frame of an exec response.
+type execFrame struct {
+	Stream  byte
+	Payload []byte
+}
+
+// readExecFrame reads the next frame from r: a stream id byte, the payload
+// length as a big-endian uint32 and the payload. It returns io.EOF only at
+// a clean frame boundary.
+func readExecFrame(r io.Reader) (execFrame, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return execFrame{}, fmt.Errorf("exec output cut off in a frame header")
+		}
+		return execFrame{}, err
+	}
+	f := execFrame{Stream: header[0]}
+	switch f.Stream {
+	case execStdout, execStderr, execExit:
+	default:
+		return execFrame{}, fmt.Errorf("unknown exec stream %d", f.Stream)
+	}
+	n := binary.BigEndian.Uint32(header[1:])
+	if n > maxExecFrame {
+		return execFrame{}, fmt.Errorf("exec frame of %d bytes is too large", n)
+	}
+	f.Payload = make([]byte, n)
+	if _, err := io.ReadFull(r, f.Payload); err != nil {
+		return execFrame{}, fmt.Errorf("exec output cut off in a frame: %v", err)
+	}
+	if f.Stream == execExit && n != 4 {
+		return execFrame{}, fmt.Errorf("exit frame of %d bytes, want 4", n)
+	}
+	return f, nil
+}
+
+// ExitCode returns the exit code an exit frame carries; -1 means the
+// command was killed.
+func (f execFrame) ExitCode() int {
+	return int(int32(binary.BigEndian.Uint32(f.Payload)))
+}
+
+// execLine is one complete line of command output.
+type execLine struct {
+	Stream byte
+	Text   string
+}
+
+// execOutput joins output frames into lines per stream. A frame may end
+// in the middle of a line, or of a UTF-8 sequence; the rest is held until
+// the next frame of the same stream or Close.
+type execOutput struct {
+	Lines   []execLine
+	partial map[byte][]byte
+}
+
+// Add appends the payload of an output frame.
+func (o *execOutput) Add(stream byte, payload []byte) {
+	if o.partial == nil {
+		o.partial = make(map[byte][]byte)
+	}
+	buf := append(o.partial[stream], payload...)
+	for {
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			break
+		}
+		o.Lines = append(o.Lines, execLine{Stream: stream, Text: string(bytes.TrimSuffix(buf[:i], []byte("\r")))})
+		buf = buf[i+1:]
+	}
+	o.partial[stream] = buf
+}
+
+// Close ends the output, keeping any last line that had no newline.
+func (o *execOutput) Close() {
+	for _, stream := range []byte{execStdout, execStderr} {
+		if buf := o.partial[stream]; len(buf) > 0 {
+			o.Lines = append(o.Lines, execLine{Stream: stream, Text: string(buf)})
+		}
+		delete(o.partial, stream)
+	}
+}
+
+// readExec reads an exec response body to the end, passing each output
+// frame to onOutput, and returns the exit code. A body that ends without
+// an exit frame is an error.
+func readExec(r io.Reader, onOutput func(stream byte, payload []byte)) (int, error) {
+	for {
+		f, err := readExecFrame(r)
+		if err == io.EOF {
+			return 0, fmt.Errorf("exec output ended without an exit code")
+		}
+		if err != nil {
+			return 0, err
+		}
+		if f.Stream == execExit {
+			return f.ExitCode(), nil
+		}
+		onOutput(f.Stream, f.Payload)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// frame encodes one exec frame the way the server writes it.
+func frame(stream byte, payload []byte) []byte {
+	out := []byte{stream, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(out[1:], uint32(len(payload)))
+	return append(out, payload...)
+}
+
+func exitFrame(code int32) []byte {
+	var p [4]byte
+	binary.BigEndian.PutUint32(p[:], uint32(code))
+	return frame(execExit, p[:])
+}
+
+func TestReadExecInterleaved(t *testing.T) {
+	body := slices.Concat(
+		frame(execStdout, []byte("compiling\nlin")),
+		frame(execStderr, []byte("warning: unused\r\n")),
+		frame(execStdout, []byte("king\n")),
+		frame(execStderr, []byte("error: failed")),
+		exitFrame(2),
+	)
+	var out execOutput
+	code, err := readExec(bytes.NewReader(body), out.Add)
+	if err != nil || code != 2 {
+		t.Fatalf("readExec = %d, %v", code, err)
+	}
+	out.Close()
+	want := []execLine{
+		{execStdout, "compiling"},
+		{execStderr, "warning: unused"},
+		{execStdout, "linking"},
+		{execStderr, "error: failed"},
+	}
+	if !slices.Equal(out.Lines, want) {
+		t.Errorf("got %+v\nwant %+v", out.Lines, want)
+	}
+}
+
+func TestExecOutputSplitsMultibyteCharacters(t *testing.T) {
+	var out execOutput
+	text := []byte("héllo\n")
+	out.Add(execStdout, text[:2]) // ends inside é
+	out.Add(execStdout, text[2:])
+	if len(out.Lines) != 1 || out.Lines[0].Text != "héllo" {
+		t.Errorf("got %+v", out.Lines)
+	}
+}
+
+func TestReadExecExitCodes(t *testing.T) {
+	for _, code := range []int32{0, 1, 255, -1} {
+		got, err := readExec(bytes.NewReader(exitFrame(code)), func(byte, []byte) {})
+		if err != nil || got != int(code) {
+			t.Errorf("exit %d: got %d, %v", code, got, err)
+		}
+	}
+}
+
+func TestReadExecErrors(t *testing.T) {
+	tooLarge := []byte{execStdout, 0xff, 0xff, 0xff, 0xff}
+	tests := []struct {
+		name string
+		body []byte
+		want string
+	}{
+		{"no exit frame", frame(execStdout, []byte("out\n")), "without an exit code"},
+		{"empty", nil, "without an exit code"},
+		{"cut in header", frame(execStdout, []byte("x"))[:3], "cut off in a frame header"},
+		{"cut in payload", frame(execStdout, []byte("output"))[:8], "cut off in a frame"},
+		{"unknown stream", frame(9, []byte("x")), "unknown exec stream 9"},
+		{"oversized", tooLarge, "too large"},
+		{"bad exit frame", frame(execExit, []byte{0, 1}), "exit frame of 2 bytes"},
+	}
+	for _, tt := range tests {
+		_, err := readExec(bytes.NewReader(tt.body), func(byte, []byte) {})
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: %v, want %q", tt.name, err, tt.want)
+		}
+	}
+
+	if _, err := readExecFrame(bytes.NewReader(nil)); err != io.EOF {
+		t.Errorf("clean end: %v", err)
+	}
+}
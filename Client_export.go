@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listingCSV renders a list_files result as CSV with the full path and the
+// base name of each entry.
+func listingCSV(paths []string) ([]byte, error) {
+	rows := [][]string{{"path", "name"}}
+	for _, p := range paths {
+		rows = append(rows, []string{p, path.Base(filepath.ToSlash(p))})
+	}
+	return writeCSV(rows)
+}
+
+// searchCSV renders search matches as CSV with one row per matching line.
+func searchCSV(matches []searchMatch) ([]byte, error) {
+	rows := [][]string{{"path", "line", "text"}}
+	for _, m := range matches {
+		rows = append(rows, []string{m.Path, strconv.Itoa(m.Line), m.Text})
+	}
+	return writeCSV(rows)
+}
+
+// writeCSV encodes rows per RFC 4180: CRLF line endings, and fields holding
+// commas, quotes or line breaks quoted with embedded quotes doubled.
+func writeCSV(rows [][]string) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.UseCRLF = true
+	if err := w.WriteAll(rows); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// exportPath returns where an export of kind ("listing" or "search") is
+// saved: local if it names a .csv file, otherwise a timestamped file in the
+// current directory.
+func exportPath(local, kind string, now time.Time) string {
+	if strings.HasSuffix(strings.ToLower(local), ".csv") {
+		return local
+	}
+	return kind + "-" + now.Format("20060102-150405") + ".csv"
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestListingCSV(t *testing.T) {
+	got, err := listingCSV([]string{"/srv/a.txt", "/srv/report, final.csv", `/srv/say "hi".txt`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "path,name\r\n" +
+		"/srv/a.txt,a.txt\r\n" +
+		"\"/srv/report, final.csv\",\"report, final.csv\"\r\n" +
+		"\"/srv/say \"\"hi\"\".txt\",\"say \"\"hi\"\".txt\"\r\n"
+	if string(got) != want {
+		t.Errorf("got %q\nwant %q", got, want)
+	}
+}
+
+func TestSearchCSV(t *testing.T) {
+	matches := []searchMatch{
+		{Path: "/srv/a.log", Line: 3, Text: "plain"},
+		{Path: "/srv/b.log", Line: 12, Text: "a, \"quoted\"\nmultiline"},
+	}
+	got, err := searchCSV(matches)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "path,line,text\r\n" +
+		"/srv/a.log,3,plain\r\n" +
+		"/srv/b.log,12,\"a, \"\"quoted\"\"\r\nmultiline\"\r\n"
+	if string(got) != want {
+		t.Errorf("got %q\nwant %q", got, want)
+	}
+
+	// A spreadsheet reading the export back sees the original fields.
+	rows, err := csv.NewReader(bytes.NewReader(got)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(rows[2], []string{"/srv/b.log", "12", matches[1].Text}) {
+		t.Errorf("round trip gave %q", rows[2])
+	}
+}
+
+func TestExportPath(t *testing.T) {
+	now := time.Date(2024, 3, 9, 14, 5, 7, 0, time.Local)
+	if got := exportPath("out/Results.CSV", "search", now); got != "out/Results.CSV" {
+		t.Errorf("named .csv file: %q", got)
+	}
+	if got := exportPath("", "listing", now); got != "listing-20240309-140507.csv" {
+		t.Errorf("default name: %q", got)
+	}
+}
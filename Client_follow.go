@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"slices"
+	"strings"
+	"time"
+)
+
+// maxFollowLines is how many lines the follow view keeps. Older ones are
+// dropped as new ones arrive.
+const maxFollowLines = 10000
+
+// followRateWindow is how far back the line rate of a follow looks.
+const followRateWindow = 5 * time.Second
+
+// followScroll is the auto-scroll state of the follow view. It follows the
+// newest line until the user scrolls away from the bottom, then stays where
+// it was left and counts the lines that arrive meanwhile. Scrolling back to
+// the bottom, or jumping there, follows again.
+type followScroll struct {
+	paused bool
+	unseen int
+}
+
+// Observe takes where the list was after a frame: atEnd when its last line
+// is in view. A list that is not at its end after the user moved it has
+// been scrolled up.
+func (s *followScroll) Observe(atEnd bool) {
+	if atEnd {
+		s.paused = false
+		s.unseen = 0
+		return
+	}
+	s.paused = true
+}
+
+// Added counts n new lines, which are unseen while the view is paused.
+func (s *followScroll) Added(n int) {
+	if s.paused {
+		s.unseen += n
+	}
+}
+
+// Jump follows the newest line again.
+func (s *followScroll) Jump() {
+	s.paused = false
+	s.unseen = 0
+}
+
+// Paused reports whether the view stays put as lines arrive.
+func (s *followScroll) Paused() bool { return s.paused }
+
+// Unseen returns how many lines arrived since the view was paused.
+func (s *followScroll) Unseen() int { return s.unseen }
+
+// lineRate measures lines per second over the last followRateWindow.
+type lineRate struct {
+	samples []rateSample
+}
+
+type rateSample struct {
+	at time.Time
+	n  int
+}
+
+// Add records n lines arriving at now.
+func (r *lineRate) Add(now time.Time, n int) {
+	r.samples = append(r.samples, rateSample{now, n})
+	r.prune(now)
+}
+
+// Rate returns the lines per second seen in the window ending at now.
+func (r *lineRate) Rate(now time.Time) float64 {
+	r.prune(now)
+	total := 0
+	for _, s := range r.samples {
+		total += s.n
+	}
+	return float64(total) / followRateWindow.Seconds()
+}
+
+func (r *lineRate) prune(now time.Time) {
+	i := 0
+	for i < len(r.samples) && now.Sub(r.samples[i].at) > followRateWindow {
+		i++
+	}
+	r.samples = r.samples[i:]
+}
+
+// followView is what the client shows of a follow: the last
+// maxFollowLines lines, the scroll state and the line rate.
+type followView struct {
+	Path   string
+	Lines  []string
+	Scroll followScroll
+	Rate   lineRate
+	// dropped counts lines dropped from the front since the last frame,
+	// so a paused list can be moved up by as many and stay on the same
+	// lines.
+	dropped int
+}
+
+// Add appends a line that arrived at now.
+func (v *followView) Add(line string, now time.Time) {
+	v.Lines = append(v.Lines, line)
+	if n := len(v.Lines) - maxFollowLines; n > 0 {
+		v.Lines = slices.Delete(v.Lines, 0, n)
+		v.dropped += n
+	}
+	v.Scroll.Added(1)
+	v.Rate.Add(now, 1)
+}
+
+// TakeDropped returns the lines dropped since it was last called.
+func (v *followView) TakeDropped() int {
+	n := v.dropped
+	v.dropped = 0
+	return n
+}
+
+// readFollowEvents reads the server-sent events of a follow from r until
+// it ends, passing each to onEvent. event is "" for a line of the file,
+// "rotated" when the file was replaced or truncated, and "end" when the
+// server ended the follow.
+func readFollowEvents(r io.Reader, onEvent func(event, data string)) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64<<10), 1<<20)
+	var event string
+	var data []string
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" {
+			if data != nil {
+				onEvent(event, strings.Join(data, "\n"))
+			}
+			event, data = "", nil
+			continue
+		}
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "event":
+			event = value
+		case "data":
+			data = append(data, value)
+		}
+	}
+	return sc.Err()
+}
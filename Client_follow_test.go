@@ -0,0 +1,115 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFollowScroll(t *testing.T) {
+	var s followScroll
+	check := func(step string, paused bool, unseen int) {
+		t.Helper()
+		if s.Paused() != paused || s.Unseen() != unseen {
+			t.Errorf("%s: paused %v, unseen %d; want %v, %d", step, s.Paused(), s.Unseen(), paused, unseen)
+		}
+	}
+
+	s.Observe(true)
+	s.Added(3)
+	check("following", false, 0)
+
+	s.Observe(false)
+	check("scrolled up", true, 0)
+	s.Added(2)
+	s.Added(1)
+	s.Observe(false)
+	check("lines while scrolled up", true, 3)
+
+	s.Observe(true)
+	check("scrolled back to the bottom", false, 0)
+	s.Added(5)
+	check("following again", false, 0)
+
+	s.Observe(false)
+	s.Added(4)
+	s.Jump()
+	check("jumped to the bottom", false, 0)
+	s.Observe(true)
+	s.Added(1)
+	check("following after the jump", false, 0)
+}
+
+func TestLineRate(t *testing.T) {
+	var r lineRate
+	start := time.Unix(1000, 0)
+	if got := r.Rate(start); got != 0 {
+		t.Errorf("empty rate = %v", got)
+	}
+	for i := 0; i < 10; i++ {
+		r.Add(start.Add(time.Duration(i)*100*time.Millisecond), 1)
+	}
+	r.Add(start.Add(2*time.Second), 5)
+	if got := r.Rate(start.Add(2 * time.Second)); got != 3 {
+		t.Errorf("rate = %v, want 15 lines over 5s", got)
+	}
+	// Samples older than the window fall out of it.
+	if got := r.Rate(start.Add(6 * time.Second)); got != 1 {
+		t.Errorf("rate after the first lines aged out = %v, want 1", got)
+	}
+	if got := r.Rate(start.Add(time.Minute)); got != 0 {
+		t.Errorf("rate after a quiet minute = %v", got)
+	}
+}
+
+func TestFollowViewCapsLines(t *testing.T) {
+	var v followView
+	now := time.Unix(1000, 0)
+	for i := 0; i < maxFollowLines+25; i++ {
+		v.Add(strconv.Itoa(i), now)
+	}
+	if len(v.Lines) != maxFollowLines || v.Lines[0] != "25" || v.Lines[len(v.Lines)-1] != strconv.Itoa(maxFollowLines+24) {
+		t.Errorf("kept %d lines, %s..%s", len(v.Lines), v.Lines[0], v.Lines[len(v.Lines)-1])
+	}
+	if n := v.TakeDropped(); n != 25 {
+		t.Errorf("dropped %d, want 25", n)
+	}
+	if n := v.TakeDropped(); n != 0 {
+		t.Errorf("dropped %d again", n)
+	}
+
+	v.Scroll.Observe(false)
+	v.Add("new", now)
+	if v.Scroll.Unseen() != 1 {
+		t.Errorf("unseen %d after a line while paused", v.Scroll.Unseen())
+	}
+}
+
+func TestReadFollowEvents(t *testing.T) {
+	stream := "data: one\n\n" +
+		"data: two: with a colon\n\n" +
+		": a comment\n\n" +
+		"event: rotated\ndata: replaced\n\n" +
+		"data: multi\ndata: line\n\n" +
+		"data:\n\n" +
+		"event: end\ndata: max duration reached\n\n"
+	var got [][2]string
+	if err := readFollowEvents(strings.NewReader(stream), func(event, data string) {
+		got = append(got, [2]string{event, data})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	want := [][2]string{
+		{"", "one"},
+		{"", "two: with a colon"},
+		{"rotated", "replaced"},
+		{"", "multi\nline"},
+		{"", ""},
+		{"end", "max duration reached"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("events %q, want %q", got, want)
+	}
+}
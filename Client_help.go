@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// serverCapabilities is what /api/capabilities reports about the
+// connected server.
+type serverCapabilities struct {
+	MaxFileSize      int64    `json:"max_file_size"`
+	StreamThreshold  int64    `json:"stream_threshold"`
+	MaxWalkEntries   int      `json:"max_walk_entries"`
+	AllowedActions   []string `json:"allowed_actions"`
+	AllowedFileTypes []string `json:"allowed_file_types"`
+}
+
+// operationHelp documents one server operation. Example is a line in the
+// syntax of the Script field.
+type operationHelp struct {
+	Name     string
+	Summary  string
+	Required []string
+	Optional []string
+	Example  string
+}
+
+// helpCatalog is the built-in help for every operation this client knows
+// of, in the order the help overlay lists them.
+var helpCatalog = []operationHelp{
+	{"list_files", "List the entries of a directory.", []string{"path"}, []string{"filter"}, "list_files path=/data"},
+	{"read_file", "Read a whole file.", []string{"path"}, []string{"stream"}, "read_file path=/data/notes.txt"},
+	{"read_lines", "Read a range of lines of a file.", []string{"path"}, []string{"start", "count"}, "read_lines path=/data/app.log start=100 count=50"},
+	{"line_count", "Count the lines of a file.", []string{"path"}, nil, "line_count path=/data/app.log"},
+	{"preview", "Show a file's type and size and the start of its text.", []string{"path"}, []string{"bytes"}, "preview path=/data/report.pdf"},
+	{"read_multi", "Read several files at once.", []string{"paths"}, nil, `read_multi paths=["/data/a.txt","/data/b.txt"]`},
+	{"write_file", "Write content to a file, replacing it.", []string{"path", "content"}, []string{"sha256", "if_match", "line_ending", "encoding", "durable", "exclusive"}, "write_file path=/data/notes.txt content=hello"},
+	{"create_folder", "Create a directory and any missing parents.", []string{"path"}, []string{"exclusive"}, "create_folder path=/data/new"},
+	{"can_write", "Check whether a write would be allowed, without writing.", []string{"path"}, []string{"size"}, "can_write path=/data/big.bin size=1048576"},
+	{"move", "Move or rename a file or directory.", []string{"path", "destination"}, nil, "move path=/data/a.txt destination=/data/b.txt"},
+	{"swap", "Swap two files in place.", []string{"path", "destination"}, nil, "swap path=/data/a.txt destination=/data/b.txt"},
+	{"copy_dir", "Copy a directory tree.", []string{"path", "destination"}, nil, "copy_dir path=/data/site destination=/data/site-backup"},
+	{"retype", "Change a file's extension.", []string{"path", "extension"}, nil, "retype path=/data/notes.txt extension=md"},
+	{"rotate", "Rotate a log file, keeping the newest rotations.", []string{"path"}, []string{"compress", "keep"}, "rotate path=/data/app.log compress=true keep=5"},
+	{"chmod", "Change permissions, within the server's limit.", []string{"path", "mode"}, []string{"recursive"}, "chmod path=/data/site mode=0755 recursive=true"},
+	{"symlink", "Create a symlink inside the allowed paths.", []string{"path", "target"}, nil, "symlink path=/data/current target=/data/releases/v2"},
+	{"disk_usage", "Report total, used and free space.", []string{"path"}, nil, "disk_usage path=/data"},
+	{"dir_etag", "Get the version tag of a directory listing.", []string{"path"}, nil, "dir_etag path=/data"},
+	{"manifest", "Hash every file under a directory.", []string{"path"}, nil, "manifest path=/data/site"},
+	{"sync_plan", "Diff a local manifest against a directory.", []string{"path", "manifest"}, []string{"mode"}, "sync_plan path=/data/site manifest={}"},
+	{"walk_dir", "List a directory tree a page at a time.", []string{"path"}, []string{"limit", "cursor"}, "walk_dir path=/data limit=500"},
+	{"find_duplicates", "Group files with identical content.", []string{"path"}, nil, "find_duplicates path=/data/photos"},
+	{"search", "Search file contents for a regular expression.", []string{"path", "pattern"}, []string{"max"}, "search path=/data pattern=TODO max=100"},
+	{"recent", "List the most recently modified files.", nil, []string{"limit", "within"}, "recent limit=20 within=24h"},
+	{"verify", "Compare a file's checksum with an expected one.", []string{"path", "checksum"}, []string{"algorithm"}, "verify path=/data/a.iso checksum=ab12..."},
+	{"tar_stream", "Download a directory as a tar archive.", []string{"path"}, []string{"gzip"}, "tar_stream path=/data/site gzip=true"},
+	{"exec", "Run an allowed command in a directory.", []string{"command", "path"}, []string{"args"}, "exec command=git path=/data/repo args=[\"status\"]"},
+	{"follow", "Stream lines as they are added to a file.", []string{"path"}, nil, "use the Follow panel"},
+}
+
+// helpContent assembles the help overlay. With the capabilities of the
+// connected server it lists only the operations that server allows, with
+// its limits; operations the server reports but the catalog lacks are
+// named without details. Without capabilities, e.g. before connecting or
+// for a server that does not report them, it lists the whole catalog.
+func helpContent(caps *serverCapabilities) string {
+	var b strings.Builder
+	entries := helpCatalog
+	if caps == nil {
+		b.WriteString("Showing every operation this client knows; the connected server may not allow all of them.\n")
+	} else {
+		entries = nil
+		for _, op := range helpCatalog {
+			if slices.Contains(caps.AllowedActions, op.Name) {
+				entries = append(entries, op)
+			}
+		}
+		b.WriteString("Operations this server allows.\n")
+		if caps.MaxFileSize > 0 {
+			fmt.Fprintf(&b, "Largest file: %d bytes.\n", caps.MaxFileSize)
+		}
+		if caps.StreamThreshold > 0 {
+			fmt.Fprintf(&b, "Files over %d bytes are read as a stream.\n", caps.StreamThreshold)
+		}
+		if caps.MaxWalkEntries > 0 {
+			fmt.Fprintf(&b, "walk_dir pages hold up to %d entries.\n", caps.MaxWalkEntries)
+		}
+		if len(caps.AllowedFileTypes) > 0 {
+			fmt.Fprintf(&b, "File types: %s.\n", strings.Join(caps.AllowedFileTypes, " "))
+		}
+	}
+
+	for _, op := range entries {
+		fmt.Fprintf(&b, "\n%s - %s\n", op.Name, op.Summary)
+		if len(op.Required) > 0 {
+			fmt.Fprintf(&b, "  Required: %s\n", strings.Join(op.Required, ", "))
+		}
+		if len(op.Optional) > 0 {
+			fmt.Fprintf(&b, "  Optional: %s\n", strings.Join(op.Optional, ", "))
+		}
+		fmt.Fprintf(&b, "  Example:  %s\n", op.Example)
+	}
+
+	if caps != nil {
+		var unknown []string
+		for _, name := range caps.AllowedActions {
+			if !slices.ContainsFunc(helpCatalog, func(op operationHelp) bool { return op.Name == name }) {
+				unknown = append(unknown, name)
+			}
+		}
+		if len(unknown) > 0 {
+			fmt.Fprintf(&b, "\nAlso allowed, with no help in this client: %s\n", strings.Join(unknown, ", "))
+		}
+	}
+	return b.String()
+}
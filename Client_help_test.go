@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestHelpContentFallback(t *testing.T) {
+	got := helpContent(nil)
+	if !strings.HasPrefix(got, "Showing every operation this client knows") {
+		t.Errorf("fallback does not say it is the built-in catalog:\n%s", got)
+	}
+	for _, op := range helpCatalog {
+		if !strings.Contains(got, "\n"+op.Name+" - "+op.Summary+"\n") {
+			t.Errorf("fallback is missing %s", op.Name)
+		}
+	}
+	if strings.Contains(got, "Also allowed") || strings.Contains(got, "Largest file") {
+		t.Errorf("fallback shows server details:\n%s", got)
+	}
+}
+
+func TestHelpContentFromCapabilities(t *testing.T) {
+	var caps serverCapabilities
+	body := `{"max_file_size": 1048576, "stream_threshold": 65536, "max_walk_entries": 500,
+		"allowed_actions": ["read_file", "frobnicate", "list_files"], "allowed_file_types": [".txt", ".log"]}`
+	if err := json.Unmarshal([]byte(body), &caps); err != nil {
+		t.Fatal(err)
+	}
+	got := helpContent(&caps)
+	for _, want := range []string{
+		"Operations this server allows.\n",
+		"Largest file: 1048576 bytes.\n",
+		"Files over 65536 bytes are read as a stream.\n",
+		"walk_dir pages hold up to 500 entries.\n",
+		"File types: .txt .log.\n",
+		"  Required: path\n  Optional: filter\n  Example:  list_files path=/data\n",
+		"\nAlso allowed, with no help in this client: frobnicate\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("help is missing %q:\n%s", want, got)
+		}
+	}
+	// Entries follow the catalog's order, not the server's, and only the
+	// allowed ones are shown.
+	list, read := strings.Index(got, "\nlist_files - "), strings.Index(got, "\nread_file - ")
+	if list < 0 || read < 0 || list > read {
+		t.Errorf("list_files at %d, read_file at %d; want both, in catalog order", list, read)
+	}
+	if strings.Contains(got, "\nwrite_file - ") || strings.Contains(got, "Showing every operation") {
+		t.Errorf("help shows operations the server does not allow:\n%s", got)
+	}
+
+	if got := helpContent(&serverCapabilities{}); got != "Operations this server allows.\n" {
+		t.Errorf("empty capabilities gave %q", got)
+	}
+}
+
+func TestHelpCatalogExamples(t *testing.T) {
+	seen := make(map[string]bool)
+	for _, op := range helpCatalog {
+		if seen[op.Name] {
+			t.Errorf("%s is listed twice", op.Name)
+		}
+		seen[op.Name] = true
+		// follow runs from its own panel, so its example is prose.
+		if op.Name == "follow" {
+			continue
+		}
+		step, err := parseScriptLine(op.Example)
+		if err != nil {
+			t.Errorf("%s: example %q does not parse: %v", op.Name, op.Example, err)
+			continue
+		}
+		if step.Operation != op.Name {
+			t.Errorf("%s: example runs %s", op.Name, step.Operation)
+		}
+		for _, p := range op.Required {
+			if _, ok := step.Parameters[p]; !ok {
+				t.Errorf("%s: example %q leaves out required %s", op.Name, op.Example, p)
+			}
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+// defaultLocale is used for any message a locale does not translate.
+const defaultLocale = "en"
+
+// locales lists the selectable languages in the order they are offered.
+var locales = []struct {
+	Code string
+	Name string
+}{
+	{"en", "English"},
+	{"es", "Español"},
+	{"de", "Deutsch"},
+}
+
+// catalog holds the user-facing messages by locale and key. Keys for server
+// error codes are "error." followed by the code.
+var catalog = map[string]map[string]string{
+	"en": {
+		"op.success":                 "Operation successful!",
+		"op.failed":                  "Operation failed",
+		"op.cached":                  "cached",
+		"error.invalid_argument":     "The request is invalid",
+		"error.invalid_name":         "The name contains characters or words that are not allowed",
+		"error.invalid_token":        "The auth token was rejected",
+		"error.bad_signature":        "The request signature was missing or did not match",
+		"error.path_denied":          "Access to this path is denied",
+		"error.type_denied":          "This file type is not allowed",
+		"error.permission_denied":    "The server lacks permission for this path",
+		"error.not_allowed":          "This operation is not allowed",
+		"error.argument_denied":      "This command argument is not allowed",
+		"error.not_found":            "The file or folder does not exist",
+		"error.already_exists":       "The target already exists",
+		"error.is_directory":         "The path is a directory, not a file",
+		"error.too_large":            "The content is too large",
+		"error.insufficient_storage": "The server is out of disk space",
+		"error.checksum_mismatch":    "The content was damaged in transit; try again",
+		"error.conflict":             "The path changed during the operation",
+		"error.unsupported":          "The server does not support this",
+		"error.maintenance":          "The server is in maintenance mode; writes are paused",
+		"error.busy":                 "The server is busy; try again shortly",
+		"error.too_many_operations":  "Too many of your operations are running; wait for one to finish",
+		"error.internal":             "The server hit an internal error",
+	},
+	"es": {
+		"op.success":                 "¡Operación completada!",
+		"op.failed":                  "La operación falló",
+		"op.cached":                  "en caché",
+		"error.invalid_argument":     "La solicitud no es válida",
+		"error.invalid_name":         "El nombre contiene caracteres o palabras no permitidos",
+		"error.invalid_token":        "El token de autenticación fue rechazado",
+		"error.bad_signature":        "La firma de la solicitud falta o no coincide",
+		"error.path_denied":          "Acceso denegado a esta ruta",
+		"error.type_denied":          "Este tipo de archivo no está permitido",
+		"error.permission_denied":    "El servidor no tiene permiso sobre esta ruta",
+		"error.not_allowed":          "Esta operación no está permitida",
+		"error.argument_denied":      "Este argumento del comando no está permitido",
+		"error.not_found":            "El archivo o la carpeta no existe",
+		"error.already_exists":       "El destino ya existe",
+		"error.is_directory":         "La ruta es una carpeta, no un archivo",
+		"error.too_large":            "El contenido es demasiado grande",
+		"error.insufficient_storage": "El servidor no tiene espacio en disco",
+		"error.checksum_mismatch":    "El contenido se dañó durante la transferencia; inténtalo de nuevo",
+		"error.conflict":             "La ruta cambió durante la operación",
+		"error.unsupported":          "El servidor no admite esta operación",
+		"error.maintenance":          "El servidor está en mantenimiento; las escrituras están en pausa",
+		"error.busy":                 "El servidor está ocupado; inténtelo de nuevo en breve",
+		"error.too_many_operations":  "Tiene demasiadas operaciones en curso; espere a que termine alguna",
+		"error.internal":             "Error interno del servidor",
+	},
+	"de": {
+		"op.success":                 "Vorgang erfolgreich!",
+		"op.failed":                  "Vorgang fehlgeschlagen",
+		"op.cached":                  "zwischengespeichert",
+		"error.invalid_argument":     "Die Anfrage ist ungültig",
+		"error.invalid_name":         "Der Name enthält nicht erlaubte Zeichen oder Wörter",
+		"error.invalid_token":        "Das Auth-Token wurde abgelehnt",
+		"error.bad_signature":        "Die Signatur der Anfrage fehlt oder stimmt nicht",
+		"error.path_denied":          "Zugriff auf diesen Pfad verweigert",
+		"error.type_denied":          "Dieser Dateityp ist nicht erlaubt",
+		"error.permission_denied":    "Dem Server fehlt die Berechtigung für diesen Pfad",
+		"error.not_allowed":          "Dieser Vorgang ist nicht erlaubt",
+		"error.argument_denied":      "Dieses Befehlsargument ist nicht erlaubt",
+		"error.not_found":            "Die Datei oder der Ordner existiert nicht",
+		"error.already_exists":       "Das Ziel existiert bereits",
+		"error.is_directory":         "Der Pfad ist ein Ordner, keine Datei",
+		"error.too_large":            "Der Inhalt ist zu groß",
+		"error.insufficient_storage": "Der Server hat keinen Speicherplatz mehr",
+		"error.checksum_mismatch":    "Der Inhalt wurde bei der Übertragung beschädigt; bitte erneut versuchen",
+		"error.conflict":             "Der Pfad hat sich während des Vorgangs geändert",
+		"error.unsupported":          "Der Server unterstützt dies nicht",
+		"error.maintenance":          "Der Server ist im Wartungsmodus; Schreibzugriffe sind pausiert",
+		"error.busy":                 "Der Server ist ausgelastet; bitte gleich erneut versuchen",
+		"error.too_many_operations":  "Zu viele eigene Vorgänge laufen; bitte warten, bis einer fertig ist",
+		"error.internal":             "Interner Serverfehler",
+	},
+}
+
+// lookupMessage returns the message for key in locale, falling back to the
+// default locale and then to the key itself so a missing translation never
+// leaves the UI blank.
+func lookupMessage(catalog map[string]map[string]string, locale, key string) string {
+	if msg, ok := catalog[locale][key]; ok {
+		return msg
+	}
+	if msg, ok := catalog[defaultLocale][key]; ok {
+		return msg
+	}
+	return key
+}
+
+// translate returns the message for key in the language selected in the UI.
+func (t *Terminal) translate(key string) string {
+	locale := t.language.Value
+	if locale == "" {
+		locale = defaultLocale
+	}
+	return lookupMessage(catalog, locale, key)
+}
+
+// describeError renders a server error in the selected language, keeping
+// the server's own message for the specifics. Errors without a known code
+// are shown as the server sent them.
+func (t *Terminal) describeError(e *ServerError) string {
+	key := "error." + e.Code
+	msg := t.translate(key)
+	if e.Code == "" || msg == key {
+		return e.Error()
+	}
+	return msg + ": " + e.Message
+}
@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestLookupMessage(t *testing.T) {
+	cat := map[string]map[string]string{
+		"en": {"greeting": "Hello", "farewell": "Goodbye"},
+		"es": {"greeting": "Hola"},
+	}
+	tests := []struct {
+		locale, key, want string
+	}{
+		{"es", "greeting", "Hola"},
+		{"en", "greeting", "Hello"},
+		{"es", "farewell", "Goodbye"},
+		{"fr", "greeting", "Hello"},
+		{"es", "missing", "missing"},
+	}
+	for _, tt := range tests {
+		if got := lookupMessage(cat, tt.locale, tt.key); got != tt.want {
+			t.Errorf("lookupMessage(%q, %q) = %q, want %q", tt.locale, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestCatalogLocalesTranslateDefaultKeys(t *testing.T) {
+	for _, l := range locales {
+		msgs, ok := catalog[l.Code]
+		if !ok {
+			t.Errorf("locale %s has no catalog", l.Code)
+			continue
+		}
+		for key := range catalog[defaultLocale] {
+			if _, ok := msgs[key]; !ok {
+				t.Errorf("locale %s lacks %s", l.Code, key)
+			}
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// idempotencyHeader carries the key of a logical operation. Every attempt
+// of the operation sends the same key, so the server runs a mutation once
+// even when a retry follows a response that was lost on the way.
+const idempotencyHeader = "Idempotency-Key"
+
+// newIdempotencyKey returns a random key for a new logical operation.
+func newIdempotencyKey() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// withIdempotencyKey returns cmd with a key of its own. A command that has
+// one already keeps it: it is being sent again, as the same operation.
+func withIdempotencyKey(cmd Command) Command {
+	if cmd.IdempotencyKey == "" {
+		cmd.IdempotencyKey = newIdempotencyKey()
+	}
+	return cmd
+}
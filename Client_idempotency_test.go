@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// keyRecorder is a transport that records the Idempotency-Key of every
+// request. It answers the first cut bodies with a truncated response and
+// the rest in full.
+type keyRecorder struct {
+	keys []string
+	cut  int
+}
+
+func (k *keyRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	k.keys = append(k.keys, req.Header.Get(idempotencyHeader))
+	body := okResponse
+	length := int64(len(body))
+	if k.cut > 0 {
+		k.cut--
+		body = body[:10]
+	}
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Status:        "200 OK",
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: length,
+		Header:        make(http.Header),
+		Request:       req,
+	}, nil
+}
+
+func keyTerminal(rt http.RoundTripper) *Terminal {
+	term := stubTerminal(rt)
+	term.latencies = newLatencyWindow(30)
+	term.listings = newListingCache(time.Minute)
+	term.serverURLInput.SetText("https://server/api/operation")
+	// A known version keeps runCommand from fetching it in the background.
+	term.serverVersion = "test"
+	return term
+}
+
+func TestIdempotencyKeyPerOperation(t *testing.T) {
+	rec := &keyRecorder{}
+	term := keyTerminal(rec)
+	write := Command{Operation: "write_file", Parameters: map[string]string{"path": "/data/a.txt", "content": "x"}}
+
+	// Each new operation gets a key of its own.
+	for i := 0; i < 3; i++ {
+		if _, err := term.sendCommand(write); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The same operation sent again keeps its key.
+	keyed := withIdempotencyKey(write)
+	for i := 0; i < 2; i++ {
+		if _, err := term.sendCommand(keyed); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(rec.keys) != 5 {
+		t.Fatalf("%d requests, want 5", len(rec.keys))
+	}
+	seen := make(map[string]bool)
+	for _, key := range rec.keys[:3] {
+		if len(key) != 32 || seen[key] {
+			t.Errorf("new operations sent keys %q, want distinct random keys", rec.keys[:3])
+		}
+		seen[key] = true
+	}
+	if rec.keys[3] != keyed.IdempotencyKey || rec.keys[4] != keyed.IdempotencyKey {
+		t.Errorf("resent operation sent keys %q, want %q both times", rec.keys[3:], keyed.IdempotencyKey)
+	}
+	if seen[keyed.IdempotencyKey] {
+		t.Error("a new operation reused another's key")
+	}
+}
+
+func TestRetryReusesIdempotencyKey(t *testing.T) {
+	rec := &keyRecorder{cut: 2}
+	term := keyTerminal(rec)
+	cmd := withIdempotencyKey(Command{Operation: "create_folder", Parameters: map[string]string{"path": "/data/new", "exclusive": "true"}})
+
+	// Two attempts are cut off; each leaves the command for Retry.
+	term.runCommand(context.Background(), cmd)
+	for i := 0; i < 2; i++ {
+		if term.retryCommand == nil {
+			t.Fatalf("attempt %d: no command kept for Retry", i+1)
+		}
+		term.runCommand(context.Background(), *term.retryCommand)
+	}
+	if term.retryCommand != nil {
+		t.Error("a command that went through is still offered for Retry")
+	}
+	if len(rec.keys) != 3 {
+		t.Fatalf("%d requests, want 3", len(rec.keys))
+	}
+	for i, key := range rec.keys {
+		if key != cmd.IdempotencyKey {
+			t.Errorf("attempt %d sent key %q, want %q", i+1, key, cmd.IdempotencyKey)
+		}
+	}
+}
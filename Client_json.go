@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// validateJSON reports whether s is a single JSON value. A syntax error
+// names the line and column it was found at, counting from 1.
+func validateJSON(s string) error {
+	err := json.Unmarshal([]byte(s), new(json.RawMessage))
+	var syntax *json.SyntaxError
+	if errors.As(err, &syntax) {
+		// Offset counts the offending byte as read.
+		line, col := lineColumn(s, max(syntax.Offset-1, 0))
+		return fmt.Errorf("line %d, column %d: %v", line, col, syntax)
+	}
+	return err
+}
+
+// formatJSON returns s indented by two spaces per level, or the error from
+// validateJSON if s is not valid JSON.
+func formatJSON(s string) (string, error) {
+	if err := validateJSON(s); err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, []byte(s), "", "  "); err != nil {
+		return "", err
+	}
+	buf.WriteByte('\n')
+	return buf.String(), nil
+}
+
+// lineColumn converts a byte offset in s to a line and column.
+func lineColumn(s string, offset int64) (line, col int) {
+	if offset > int64(len(s)) {
+		offset = int64(len(s))
+	}
+	before := s[:offset]
+	line = strings.Count(before, "\n") + 1
+	col = len(before) - strings.LastIndex(before, "\n")
+	return line, col
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateJSON(t *testing.T) {
+	for _, s := range []string{`{"a": [1, 2, {"b": null}]}`, `"text"`, ` 42 `} {
+		if err := validateJSON(s); err != nil {
+			t.Errorf("validateJSON(%q) = %v", s, err)
+		}
+	}
+
+	tests := []struct {
+		in, where string
+	}{
+		{"{\"a\": 1,\n  }", "line 2, column 3"},
+		{`{"a" 1}`, "line 1, column 6"},
+	}
+	for _, tt := range tests {
+		err := validateJSON(tt.in)
+		if err == nil || !strings.HasPrefix(err.Error(), tt.where) {
+			t.Errorf("validateJSON(%q) = %v, want an error at %s", tt.in, err, tt.where)
+		}
+	}
+	for _, s := range []string{"", `{"a": 1`, `{"a": 1} {"b": 2}`} {
+		if validateJSON(s) == nil {
+			t.Errorf("validateJSON(%q) accepted it", s)
+		}
+	}
+}
+
+func TestFormatJSON(t *testing.T) {
+	got, err := formatJSON(`{"a":[1,2],"b":{}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "{\n  \"a\": [\n    1,\n    2\n  ],\n  \"b\": {}\n}\n"
+	if got != want {
+		t.Errorf("formatJSON = %q, want %q", got, want)
+	}
+	if _, err := formatJSON(`{"a":`); err == nil {
+		t.Error("invalid JSON was formatted")
+	}
+}
+
+func TestLineColumn(t *testing.T) {
+	s := "ab\ncde\nf"
+	tests := []struct {
+		offset    int64
+		line, col int
+	}{
+		{0, 1, 1},
+		{2, 1, 3},
+		{3, 2, 1},
+		{5, 2, 3},
+		{100, 3, 2},
+	}
+	for _, tt := range tests {
+		if line, col := lineColumn(s, tt.offset); line != tt.line || col != tt.col {
+			t.Errorf("lineColumn(%d) = %d:%d, want %d:%d", tt.offset, line, col, tt.line, tt.col)
+		}
+	}
+}
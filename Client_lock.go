@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sessionLock locks the client after a stretch without user input, so a
+// token left on a shared workstation cannot be used by the next person.
+// Locking is one way: only Unlock, with a token entered again, lifts it.
+type sessionLock struct {
+	mu     sync.Mutex
+	idle   time.Duration
+	last   time.Time
+	locked bool
+}
+
+func newSessionLock(now time.Time) *sessionLock {
+	return &sessionLock{last: now}
+}
+
+// SetIdle sets how long the client may go without input before it locks.
+// Zero or less never locks. The idle time counts from now.
+func (l *sessionLock) SetIdle(idle time.Duration, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.idle = idle
+	l.last = now
+}
+
+// Touch records user input at now. Input while locked does not count.
+func (l *sessionLock) Touch(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.locked {
+		l.last = now
+	}
+}
+
+// Check locks the session if it has been idle for the configured period
+// at now, and reports whether this call locked it.
+func (l *sessionLock) Check(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.locked || l.idle <= 0 || now.Sub(l.last) < l.idle {
+		return false
+	}
+	l.locked = true
+	return true
+}
+
+// Locked reports whether the session is locked.
+func (l *sessionLock) Locked() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.locked
+}
+
+// Unlock lifts the lock once a token has been entered again.
+func (l *sessionLock) Unlock(token string, now time.Time) error {
+	if strings.TrimSpace(token) == "" {
+		return fmt.Errorf("enter your token to unlock")
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.locked = false
+	l.last = now
+	return nil
+}
+
+// parseIdleMinutes reads the lock field: whole minutes, with empty or 0
+// meaning never.
+func parseIdleMinutes(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("lock after must be a whole number of minutes")
+	}
+	return time.Duration(n) * time.Minute, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionLocksWhenIdle(t *testing.T) {
+	start := time.Date(2024, 6, 1, 9, 0, 0, 0, time.UTC)
+	l := newSessionLock(start)
+	l.SetIdle(5*time.Minute, start)
+
+	l.Touch(start.Add(4 * time.Minute))
+	if l.Check(start.Add(8 * time.Minute)) {
+		t.Fatal("locked 4 minutes after the last input")
+	}
+	if !l.Check(start.Add(9*time.Minute)) || !l.Locked() {
+		t.Fatal("did not lock after 5 idle minutes")
+	}
+	if l.Check(start.Add(20 * time.Minute)) {
+		t.Error("Check reported locking an already locked session")
+	}
+
+	// Input while locked neither unlocks nor resets the clock.
+	l.Touch(start.Add(21 * time.Minute))
+	if !l.Locked() {
+		t.Error("input unlocked the session")
+	}
+}
+
+func TestSessionUnlock(t *testing.T) {
+	start := time.Now()
+	l := newSessionLock(start)
+	l.SetIdle(time.Minute, start)
+	l.Check(start.Add(time.Minute))
+
+	for _, token := range []string{"", "   \n"} {
+		if err := l.Unlock(token, start.Add(2*time.Minute)); err == nil || !l.Locked() {
+			t.Errorf("unlocked with token %q", token)
+		}
+	}
+	unlockedAt := start.Add(3 * time.Minute)
+	if err := l.Unlock("eyJhbGciOi...", unlockedAt); err != nil || l.Locked() {
+		t.Fatalf("Unlock: %v, locked %v", err, l.Locked())
+	}
+	// The idle period starts over from the unlock.
+	if l.Check(unlockedAt.Add(59 * time.Second)) {
+		t.Error("locked again straight after unlocking")
+	}
+	if !l.Check(unlockedAt.Add(time.Minute)) {
+		t.Error("did not lock again after a further idle minute")
+	}
+}
+
+func TestSessionLockDisabled(t *testing.T) {
+	start := time.Now()
+	l := newSessionLock(start)
+	if l.Check(start.Add(24 * time.Hour)) {
+		t.Error("locked without an idle period set")
+	}
+
+	// Turning the lock on later counts from then, not from the last input.
+	l.SetIdle(10*time.Minute, start.Add(24*time.Hour))
+	if l.Check(start.Add(24*time.Hour + 9*time.Minute)) {
+		t.Error("idle time before SetIdle counted")
+	}
+}
+
+func TestParseIdleMinutes(t *testing.T) {
+	for in, want := range map[string]time.Duration{"": 0, "0": 0, " 15 ": 15 * time.Minute} {
+		if got, err := parseIdleMinutes(in); err != nil || got != want {
+			t.Errorf("parseIdleMinutes(%q) = %v, %v", in, got, err)
+		}
+	}
+	for _, in := range []string{"-1", "1.5", "5m", "soon"} {
+		if _, err := parseIdleMinutes(in); err == nil {
+			t.Errorf("parseIdleMinutes(%q) accepted", in)
+		}
+	}
+}
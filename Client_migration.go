@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// pathProbe reports the local address packets to remote currently leave
+// from. It changes when the client moves to another network, e.g. from
+// Wi-Fi to mobile data.
+type pathProbe interface {
+	LocalAddr(remote string) (string, error)
+}
+
+// udpPathProbe asks the routing table by connecting a UDP socket, which
+// sends nothing.
+type udpPathProbe struct{}
+
+func (udpPathProbe) LocalAddr(remote string) (string, error) {
+	if _, _, err := net.SplitHostPort(remote); err != nil {
+		remote = net.JoinHostPort(remote, "443")
+	}
+	conn, err := net.Dial("udp", remote)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	host, _, err := net.SplitHostPort(conn.LocalAddr().String())
+	return host, err
+}
+
+// pathChange is a change of the local address between two requests.
+// Migrated is set when the request after the change still went over the
+// existing QUIC connection, i.e. the connection moved to the new path
+// instead of being dialed again.
+type pathChange struct {
+	At       time.Time
+	From, To string
+	Migrated bool
+}
+
+func (c pathChange) String() string {
+	outcome := "new connection"
+	if c.Migrated {
+		outcome = "connection migrated"
+	}
+	return fmt.Sprintf("%s -> %s at %s (%s)", c.From, c.To, c.At.Format("15:04:05"), outcome)
+}
+
+// pathWatcher samples the local address after each request and keeps the
+// changes it sees.
+type pathWatcher struct {
+	mu      sync.Mutex
+	probe   pathProbe
+	current string
+	changes []pathChange
+}
+
+// maxPathChanges is how many path changes the watcher keeps.
+const maxPathChanges = 10
+
+func newPathWatcher(probe pathProbe) *pathWatcher {
+	return &pathWatcher{probe: probe}
+}
+
+// Sample records the path to remote after a request that reused the
+// connection or not, and returns the change if the path is not the one
+// seen last time.
+func (w *pathWatcher) Sample(remote string, reused bool, now time.Time) (pathChange, bool) {
+	addr, err := w.probe.LocalAddr(remote)
+	if err != nil {
+		return pathChange{}, false
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	previous := w.current
+	w.current = addr
+	if previous == "" || previous == addr {
+		return pathChange{}, false
+	}
+	change := pathChange{At: now, From: previous, To: addr, Migrated: reused}
+	w.changes = append(w.changes, change)
+	if len(w.changes) > maxPathChanges {
+		w.changes = w.changes[1:]
+	}
+	return change, true
+}
+
+// Current returns the local address last seen and the changes so far,
+// oldest first.
+func (w *pathWatcher) Current() (string, []pathChange) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.current, append([]pathChange(nil), w.changes...)
+}
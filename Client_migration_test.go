@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// fakeProbe reports the addresses in addrs one per call, repeating the
+// last; an empty entry is a failed probe.
+type fakeProbe struct {
+	addrs []string
+	calls int
+}
+
+func (p *fakeProbe) LocalAddr(remote string) (string, error) {
+	addr := p.addrs[min(p.calls, len(p.addrs)-1)]
+	p.calls++
+	if addr == "" {
+		return "", errors.New("network is unreachable")
+	}
+	return addr, nil
+}
+
+func TestPathWatcherReportsChanges(t *testing.T) {
+	probe := &fakeProbe{addrs: []string{"192.168.1.20", "192.168.1.20", "", "10.0.0.7", "10.0.0.7", "192.168.1.20"}}
+	w := newPathWatcher(probe)
+	now := time.Date(2024, 6, 1, 9, 30, 0, 0, time.UTC)
+
+	if _, changed := w.Sample("example.com:443", false, now); changed {
+		t.Error("first sample reported a change")
+	}
+	if _, changed := w.Sample("example.com:443", true, now); changed {
+		t.Error("same address reported a change")
+	}
+	if _, changed := w.Sample("example.com:443", true, now); changed {
+		t.Error("failed probe reported a change")
+	}
+
+	// Wi-Fi to mobile, with the next request on the same connection.
+	change, changed := w.Sample("example.com:443", true, now.Add(time.Minute))
+	want := pathChange{At: now.Add(time.Minute), From: "192.168.1.20", To: "10.0.0.7", Migrated: true}
+	if !changed || change != want {
+		t.Fatalf("got %+v, %v", change, changed)
+	}
+	if got := change.String(); got != "192.168.1.20 -> 10.0.0.7 at 09:31:00 (connection migrated)" {
+		t.Errorf("String() = %q", got)
+	}
+
+	w.Sample("example.com:443", true, now)
+	change, _ = w.Sample("example.com:443", false, now.Add(2*time.Minute))
+	if change.Migrated || change.String() != "10.0.0.7 -> 192.168.1.20 at 09:32:00 (new connection)" {
+		t.Errorf("redialed change %+v", change)
+	}
+
+	current, changes := w.Current()
+	if current != "192.168.1.20" || len(changes) != 2 || changes[0] != want {
+		t.Errorf("Current() = %q, %+v", current, changes)
+	}
+	changes[0].From = "edited"
+	if _, again := w.Current(); again[0].From != "192.168.1.20" {
+		t.Error("Current returned the watcher's own slice")
+	}
+}
+
+func TestPathWatcherKeepsRecentChanges(t *testing.T) {
+	var addrs []string
+	for i := range maxPathChanges + 5 {
+		addrs = append(addrs, fmt.Sprintf("10.0.0.%d", i))
+	}
+	w := newPathWatcher(&fakeProbe{addrs: addrs})
+	for range addrs {
+		w.Sample("example.com", false, time.Now())
+	}
+	_, changes := w.Current()
+	if len(changes) != maxPathChanges || changes[0].From != "10.0.0.4" || changes[len(changes)-1].To != addrs[len(addrs)-1] {
+		t.Errorf("kept %d changes, from %s to %s", len(changes), changes[0].From, changes[len(changes)-1].To)
+	}
+}
+
+func TestUDPPathProbe(t *testing.T) {
+	for _, remote := range []string{"127.0.0.1", "127.0.0.1:4433"} {
+		if addr, err := (udpPathProbe{}).LocalAddr(remote); err != nil || addr != "127.0.0.1" {
+			t.Errorf("LocalAddr(%q) = %q, %v", remote, addr, err)
+		}
+	}
+}
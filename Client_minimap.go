@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// minimapMinLines is how long the output must be before the minimap is
+// shown; shorter output fits on screen or scrolls quickly enough.
+const minimapMinLines = 60
+
+// minimapLine maps a point y down a minimap height tall to the output
+// line it stands for, out of lines. Every line gets an equal share of the
+// height, so a long output packs several lines into a pixel and a short
+// one spreads a line over several. Points past either end land on the
+// first or last line.
+func minimapLine(y, height float32, lines int) int {
+	if lines <= 0 || height <= 0 {
+		return 0
+	}
+	return max(0, min(int(y/height*float32(lines)), lines-1))
+}
+
+// minimapRows condenses the line lengths into rows rows for drawing. Each
+// row shows the longest line it covers, as a fraction of the longest line
+// overall, so the shape of the output stays visible at any size.
+func minimapRows(lengths []int, rows int) []float32 {
+	if rows <= 0 || len(lengths) == 0 {
+		return nil
+	}
+	widest := 1
+	for _, n := range lengths {
+		widest = max(widest, n)
+	}
+	out := make([]float32, rows)
+	for row := range out {
+		from := row * len(lengths) / rows
+		to := max(from+1, (row+1)*len(lengths)/rows)
+		longest := 0
+		for _, n := range lengths[from:to] {
+			longest = max(longest, n)
+		}
+		out[row] = float32(longest) / float32(widest)
+	}
+	return out
+}
+
+// lineLengths returns the length in runes of each line of text.
+func lineLengths(text string) []int {
+	lines := strings.Split(text, "\n")
+	lengths := make([]int, len(lines))
+	for i, line := range lines {
+		lengths[i] = utf8.RuneCountInString(line)
+	}
+	return lengths
+}
+
+// lineOffset returns the rune offset at which line starts in text whose
+// lines have the given lengths, counting the newline after each. This is
+// the position the output editor's caret is moved to when jumping there.
+func lineOffset(lengths []int, line int) int {
+	offset := 0
+	for _, n := range lengths[:max(0, min(line, len(lengths)))] {
+		offset += n + 1
+	}
+	return offset
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestMinimapLine(t *testing.T) {
+	tests := []struct {
+		y, height float32
+		lines     int
+		want      int
+	}{
+		// A long output packs many lines into each pixel.
+		{0, 400, 100000, 0},
+		{200, 400, 100000, 50000},
+		{399.99, 400, 100000, 99997},
+		{400, 400, 100000, 99999},
+		// A short one spreads each line over several pixels.
+		{0, 400, 4, 0},
+		{99, 400, 4, 0},
+		{100, 400, 4, 1},
+		{399, 400, 4, 3},
+		// Points past either end land on the first or last line.
+		{-50, 400, 10, 0},
+		{900, 400, 10, 9},
+		// Nothing to map.
+		{10, 400, 0, 0},
+		{10, 0, 10, 0},
+	}
+	for _, tt := range tests {
+		if got := minimapLine(tt.y, tt.height, tt.lines); got != tt.want {
+			t.Errorf("minimapLine(%v, %v, %d) = %d, want %d", tt.y, tt.height, tt.lines, got, tt.want)
+		}
+	}
+}
+
+func TestMinimapRoundTrip(t *testing.T) {
+	// Jumping to the row a line is drawn on lands on or just before it.
+	for _, lines := range []int{1, 7, 60, 1000, 123457} {
+		const height = 300
+		for _, line := range []int{0, lines / 3, lines - 1} {
+			y := (float32(line) + 0.5) / float32(lines) * height
+			if got := minimapLine(y, height, lines); got != line {
+				t.Errorf("%d lines: line %d drawn at %v maps back to %d", lines, line, y, got)
+			}
+		}
+	}
+}
+
+func TestMinimapRows(t *testing.T) {
+	// Each row shows the longest line it covers.
+	got := minimapRows([]int{10, 40, 0, 20, 5, 80, 0, 0}, 4)
+	if want := []float32{0.5, 0.25, 1, 0}; !slices.Equal(got, want) {
+		t.Errorf("condensed rows %v, want %v", got, want)
+	}
+	// More rows than lines repeats lines rather than leaving gaps.
+	got = minimapRows([]int{2, 4}, 4)
+	if want := []float32{0.5, 0.5, 1, 1}; !slices.Equal(got, want) {
+		t.Errorf("stretched rows %v, want %v", got, want)
+	}
+	if got := minimapRows([]int{0, 0}, 2); !slices.Equal(got, []float32{0, 0}) {
+		t.Errorf("blank lines %v", got)
+	}
+	if minimapRows(nil, 10) != nil || minimapRows([]int{1}, 0) != nil {
+		t.Error("rows for nothing")
+	}
+}
+
+func TestLineOffsets(t *testing.T) {
+	lengths := lineLengths("héllo\n\nwörld\nend")
+	if !slices.Equal(lengths, []int{5, 0, 5, 3}) {
+		t.Fatalf("lengths %v", lengths)
+	}
+	for line, want := range map[int]int{-1: 0, 0: 0, 1: 6, 2: 7, 3: 13, 4: 17, 99: 17} {
+		if got := lineOffset(lengths, line); got != want {
+			t.Errorf("lineOffset(%d) = %d, want %d", line, got, want)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"path"
+	"strings"
+)
+
+// inferOperation suggests the operation for a path typed into the
+// Directory field or picked in the file browser: list_files for a
+// directory, read_file for a file. isDir is set when the path is known to
+// be a directory, e.g. because it has been listed. Otherwise the path
+// decides: a trailing slash means a directory and a name with an extension
+// a file. Anything else, like "/data/build" or ".config", could be either
+// and gets no suggestion, returned as "".
+func inferOperation(p string, isDir bool) string {
+	p = strings.TrimSpace(p)
+	if p == "" {
+		return ""
+	}
+	if isDir || strings.HasSuffix(p, "/") || strings.HasSuffix(p, `\`) {
+		return "list_files"
+	}
+	base := path.Base(strings.ReplaceAll(p, `\`, "/"))
+	if base == "." || base == ".." {
+		return "list_files"
+	}
+	if ext := path.Ext(base); ext != "" && ext != base && len(ext) > 1 {
+		return "read_file"
+	}
+	return ""
+}
@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestInferOperation(t *testing.T) {
+	tests := []struct {
+		path  string
+		isDir bool
+		want  string
+	}{
+		// Directories.
+		{"/data/logs/", false, "list_files"},
+		{`C:\data\logs\`, false, "list_files"},
+		{"/", false, "list_files"},
+		{"/data/v1.2/", false, "list_files"},
+		{".", false, "list_files"},
+		{"/data/..", false, "list_files"},
+		{"/data/build", true, "list_files"},
+		{"/data/archive.d", true, "list_files"},
+		// Files.
+		{"/data/notes.txt", false, "read_file"},
+		{"  /data/report.csv  ", false, "read_file"},
+		{`C:\data\app.log`, false, "read_file"},
+		{"/data/backup.tar.gz", false, "read_file"},
+		{"/data/v1.2/config.json", false, "read_file"},
+		// Ambiguous.
+		{"", false, ""},
+		{"   ", true, ""},
+		{"/data/build", false, ""},
+		{"/data/.config", false, ""},
+		{"/data/name.", false, ""},
+		{"Makefile", false, ""},
+	}
+	for _, tt := range tests {
+		if got := inferOperation(tt.path, tt.isDir); got != tt.want {
+			t.Errorf("inferOperation(%q, %v) = %q, want %q", tt.path, tt.isDir, got, tt.want)
+		}
+	}
+}
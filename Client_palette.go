@@ -0,0 +1,119 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// paletteOperations are the operations the command palette offers, in the
+// order of the operation selector.
+var paletteOperations = []string{"list_files", "read_file", "write_file", "create_folder", "disk_usage"}
+
+// maxRecentPaths is how many recently used paths the palette remembers.
+const maxRecentPaths = 10
+
+// paletteCommand is one entry of the command palette. An empty Path keeps
+// whatever is in the Directory field.
+type paletteCommand struct {
+	Label     string
+	Operation string
+	Path      string
+}
+
+// paletteCommands lists every operation on its own, then list_files and
+// read_file for each bookmark, in the user's order, and for each recent
+// path, most recent first. A labelled bookmark matches by its label and
+// its path.
+func paletteCommands(recent []string, bookmarks []bookmark) []paletteCommand {
+	commands := make([]paletteCommand, 0, len(paletteOperations)+2*len(bookmarks)+2*len(recent))
+	for _, op := range paletteOperations {
+		commands = append(commands, paletteCommand{Label: op, Operation: op})
+	}
+	for _, b := range bookmarks {
+		name := b.Path
+		if b.Label != "" {
+			name = b.Label + " (" + b.Path + ")"
+		}
+		for _, op := range []string{"list_files", "read_file"} {
+			commands = append(commands, paletteCommand{Label: op + " " + name, Operation: op, Path: b.Path})
+		}
+	}
+	for _, p := range recent {
+		for _, op := range []string{"list_files", "read_file"} {
+			commands = append(commands, paletteCommand{Label: op + " " + p, Operation: op, Path: p})
+		}
+	}
+	return commands
+}
+
+// rememberPath moves p to the front of recent, dropping the oldest entry
+// beyond maxRecentPaths.
+func rememberPath(recent []string, p string) []string {
+	if p == "" {
+		return recent
+	}
+	out := []string{p}
+	for _, r := range recent {
+		if r != p && len(out) < maxRecentPaths {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// fuzzyScore matches query against candidate as a case-insensitive
+// subsequence. Matches at the start of the candidate, after a separator or
+// straight after the previous match score higher, and gaps between matches
+// cost a little. ok is false when the query does not occur in order.
+func fuzzyScore(query, candidate string) (score int, ok bool) {
+	q := []rune(strings.ToLower(query))
+	c := []rune(strings.ToLower(candidate))
+	if len(q) == 0 {
+		return 0, true
+	}
+
+	qi, last := 0, -1
+	for ci := 0; ci < len(c) && qi < len(q); ci++ {
+		if c[ci] != q[qi] {
+			continue
+		}
+		score++
+		switch {
+		case ci == 0:
+			score += 8
+		case last == ci-1:
+			score += 5
+		case strings.ContainsRune(" _-/.", c[ci-1]):
+			score += 4
+		}
+		if last >= 0 {
+			score -= min(ci-last-1, 3)
+		}
+		last = ci
+		qi++
+	}
+	if qi < len(q) {
+		return 0, false
+	}
+	return score, true
+}
+
+// rankCandidates returns the indexes of the candidates that match query,
+// best first. Equal scores keep their original order, so recent paths stay
+// ahead of older ones.
+func rankCandidates(query string, candidates []string) []int {
+	type match struct{ index, score int }
+	var matches []match
+	for i, c := range candidates {
+		if score, ok := fuzzyScore(query, c); ok {
+			matches = append(matches, match{i, score})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].score > matches[j].score })
+
+	ranked := make([]int, len(matches))
+	for i, m := range matches {
+		ranked[i] = m.index
+	}
+	return ranked
+}
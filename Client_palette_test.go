@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestFuzzyScore(t *testing.T) {
+	if _, ok := fuzzyScore("fr", "read_file"); ok {
+		t.Error("out-of-order query matched")
+	}
+	if score, ok := fuzzyScore("", "anything"); !ok || score != 0 {
+		t.Errorf("empty query = %d, %v", score, ok)
+	}
+	prefix, _ := fuzzyScore("read", "read_file")
+	inner, _ := fuzzyScore("read", "thread")
+	if prefix <= inner {
+		t.Errorf("prefix match scored %d, inner match %d", prefix, inner)
+	}
+	upper, ok := fuzzyScore("READ", "read_file")
+	if !ok || upper != prefix {
+		t.Errorf("matching is case-sensitive: %d, %v", upper, ok)
+	}
+}
+
+func TestRankCandidates(t *testing.T) {
+	candidates := []string{"write_file", "read_file", "list_files", "create_folder"}
+	tests := []struct {
+		query string
+		want  []int
+	}{
+		// read_file matches at the start; the others tie and keep
+		// their order.
+		{"rf", []int{1, 0, 3}},
+		{"list", []int{2}},
+		{"", []int{0, 1, 2, 3}},
+		{"zz", []int{}},
+	}
+	for _, tt := range tests {
+		if got := rankCandidates(tt.query, candidates); !slices.Equal(got, tt.want) {
+			t.Errorf("rankCandidates(%q) = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestRememberPath(t *testing.T) {
+	recent := rememberPath([]string{"/a", "/b", "/c"}, "/b")
+	if want := []string{"/b", "/a", "/c"}; !slices.Equal(recent, want) {
+		t.Errorf("got %q, want %q", recent, want)
+	}
+	if got := rememberPath(recent, ""); !slices.Equal(got, recent) {
+		t.Errorf("empty path changed the list to %q", got)
+	}
+
+	recent = nil
+	for i := range maxRecentPaths + 2 {
+		recent = rememberPath(recent, fmt.Sprintf("/p%d", i))
+	}
+	if len(recent) != maxRecentPaths || recent[0] != fmt.Sprintf("/p%d", maxRecentPaths+1) {
+		t.Errorf("got %q", recent)
+	}
+}
+
+func TestPaletteCommands(t *testing.T) {
+	commands := paletteCommands([]string{"/recent"}, []bookmark{{Path: "/logs", Label: "Logs"}})
+	var labels []string
+	for _, c := range commands {
+		labels = append(labels, c.Label)
+	}
+	want := append(slices.Clone(paletteOperations),
+		"list_files Logs (/logs)", "read_file Logs (/logs)",
+		"list_files /recent", "read_file /recent")
+	if !slices.Equal(labels, want) {
+		t.Errorf("labels %q, want %q", labels, want)
+	}
+	if last := commands[len(commands)-1]; last.Operation != "read_file" || last.Path != "/recent" {
+		t.Errorf("last command %+v", last)
+	}
+}
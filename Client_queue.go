@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// queuedCommand is an operation waiting in, or running from, the command
+// queue. Label names it in the output, e.g. "list_files /data".
+type queuedCommand struct {
+	Label string
+	run   func(ctx context.Context)
+}
+
+// commandQueue runs the operations the user starts one at a time, in the
+// order they were started. The running one can be cancelled, which ends
+// the context its requests were made with, and the pending ones can be
+// dropped before they start. onChange is called whenever a command starts
+// or ends, so the queue's status can be redrawn.
+type commandQueue struct {
+	mu       sync.Mutex
+	wake     *sync.Cond
+	pending  []queuedCommand
+	current  *queuedCommand
+	cancel   context.CancelFunc
+	onChange func()
+}
+
+func newCommandQueue(onChange func()) *commandQueue {
+	q := &commandQueue{onChange: onChange}
+	q.wake = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *commandQueue) changed() {
+	if q.onChange != nil {
+		q.onChange()
+	}
+}
+
+// Push queues run under label.
+func (q *commandQueue) Push(label string, run func(ctx context.Context)) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pending = append(q.pending, queuedCommand{Label: label, run: run})
+	q.wake.Signal()
+}
+
+// next takes the first pending command, if any, and makes it the current
+// one with a context of its own.
+func (q *commandQueue) next() (queuedCommand, context.Context, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.pending) == 0 {
+		return queuedCommand{}, nil, false
+	}
+	cmd := q.pending[0]
+	q.pending = q.pending[1:]
+	ctx, cancel := context.WithCancel(context.Background())
+	q.current, q.cancel = &cmd, cancel
+	return cmd, ctx, true
+}
+
+// finish ends the current command.
+func (q *commandQueue) finish() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.cancel != nil {
+		q.cancel()
+	}
+	q.current, q.cancel = nil, nil
+}
+
+// Work runs the queued commands as they come, forever.
+func (q *commandQueue) Work() {
+	for {
+		q.mu.Lock()
+		for len(q.pending) == 0 {
+			q.wake.Wait()
+		}
+		q.mu.Unlock()
+
+		// The queue may have been cleared in between.
+		if cmd, ctx, ok := q.next(); ok {
+			q.changed()
+			cmd.run(ctx)
+			q.finish()
+			q.changed()
+		}
+	}
+}
+
+// CancelCurrent cancels the running command and returns its label. ok is
+// false when nothing is running. The pending commands are left to run.
+func (q *commandQueue) CancelCurrent() (label string, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.current == nil {
+		return "", false
+	}
+	q.cancel()
+	return q.current.Label, true
+}
+
+// ClearPending drops every command that has not started and returns
+// their labels, in queue order. The running command is left to finish.
+func (q *commandQueue) ClearPending() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	labels := make([]string, len(q.pending))
+	for i, cmd := range q.pending {
+		labels[i] = cmd.Label
+	}
+	q.pending = nil
+	return labels
+}
+
+// Status returns the label of the running command, "" when idle, and how
+// many are waiting behind it.
+func (q *commandQueue) Status() (current string, pending int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.current != nil {
+		current = q.current.Label
+	}
+	return current, len(q.pending)
+}
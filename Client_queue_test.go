@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// blockingJob returns a command that reports when it starts and then
+// waits for its context to end or for release to be closed. The context's
+// error, nil when released, is sent on done.
+func blockingJob(started chan<- string, label string, release <-chan struct{}, done chan<- error) func(ctx context.Context) {
+	return func(ctx context.Context) {
+		started <- label
+		select {
+		case <-ctx.Done():
+			done <- ctx.Err()
+		case <-release:
+			done <- nil
+		}
+	}
+}
+
+func waitStarted(t *testing.T, ch <-chan string, want string) {
+	t.Helper()
+	select {
+	case got := <-ch:
+		if got != want {
+			t.Fatalf("%q started, want %q", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%q never started", want)
+	}
+}
+
+func waitErr(t *testing.T, ch <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-ch:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("job never ended")
+		return nil
+	}
+}
+
+func TestCommandQueueCancelCurrent(t *testing.T) {
+	q := newCommandQueue(nil)
+	if _, ok := q.CancelCurrent(); ok {
+		t.Error("CancelCurrent on an idle queue reported a command")
+	}
+
+	started := make(chan string, 3)
+	done := make(chan error, 3)
+	release := make(chan struct{})
+	q.Push("list_files /a", blockingJob(started, "list_files /a", release, done))
+	q.Push("list_files /b", blockingJob(started, "list_files /b", release, done))
+	go q.Work()
+
+	waitStarted(t, started, "list_files /a")
+	if cur, pending := q.Status(); cur != "list_files /a" || pending != 1 {
+		t.Errorf("Status = %q, %d; want list_files /a, 1", cur, pending)
+	}
+	label, ok := q.CancelCurrent()
+	if !ok || label != "list_files /a" {
+		t.Errorf("CancelCurrent = %q, %v", label, ok)
+	}
+	if err := waitErr(t, done); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled job ended with %v, want context.Canceled", err)
+	}
+
+	// The next command still runs, with a context of its own.
+	waitStarted(t, started, "list_files /b")
+	close(release)
+	if err := waitErr(t, done); err != nil {
+		t.Errorf("second job ended with %v, want it to finish", err)
+	}
+}
+
+func TestCommandQueueClearPending(t *testing.T) {
+	changes := make(chan struct{}, 16)
+	q := newCommandQueue(func() { changes <- struct{}{} })
+	if labels := q.ClearPending(); len(labels) != 0 {
+		t.Errorf("ClearPending on an empty queue = %v", labels)
+	}
+
+	started := make(chan string, 4)
+	done := make(chan error, 4)
+	release := make(chan struct{})
+	q.Push("read_file /a", blockingJob(started, "read_file /a", release, done))
+	go q.Work()
+	waitStarted(t, started, "read_file /a")
+
+	q.Push("read_file /b", blockingJob(started, "read_file /b", release, done))
+	q.Push("read_file /c", blockingJob(started, "read_file /c", release, done))
+	got := q.ClearPending()
+	if want := []string{"read_file /b", "read_file /c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ClearPending = %v, want %v", got, want)
+	}
+	if cur, pending := q.Status(); cur != "read_file /a" || pending != 0 {
+		t.Errorf("Status after clearing = %q, %d; want read_file /a, 0", cur, pending)
+	}
+
+	// The running command is left to finish and nothing runs after it.
+	close(release)
+	if err := waitErr(t, done); err != nil {
+		t.Errorf("running job ended with %v, want it to finish", err)
+	}
+	// onChange is called as the command starts and again as it ends.
+	waitFor(t, "the queue to go idle", func() bool { return len(changes) == 2 })
+	if cur, pending := q.Status(); cur != "" || pending != 0 {
+		t.Errorf("Status when idle = %q, %d", cur, pending)
+	}
+	select {
+	case label := <-started:
+		t.Errorf("%q started after the queue was cleared", label)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestCancelAbandonsRequest(t *testing.T) {
+	inFlight := make(chan struct{})
+	term := keyTerminal(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		close(inFlight)
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	}))
+
+	q := newCommandQueue(nil)
+	result := make(chan error, 1)
+	q.Push("list_files /data", func(ctx context.Context) {
+		_, err := term.sendCommandContext(ctx, Command{Operation: "list_files", Parameters: map[string]string{"path": "/data"}})
+		result <- err
+	})
+	go q.Work()
+
+	select {
+	case <-inFlight:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request never sent")
+	}
+	if _, ok := q.CancelCurrent(); !ok {
+		t.Fatal("nothing to cancel")
+	}
+	select {
+	case err := <-result:
+		// The error is reported as text, not wrapped.
+		if err == nil || !strings.Contains(err.Error(), context.Canceled.Error()) {
+			t.Errorf("cancelled request returned %v, want %q", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancelled request never returned")
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// maxResponseBody bounds how much of a response the client reads into
+// memory. Anything larger is refused rather than read without limit.
+const maxResponseBody = 64 << 20
+
+// TruncatedError is a response that was cut off on the way, e.g. by the
+// connection dropping: the server may well have answered in full, so the
+// request is worth retrying. Expected is -1 when the server did not say
+// how long the body was.
+type TruncatedError struct {
+	Received int64
+	Expected int64
+	Err      error
+}
+
+func (e *TruncatedError) Error() string {
+	if e.Expected >= 0 {
+		return fmt.Sprintf("response cut off after %d of %d bytes; the connection dropped, retry the request", e.Received, e.Expected)
+	}
+	return fmt.Sprintf("response cut off after %d bytes; the connection dropped, retry the request", e.Received)
+}
+
+func (e *TruncatedError) Unwrap() error { return e.Err }
+
+// readResponseBody reads the body of resp, up to maxResponseBody. A read
+// that fails part way, or ends before the Content-Length the server sent,
+// is a *TruncatedError.
+func readResponseBody(resp *http.Response) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseBody+1))
+	if err != nil {
+		return nil, &TruncatedError{Received: int64(len(body)), Expected: resp.ContentLength, Err: err}
+	}
+	if len(body) > maxResponseBody {
+		return nil, fmt.Errorf("response is larger than %d bytes", maxResponseBody)
+	}
+	if resp.ContentLength >= 0 && int64(len(body)) < resp.ContentLength {
+		return nil, &TruncatedError{Received: int64(len(body)), Expected: resp.ContentLength, Err: io.ErrUnexpectedEOF}
+	}
+	return body, nil
+}
+
+// decodeResponse parses the JSON Response in body. JSON that stops part way
+// through a value is a *TruncatedError even when the transport did not
+// notice; anything else that is not a Response is the server's fault, and
+// the error says so with the status and the start of what was sent.
+func decodeResponse(body []byte, status string) (Response, error) {
+	var response Response
+	err := json.NewDecoder(bytes.NewReader(body)).Decode(&response)
+	switch {
+	case err == nil:
+		return response, nil
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return Response{}, &TruncatedError{Received: int64(len(body)), Expected: -1, Err: err}
+	case len(bytes.TrimSpace(body)) == 0:
+		return Response{}, fmt.Errorf("server sent an empty response (%s)", status)
+	}
+	snippet := strings.TrimSpace(string(body))
+	if len(snippet) > 80 {
+		snippet = snippet[:80] + "..."
+	}
+	return Response{}, fmt.Errorf("server sent an invalid response (%s): %v: %q", status, err, snippet)
+}
+
+// isTruncated reports whether err is a response cut off on the way.
+func isTruncated(err error) bool {
+	var truncated *TruncatedError
+	return errors.As(err, &truncated)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// roundTripFunc is an http.RoundTripper answering with a function.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+// brokenBody yields its data and then fails with err, as a body does when
+// the connection drops part way.
+type brokenBody struct {
+	r   io.Reader
+	err error
+}
+
+func (b *brokenBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err == io.EOF {
+		return n, b.err
+	}
+	return n, err
+}
+
+func (b *brokenBody) Close() error { return nil }
+
+// stubTerminal returns a Terminal whose requests are answered by rt.
+func stubTerminal(rt http.RoundTripper) *Terminal {
+	return &Terminal{client: &http.Client{Transport: rt}, conns: &connTracker{}}
+}
+
+const okResponse = `{"status":"success","data":["a.txt","b.txt"],"message":""}`
+
+func TestDoClassifiesResponses(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		body      io.ReadCloser
+		length    int64
+		truncated bool
+		errText   string
+	}{
+		{"complete", http.StatusOK, io.NopCloser(strings.NewReader(okResponse)), int64(len(okResponse)), false, ""},
+		{"short of Content-Length", http.StatusOK, io.NopCloser(strings.NewReader(okResponse[:20])), int64(len(okResponse)), true, fmt.Sprintf("cut off after 20 of %d bytes", len(okResponse))},
+		{"read error part way", http.StatusOK, &brokenBody{strings.NewReader(okResponse[:30]), syscall.ECONNRESET}, -1, true, "cut off after 30 bytes"},
+		{"JSON cut off", http.StatusOK, io.NopCloser(strings.NewReader(okResponse[:40])), -1, true, "cut off after 40 bytes"},
+		{"HTML error page", http.StatusBadGateway, io.NopCloser(strings.NewReader("<html>Bad Gateway</html>")), -1, false, "server sent an invalid response (502 Bad Gateway)"},
+		{"empty body", http.StatusBadGateway, io.NopCloser(strings.NewReader("")), 0, false, "server sent an empty response (502 Bad Gateway)"},
+	}
+	for _, tt := range tests {
+		term := stubTerminal(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode:    tt.status,
+				Status:        fmt.Sprintf("%d %s", tt.status, http.StatusText(tt.status)),
+				Body:          tt.body,
+				ContentLength: tt.length,
+				Header:        make(http.Header),
+				Request:       req,
+			}, nil
+		}))
+		req, err := http.NewRequest(http.MethodPost, "https://server/api/operation", strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := term.do(req)
+		if tt.errText == "" {
+			if err != nil || resp.Status != "success" {
+				t.Errorf("%s: %+v, %v", tt.name, resp, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: no error", tt.name)
+			continue
+		}
+		if isTruncated(err) != tt.truncated {
+			t.Errorf("%s: truncated %v, want %v: %v", tt.name, isTruncated(err), tt.truncated, err)
+		}
+		if !strings.Contains(err.Error(), tt.errText) {
+			t.Errorf("%s: error %q, want it to contain %q", tt.name, err, tt.errText)
+		}
+	}
+}
+
+func TestReadResponseBody(t *testing.T) {
+	var truncated *TruncatedError
+	_, err := readResponseBody(&http.Response{Body: &brokenBody{strings.NewReader("abc"), io.ErrUnexpectedEOF}, ContentLength: 10})
+	if !errors.As(err, &truncated) || truncated.Received != 3 || truncated.Expected != 10 || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("broken body: %#v", err)
+	}
+
+	big := io.LimitReader(zeroReader{}, maxResponseBody+1)
+	if _, err := readResponseBody(&http.Response{Body: io.NopCloser(big), ContentLength: -1}); err == nil || isTruncated(err) {
+		t.Errorf("oversized body: %v, want a size error", err)
+	}
+
+	body, err := readResponseBody(&http.Response{Body: io.NopCloser(strings.NewReader("abc")), ContentLength: 3})
+	if err != nil || string(body) != "abc" {
+		t.Errorf("complete body = %q, %v", body, err)
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// scriptStep is one operation of a script.
+type scriptStep struct {
+	Line       int               `json:"-"`
+	Operation  string            `json:"operation"`
+	Parameters map[string]string `json:"parameters"`
+	// IgnoreError lets the script go on when this step fails, even with
+	// stop-on-error set.
+	IgnoreError bool `json:"ignore_error"`
+}
+
+// scriptStepResult is the outcome of one step. A step that ran has either
+// a Response or an Err; steps after a failure that stopped the script are
+// Skipped.
+type scriptStepResult struct {
+	Step     scriptStep
+	Response Response
+	Err      error
+	Skipped  bool
+}
+
+// Failed reports whether the step ran and did not succeed.
+func (r scriptStepResult) Failed() bool {
+	return !r.Skipped && (r.Err != nil || r.Response.Status != "success")
+}
+
+var (
+	scriptOperation = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+	scriptParameter = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+)
+
+// parseScript reads a script in either of two forms. A JSON array of
+// steps:
+//
+//	[{"operation": "create_folder", "parameters": {"path": "/data/new"}}]
+//
+// or one step per line, an operation followed by key=value parameters,
+// with values quoted as Go strings when they hold spaces:
+//
+//	# comments and blank lines are ignored
+//	create_folder path=/data/new
+//	write_file path=/data/new/a.txt content="hello world\n"
+//	-read_file path=/data/maybe.txt
+//
+// A leading "-" marks a step whose failure does not stop the script. The
+// whole script is checked before anything runs; the first problem is
+// returned with its line number.
+func parseScript(src string) ([]scriptStep, error) {
+	if strings.HasPrefix(strings.TrimSpace(src), "[") {
+		var steps []scriptStep
+		if err := json.Unmarshal([]byte(src), &steps); err != nil {
+			return nil, fmt.Errorf("script: %v", err)
+		}
+		for i := range steps {
+			steps[i].Line = i + 1
+			if err := checkScriptStep(steps[i]); err != nil {
+				return nil, fmt.Errorf("step %d: %v", i+1, err)
+			}
+		}
+		if len(steps) == 0 {
+			return nil, fmt.Errorf("script has no steps")
+		}
+		return steps, nil
+	}
+
+	var steps []scriptStep
+	for i, line := range strings.Split(src, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		step, err := parseScriptLine(line)
+		if err == nil {
+			err = checkScriptStep(step)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		step.Line = i + 1
+		steps = append(steps, step)
+	}
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("script has no steps")
+	}
+	return steps, nil
+}
+
+func parseScriptLine(line string) (scriptStep, error) {
+	step := scriptStep{Parameters: make(map[string]string)}
+	if rest, ok := strings.CutPrefix(line, "-"); ok {
+		step.IgnoreError = true
+		line = rest
+	}
+
+	fields, err := splitScriptFields(line)
+	if err != nil {
+		return step, err
+	}
+	step.Operation = fields[0]
+	for _, f := range fields[1:] {
+		key, value, ok := strings.Cut(f, "=")
+		if !ok {
+			return step, fmt.Errorf("%q is not key=value", f)
+		}
+		if strings.HasPrefix(value, `"`) {
+			if value, err = strconv.Unquote(value); err != nil {
+				return step, fmt.Errorf("parameter %s: bad quoting", key)
+			}
+		}
+		if _, dup := step.Parameters[key]; dup {
+			return step, fmt.Errorf("parameter %s given twice", key)
+		}
+		step.Parameters[key] = value
+	}
+	return step, nil
+}
+
+// splitScriptFields splits line at spaces outside double quotes.
+func splitScriptFields(line string) ([]string, error) {
+	var fields []string
+	var current strings.Builder
+	quoted, escaped := false, false
+	for _, r := range line {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && r == '\\':
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+		case !quoted && (r == ' ' || r == '\t'):
+			if current.Len() > 0 {
+				fields = append(fields, current.String())
+				current.Reset()
+			}
+			continue
+		}
+		current.WriteRune(r)
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	if current.Len() > 0 {
+		fields = append(fields, current.String())
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("missing operation")
+	}
+	return fields, nil
+}
+
+func checkScriptStep(step scriptStep) error {
+	if !scriptOperation.MatchString(step.Operation) {
+		return fmt.Errorf("%q is not an operation name", step.Operation)
+	}
+	for key := range step.Parameters {
+		if !scriptParameter.MatchString(key) {
+			return fmt.Errorf("%q is not a parameter name", key)
+		}
+	}
+	return nil
+}
+
+// runScript sends each step through send, in order, and reports every
+// result as it comes in. With stopOnError a failed step skips the rest,
+// unless it is marked IgnoreError.
+func runScript(steps []scriptStep, send func(Command) (Response, error), stopOnError bool, report func(scriptStepResult)) []scriptStepResult {
+	results := make([]scriptStepResult, 0, len(steps))
+	stopped := false
+	for _, step := range steps {
+		result := scriptStepResult{Step: step, Skipped: stopped}
+		if !stopped {
+			params := make(map[string]string, len(step.Parameters))
+			for k, v := range step.Parameters {
+				params[k] = v
+			}
+			if content, ok := params["content"]; ok {
+				setContent(Command{Parameters: params}, content)
+			}
+			result.Response, result.Err = send(Command{Operation: step.Operation, Parameters: params})
+			stopped = stopOnError && result.Failed() && !step.IgnoreError
+		}
+		results = append(results, result)
+		report(result)
+	}
+	return results
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"maps"
+	"strings"
+	"testing"
+)
+
+func TestParseScriptLines(t *testing.T) {
+	steps, err := parseScript(`
+# set up a folder
+create_folder path=/data/new
+write_file path=/data/new/a.txt content="hello world\n" durable=true
+
+-read_file	path="/data/with space.txt"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) != 3 {
+		t.Fatalf("got %d steps", len(steps))
+	}
+	if s := steps[0]; s.Operation != "create_folder" || s.Line != 3 || s.IgnoreError || !maps.Equal(s.Parameters, map[string]string{"path": "/data/new"}) {
+		t.Errorf("step 1: %+v", s)
+	}
+	if s := steps[1]; s.Parameters["content"] != "hello world\n" || s.Parameters["durable"] != "true" {
+		t.Errorf("step 2: %+v", s)
+	}
+	if s := steps[2]; s.Operation != "read_file" || s.Line != 6 || !s.IgnoreError || s.Parameters["path"] != "/data/with space.txt" {
+		t.Errorf("step 3: %+v", s)
+	}
+}
+
+func TestParseScriptJSON(t *testing.T) {
+	steps, err := parseScript(`[
+		{"operation": "create_folder", "parameters": {"path": "/data/new"}},
+		{"operation": "read_file", "parameters": {"path": "/x"}, "ignore_error": true}
+	]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) != 2 || steps[1].Line != 2 || !steps[1].IgnoreError || steps[0].Parameters["path"] != "/data/new" {
+		t.Errorf("got %+v", steps)
+	}
+}
+
+func TestParseScriptRejects(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		{"", "no steps"},
+		{"# only a comment\n", "no steps"},
+		{"[]", "no steps"},
+		{"list_files path=/a\nRead_File path=/b", "line 2:"},
+		{"read_file /b", "line 1: \"/b\" is not key=value"},
+		{`write_file path=/a content="open`, "unterminated quote"},
+		{`write_file path=/a content="bad\q"`, "bad quoting"},
+		{"read_file path=/a path=/b", "given twice"},
+		{"read_file Path=/a", "not a parameter name"},
+		{`[{"operation": "read_file"}, {"operation": "rm -rf"}]`, "step 2:"},
+		{`[{"operation": 1}]`, "script:"},
+	}
+	for _, tt := range tests {
+		_, err := parseScript(tt.src)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseScript(%q) = %v, want %q", tt.src, err, tt.want)
+		}
+	}
+}
+
+// scriptTransport answers each operation with its canned response, or a
+// success, and records what was sent.
+type scriptTransport struct {
+	responses map[string]Response
+	errs      map[string]error
+	sent      []Command
+}
+
+func (s *scriptTransport) send(cmd Command) (Response, error) {
+	s.sent = append(s.sent, cmd)
+	if err := s.errs[cmd.Operation]; err != nil {
+		return Response{}, err
+	}
+	if resp, ok := s.responses[cmd.Operation]; ok {
+		return resp, nil
+	}
+	return Response{Status: "success"}, nil
+}
+
+const failingScript = `create_folder path=/data/new
+write_file path=/data/new/a.txt content=hi
+read_file path=/data/missing.txt
+list_files path=/data/new`
+
+func TestRunScriptStopsOnError(t *testing.T) {
+	steps, err := parseScript(failingScript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := &scriptTransport{responses: map[string]Response{
+		"read_file": {Status: "error", Message: "file not found"},
+	}}
+	var reported []scriptStepResult
+	results := runScript(steps, tr.send, true, func(r scriptStepResult) { reported = append(reported, r) })
+
+	if len(tr.sent) != 3 {
+		t.Fatalf("sent %d commands after the failure", len(tr.sent))
+	}
+	if len(results) != 4 || len(reported) != 4 {
+		t.Fatalf("%d results, %d reported", len(results), len(reported))
+	}
+	for i, want := range []struct{ failed, skipped bool }{{false, false}, {false, false}, {true, false}, {false, true}} {
+		if results[i].Failed() != want.failed || results[i].Skipped != want.skipped {
+			t.Errorf("step %d: failed %v skipped %v", i+1, results[i].Failed(), results[i].Skipped)
+		}
+	}
+	if results[2].Response.Message != "file not found" || results[2].Step.Line != 3 {
+		t.Errorf("failed step %+v", results[2])
+	}
+	// Content goes out with its checksum, as the write_file command does.
+	if p := tr.sent[1].Parameters; p["content"] != "hi" || p["sha256"] != "8f434346648f6b96df89dda901c5176b10a6d83961dd3c1ac88b59b2dc327aa4" {
+		t.Errorf("write_file parameters %v", p)
+	}
+	if _, ok := steps[1].Parameters["sha256"]; ok {
+		t.Error("running the script changed its steps")
+	}
+}
+
+func TestRunScriptContinues(t *testing.T) {
+	steps, _ := parseScript(failingScript)
+	tr := &scriptTransport{errs: map[string]error{"read_file": errors.New("connection reset")}}
+	results := runScript(steps, tr.send, false, func(scriptStepResult) {})
+	if len(tr.sent) != 4 || !results[2].Failed() || results[3].Failed() {
+		t.Errorf("without stop-on-error: sent %d, results %+v", len(tr.sent), results)
+	}
+
+	// A step marked with "-" does not stop the script either.
+	steps, _ = parseScript(strings.Replace(failingScript, "read_file", "-read_file", 1))
+	tr = &scriptTransport{errs: map[string]error{"read_file": errors.New("connection reset")}}
+	runScript(steps, tr.send, true, func(scriptStepResult) {})
+	if len(tr.sent) != 4 {
+		t.Errorf("ignored failure stopped the script after %d steps", len(tr.sent))
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeLocalFile creates path with content, and any missing parents.
+func writeLocalFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPlanUploads(t *testing.T) {
+	dir := t.TempDir()
+	writeLocalFile(t, filepath.Join(dir, "single.txt"), "12345")
+	writeLocalFile(t, filepath.Join(dir, "site", "index.html"), "abc")
+	writeLocalFile(t, filepath.Join(dir, "site", "css", "main.css"), "ab")
+
+	steps, err := planUploads([]string{
+		filepath.Join(dir, "single.txt"),
+		"   ",
+		filepath.Join(dir, "site"),
+	}, "/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type step struct {
+		op, remote string
+		size       int64
+	}
+	want := []step{
+		{"write_file", "/data/single.txt", 5},
+		{"create_folder", "/data/site", 0},
+		{"create_folder", "/data/site/css", 0},
+		{"write_file", "/data/site/css/main.css", 2},
+		{"write_file", "/data/site/index.html", 3},
+	}
+	if len(steps) != len(want) {
+		t.Fatalf("got %d steps, want %d: %+v", len(steps), len(want), steps)
+	}
+	for i, s := range steps {
+		got := step{s.Command.Operation, s.Command.Parameters["path"], s.Size}
+		if got != want[i] {
+			t.Errorf("step %d = %+v, want %+v", i, got, want[i])
+		}
+		if s.Command.Operation == "write_file" && s.Local == "" {
+			t.Errorf("step %d has no local file", i)
+		}
+	}
+}
+
+func TestPlanUploadsMissingFile(t *testing.T) {
+	if _, err := planUploads([]string{filepath.Join(t.TempDir(), "missing")}, "/data"); err == nil {
+		t.Error("a missing local file was planned")
+	}
+}
+
+func TestSummarizeUploads(t *testing.T) {
+	results := []uploadResult{
+		{Step: writeStep("/home/a.txt", 1, "/data/a.txt")},
+		{Step: writeStep("/home/b.txt", 1, "/data/b.txt"), Err: errors.New("access denied")},
+		{Step: uploadStep{Command: Command{Operation: "create_folder", Parameters: map[string]string{"path": "/data/c"}}}, Err: errors.New("exists")},
+	}
+
+	got := summarizeUploads(results)
+	for _, want := range []string{
+		"1 of 3 succeeded",
+		"FAILED write_file /home/b.txt -> /data/b.txt: access denied",
+		"FAILED create_folder /data/c: exists",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("summary %q lacks %q", got, want)
+		}
+	}
+	if strings.Contains(got, "a.txt") {
+		t.Errorf("summary %q lists a step that succeeded", got)
+	}
+}
+
+func TestNextFocus(t *testing.T) {
+	tests := []struct {
+		current, n int
+		backward   bool
+		want       int
+	}{
+		{-1, 3, false, 0},
+		{-1, 3, true, 2},
+		{0, 3, false, 1},
+		{2, 3, false, 0},
+		{0, 3, true, 2},
+		{1, 3, true, 0},
+		{0, 1, false, 0},
+		{-1, 0, false, -1},
+	}
+	for _, tt := range tests {
+		if got := nextFocus(tt.current, tt.n, tt.backward); got != tt.want {
+			t.Errorf("nextFocus(%d, %d, %v) = %d, want %d", tt.current, tt.n, tt.backward, got, tt.want)
+		}
+	}
+}
+
+func TestCheckContentSize(t *testing.T) {
+	if err := checkContentSize("12345", 5); err != nil {
+		t.Errorf("content at the limit: %v", err)
+	}
+	if err := checkContentSize("123456", 5); err == nil {
+		t.Error("content over the limit was accepted")
+	}
+	if err := checkContentSize(strings.Repeat("x", 1<<20), 0); err != nil {
+		t.Errorf("content with no known limit: %v", err)
+	}
+}
+
+func TestLatencyWindow(t *testing.T) {
+	w := newLatencyWindow(3)
+	if w.Average() != 0 || len(w.Values()) != 0 {
+		t.Fatal("empty window is not empty")
+	}
+
+	w.Add(10 * time.Millisecond)
+	w.Add(20 * time.Millisecond)
+	if got, want := w.Values(), []time.Duration{10 * time.Millisecond, 20 * time.Millisecond}; !slices.Equal(got, want) {
+		t.Errorf("Values = %v, want %v", got, want)
+	}
+	if got := w.Average(); got != 15*time.Millisecond {
+		t.Errorf("Average = %v, want 15ms", got)
+	}
+
+	// Wrapping drops the oldest sample and keeps the order.
+	w.Add(30 * time.Millisecond)
+	w.Add(60 * time.Millisecond)
+	if got, want := w.Values(), []time.Duration{20 * time.Millisecond, 30 * time.Millisecond, 60 * time.Millisecond}; !slices.Equal(got, want) {
+		t.Errorf("Values after wrapping = %v, want %v", got, want)
+	}
+	if got := w.Average(); got != 110*time.Millisecond/3 {
+		t.Errorf("Average after wrapping = %v, want %v", got, 110*time.Millisecond/3)
+	}
+}
+
+func TestSparkline(t *testing.T) {
+	if got := sparkline(nil); got != "" {
+		t.Errorf("sparkline(nil) = %q", got)
+	}
+	if got := sparkline([]time.Duration{5, 5, 5}); got != "▁▁▁" {
+		t.Errorf("flat sparkline = %q, want ▁▁▁", got)
+	}
+	if got := sparkline([]time.Duration{0, 70, 35, 10}); got != "▁█▄▂" {
+		t.Errorf("sparkline = %q, want ▁█▄▂", got)
+	}
+}
+
+func TestRequestTimingString(t *testing.T) {
+	if got := (requestTiming{Total: 42 * time.Millisecond}).String(); got != "42ms" {
+		t.Errorf("reused connection: %q", got)
+	}
+	got := requestTiming{Connect: 30 * time.Millisecond, Total: 50 * time.Millisecond}.String()
+	if want := "50ms (connect 30ms, request 20ms)"; got != want {
+		t.Errorf("new connection: %q, want %q", got, want)
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		header       string
+		start, total int64
+		ok           bool
+	}{
+		{"bytes 100-199/1000", 100, 1000, true},
+		{"bytes 0-0/1", 0, 1, true},
+		{"bytes */1000", -1, 1000, true},
+		{"bytes 100-199/*", 0, 0, false},
+		{"items 0-1/2", 0, 0, false},
+		{"bytes 100/1000", 0, 0, false},
+		{"", 0, 0, false},
+	}
+	for _, tt := range tests {
+		start, total, err := parseContentRange(tt.header)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseContentRange(%q) error = %v, want ok %v", tt.header, err, tt.ok)
+			continue
+		}
+		if tt.ok && (start != tt.start || total != tt.total) {
+			t.Errorf("parseContentRange(%q) = %d, %d, want %d, %d", tt.header, start, total, tt.start, tt.total)
+		}
+	}
+}
+
+func TestListingCacheExpires(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := newListingCache(time.Minute)
+	c.now = func() time.Time { return now }
+
+	c.Put("/data/", "", json.RawMessage(`["a"]`))
+	if data, ok := c.Get("/data", ""); !ok || string(data) != `["a"]` {
+		t.Fatalf("Get = %s, %v", data, ok)
+	}
+	if _, ok := c.Get("/data", "*.txt"); ok {
+		t.Error("a listing with another filter was served")
+	}
+
+	now = now.Add(59 * time.Second)
+	if _, ok := c.Get("/data", ""); !ok {
+		t.Error("listing expired early")
+	}
+	now = now.Add(time.Second)
+	if _, ok := c.Get("/data", ""); ok {
+		t.Error("expired listing was served")
+	}
+}
+
+func TestListingCacheInvalidate(t *testing.T) {
+	c := newListingCache(time.Minute)
+	c.Put("/data", "", json.RawMessage(`[]`))
+	c.Put("/data", "*.txt", json.RawMessage(`[]`))
+	c.Put("/data/sub", "", json.RawMessage(`[]`))
+
+	c.Invalidate("/data/")
+	if _, ok := c.Get("/data", ""); ok {
+		t.Error("invalidated listing was served")
+	}
+	if _, ok := c.Get("/data", "*.txt"); ok {
+		t.Error("invalidated filtered listing was served")
+	}
+	if _, ok := c.Get("/data/sub", ""); !ok {
+		t.Error("listing of another directory was dropped")
+	}
+}
+
+func TestMutatedDirs(t *testing.T) {
+	cmd := func(op string, params map[string]string) Command {
+		return Command{Operation: op, Parameters: params}
+	}
+	tests := []struct {
+		cmd  Command
+		want []string
+	}{
+		{cmd("write_file", map[string]string{"path": "/data/a.txt"}), []string{"/data"}},
+		{cmd("create_folder", map[string]string{"path": "/data/new/"}), []string{"/data"}},
+		{cmd("copy_dir", map[string]string{"path": "/data/a", "destination": "/backup/a"}), []string{"/backup"}},
+		{cmd("move", map[string]string{"path": "/data/a.txt", "destination": "/archive/a.txt"}), []string{"/data", "/archive"}},
+		{cmd("read_file", map[string]string{"path": "/data/a.txt"}), nil},
+	}
+	for _, tt := range tests {
+		if got := mutatedDirs(tt.cmd); !slices.Equal(got, tt.want) {
+			t.Errorf("mutatedDirs(%s) = %q, want %q", tt.cmd.Operation, got, tt.want)
+		}
+	}
+}
+
+func TestSetContent(t *testing.T) {
+	cmd := Command{Operation: "write_file", Parameters: map[string]string{"path": "/data/a.txt"}}
+	setContent(cmd, "hello")
+	if cmd.Parameters["content"] != "hello" {
+		t.Errorf("content %q", cmd.Parameters["content"])
+	}
+	// sha256 of "hello".
+	if got, want := cmd.Parameters["sha256"], "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"; got != want {
+		t.Errorf("sha256 %q, want %q", got, want)
+	}
+}
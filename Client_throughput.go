@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// throughputWindow is how far back the rate of a transfer looks, so it
+// follows changes in speed without jumping with every chunk.
+const throughputWindow = 5 * time.Second
+
+// stallAfter is how long a transfer may go without moving a byte before it
+// is shown as stalled rather than with a rate.
+const stallAfter = 3 * time.Second
+
+// maxETA is the longest ETA worth showing. A rate that slow says more by
+// itself than a guess at the number of days left.
+const maxETA = 99 * time.Hour
+
+// transferSample is how many bytes a transfer had moved at a moment.
+type transferSample struct {
+	At    time.Time
+	Bytes int64
+}
+
+// transferStat is the throughput of a transfer as it is shown. HasETA is
+// false while the time left cannot be told: before any progress, while
+// stalled, or when the size of the transfer is unknown.
+type transferStat struct {
+	BytesPerSec float64
+	ETA         time.Duration
+	HasETA      bool
+	Stalled     bool
+	Done        bool
+}
+
+// transferStats works out the throughput at now from samples, oldest
+// first, of a transfer of total bytes (0 when unknown). The rate is over
+// the window ending at now, measured from the newest sample older than
+// the window, so a transfer that stops slows down to 0 instead of keeping
+// its last rate.
+func transferStats(samples []transferSample, total int64, now time.Time) transferStat {
+	if len(samples) == 0 {
+		return transferStat{}
+	}
+	last := samples[len(samples)-1]
+	if total > 0 && last.Bytes >= total {
+		return transferStat{HasETA: true, Done: true}
+	}
+
+	first := samples[0]
+	for _, s := range samples {
+		if now.Sub(s.At) < throughputWindow {
+			break
+		}
+		first = s
+	}
+	var stat transferStat
+	if elapsed := now.Sub(first.At).Seconds(); elapsed > 0 && last.Bytes > first.Bytes {
+		stat.BytesPerSec = float64(last.Bytes-first.Bytes) / elapsed
+	}
+	stat.Stalled = now.Sub(last.At) >= stallAfter
+	if stat.Stalled || stat.BytesPerSec <= 0 || total <= 0 {
+		return stat
+	}
+	eta := float64(total-last.Bytes) / stat.BytesPerSec
+	if eta < maxETA.Seconds() {
+		stat.ETA = time.Duration(eta * float64(time.Second)).Round(time.Second)
+		stat.HasETA = true
+	}
+	return stat
+}
+
+// transferRate collects the samples of one transfer for transferStats.
+type transferRate struct {
+	samples []transferSample
+}
+
+// Add records that the transfer had moved bytes at now. A count lower
+// than the last one means the transfer started over, and starts the
+// samples over with it.
+func (r *transferRate) Add(now time.Time, bytes int64) {
+	if n := len(r.samples); n > 0 && bytes < r.samples[n-1].Bytes {
+		r.samples = r.samples[:0]
+	}
+	r.samples = append(r.samples, transferSample{now, bytes})
+	// Keep the newest sample older than the window; it is where the
+	// window's rate is measured from.
+	i := 0
+	for i+1 < len(r.samples) && now.Sub(r.samples[i+1].At) >= throughputWindow {
+		i++
+	}
+	r.samples = r.samples[i:]
+}
+
+// Stats returns the throughput at now of a transfer of total bytes.
+func (r *transferRate) Stats(total int64, now time.Time) transferStat {
+	return transferStats(r.samples, total, now)
+}
+
+// formatThroughput renders s for the transfer lists, e.g.
+// "2.4 MB/s, ETA 1m5s". It is "" before anything was measured.
+func formatThroughput(s transferStat) string {
+	switch {
+	case s.Done:
+		return ""
+	case s.Stalled:
+		return "stalled"
+	case s.BytesPerSec <= 0:
+		return ""
+	case !s.HasETA:
+		return formatRate(s.BytesPerSec)
+	}
+	return fmt.Sprintf("%s, ETA %s", formatRate(s.BytesPerSec), s.ETA)
+}
+
+// formatRate renders a rate in bytes per second in the largest unit that
+// keeps it at or above 1.
+func formatRate(bytesPerSec float64) string {
+	switch {
+	case bytesPerSec >= 1e6:
+		return fmt.Sprintf("%.1f MB/s", bytesPerSec/1e6)
+	case bytesPerSec >= 1e3:
+		return fmt.Sprintf("%.1f kB/s", bytesPerSec/1e3)
+	}
+	return fmt.Sprintf("%.0f B/s", bytesPerSec)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// steadySamples returns one sample a second for n seconds of a transfer
+// moving rate bytes a second, starting at start.
+func steadySamples(start time.Time, n int, rate int64) []transferSample {
+	samples := make([]transferSample, n+1)
+	for i := range samples {
+		samples[i] = transferSample{start.Add(time.Duration(i) * time.Second), int64(i) * rate}
+	}
+	return samples
+}
+
+func TestTransferStatsSteady(t *testing.T) {
+	start := time.Unix(1000, 0)
+	samples := steadySamples(start, 10, 1e6)
+	now := start.Add(10 * time.Second)
+
+	s := transferStats(samples, 20e6, now)
+	if s.BytesPerSec != 1e6 || !s.HasETA || s.ETA != 10*time.Second || s.Stalled || s.Done {
+		t.Errorf("steady transfer: %+v", s)
+	}
+	if got := formatThroughput(s); got != "1.0 MB/s, ETA 10s" {
+		t.Errorf("formatted %q", got)
+	}
+
+	// The size is unknown: a rate but no ETA.
+	s = transferStats(samples, 0, now)
+	if s.BytesPerSec != 1e6 || s.HasETA {
+		t.Errorf("unknown size: %+v", s)
+	}
+	if got := formatThroughput(s); got != "1.0 MB/s" {
+		t.Errorf("formatted %q", got)
+	}
+
+	// Only the last window counts: a speed-up shows within it.
+	fast := append(steadySamples(start, 10, 1e3), steadySamples(start.Add(11*time.Second), 10, 1e6)[1:]...)
+	if s := transferStats(fast, 0, start.Add(21*time.Second)); math.Abs(s.BytesPerSec-1e6) > 1 {
+		t.Errorf("rate after a speed-up = %v, want 1e6", s.BytesPerSec)
+	}
+}
+
+func TestTransferStatsStall(t *testing.T) {
+	start := time.Unix(1000, 0)
+	samples := steadySamples(start, 4, 1e6)
+
+	s := transferStats(samples, 20e6, start.Add(4*time.Second+stallAfter))
+	if !s.Stalled || s.HasETA || s.ETA != 0 {
+		t.Errorf("stalled transfer: %+v", s)
+	}
+	if math.IsNaN(s.BytesPerSec) || math.IsInf(s.BytesPerSec, 0) {
+		t.Errorf("stalled rate %v", s.BytesPerSec)
+	}
+	if got := formatThroughput(s); got != "stalled" {
+		t.Errorf("formatted %q", got)
+	}
+
+	// Long after the last byte the rate has fallen to nothing.
+	if s := transferStats(samples, 20e6, start.Add(time.Minute)); s.BytesPerSec != 0 || s.HasETA {
+		t.Errorf("a minute into a stall: %+v", s)
+	}
+
+	// No progress at all since the start.
+	idle := []transferSample{{start, 0}, {start.Add(time.Second), 0}}
+	if s := transferStats(idle, 100, start.Add(time.Second)); s.BytesPerSec != 0 || s.HasETA || math.IsNaN(s.BytesPerSec) {
+		t.Errorf("no progress: %+v", s)
+	}
+
+	// A crawl slow enough to take past maxETA shows a rate but no ETA.
+	slow := []transferSample{{start, 0}, {start.Add(time.Second), 1}}
+	if s := transferStats(slow, 1e9, start.Add(time.Second)); s.HasETA {
+		t.Errorf("crawl: %+v", s)
+	}
+}
+
+func TestTransferStatsDone(t *testing.T) {
+	start := time.Unix(1000, 0)
+	samples := steadySamples(start, 10, 1e6)
+	s := transferStats(samples, 10e6, start.Add(time.Hour))
+	if !s.Done || !s.HasETA || s.ETA != 0 || s.Stalled {
+		t.Errorf("finished transfer: %+v", s)
+	}
+	if got := formatThroughput(s); got != "" {
+		t.Errorf("formatted %q", got)
+	}
+
+	for name, samples := range map[string][]transferSample{
+		"no samples":   nil,
+		"one sample":   {{start, 5}},
+		"zero elapsed": {{start, 0}, {start, 5}},
+	} {
+		s := transferStats(samples, 100, start)
+		if s.BytesPerSec != 0 || s.HasETA || math.IsNaN(s.BytesPerSec) {
+			t.Errorf("%s: %+v", name, s)
+		}
+	}
+}
+
+func TestTransferRate(t *testing.T) {
+	start := time.Unix(1000, 0)
+	var r transferRate
+	for i := 0; i <= 20; i++ {
+		r.Add(start.Add(time.Duration(i)*time.Second), int64(i)*1000)
+	}
+	// Only the window and the one sample before it are kept.
+	if len(r.samples) != 6 || r.samples[0].Bytes != 15000 {
+		t.Errorf("kept %d samples from %+v", len(r.samples), r.samples[0])
+	}
+	if s := r.Stats(0, start.Add(20*time.Second)); s.BytesPerSec != 1000 {
+		t.Errorf("rate %v, want 1000", s.BytesPerSec)
+	}
+
+	// A lower count means the transfer started over.
+	r.Add(start.Add(21*time.Second), 10)
+	if len(r.samples) != 1 || r.samples[0].Bytes != 10 {
+		t.Errorf("after a restart: %+v", r.samples)
+	}
+}
+
+func TestFormatRate(t *testing.T) {
+	for rate, want := range map[float64]string{
+		0:     "0 B/s",
+		999:   "999 B/s",
+		1500:  "1.5 kB/s",
+		2.4e6: "2.4 MB/s",
+	} {
+		if got := formatRate(rate); got != want {
+			t.Errorf("formatRate(%v) = %q, want %q", rate, got, want)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// transform rewrites the data of a response before it is displayed.
+type transform struct {
+	Name  string
+	Apply func(string) (string, error)
+}
+
+// ansiEscape matches terminal escape sequences: colours, cursor moves and
+// the like.
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;?]*[ -/]*[@-~]|\x1b\][^\x07]*\x07`)
+
+// builtinTransforms build each transform a Transforms line can name,
+// from the rest of the line.
+var builtinTransforms = map[string]func(arg string) (func(string) (string, error), error){
+	// pretty_json indents JSON; anything else is left as it is.
+	"pretty_json": func(string) (func(string) (string, error), error) {
+		return func(s string) (string, error) {
+			var out bytes.Buffer
+			if json.Indent(&out, []byte(s), "", "  ") != nil {
+				return s, nil
+			}
+			return out.String(), nil
+		}, nil
+	},
+	// unquote shows a JSON string, such as read_file's result, as the
+	// text it holds.
+	"unquote": func(string) (func(string) (string, error), error) {
+		return func(s string) (string, error) {
+			var text string
+			if json.Unmarshal([]byte(s), &text) != nil {
+				return s, nil
+			}
+			return text, nil
+		}, nil
+	},
+	// strip_ansi removes terminal escape sequences.
+	"strip_ansi": func(string) (func(string) (string, error), error) {
+		return func(s string) (string, error) {
+			return ansiEscape.ReplaceAllString(s, ""), nil
+		}, nil
+	},
+	// replace PATTERN => REPLACEMENT rewrites every match of a regular
+	// expression; the replacement may use $1 and ${name}.
+	"replace": func(arg string) (func(string) (string, error), error) {
+		pattern, replacement, ok := strings.Cut(arg, "=>")
+		if !ok {
+			return nil, fmt.Errorf("expected PATTERN => REPLACEMENT")
+		}
+		re, err := regexp.Compile(strings.TrimSpace(pattern))
+		if err != nil {
+			return nil, err
+		}
+		replacement = strings.TrimSpace(replacement)
+		return func(s string) (string, error) {
+			return re.ReplaceAllString(s, replacement), nil
+		}, nil
+	},
+}
+
+// parseTransforms reads one transform per line, a name followed by its
+// argument, skipping blank lines and ones starting with "#":
+//
+//	unquote
+//	strip_ansi
+//	replace \d{4}-\d{2}-\d{2} => <date>
+func parseTransforms(text string) ([]transform, error) {
+	var transforms []transform
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, arg, _ := strings.Cut(line, " ")
+		build, ok := builtinTransforms[name]
+		if !ok {
+			return nil, fmt.Errorf("transforms line %d: unknown transform %q", i+1, name)
+		}
+		apply, err := build(strings.TrimSpace(arg))
+		if err != nil {
+			return nil, fmt.Errorf("transforms line %d: %s: %v", i+1, name, err)
+		}
+		transforms = append(transforms, transform{Name: name, Apply: apply})
+	}
+	return transforms, nil
+}
+
+// applyTransforms runs data through each transform in turn. On the first
+// failure it returns the data as it came in, with the error naming the
+// transform.
+func applyTransforms(data string, transforms []transform) (string, error) {
+	out := data
+	for _, t := range transforms {
+		next, err := t.Apply(out)
+		if err != nil {
+			return data, fmt.Errorf("%s: %v", t.Name, err)
+		}
+		out = next
+	}
+	return out, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestChainedTransforms(t *testing.T) {
+	transforms, err := parseTransforms(`
+# show read_file results as plain, uncoloured text with dates masked
+unquote
+strip_ansi
+replace (\d{4})-\d{2}-\d{2} => $1-xx-xx
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(transforms) != 3 {
+		t.Fatalf("got %d transforms", len(transforms))
+	}
+
+	data := `"\u001b[31mERROR\u001b[0m 2024-06-01 disk full\n\u001b]0;title\u0007done 2023-12-31"`
+	got, err := applyTransforms(data, transforms)
+	if want := "ERROR 2024-xx-xx disk full\ndone 2023-xx-xx"; err != nil || got != want {
+		t.Errorf("got %q, %v; want %q", got, err, want)
+	}
+
+	// Order matters: replacing before unquoting works on the JSON text.
+	reversed := []transform{transforms[2], transforms[0]}
+	if got, _ := applyTransforms(`"2024-06-01"`, reversed); got != "2024-xx-xx" {
+		t.Errorf("reversed chain gave %q", got)
+	}
+}
+
+func TestPrettyJSONTransform(t *testing.T) {
+	transforms, _ := parseTransforms("pretty_json")
+	got, _ := applyTransforms(`{"a":[1,2]}`, transforms)
+	if got != "{\n  \"a\": [\n    1,\n    2\n  ]\n}" {
+		t.Errorf("got %q", got)
+	}
+	if got, _ := applyTransforms("not json", transforms); got != "not json" {
+		t.Errorf("non-JSON changed to %q", got)
+	}
+}
+
+func TestApplyTransformsFailure(t *testing.T) {
+	upper := transform{Name: "upper", Apply: func(s string) (string, error) { return strings.ToUpper(s), nil }}
+	broken := transform{Name: "broken", Apply: func(string) (string, error) { return "", errors.New("boom") }}
+	got, err := applyTransforms("data", []transform{upper, broken})
+	if got != "data" || err == nil || err.Error() != "broken: boom" {
+		t.Errorf("got %q, %v", got, err)
+	}
+	if got, err := applyTransforms("data", nil); got != "data" || err != nil {
+		t.Errorf("no transforms: %q, %v", got, err)
+	}
+}
+
+func TestParseTransformsErrors(t *testing.T) {
+	tests := []struct {
+		text, want string
+	}{
+		{"unquote\nshout", `transforms line 2: unknown transform "shout"`},
+		{"replace abc", "transforms line 1: replace: expected PATTERN => REPLACEMENT"},
+		{"replace ([a-z] => x", "transforms line 1: replace: error parsing regexp"},
+	}
+	for _, tt := range tests {
+		if _, err := parseTransforms(tt.text); err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+			t.Errorf("parseTransforms(%q) = %v, want %q", tt.text, err, tt.want)
+		}
+	}
+	if transforms, err := parseTransforms("\n# nothing\n"); err != nil || len(transforms) != 0 {
+		t.Errorf("empty: %v, %v", transforms, err)
+	}
+}
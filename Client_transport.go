@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/http3"
+)
+
+// transportSettings tunes the QUIC connection the client keeps open to the
+// server. They are read from transport.json next to the download list.
+type transportSettings struct {
+	// MaxIdleSeconds is how long an unused connection is kept before it
+	// is closed and the next request has to dial again.
+	MaxIdleSeconds int `json:"max_idle_seconds"`
+	// MaxStreams caps how many requests share the connection at once.
+	// Further requests wait for a stream to free up. Zero means no cap.
+	MaxStreams int `json:"max_streams"`
+	// KeepAliveSeconds is how often an idle connection sends a keep-alive.
+	// Keeping the NAT binding open lets the connection survive a brief
+	// network change instead of being dialed again. Zero disables it.
+	KeepAliveSeconds int `json:"keep_alive_seconds"`
+}
+
+func defaultTransportSettings() transportSettings {
+	return transportSettings{MaxIdleSeconds: 30, MaxStreams: 16, KeepAliveSeconds: 15}
+}
+
+// transportSettingsPath returns where the transport settings are kept.
+func transportSettingsPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "transport.json"
+	}
+	return filepath.Join(dir, "quic-ssh", "transport.json")
+}
+
+// loadTransportSettings returns the defaults overlaid with the settings in
+// path, if it exists and parses.
+func loadTransportSettings(path string) transportSettings {
+	s := defaultTransportSettings()
+	if data, err := os.ReadFile(path); err == nil {
+		json.Unmarshal(data, &s)
+	}
+	return s
+}
+
+// connTracker counts the QUIC connections the transport dials, so a request
+// can tell whether it went over the connection that was already open. It
+// also keeps the handshake time of the latest connection and the TLS state
+// of the latest response for the diagnostics panel.
+type connTracker struct {
+	dials     atomic.Int64
+	handshake atomic.Int64
+	tlsState  atomic.Pointer[tls.ConnectionState]
+}
+
+// dialed records a new connection.
+func (c *connTracker) dialed() {
+	c.dials.Add(1)
+}
+
+// handshook records how long a new connection took to complete its
+// handshake.
+func (c *connTracker) handshook(d time.Duration) {
+	c.handshake.Store(int64(d))
+}
+
+// observe records the TLS state a response arrived with.
+func (c *connTracker) observe(resp *http.Response) {
+	if resp.TLS != nil {
+		c.tlsState.Store(resp.TLS)
+	}
+}
+
+func (c *connTracker) TLSState() *tls.ConnectionState {
+	return c.tlsState.Load()
+}
+
+func (c *connTracker) HandshakeRTT() (time.Duration, bool) {
+	d := time.Duration(c.handshake.Load())
+	return d, d > 0
+}
+
+// track runs a request and reports whether it completed without dialing.
+// Requests running at the same time share the counter, so one that
+// overlaps a dial made for another may report a new connection too.
+func (c *connTracker) track(do func() error) (reused bool, err error) {
+	before := c.dials.Load()
+	err = do()
+	return c.dials.Load() == before, err
+}
+
+// quicConfig returns the QUIC settings s asks for.
+func quicConfig(s transportSettings) *quic.Config {
+	return &quic.Config{
+		MaxIdleTimeout:  time.Duration(s.MaxIdleSeconds) * time.Second,
+		KeepAlivePeriod: time.Duration(s.KeepAliveSeconds) * time.Second,
+	}
+}
+
+// newTransport builds the HTTP/3 transport from s, reporting every dial
+// to conns and presenting certs when the server asks for a certificate.
+func newTransport(s transportSettings, conns *connTracker, certs *clientCertificate) http.RoundTripper {
+	rt := &http3.RoundTripper{
+		TLSClientConfig: &tls.Config{GetClientCertificate: certs.get},
+		QuicConfig:      quicConfig(s),
+		Dial: func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+			conns.dialed()
+			start := time.Now()
+			conn, err := quic.DialAddrEarlyContext(ctx, addr, tlsCfg, cfg)
+			if err != nil {
+				return nil, err
+			}
+			// The dial returns before the handshake is done; it takes a
+			// round trip, so its duration stands in for the RTT.
+			go func() {
+				<-conn.HandshakeComplete().Done()
+				conns.handshook(time.Since(start))
+			}()
+			return conn, nil
+		},
+	}
+	if s.MaxStreams <= 0 {
+		return rt
+	}
+	return &streamLimiter{next: rt, slots: make(chan struct{}, s.MaxStreams)}
+}
+
+// streamLimiter holds requests back once every stream slot is taken.
+type streamLimiter struct {
+	next  http.RoundTripper
+	slots chan struct{}
+}
+
+func (l *streamLimiter) RoundTrip(req *http.Request) (*http.Response, error) {
+	select {
+	case l.slots <- struct{}{}:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	resp, err := l.next.RoundTrip(req)
+	if err != nil {
+		<-l.slots
+		return nil, err
+	}
+	// The stream stays busy until the body has been read and closed.
+	resp.Body = &releaseOnClose{ReadCloser: resp.Body, release: func() { <-l.slots }}
+	return resp, nil
+}
+
+type releaseOnClose struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (r *releaseOnClose) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(r.release)
+	return err
+}
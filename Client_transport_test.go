@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// countingClient returns a client for srv whose dials are reported to
+// conns, as newTransport's QUIC dialer reports them.
+func countingClient(conns *connTracker) *http.Client {
+	var d net.Dialer
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conns.dialed()
+			return d.DialContext(ctx, network, addr)
+		},
+	}}
+}
+
+func TestConnTrackerDetectsReuse(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+	conns := &connTracker{}
+	client := countingClient(conns)
+	get := func() error {
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			return err
+		}
+		io.Copy(io.Discard, resp.Body)
+		return resp.Body.Close()
+	}
+
+	for i, want := range []bool{false, true, true} {
+		reused, err := conns.track(get)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reused != want {
+			t.Errorf("request %d: reused %v, want %v", i, reused, want)
+		}
+	}
+	if n := conns.dials.Load(); n != 1 {
+		t.Errorf("%d connections dialed for sequential requests", n)
+	}
+
+	client.CloseIdleConnections()
+	if reused, _ := conns.track(get); reused {
+		t.Error("request after the connection closed reported reuse")
+	}
+}
+
+func TestConnTrackerHandshake(t *testing.T) {
+	conns := &connTracker{}
+	if _, ok := conns.HandshakeRTT(); ok {
+		t.Error("handshake time reported before any connection")
+	}
+	conns.handshook(25 * time.Millisecond)
+	if d, ok := conns.HandshakeRTT(); !ok || d != 25*time.Millisecond {
+		t.Errorf("HandshakeRTT = %v, %v", d, ok)
+	}
+}
+
+// stubTransport answers every request with an empty body.
+type stubTransport struct{}
+
+func (stubTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(http.NoBody), Request: req}, nil
+}
+
+func TestStreamLimiter(t *testing.T) {
+	l := &streamLimiter{next: stubTransport{}, slots: make(chan struct{}, 1)}
+	first, err := l.RoundTrip(httptest.NewRequest(http.MethodGet, "https://server/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The only stream is busy until the first body is closed.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := l.RoundTrip(httptest.NewRequest(http.MethodGet, "https://server/", nil).WithContext(ctx)); err != context.DeadlineExceeded {
+		t.Errorf("second request while the stream was busy: %v", err)
+	}
+
+	first.Body.Close()
+	first.Body.Close()
+	second, err := l.RoundTrip(httptest.NewRequest(http.MethodGet, "https://server/", nil))
+	if err != nil {
+		t.Fatalf("request after the stream freed up: %v", err)
+	}
+	second.Body.Close()
+	if len(l.slots) != 0 {
+		t.Errorf("%d slots still held", len(l.slots))
+	}
+}
+
+func TestLoadTransportSettings(t *testing.T) {
+	dir := t.TempDir()
+	if got := loadTransportSettings(filepath.Join(dir, "missing.json")); got != defaultTransportSettings() {
+		t.Errorf("missing file gave %+v", got)
+	}
+
+	path := filepath.Join(dir, "transport.json")
+	if err := os.WriteFile(path, []byte(`{"max_streams": 4}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	want := defaultTransportSettings()
+	want.MaxStreams = 4
+	if got := loadTransportSettings(path); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestQUICConfig(t *testing.T) {
+	c := quicConfig(defaultTransportSettings())
+	if c.MaxIdleTimeout != 30*time.Second || c.KeepAlivePeriod != 15*time.Second {
+		t.Errorf("defaults: idle %v, keep-alive %v", c.MaxIdleTimeout, c.KeepAlivePeriod)
+	}
+	if c := quicConfig(transportSettings{MaxIdleSeconds: 60}); c.KeepAlivePeriod != 0 {
+		t.Errorf("keep_alive_seconds 0 still sends keep-alives every %v", c.KeepAlivePeriod)
+	}
+}
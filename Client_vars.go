@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+var varName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// expandVars replaces each ${NAME} in s with its value from vars. "$$"
+// stands for a literal "$", so "$${NAME}" is left as "${NAME}"; any other
+// "$" is kept as it is. Every variable missing from vars is named in the
+// error, and nothing is expanded then, so a half-expanded path is never
+// sent.
+func expandVars(s string, vars map[string]string) (string, error) {
+	var out strings.Builder
+	var missing []string
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			out.WriteByte(s[i])
+			continue
+		}
+		switch s[i+1] {
+		case '$':
+			out.WriteByte('$')
+			i++
+		case '{':
+			end := strings.IndexByte(s[i+2:], '}')
+			if end < 0 {
+				return "", fmt.Errorf("unterminated ${ at position %d", i+1)
+			}
+			name := s[i+2 : i+2+end]
+			if !varName.MatchString(name) {
+				return "", fmt.Errorf("invalid variable name %q", name)
+			}
+			if value, ok := vars[name]; ok {
+				out.WriteString(value)
+			} else if !slices.Contains(missing, name) {
+				missing = append(missing, name)
+			}
+			i += 2 + end
+		default:
+			out.WriteByte('$')
+		}
+	}
+	if len(missing) > 0 {
+		return "", fmt.Errorf("undefined variable ${%s}", strings.Join(missing, "}, ${"))
+	}
+	return out.String(), nil
+}
+
+// builtinVars are the variables every path may use: USER and HOME for the
+// local user and DATE for today as 2006-01-02.
+func builtinVars(now time.Time) map[string]string {
+	vars := map[string]string{"DATE": now.Format("2006-01-02")}
+	if u, err := user.Current(); err == nil {
+		vars["USER"] = u.Username
+	} else if name := os.Getenv("USER"); name != "" {
+		vars["USER"] = name
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		vars["HOME"] = home
+	}
+	return vars
+}
+
+// parseVarDefs reads NAME=value lines, skipping blank lines and ones
+// starting with "#", and returns them over the built-in variables.
+func parseVarDefs(text string, builtins map[string]string) (map[string]string, error) {
+	vars := make(map[string]string, len(builtins))
+	for k, v := range builtins {
+		vars[k] = v
+	}
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		name = strings.TrimSpace(name)
+		if !ok || !varName.MatchString(name) {
+			return nil, fmt.Errorf("variables line %d: expected NAME=value", i+1)
+		}
+		vars[name] = strings.TrimSpace(value)
+	}
+	return vars, nil
+}
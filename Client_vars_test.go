@@ -0,0 +1,86 @@
+package main
+
+import (
+	"maps"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpandVars(t *testing.T) {
+	vars := map[string]string{"USER": "alice", "DATE": "2024-06-01", "EMPTY": "", "NESTED": "${USER}"}
+	tests := []struct {
+		in, want string
+	}{
+		{"/home/${USER}/logs/${DATE}.log", "/home/alice/logs/2024-06-01.log"},
+		{"/srv/${USER}${USER}", "/srv/alicealice"},
+		{"/srv/x${EMPTY}y", "/srv/xy"},
+		{"/srv/${NESTED}", "/srv/${USER}"},
+		{"/srv/no/vars", "/srv/no/vars"},
+		{"/srv/$${USER}", "/srv/${USER}"},
+		{"/srv/$$$${USER}", "/srv/$${USER}"},
+		{"/srv/$$${USER}", "/srv/$alice"},
+		{"/srv/$USER/price$5", "/srv/$USER/price$5"},
+		{"/srv/ends-with$", "/srv/ends-with$"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		got, err := expandVars(tt.in, vars)
+		if err != nil || got != tt.want {
+			t.Errorf("expandVars(%q) = %q, %v; want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestExpandVarsErrors(t *testing.T) {
+	vars := map[string]string{"USER": "alice"}
+	tests := []struct {
+		in, want string
+	}{
+		{"/srv/${PROJECT}/a.txt", "undefined variable ${PROJECT}"},
+		{"/srv/${A}/${USER}/${B}/${A}", "undefined variable ${A}, ${B}"},
+		{"/srv/${user}", "undefined variable ${user}"},
+		{"/srv/${USER", "unterminated ${ at position 6"},
+		{"/srv/${}", `invalid variable name ""`},
+		{"/srv/${1X}", `invalid variable name "1X"`},
+		{"/srv/${A B}", `invalid variable name "A B"`},
+	}
+	for _, tt := range tests {
+		got, err := expandVars(tt.in, vars)
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("expandVars(%q) = %q, %v; want error %q", tt.in, got, err, tt.want)
+		}
+		if got != "" {
+			t.Errorf("expandVars(%q) returned %q with its error", tt.in, got)
+		}
+	}
+}
+
+func TestParseVarDefs(t *testing.T) {
+	builtins := builtinVars(time.Date(2024, 6, 1, 23, 59, 0, 0, time.Local))
+	if builtins["DATE"] != "2024-06-01" {
+		t.Errorf("DATE = %q", builtins["DATE"])
+	}
+
+	vars, err := parseVarDefs("# project paths\n\nPROJECT = web \nDATE=pinned\nURL=http://x/?a=b\n", builtins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := maps.Clone(builtins)
+	want["PROJECT"], want["DATE"], want["URL"] = "web", "pinned", "http://x/?a=b"
+	if !maps.Equal(vars, want) {
+		t.Errorf("got %v, want %v", vars, want)
+	}
+	if builtins["DATE"] != "2024-06-01" {
+		t.Error("parseVarDefs changed the built-ins")
+	}
+
+	for _, text := range []string{"no equals sign", "A=1\n2B=x", "=value"} {
+		if _, err := parseVarDefs(text, builtins); err == nil || !strings.HasPrefix(err.Error(), "variables line") {
+			t.Errorf("parseVarDefs(%q) = %v", text, err)
+		}
+	}
+	if _, err := parseVarDefs("A=1\n2B=x", builtins); err.Error() != "variables line 2: expected NAME=value" {
+		t.Errorf("line number: %v", err)
+	}
+}
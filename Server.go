@@ -1,17 +1,61 @@
 package main
 
 import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"container/heap"
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"expvar"
 	"fmt"
+	"hash"
+	"io"
+	"io/fs"
 	"log"
+	"math"
+	"mime"
 	"net/http"
+	"net/http/pprof"
 	"os"
+	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/golang-jwt/jwt"
 	"github.com/lucas-clemente/quic-go/http3"
+	"golang.org/x/sync/singleflight"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
 )
 
 // Operation represents a validated command request
@@ -23,216 +67,7129 @@ type Operation struct {
 
 // Response represents the server's response
 type Response struct {
-	Status  string      `json:"status"`
-	Data    interface{} `json:"data"`
-	Message string      `json:"message"`
+	Status  string            `json:"status"`
+	Data    interface{}       `json:"data"`
+	Message string            `json:"message"`
+	Code    string            `json:"code,omitempty"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// OpError is an operation failure a client can act on: Code is one of the
+// code* constants below and stays stable while Message may be reworded.
+type OpError struct {
+	Code    string
+	Message string
+	Details map[string]string
+}
+
+func (e *OpError) Error() string {
+	return e.Message
+}
+
+// Error codes reported in Response.Code.
+const (
+	codeInvalidArgument  = "invalid_argument"
+	codeInvalidName      = "invalid_name"
+	codeInvalidToken     = "invalid_token"
+	codeBadSignature     = "bad_signature"
+	codePathDenied       = "path_denied"
+	codeTypeDenied       = "type_denied"
+	codePermissionDenied = "permission_denied"
+	codeNotAllowed       = "not_allowed"
+	codeArgumentDenied   = "argument_denied"
+	codeNotFound         = "not_found"
+	codeAlreadyExists    = "already_exists"
+	codeIsDirectory      = "is_directory"
+	codeTooLarge         = "too_large"
+	codeNoSpace          = "insufficient_storage"
+	codeChecksumMismatch = "checksum_mismatch"
+	codeConflict         = "conflict"
+	codeUnsupported      = "unsupported"
+	codeMaintenance      = "maintenance"
+	codeBusy             = "busy"
+	codeTooManyOps       = "too_many_operations"
+	codeInternal         = "internal"
+)
+
+// codeStatus maps each error code to the HTTP status it is sent with.
+var codeStatus = map[string]int{
+	codeInvalidArgument:  http.StatusBadRequest,
+	codeInvalidName:      http.StatusBadRequest,
+	codeInvalidToken:     http.StatusUnauthorized,
+	codeBadSignature:     http.StatusUnauthorized,
+	codePathDenied:       http.StatusForbidden,
+	codeTypeDenied:       http.StatusForbidden,
+	codePermissionDenied: http.StatusForbidden,
+	codeNotAllowed:       http.StatusForbidden,
+	codeArgumentDenied:   http.StatusForbidden,
+	codeNotFound:         http.StatusNotFound,
+	codeAlreadyExists:    http.StatusConflict,
+	codeIsDirectory:      http.StatusConflict,
+	codeTooLarge:         http.StatusRequestEntityTooLarge,
+	codeNoSpace:          http.StatusInsufficientStorage,
+	codeChecksumMismatch: http.StatusUnprocessableEntity,
+	codeConflict:         http.StatusConflict,
+	codeUnsupported:      http.StatusNotImplemented,
+	codeMaintenance:      http.StatusServiceUnavailable,
+	codeBusy:             http.StatusServiceUnavailable,
+	codeTooManyOps:       http.StatusTooManyRequests,
+	codeInternal:         http.StatusInternalServerError,
+}
+
+func opErrorf(code, format string, args ...interface{}) *OpError {
+	return &OpError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// asOpError returns err as an OpError, deriving a code for plain errors
+// from the filesystem error they wrap.
+func asOpError(err error) *OpError {
+	var opErr *OpError
+	if errors.As(err, &opErr) {
+		return opErr
+	}
+
+	code := codeInternal
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		code = codeNotFound
+	case errors.Is(err, fs.ErrExist):
+		code = codeAlreadyExists
+	case errors.Is(err, fs.ErrPermission):
+		code = codePermissionDenied
+	case isNoSpace(err):
+		return &OpError{Code: codeNoSpace, Message: "not enough space on the server: " + err.Error()}
+	}
+	return &OpError{Code: code, Message: err.Error()}
+}
+
+// errExists is the error of an exclusive create whose target is there
+// already.
+func errExists(path string) error {
+	return &OpError{
+		Code:    codeAlreadyExists,
+		Message: fmt.Sprintf("target already exists: %s", path),
+		Details: map[string]string{"path": path},
+	}
+}
+
+// checkNotDir fails with codeIsDirectory when info, the file at path, is
+// a directory, for the operations that read or write a file. Without it
+// they fail later with a bare "is a directory" from the system.
+func checkNotDir(path string, info os.FileInfo) error {
+	if info.IsDir() {
+		return &OpError{
+			Code:    codeIsDirectory,
+			Message: fmt.Sprintf("target is a directory: %s", path),
+			Details: map[string]string{"path": path},
+		}
+	}
+	return nil
+}
+
+// noSpaceErrors are the errors that mean the disk, or the server's quota
+// on it, is full. Server_windows.go adds the Windows ones.
+var noSpaceErrors = []error{syscall.ENOSPC, syscall.EDQUOT}
+
+func isNoSpace(err error) bool {
+	for _, target := range noSpaceErrors {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
 }
 
 // Config holds server configuration
 type Config struct {
-	AllowedPaths     []string          `json:"allowed_paths"`
+	AllowedPaths     []AllowedPath     `json:"allowed_paths"`
 	AllowedActions   map[string]bool   `json:"allowed_actions"`
-	MaxFileSize      int64            `json:"max_file_size"`
+	MaxFileSize      int64             `json:"max_file_size"`
 	AllowedFileTypes []string          `json:"allowed_file_types"`
+	AuditLogPath     string            `json:"audit_log_path"`
+	ActionAliases    map[string]string `json:"action_aliases"`
+	GRPCAddr         string            `json:"grpc_addr"`
+	// Permissions maps a role to the actions it may run and, for each, the
+	// path patterns it may run them on. "*" as an action covers every
+	// action. Patterns are absolute filepath.Match globs matched against the
+	// canonical path; a trailing "/**" matches a directory and everything
+	// below it. Without any permissions, every token may run every allowed
+	// action on every allowed path.
+	Permissions map[string]map[string][]string `json:"permissions"`
+	// BandwidthLimit caps file transfers in bytes per second, shared by all
+	// requests made with the same token subject. Zero means unlimited.
+	BandwidthLimit int64 `json:"bandwidth_limit"`
+	// ShutdownTimeout is how long, in seconds, a shutdown waits for
+	// operations in flight before closing the remaining connections.
+	ShutdownTimeout int `json:"shutdown_timeout"`
+	// CertWarnDays are the days before the certificate expires at which a
+	// warning is logged, each one once, e.g. [30, 7, 1].
+	CertWarnDays []int `json:"cert_warn_days"`
+	// MaxFolderDepth limits how many levels below its allowed root a
+	// folder may be created. Zero means no limit.
+	MaxFolderDepth int `json:"max_folder_depth"`
+	// Audience, when set, is the "aud" value every token must carry.
+	Audience string `json:"audience"`
+	// TokenFormat selects how bearer tokens are verified: "jwt", the
+	// default, for HMAC-signed JWTs under JWT_SECRET, or "paseto" for
+	// v2.public and v4.public tokens signed with PasetoPublicKey.
+	TokenFormat string `json:"token_format"`
+	// PasetoPublicKey is the hex-encoded Ed25519 key PASETO tokens are
+	// verified with.
+	PasetoPublicKey string `json:"paseto_public_key"`
+	// SigningKeys maps a token subject to the HMAC key its request bodies
+	// must be signed with. Subjects without a key send unsigned requests.
+	// gRPC requests cannot be signed, so subjects with a key cannot use it.
+	SigningKeys map[string]string `json:"signing_keys"`
+	// APIKeys are static keys accepted in the X-API-Key header alongside
+	// bearer tokens.
+	APIKeys []APIKey `json:"api_keys"`
+	// LogSampleRate logs one in every LogSampleRate successful requests;
+	// failed ones are always logged. Zero or one logs every request.
+	LogSampleRate int `json:"log_sample_rate"`
+	// MaxMode is the octal permission mask chmod may not exceed, e.g.
+	// "0775" to never make anything world-writable.
+	MaxMode string `json:"max_mode"`
+	// IdleShutdown shuts the server down, gracefully, after this many
+	// seconds without a request. Zero keeps it running.
+	IdleShutdown int `json:"idle_shutdown"`
+	// ExecCommands maps the command names exec accepts to the absolute
+	// path of the binary each runs. Exec runs nothing else.
+	ExecCommands map[string]string `json:"exec_commands"`
+	// ExecArgs limits the arguments each exec command accepts. A command
+	// without an entry takes no arguments at all.
+	ExecArgs map[string]ExecArgPolicy `json:"exec_args"`
+	// ExecTimeout is how long, in seconds, an exec may run before it is
+	// killed.
+	ExecTimeout int `json:"exec_timeout"`
+	// FollowMaxDuration is how long, in seconds, a follow may stream
+	// before the server ends it. Zero lets it run until the client goes.
+	FollowMaxDuration int `json:"follow_max_duration"`
+	// ReadBudget caps the bytes all buffered reads may hold in memory at
+	// once. A read that would go over it is refused; downloads through
+	// /api/file are streamed and do not count. Zero means no cap.
+	ReadBudget int64 `json:"read_budget"`
+	// StreamThreshold is the file size, in bytes, above which read_file
+	// on /api/operation sends the file as a raw stream even if the client
+	// did not ask for one, so large reads are never buffered whole. Zero
+	// streams only on request.
+	StreamThreshold int64 `json:"stream_threshold"`
+	// DeniedPatterns hide paths inside the allowed roots from every
+	// operation, e.g. "**/.git/**" or "**/secrets/*". Each is a glob in
+	// which "**" matches any number of directories, or a regular
+	// expression when it starts with "re:". A denied directory denies
+	// everything below it, and listings leave denied entries out.
+	DeniedPatterns []string `json:"denied_patterns"`
+	// MaxWalkEntries is the most entries one page of walk_dir returns;
+	// the rest of the tree is fetched with the cursor of the page.
+	MaxWalkEntries int `json:"max_walk_entries"`
+	// MaxConcurrentOps caps the operations that run at once, whichever
+	// API they come through. The rest wait and are admitted by priority,
+	// highest first. Zero means no cap.
+	MaxConcurrentOps int `json:"max_concurrent_ops"`
+	// MaxDuplicateScan is the most files find_duplicates looks at in one
+	// call; past it the result covers only the files scanned and says so.
+	MaxDuplicateScan int `json:"max_duplicate_scan"`
+	// MaxOpsPerClient caps the operations one token subject, or one
+	// credential without a subject, may have running or waiting at once
+	// over every API, so no client takes all of MaxConcurrentOps.
+	// Requests over it get 429. Zero means no cap.
+	MaxOpsPerClient int `json:"max_ops_per_client"`
+	// RoleOpLimits replace MaxOpsPerClient for tokens with the role; a
+	// token with several gets the most generous. Zero means no cap.
+	RoleOpLimits map[string]int `json:"role_op_limits"`
+	// ActionPriorities rank actions for admission under
+	// MaxConcurrentOps, from -maxPriority to maxPriority; actions not
+	// listed have priority 0. A token's numeric "priority" claim, when
+	// present, is used instead, limited to the same range.
+	ActionPriorities map[string]int `json:"action_priorities"`
+}
+
+// ExecArgPolicy is the arguments one exec command may be given, e.g. for
+// tail only "-n N" followed by a single allowed path:
+//
+//	{"flags": {"-n": "[0-9]{1,6}"}, "args": "path", "max_args": 1}
+type ExecArgPolicy struct {
+	// Flags maps each flag the command accepts to the pattern its value
+	// must match in full, given as the next argument or after "=". An
+	// empty pattern is a flag without a value.
+	Flags map[string]string `json:"flags"`
+	// Args is what the other arguments may be: "path" for paths inside
+	// the allowed roots, relative ones taken from the working directory,
+	// or a pattern each must match in full. Empty allows none.
+	Args string `json:"args"`
+	// MaxArgs caps the number of other arguments. Zero means no cap.
+	MaxArgs int `json:"max_args"`
+}
+
+// AllowedPath is a directory operations may reach and whether they may
+// change anything below it. In the config file a bare string stands for a
+// read-write root.
+type AllowedPath struct {
+	Path string `json:"path"`
+	Mode string `json:"mode"`
+}
+
+const (
+	modeReadOnly  = "ro"
+	modeReadWrite = "rw"
+)
+
+func (p *AllowedPath) UnmarshalJSON(data []byte) error {
+	var path string
+	if err := json.Unmarshal(data, &path); err == nil {
+		*p = AllowedPath{Path: path, Mode: modeReadWrite}
+		return nil
+	}
+	type plain AllowedPath
+	v := plain{Mode: modeReadWrite}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*p = AllowedPath(v)
+	return nil
+}
+
+var (
+	jwtSecret = []byte(os.Getenv("JWT_SECRET"))
+	// configPath names an optional JSON file that overrides the defaults
+	// below and receives changes made through /api/admin/config.
+	configPath = os.Getenv("CONFIG_FILE")
+)
+
+// liveConfig is the config in effect. A Config is never modified once it
+// is stored here: an update builds a new one and swaps it in, so readers
+// never wait for an update and an update never waits for requests in
+// flight.
+var liveConfig atomic.Pointer[Config]
+
+// configMu serializes updates, so two of them cannot both build on the
+// same config and lose one's changes.
+var configMu sync.Mutex
+
+// currentConfig returns the config in effect. Callers must not modify it.
+func currentConfig() *Config {
+	return liveConfig.Load()
+}
+
+// setConfig makes c the config in effect. The caller must hold configMu.
+func setConfig(c Config) {
+	liveConfig.Store(&c)
+}
+
+type configKey struct{}
+
+// withConfig gives the request the config in effect when it arrives, so
+// its handler reads one config throughout, even if an update is swapped in
+// while it runs. The helpers that check paths and permissions read the
+// config in effect when they are called, so a root an update removes is
+// refused from then on, also to a request already running.
+func withConfig(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), configKey{}, currentConfig())
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+}
+
+// configFrom returns the config ctx was given by withConfig, or the config
+// in effect for a context without one.
+func configFrom(ctx context.Context) *Config {
+	if c, ok := ctx.Value(configKey{}).(*Config); ok {
+		return c
+	}
+	return currentConfig()
+}
+
+// readConfigFile returns the defaults overlaid with the settings in
+// configPath, if it exists.
+func readConfigFile() (Config, error) {
+	c := defaultConfig()
+	if configPath == "" {
+		return c, nil
+	}
+	data, err := os.ReadFile(configPath)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return Config{}, err
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return Config{}, err
+	}
+	return c, nil
+}
+
+// reloadConfig re-reads CONFIG_FILE and swaps it in. It does not wait for
+// operations in flight: their handlers keep the config they started with,
+// while the path checks they make from then on apply the new one.
+func reloadConfig() error {
+	if configPath == "" {
+		return fmt.Errorf("no CONFIG_FILE configured")
+	}
+	next, err := readConfigFile()
+	if err != nil {
+		return err
+	}
+	if err := validateConfig(next); err != nil {
+		return err
+	}
+
+	configMu.Lock()
+	setConfig(next)
+	configMu.Unlock()
+	log.Println("Configuration reloaded from", configPath)
+	return nil
+}
+
+// saveConfigFile writes c to configPath, replacing it atomically. It does
+// nothing when no config file is configured.
+func saveConfigFile(c Config) error {
+	if configPath == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := configPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, configPath)
+}
+
+const (
+	certFile = "server.crt"
+	keyFile  = "server.key"
+)
+
+// serveGRPC runs the gRPC sidecar on addr. It is set by Server_grpc.go, so
+// the gRPC dependency is only needed by builds that include that file.
+var serveGRPC func(addr string) error
+
+// Set at build time with
+//
+//	go build -ldflags "-X main.version=v1.2.3 -X main.gitCommit=$(git rev-parse HEAD)"
+//
+// Values left empty are filled from the binary's embedded build info.
+var (
+	version   string
+	gitCommit string
+)
+
+func init() {
+	setConfig(defaultConfig())
+}
+
+// defaultConfig returns the built-in server configuration.
+func defaultConfig() Config {
+	return Config{
+		AllowedPaths: []AllowedPath{
+			{Path: "/var/www/public", Mode: modeReadWrite},
+			{Path: "/data/shared", Mode: modeReadWrite},
+		},
+		AllowedActions: map[string]bool{
+			"list_files":      true,
+			"read_file":       true,
+			"write_file":      true,
+			"create_folder":   true,
+			"disk_usage":      true,
+			"copy_dir":        true,
+			"manifest":        true,
+			"sync_plan":       true,
+			"read_multi":      true,
+			"dir_etag":        true,
+			"preview":         true,
+			"tar_stream":      true,
+			"follow":          true,
+			"search":          true,
+			"recent":          true,
+			"verify":          true,
+			"read_lines":      true,
+			"can_write":       true,
+			"walk_dir":        true,
+			"find_duplicates": true,
+			"line_count":      true,
+		},
+		MaxFileSize: 10 * 1024 * 1024, // 10MB
+		AllowedFileTypes: []string{
+			".txt", ".json", ".csv", ".log",
+		},
+		AuditLogPath: os.Getenv("AUDIT_LOG"),
+		GRPCAddr:     os.Getenv("GRPC_ADDR"),
+		ActionAliases: map[string]string{
+			"ls":    "list_files",
+			"cat":   "read_file",
+			"mkdir": "create_folder",
+		},
+		ShutdownTimeout:   30,
+		CertWarnDays:      []int{30, 7, 1},
+		MaxMode:           "0775",
+		ExecTimeout:       60,
+		FollowMaxDuration: 600,
+		MaxWalkEntries:    1000,
+		MaxDuplicateScan:  10000,
+		ActionPriorities: map[string]int{
+			"list_files":      1,
+			"dir_etag":        1,
+			"can_write":       1,
+			"preview":         1,
+			"read_lines":      1,
+			"line_count":      1,
+			"tar_stream":      -1,
+			"copy_dir":        -1,
+			"manifest":        -1,
+			"sync_plan":       -1,
+			"find_duplicates": -1,
+		},
+	}
+}
+
+// knownActions lists every action processOperation can dispatch.
+var knownActions = map[string]bool{
+	"list_files":      true,
+	"read_file":       true,
+	"write_file":      true,
+	"create_folder":   true,
+	"disk_usage":      true,
+	"rotate":          true,
+	"copy_dir":        true,
+	"manifest":        true,
+	"sync_plan":       true,
+	"read_multi":      true,
+	"dir_etag":        true,
+	"preview":         true,
+	"retype":          true,
+	"swap":            true,
+	"move":            true,
+	"tar_stream":      true,
+	"follow":          true,
+	"search":          true,
+	"recent":          true,
+	"chmod":           true,
+	"symlink":         true,
+	"verify":          true,
+	"exec":            true,
+	"read_lines":      true,
+	"can_write":       true,
+	"walk_dir":        true,
+	"find_duplicates": true,
+	"line_count":      true,
+}
+
+// mutatingActions lists the actions that change files and are refused
+// while the server is in maintenance mode.
+var mutatingActions = map[string]bool{
+	"write_file":    true,
+	"create_folder": true,
+	"rotate":        true,
+	"copy_dir":      true,
+	"retype":        true,
+	"swap":          true,
+	"move":          true,
+	"chmod":         true,
+	"symlink":       true,
+	"exec":          true,
 }
 
+// maintenance freezes writes, e.g. while a backup runs, without stopping
+// reads. It is toggled at runtime through /api/admin/maintenance or, where
+// supported, SIGUSR1.
+var maintenance atomic.Bool
+
+// maintenanceRetryAfter is the Retry-After, in seconds, sent with requests
+// refused for maintenance.
+const maintenanceRetryAfter = 60
+
 var (
-	config     Config
-	jwtSecret  = []byte(os.Getenv("JWT_SECRET"))
+	errNotAllowed  = opErrorf(codeNotAllowed, "Operation not allowed")
+	errMaintenance = opErrorf(codeMaintenance, "Server is in maintenance mode; writes are disabled")
+)
+
+// blockedByMaintenance reports whether action must be refused right now.
+func blockedByMaintenance(action string) bool {
+	return mutatingActions[action] && maintenance.Load()
+}
+
+// watchSignals toggles maintenance mode and reloads the config on platform
+// signals. It is set by Server_signal.go on systems that have them.
+var watchSignals func()
+
+// validateConfig rejects configurations that would misbehave at request
+// time rather than failing loudly at startup.
+func validateConfig(c Config) error {
+	if c.ShutdownTimeout < 0 {
+		return fmt.Errorf("shutdown_timeout must not be negative")
+	}
+	if c.MaxFolderDepth < 0 {
+		return fmt.Errorf("max_folder_depth must not be negative")
+	}
+	if c.LogSampleRate < 0 {
+		return fmt.Errorf("log_sample_rate must not be negative")
+	}
+	if c.IdleShutdown < 0 {
+		return fmt.Errorf("idle_shutdown must not be negative")
+	}
+	if c.ReadBudget < 0 {
+		return fmt.Errorf("read_budget must not be negative")
+	}
+	if c.StreamThreshold < 0 {
+		return fmt.Errorf("stream_threshold must not be negative")
+	}
+	if c.MaxWalkEntries <= 0 {
+		return fmt.Errorf("max_walk_entries must be positive")
+	}
+	if c.MaxDuplicateScan <= 0 {
+		return fmt.Errorf("max_duplicate_scan must be positive")
+	}
+	if c.MaxConcurrentOps < 0 {
+		return fmt.Errorf("max_concurrent_ops must not be negative")
+	}
+	if c.MaxOpsPerClient < 0 {
+		return fmt.Errorf("max_ops_per_client must not be negative")
+	}
+	for role, limit := range c.RoleOpLimits {
+		if role == "" {
+			return fmt.Errorf("role_op_limits: empty role name")
+		}
+		if limit < 0 {
+			return fmt.Errorf("role_op_limits: %s must not be negative", role)
+		}
+	}
+	for action, priority := range c.ActionPriorities {
+		if !knownActions[action] {
+			return fmt.Errorf("action_priorities: unknown action %q", action)
+		}
+		if priority < -maxPriority || priority > maxPriority {
+			return fmt.Errorf("action_priorities: %s must be between %d and %d", action, -maxPriority, maxPriority)
+		}
+	}
+	if c.ExecTimeout < 0 {
+		return fmt.Errorf("exec_timeout must not be negative")
+	}
+	if c.FollowMaxDuration < 0 {
+		return fmt.Errorf("follow_max_duration must not be negative")
+	}
+	for name, bin := range c.ExecCommands {
+		if !filepath.IsAbs(bin) {
+			return fmt.Errorf("exec_commands: %s must be an absolute path, got %q", name, bin)
+		}
+	}
+	for name, policy := range c.ExecArgs {
+		if _, ok := c.ExecCommands[name]; !ok {
+			return fmt.Errorf("exec_args: %s is not in exec_commands", name)
+		}
+		if err := policy.validate(); err != nil {
+			return fmt.Errorf("exec_args: %s: %v", name, err)
+		}
+	}
+	if _, err := tokenVerifierFor(c); err != nil {
+		return err
+	}
+	if _, err := parseMode(c.MaxMode); err != nil {
+		return fmt.Errorf("max_mode: %v", err)
+	}
+	for subject, key := range c.SigningKeys {
+		if key == "" {
+			return fmt.Errorf("signing_keys: empty key for %q", subject)
+		}
+	}
+	for i, key := range c.APIKeys {
+		if sum, err := hex.DecodeString(key.SHA256); err != nil || len(sum) != sha256.Size {
+			return fmt.Errorf("api_keys[%d]: sha256 must be a hex-encoded SHA-256 hash", i)
+		}
+		if key.Subject == "" {
+			return fmt.Errorf("api_keys[%d]: subject is required", i)
+		}
+	}
+	for _, days := range c.CertWarnDays {
+		if days <= 0 {
+			return fmt.Errorf("cert_warn_days must be positive")
+		}
+	}
+	for _, pattern := range c.DeniedPatterns {
+		if err := validateDeniedPattern(pattern); err != nil {
+			return fmt.Errorf("denied_patterns: %q: %v", pattern, err)
+		}
+	}
+	for _, p := range c.AllowedPaths {
+		if p.Mode != modeReadOnly && p.Mode != modeReadWrite {
+			return fmt.Errorf("allowed path %q has mode %q, want %q or %q", p.Path, p.Mode, modeReadOnly, modeReadWrite)
+		}
+	}
+	for alias, action := range c.ActionAliases {
+		if knownActions[alias] {
+			return fmt.Errorf("action alias %q shadows an existing action", alias)
+		}
+		if !knownActions[action] {
+			return fmt.Errorf("action alias %q points to unknown action %q", alias, action)
+		}
+	}
+	for role, rules := range c.Permissions {
+		if role == "" {
+			return fmt.Errorf("permissions: empty role name")
+		}
+		for action, patterns := range rules {
+			if action != "*" && !knownActions[action] {
+				return fmt.Errorf("permissions: role %q names unknown action %q", role, action)
+			}
+			for _, pattern := range patterns {
+				if !filepath.IsAbs(pattern) {
+					return fmt.Errorf("permissions: role %q: pattern %q is not absolute", role, pattern)
+				}
+				if _, err := filepath.Match(strings.TrimSuffix(pattern, "/**"), ""); err != nil {
+					return fmt.Errorf("permissions: role %q: invalid pattern %q", role, pattern)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// authorize decides whether the token with claims may run action on path.
+// The action must be enabled in AllowedActions and, when a permission
+// matrix is configured, one of the token's roles must grant it on a
+// pattern matching the canonical path. An empty path is only checked
+// against the action.
+func authorize(claims jwt.MapClaims, action, path string) error {
+	config := currentConfig()
+	if !config.AllowedActions[action] {
+		return errNotAllowed
+	}
+	if len(config.Permissions) == 0 {
+		return nil
+	}
+
+	canonical := ""
+	if path != "" {
+		var err error
+		if canonical, err = canonicalize(path); err != nil {
+			return err
+		}
+	}
+
+	for _, role := range claimRoles(claims) {
+		rules := config.Permissions[role]
+		for _, patterns := range [][]string{rules[action], rules["*"]} {
+			for _, pattern := range patterns {
+				if canonical == "" || matchPathPattern(pattern, canonical) {
+					return nil
+				}
+			}
+		}
+	}
+	if canonical == "" {
+		return errNotAllowed
+	}
+	return &OpError{
+		Code:    codePathDenied,
+		Message: fmt.Sprintf("%s is not permitted on %s", action, path),
+		Details: map[string]string{"path": path, "action": action},
+	}
+}
+
+// paramLimits caps the length, in bytes, of the operation parameters that
+// are resolved, parsed or compiled, so an oversized one is refused before
+// any work is done on it. Parameters not listed, such as content, are
+// bounded only by the request body limits.
+var paramLimits = map[string]int{
+	"path":        4096,
+	"destination": 4096,
+	"target":      4096,
+	"paths":       1 << 20,
+	"pattern":     1024,
+	"filter":      1024,
+	"cursor":      8192,
+	"command":     256,
+	"args":        64 << 10,
+	"extension":   255,
+	"checksum":    256,
+	"sha256":      256,
+	"if_match":    256,
+	"algorithm":   32,
+	"encoding":    64,
+	"line_ending": 16,
+	"mode":        16,
+	"within":      64,
+	"limit":       20,
+	"start":       20,
+	"count":       20,
+	"keep":        20,
+	"size":        20,
+	"max":         20,
+	"bytes":       20,
+	"max_seconds": 20,
+}
+
+// validateParameters refuses an operation with a parameter longer than its
+// paramLimits entry.
+func validateParameters(op Operation) error {
+	for name, value := range op.Parameters {
+		if limit, ok := paramLimits[name]; ok && len(value) > limit {
+			return &OpError{
+				Code:    codeInvalidArgument,
+				Message: fmt.Sprintf("parameter %s is %d bytes long; the limit is %d", name, len(value), limit),
+				Details: map[string]string{"parameter": name, "limit": strconv.Itoa(limit)},
+			}
+		}
+	}
+	return nil
+}
+
+// authorizeOperation runs authorize for every path op touches.
+func authorizeOperation(claims jwt.MapClaims, op Operation) error {
+	paths := []string{op.Parameters["path"]}
+	if dst := op.Parameters["destination"]; dst != "" {
+		paths = append(paths, dst)
+	}
+	if op.Action == "retype" {
+		if target, err := retypeTarget(op.Parameters["path"], op.Parameters["extension"]); err == nil {
+			paths = append(paths, target)
+		}
+	}
+	if op.Action == "symlink" && op.Parameters["target"] != "" {
+		paths = append(paths, symlinkTarget(op.Parameters["path"], op.Parameters["target"]))
+	}
+	if op.Action == "exec" {
+		// Path arguments need the same permission as the working
+		// directory; other argument problems are reported by exec.
+		var args []string
+		if json.Unmarshal([]byte(op.Parameters["args"]), &args) == nil {
+			if dir, err := canonicalize(op.Parameters["path"]); err == nil {
+				_, argPaths, _ := checkExecArgs(currentConfig().ExecArgs[op.Parameters["command"]], args, dir)
+				paths = append(paths, argPaths...)
+			}
+		}
+	}
+	if op.Action == "read_multi" {
+		var list []string
+		if err := json.Unmarshal([]byte(op.Parameters["paths"]), &list); err != nil {
+			return opErrorf(codeInvalidArgument, "paths must be a JSON array of strings: %v", err)
+		}
+		paths = append(paths, list...)
+	}
+
+	for _, p := range paths {
+		if err := authorize(claims, op.Action, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// claimRoles returns the roles in the token's "role" or "roles" claim.
+func claimRoles(claims jwt.MapClaims) []string {
+	var roles []string
+	for _, key := range []string{"role", "roles"} {
+		switch v := claims[key].(type) {
+		case string:
+			roles = append(roles, v)
+		case []interface{}:
+			for _, r := range v {
+				if s, ok := r.(string); ok {
+					roles = append(roles, s)
+				}
+			}
+		}
+	}
+	return roles
+}
+
+// matchPathPattern reports whether path matches a permission pattern.
+func matchPathPattern(pattern, path string) bool {
+	if dir, ok := strings.CutSuffix(pattern, "/**"); ok {
+		return isWithin(path, dir)
+	}
+	matched, _ := filepath.Match(pattern, path)
+	return matched
+}
+
+// resolveAction maps an alias to its canonical action name. Anything that is
+// not an alias is returned unchanged.
+func resolveAction(action string) string {
+	if canonical, ok := currentConfig().ActionAliases[action]; ok {
+		return canonical
+	}
+	return action
+}
+
+// tokenVerifier checks a bearer token's signature and time claims and
+// returns its claims. Every token format reports its claims as
+// jwt.MapClaims with the time claims in Unix seconds, so the rest of the
+// server does not care which format was used, and fails with a
+// *jwt.ValidationError so tokenFailure can name the reason.
+type tokenVerifier interface {
+	Verify(token string) (jwt.MapClaims, error)
+}
+
+// Token formats for Config.TokenFormat.
+const (
+	tokenFormatJWT    = "jwt"
+	tokenFormatPASETO = "paseto"
 )
 
-func init() {
-	// Initialize server configuration
-	config = Config{
-		AllowedPaths: []string{
-			"/var/www/public",
-			"/data/shared",
-		},
-		AllowedActions: map[string]bool{
-			"list_files":    true,
-			"read_file":     true,
-			"write_file":    true,
-			"create_folder": true,
-		},
-		MaxFileSize: 10 * 1024 * 1024, // 10MB
-		AllowedFileTypes: []string{
-			".txt", ".json", ".csv", ".log",
-		},
+// tokenVerifierFor returns the verifier c selects.
+func tokenVerifierFor(c Config) (tokenVerifier, error) {
+	switch c.TokenFormat {
+	case "", tokenFormatJWT:
+		return jwtVerifier{secret: jwtSecret}, nil
+	case tokenFormatPASETO:
+		key, err := hex.DecodeString(c.PasetoPublicKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("paseto_public_key must be a hex-encoded Ed25519 public key")
+		}
+		return pasetoVerifier{key: ed25519.PublicKey(key)}, nil
+	}
+	return nil, fmt.Errorf("token_format must be %q or %q", tokenFormatJWT, tokenFormatPASETO)
+}
+
+// jwtVerifier accepts JWTs signed with HMAC under secret.
+type jwtVerifier struct {
+	secret []byte
+}
+
+func (v jwtVerifier) Verify(token string) (jwt.MapClaims, error) {
+	parsed, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return v.secret, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	claims, _ := parsed.Claims.(jwt.MapClaims)
+	return claims, nil
+}
+
+// pasetoVerifier accepts v2.public and v4.public PASETO tokens signed with
+// the Ed25519 key. Their exp, nbf and iat claims are RFC 3339 times.
+type pasetoVerifier struct {
+	key ed25519.PublicKey
+}
+
+func (v pasetoVerifier) Verify(token string) (jwt.MapClaims, error) {
+	var header string
+	for _, h := range []string{"v2.public.", "v4.public."} {
+		if strings.HasPrefix(token, h) {
+			header = h
+		}
+	}
+	if header == "" {
+		return nil, jwt.NewValidationError("not a v2.public or v4.public token", jwt.ValidationErrorMalformed)
+	}
+
+	payload, footer, _ := strings.Cut(token[len(header):], ".")
+	signed, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil || len(signed) < ed25519.SignatureSize {
+		return nil, jwt.NewValidationError("token payload is malformed", jwt.ValidationErrorMalformed)
+	}
+	f, err := base64.RawURLEncoding.DecodeString(footer)
+	if err != nil {
+		return nil, jwt.NewValidationError("token footer is malformed", jwt.ValidationErrorMalformed)
+	}
+
+	msg, sig := signed[:len(signed)-ed25519.SignatureSize], signed[len(signed)-ed25519.SignatureSize:]
+	pieces := [][]byte{[]byte(header), msg, f}
+	if header == "v4.public." {
+		// v4 also signs the implicit assertion, which is empty here.
+		pieces = append(pieces, nil)
+	}
+	if !ed25519.Verify(v.key, preAuthEncode(pieces...), sig) {
+		return nil, jwt.NewValidationError("signature is invalid", jwt.ValidationErrorSignatureInvalid)
+	}
+
+	var claims jwt.MapClaims
+	if err := json.Unmarshal(msg, &claims); err != nil {
+		return nil, jwt.NewValidationError("token claims are malformed", jwt.ValidationErrorMalformed)
+	}
+	for _, key := range []string{"exp", "nbf", "iat"} {
+		s, ok := claims[key].(string)
+		if !ok {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return nil, jwt.NewValidationError(key+" is not an RFC 3339 time", jwt.ValidationErrorMalformed)
+		}
+		claims[key] = float64(t.Unix())
+	}
+	if err := claims.Valid(); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// preAuthEncode is PASETO's PAE: the number of pieces, then each piece
+// prefixed with its length, all lengths as 64-bit little-endian integers
+// with the top bit cleared.
+func preAuthEncode(pieces ...[]byte) []byte {
+	le64 := func(n int) []byte {
+		b := make([]byte, 8)
+		binary.LittleEndian.PutUint64(b, uint64(n)&math.MaxInt64)
+		return b
+	}
+	out := le64(len(pieces))
+	for _, p := range pieces {
+		out = append(out, le64(len(p))...)
+		out = append(out, p...)
+	}
+	return out
+}
+
+// validateToken verifies token with the configured verifier and, when
+// one is configured, checks its audience.
+func validateToken(token string) (jwt.MapClaims, error) {
+	config := currentConfig()
+	verifier, err := tokenVerifierFor(*config)
+	audience := config.Audience
+	if err != nil {
+		return nil, err
+	}
+
+	claims, err := verifier.Verify(token)
+	if err != nil {
+		return nil, err
+	}
+	if audience != "" && !claims.VerifyAudience(audience, true) {
+		return nil, jwt.NewValidationError("token is not meant for this server", jwt.ValidationErrorAudience)
+	}
+	return claims, nil
+}
+
+// apiKeyHeader is the header clients send an API key in.
+const apiKeyHeader = "X-API-Key"
+
+// APIKey is a static credential that stands for the subject, roles and
+// scope a token would carry, so Permissions and the admin scope apply to
+// it the same way. Only the hex SHA-256 of the key is stored, e.g. from
+// "printf %s KEY | sha256sum".
+type APIKey struct {
+	SHA256  string   `json:"sha256"`
+	Subject string   `json:"subject"`
+	Roles   []string `json:"roles"`
+	Scope   string   `json:"scope"`
+}
+
+// errInvalidAPIKey is returned for a key that matches no configured one.
+var errInvalidAPIKey = errors.New("invalid API key")
+
+// compareKeyHash compares a stored API key hash with that of a presented
+// key. It must take the same time however much of the two agree.
+var compareKeyHash = subtle.ConstantTimeCompare
+
+// validateAPIKey returns the claims of the configured API key that key
+// is, as validateToken does for a token.
+func validateAPIKey(key string) (jwt.MapClaims, error) {
+	return matchAPIKey(currentConfig().APIKeys, key)
+}
+
+// matchAPIKey finds key among keys by its hash. Every stored hash is
+// compared in constant time, and the loop does not stop at a match, so
+// the time taken tells nothing about which entry matched or how close a
+// guess came.
+func matchAPIKey(keys []APIKey, key string) (jwt.MapClaims, error) {
+	if key == "" {
+		return nil, errInvalidAPIKey
+	}
+	sum := sha256.Sum256([]byte(key))
+	match := -1
+	for i, k := range keys {
+		stored, _ := hex.DecodeString(k.SHA256)
+		if compareKeyHash(stored, sum[:]) == 1 && match < 0 {
+			match = i
+		}
+	}
+	if match < 0 {
+		return nil, errInvalidAPIKey
+	}
+
+	k := keys[match]
+	roles := make([]interface{}, len(k.Roles))
+	for i, role := range k.Roles {
+		roles[i] = role
+	}
+	claims := jwt.MapClaims{"sub": k.Subject, "roles": roles}
+	if k.Scope != "" {
+		claims["scope"] = k.Scope
+	}
+	return claims, nil
+}
+
+// credentialClaims validates the credential a request carries: the bearer
+// token in authorization or, without one, apiKey. ok is false when it
+// carries neither.
+func credentialClaims(authorization, apiKey string) (claims jwt.MapClaims, ok bool, err error) {
+	if token, found := strings.CutPrefix(authorization, "Bearer "); found {
+		claims, err = validateToken(token)
+		return claims, true, err
+	}
+	if apiKey != "" {
+		claims, err = validateAPIKey(apiKey)
+		return claims, true, err
+	}
+	return nil, false, nil
+}
+
+// tokenFailure names why validateToken rejected a token. A bad signature
+// is reported ahead of anything else, as the claims of a forged token mean
+// nothing.
+func tokenFailure(err error) string {
+	var ve *jwt.ValidationError
+	if !errors.As(err, &ve) {
+		return "invalid"
+	}
+	switch {
+	case ve.Errors&jwt.ValidationErrorMalformed != 0:
+		return "malformed"
+	case ve.Errors&jwt.ValidationErrorUnverifiable != 0:
+		return "unverifiable"
+	case ve.Errors&jwt.ValidationErrorSignatureInvalid != 0:
+		return "bad_signature"
+	case ve.Errors&jwt.ValidationErrorExpired != 0:
+		return "expired"
+	case ve.Errors&jwt.ValidationErrorNotValidYet != 0:
+		return "not_yet_valid"
+	case ve.Errors&jwt.ValidationErrorIssuedAt != 0:
+		return "issued_in_future"
+	case ve.Errors&jwt.ValidationErrorAudience != 0:
+		return "wrong_audience"
+	}
+	return "invalid"
+}
+
+// tokenSummary is what /api/auth/verify reports about a valid token.
+type tokenSummary struct {
+	Subject   string      `json:"subject,omitempty"`
+	Audience  interface{} `json:"audience,omitempty"`
+	Roles     []string    `json:"roles,omitempty"`
+	Scope     interface{} `json:"scope,omitempty"`
+	ExpiresAt *time.Time  `json:"expires_at,omitempty"`
+	NotBefore *time.Time  `json:"not_before,omitempty"`
+	IssuedAt  *time.Time  `json:"issued_at,omitempty"`
+}
+
+func summarizeClaims(claims jwt.MapClaims) tokenSummary {
+	at := func(key string) *time.Time {
+		if v, ok := claims[key].(float64); ok {
+			t := time.Unix(int64(v), 0).UTC()
+			return &t
+		}
+		return nil
+	}
+	subject, _ := claims["sub"].(string)
+	return tokenSummary{
+		Subject:   subject,
+		Audience:  claims["aud"],
+		Roles:     claimRoles(claims),
+		Scope:     claims["scope"],
+		ExpiresAt: at("exp"),
+		NotBefore: at("nbf"),
+		IssuedAt:  at("iat"),
+	}
+}
+
+// verifyTokenHandler serves /api/auth/verify. It validates the bearer
+// token the way every other endpoint does and reports the result: a
+// summary of the claims, or an invalid_token error whose "reason" detail
+// says what failed. Nothing else is done with the token.
+func verifyTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tokenString, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		sendError(w, &OpError{
+			Code:    codeInvalidToken,
+			Message: "no bearer token in the Authorization header",
+			Details: map[string]string{"reason": "missing"},
+		})
+		return
+	}
+	claims, err := validateToken(tokenString)
+	if err != nil {
+		reason := tokenFailure(err)
+		sendError(w, &OpError{
+			Code:    codeInvalidToken,
+			Message: fmt.Sprintf("token rejected: %v", err),
+			Details: map[string]string{"reason": reason},
+		})
+		return
+	}
+
+	sendResponse(w, Response{
+		Status: "success",
+		Data:   summarizeClaims(claims),
+	}, http.StatusOK)
+}
+
+// authMiddleware requires a bearer token or, failing that, an API key in
+// X-API-Key, and attaches the claims either one carries to the request.
+func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, ok, err := credentialClaims(r.Header.Get("Authorization"), r.Header.Get(apiKeyHeader))
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		ctx := withCredential(r.Context(), claims, r.Header.Get("Authorization"), r.Header.Get(apiKeyHeader))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+}
+
+// signatureMaxSkew is how far the X-Signature-Timestamp of a signed
+// request may be from the server's clock.
+const signatureMaxSkew = 5 * time.Minute
+
+// bodySignature is the X-Signature a request body carries: the hex
+// HMAC-SHA256, under key, of the X-Signature-Timestamp, a dot and the body.
+func bodySignature(key []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkSignature verifies a signed request made at timestamp, in Unix
+// seconds, against key.
+func checkSignature(key []byte, signature, timestamp string, body []byte, now time.Time) error {
+	if signature == "" || timestamp == "" {
+		return &OpError{
+			Code:    codeBadSignature,
+			Message: "this client must sign its requests with X-Signature and X-Signature-Timestamp",
+			Details: map[string]string{"reason": "missing"},
+		}
+	}
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return &OpError{Code: codeBadSignature, Message: "X-Signature-Timestamp is not a Unix time", Details: map[string]string{"reason": "malformed"}}
+	}
+	if skew := now.Sub(time.Unix(sec, 0)); skew > signatureMaxSkew || skew < -signatureMaxSkew {
+		return &OpError{Code: codeBadSignature, Message: "request signature has expired", Details: map[string]string{"reason": "stale"}}
+	}
+	if !hmac.Equal([]byte(strings.ToLower(signature)), []byte(bodySignature(key, timestamp, body))) {
+		return &OpError{Code: codeBadSignature, Message: "request signature does not match the body", Details: map[string]string{"reason": "mismatch"}}
+	}
+	return nil
+}
+
+// signatureMiddleware checks the body signature of requests from token
+// subjects that have a signing key, before the body is decoded. The key is
+// looked up by subject rather than X-Client-ID, which an intermediary
+// could change or drop. The timestamp is signed along with the body and
+// must be recent, so a captured request cannot be replayed later. It runs
+// under withConfig, after authMiddleware.
+func signatureMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		subject, _ := claimsFrom(r)["sub"].(string)
+		config := currentConfig()
+		key, ok := config.SigningKeys[subject]
+		if !ok || subject == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// JSON escaping can grow content, so allow well beyond the file
+		// size limit before refusing the body outright.
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 2*config.MaxFileSize+1<<20))
+		if err != nil {
+			sendError(w, opErrorf(codeTooLarge, "request body too large to verify"))
+			return
+		}
+		err = checkSignature([]byte(key), r.Header.Get("X-Signature"), r.Header.Get("X-Signature-Timestamp"), body, time.Now())
+		if err != nil {
+			log.Printf("Rejected request from %q: %v", subject, err)
+			sendError(w, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, r)
+	}
+}
+
+type claimsKey struct{}
+
+type credentialKey struct{}
+
+// withCredential attaches the claims of a validated credential to ctx,
+// along with a hash that tells the credential apart from others without
+// keeping it.
+func withCredential(ctx context.Context, claims jwt.MapClaims, authorization, apiKey string) context.Context {
+	credential := apiKey
+	if token, found := strings.CutPrefix(authorization, "Bearer "); found {
+		credential = token
+	}
+	sum := sha256.Sum256([]byte(credential))
+	ctx = context.WithValue(ctx, credentialKey{}, hex.EncodeToString(sum[:16]))
+	return context.WithValue(ctx, claimsKey{}, claims)
+}
+
+// credentialFrom returns the hash withCredential attached to ctx, or "".
+func credentialFrom(ctx context.Context) string {
+	credential, _ := ctx.Value(credentialKey{}).(string)
+	return credential
+}
+
+// claimsFrom returns the validated token claims authMiddleware attached to
+// the request, or nil for unauthenticated routes.
+func claimsFrom(r *http.Request) jwt.MapClaims {
+	return claimsFromContext(r.Context())
+}
+
+func claimsFromContext(ctx context.Context) jwt.MapClaims {
+	claims, _ := ctx.Value(claimsKey{}).(jwt.MapClaims)
+	return claims
+}
+
+// hasScope reports whether the token grants scope. The "scope" claim may be
+// a space-separated string (RFC 8693) or a list of strings.
+func hasScope(claims jwt.MapClaims, scope string) bool {
+	switch v := claims["scope"].(type) {
+	case string:
+		for _, s := range strings.Fields(v) {
+			if s == scope {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, s := range v {
+			if s == scope {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// adminMiddleware authenticates like authMiddleware and additionally
+// requires the "admin" scope.
+func adminMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if !hasScope(claimsFrom(r), "admin") {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// precompressedExts lists file types whose content is already compressed, so
+// gzipping them again costs CPU without saving bytes.
+var precompressedExts = map[string]bool{
+	".gz": true, ".tgz": true, ".zip": true, ".bz2": true, ".xz": true,
+	".zst": true, ".7z": true, ".png": true, ".jpg": true, ".jpeg": true,
+	".gif": true, ".webp": true, ".mp3": true, ".mp4": true,
+}
+
+// isCompressible reports whether a response of contentType, carrying a file
+// with extension ext (may be empty), is worth gzipping.
+func isCompressible(contentType, ext string) bool {
+	if precompressedExts[strings.ToLower(ext)] {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch mediaType {
+	case "text/event-stream":
+		// Server-sent events must reach the client as soon as they are
+		// flushed, so they are sent uncompressed.
+		return false
+	case "application/json", "application/xml", "application/javascript", "image/svg+xml":
+		return true
+	}
+	return strings.HasPrefix(mediaType, "text/") ||
+		strings.HasSuffix(mediaType, "+json") ||
+		strings.HasSuffix(mediaType, "+xml")
+}
+
+// compressWriter gzips the response body when the client accepts it and
+// isCompressible approves the response's content type and file extension.
+// The decision is made when the header is written, so handlers can still set
+// Content-Type and call setCompressionExt beforehand.
+type compressWriter struct {
+	http.ResponseWriter
+	ext     string
+	gz      *gzip.Writer
+	decided bool
+	// head is set for HEAD requests, which get the same headers as GET
+	// but no body, not even an empty gzip stream.
+	head bool
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if !cw.decided {
+		cw.decided = true
+		h := cw.Header()
+		// Partial content is never compressed: Content-Range counts bytes
+		// of the file itself, which a gzipped body would not match.
+		if h.Get("Content-Encoding") == "" && h.Get("Content-Range") == "" &&
+			status != http.StatusNoContent && status != http.StatusNotModified &&
+			status != http.StatusPartialContent &&
+			isCompressible(h.Get("Content-Type"), cw.ext) {
+			h.Set("Content-Encoding", "gzip")
+			h.Del("Content-Length")
+			if etag := h.Get("ETag"); etag != "" {
+				h.Set("ETag", encodedETag(etag))
+			}
+			if !cw.head {
+				cw.gz = gzip.NewWriter(cw.ResponseWriter)
+			}
+		}
+		// A 304 carries the tag the full response would have had. It has
+		// no Content-Type of its own, so the file extension stands in.
+		if status == http.StatusNotModified && h.Get("ETag") != "" {
+			contentType := h.Get("Content-Type")
+			if contentType == "" {
+				contentType = mime.TypeByExtension(cw.ext)
+			}
+			if isCompressible(contentType, cw.ext) {
+				h.Set("ETag", encodedETag(h.Get("ETag")))
+			}
+		}
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.decided {
+		if cw.Header().Get("Content-Type") == "" {
+			cw.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.gz != nil {
+		return cw.gz.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+func (cw *compressWriter) Flush() {
+	if cw.gz != nil {
+		cw.gz.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (cw *compressWriter) Close() error {
+	if cw.gz != nil {
+		return cw.gz.Close()
+	}
+	return nil
+}
+
+// setCompressionExt tells the compression middleware which file the response
+// carries, so already-compressed formats are sent as they are.
+func setCompressionExt(w http.ResponseWriter, ext string) {
+	if cw, ok := w.(*compressWriter); ok {
+		cw.ext = ext
+	}
+}
+
+// gzipETagSuffix marks the entity tag of a gzipped response. The same
+// resource sent compressed and uncompressed is two different sets of
+// bytes, and a cache must not answer a request for one with the other.
+const gzipETagSuffix = "-gzip"
+
+// encodedETag returns etag marked as the tag of the gzipped form, e.g.
+// "5-1a2b" becomes "5-1a2b-gzip".
+func encodedETag(etag string) string {
+	if !strings.HasSuffix(etag, `"`) || strings.HasSuffix(etag, gzipETagSuffix+`"`) {
+		return etag
+	}
+	return strings.TrimSuffix(etag, `"`) + gzipETagSuffix + `"`
+}
+
+// decodedETags strips the gzip mark from every tag in an If-None-Match
+// header, so handlers compare against the tag of the content itself. A
+// client revalidating a gzipped copy then still gets its 304.
+func decodedETags(header string) string {
+	tags := strings.Split(header, ",")
+	for i, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if strings.HasSuffix(tag, gzipETagSuffix+`"`) {
+			tag = strings.TrimSuffix(tag, gzipETagSuffix+`"`) + `"`
+		}
+		tags[i] = tag
+	}
+	return strings.Join(tags, ", ")
+}
+
+func compressMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if inm := r.Header.Get("If-None-Match"); inm != "" {
+			r.Header.Set("If-None-Match", decodedETags(inm))
+		}
+
+		cw := &compressWriter{ResponseWriter: w, head: r.Method == http.MethodHead}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// logSampler picks which successful requests get logged: the first of
+// every n. Failed requests are always logged. Counting rather than drawing
+// at random keeps the choice deterministic for a given sequence of
+// requests.
+type logSampler struct {
+	seen atomic.Uint64
+}
+
+var requestLogSampler logSampler
+
+// Sample reports whether a request that ended with status is logged when
+// one in n successful requests is.
+func (s *logSampler) Sample(status, n int) bool {
+	if status >= 400 || n <= 1 {
+		return true
+	}
+	return (s.seen.Add(1)-1)%uint64(n) == 0
+}
+
+// statusRecorder remembers the status a handler sent.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	return sr.ResponseWriter.Write(b)
+}
+
+func (sr *statusRecorder) Flush() {
+	if f, ok := sr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// logRequests logs each request's method, path, status and duration,
+// subject to the LogSampleRate in the config.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(sr, r)
+		if sr.status == 0 {
+			sr.status = http.StatusOK
+		}
+
+		if requestLogSampler.Sample(sr.status, currentConfig().LogSampleRate) {
+			log.Printf("%s %s %d %s", r.Method, r.URL.Path, sr.status, time.Since(start).Round(time.Millisecond))
+		}
+	})
+}
+
+func operationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var op Operation
+	in := &countingReader{Reader: r.Body}
+	body := throttle(r, in)
+	if err := json.NewDecoder(body).Decode(&op); err != nil {
+		sendResponse(w, Response{
+			Status:  "error",
+			Message: "Invalid request format",
+		}, http.StatusBadRequest)
+		return
+	}
+
+	setCompressionExt(w, filepath.Ext(op.Parameters["path"]))
+	op.Action = resolveAction(op.Action)
+
+	cw := newCountingWriter(w)
+	w = cw
+	defer func() {
+		pathMetrics.Record(metricsRoot(op.Parameters["path"]), cw.Failed(), in.n, cw.n)
+	}()
+
+	// Validate operation
+	if err := validateParameters(op); err != nil {
+		audit(r, op, err)
+		sendError(w, err)
+		return
+	}
+	if err := authorizeOperation(claimsFrom(r), op); err != nil {
+		audit(r, op, err)
+		sendError(w, err)
+		return
+	}
+
+	if blockedByMaintenance(op.Action) {
+		audit(r, op, errMaintenance)
+		w.Header().Set("Retry-After", strconv.Itoa(maintenanceRetryAfter))
+		sendError(w, errMaintenance)
+		return
+	}
+
+	// A client holding a current listing gets 304 instead of the entries.
+	if op.Action == "list_files" {
+		if etag, err := dirETag(op.Parameters["path"]); err == nil {
+			w.Header().Set("ETag", etag)
+			if etagMatches(r.Header.Get("If-None-Match"), etag) {
+				audit(r, op, nil)
+				// Lets the compression middleware tag the 304 as it
+				// would have tagged the listing.
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+	}
+
+	release, err := admitOperation(r.Context(), op.Action, r.Header.Get("X-Client-ID"))
+	if err != nil {
+		audit(r, op, err)
+		refuseOperation(w, r, err)
+		return
+	}
+	defer release()
+
+	if op.Action == "tar_stream" {
+		done := inflight.Begin(op.Action, op.Parameters["path"], r.Header.Get("X-Client-ID"))
+		err := streamTar(w, r, op.Parameters["path"], op.Parameters["gzip"] == "true")
+		done()
+		audit(r, op, err)
+		return
+	}
+
+	if op.Action == "read_file" {
+		f, info, err := openStreamedRead(op.Parameters["path"], op.Parameters["stream"] == "true")
+		if err != nil {
+			audit(r, op, err)
+			sendError(w, err)
+			return
+		}
+		if f != nil {
+			done := inflight.Begin(op.Action, f.Name(), r.Header.Get("X-Client-ID"))
+			err := streamRead(w, r, f, info)
+			done()
+			audit(r, op, err)
+			return
+		}
+	}
+
+	if op.Action == "exec" {
+		done := inflight.Begin(op.Action, op.Parameters["path"], r.Header.Get("X-Client-ID"))
+		err := streamExec(w, r, op.Parameters)
+		done()
+		audit(r, op, err)
+		return
+	}
+
+	// Process operation
+	run := func() (interface{}, error) {
+		done := inflight.Begin(op.Action, op.Parameters["path"], r.Header.Get("X-Client-ID"))
+		defer done()
+		return processOperation(claimsFrom(r), op)
+	}
+	key, err := idempotencyKeyOf(r)
+	var result interface{}
+	if err == nil {
+		if key != "" && mutatingActions[op.Action] {
+			var replayed bool
+			result, replayed, err = idempotency.Do(key, operationFingerprint(op), time.Now(), run)
+			if replayed {
+				w.Header().Set("Idempotent-Replayed", "true")
+			}
+		} else {
+			result, err = run()
+		}
+	}
+	audit(r, op, err)
+	if err != nil {
+		sendError(w, err)
+		return
+	}
+
+	sendResponse(w, Response{
+		Status: "success",
+		Data:   result,
+	}, http.StatusOK)
+}
+
+// idempotencyHeader carries a key the client sends with every attempt of
+// one logical operation, so a retry of a mutation whose response was lost
+// is answered with the first outcome instead of running again.
+const idempotencyHeader = "Idempotency-Key"
+
+// idempotencyTTL is how long the outcome of a keyed mutation is kept for
+// retries to find.
+const idempotencyTTL = 24 * time.Hour
+
+// maxIdempotencyKeys bounds the outcomes kept. Past it, expired ones are
+// dropped and, if none have expired, new mutations run without a key.
+const maxIdempotencyKeys = 10000
+
+// maxIdempotencyKeyLen bounds the length of an Idempotency-Key.
+const maxIdempotencyKeyLen = 255
+
+// idempotencyEntry is the outcome of one keyed mutation. done is closed
+// once result and err are set.
+type idempotencyEntry struct {
+	fingerprint string
+	done        chan struct{}
+	result      interface{}
+	err         error
+	expires     time.Time
+}
+
+// idempotencyStore remembers the outcomes of keyed mutations.
+type idempotencyStore struct {
+	mu      sync.Mutex
+	entries map[string]*idempotencyEntry
+}
+
+var idempotency = &idempotencyStore{entries: make(map[string]*idempotencyEntry)}
+
+// Do runs fn for the first request with key and hands its outcome to the
+// later ones, waiting for it if the first is still running. A key seen
+// with a different request, as fingerprint tells, is a conflict. A failed
+// run is forgotten once the requests waiting for it have their answer,
+// so it can be retried. replayed reports an outcome that was not run
+// for this request.
+func (s *idempotencyStore) Do(key, fingerprint string, now time.Time, fn func() (interface{}, error)) (result interface{}, replayed bool, err error) {
+	s.mu.Lock()
+	if e, ok := s.entries[key]; ok && now.Before(e.expires) {
+		s.mu.Unlock()
+		if e.fingerprint != fingerprint {
+			return nil, false, opErrorf(codeConflict, "idempotency key was already used for a different request")
+		}
+		<-e.done
+		return e.result, true, e.err
+	}
+	if len(s.entries) >= maxIdempotencyKeys {
+		s.prune(now)
+	}
+	if len(s.entries) >= maxIdempotencyKeys {
+		s.mu.Unlock()
+		result, err := fn()
+		return result, false, err
+	}
+	e := &idempotencyEntry{fingerprint: fingerprint, done: make(chan struct{}), expires: now.Add(idempotencyTTL)}
+	s.entries[key] = e
+	s.mu.Unlock()
+
+	e.result, e.err = fn()
+	if e.err != nil {
+		s.mu.Lock()
+		delete(s.entries, key)
+		s.mu.Unlock()
+	}
+	close(e.done)
+	return e.result, false, e.err
+}
+
+// prune drops the expired outcomes. The caller holds s.mu.
+func (s *idempotencyStore) prune(now time.Time) {
+	for key, e := range s.entries {
+		if !now.Before(e.expires) {
+			delete(s.entries, key)
+		}
+	}
+}
+
+// idempotencyKeyOf returns the key of a request, scoped to the token
+// subject so two callers never share an outcome, or "" without one.
+func idempotencyKeyOf(r *http.Request) (string, error) {
+	key := r.Header.Get(idempotencyHeader)
+	if key == "" {
+		return "", nil
+	}
+	if len(key) > maxIdempotencyKeyLen {
+		return "", opErrorf(codeInvalidArgument, "%s is longer than %d characters", idempotencyHeader, maxIdempotencyKeyLen)
+	}
+	sub, _ := claimsFrom(r)["sub"].(string)
+	return sub + "\x00" + key, nil
+}
+
+// operationFingerprint identifies what op asks for, so a reused key can
+// be told from a retry. The timestamp differs between attempts and is
+// left out.
+func operationFingerprint(op Operation) string {
+	params, _ := json.Marshal(op.Parameters)
+	sum := sha256.Sum256(append([]byte(op.Action+"\x00"), params...))
+	return hex.EncodeToString(sum[:])
+}
+
+// downloadHandler streams a file as a raw body instead of a JSON string. It
+// honours Range requests (206 Partial Content, 416 when unsatisfiable) so
+// clients can resume an interrupted download from the bytes they already have.
+// HEAD returns the same headers without the body, so clients can probe the
+// size, ETag and type of a file before fetching it. X-File-Size carries the
+// size even when the body would be gzipped and Content-Length is absent.
+func downloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	op := Operation{
+		Action:     "download",
+		Parameters: map[string]string{"path": r.URL.Query().Get("path")},
+		Timestamp:  time.Now(),
+	}
+
+	var f *os.File
+	var info os.FileInfo
+	err := validateParameters(op)
+	if err == nil {
+		f, info, err = openDownload(claimsFrom(r), op.Parameters["path"])
+	}
+	bucket := bandwidthBucket(claimsFrom(r))
+	root := metricsRoot(op.Parameters["path"])
+
+	cw := newCountingWriter(w)
+	defer func() { pathMetrics.Record(root, cw.Failed(), 0, cw.n) }()
+	if err != nil {
+		audit(r, op, err)
+		sendError(cw, err)
+		return
+	}
+	defer f.Close()
+	path := f.Name()
+
+	release, err := admitOperation(r.Context(), op.Action, r.Header.Get("X-Client-ID"))
+	if err != nil {
+		audit(r, op, err)
+		refuseOperation(cw, r, err)
+		return
+	}
+	defer release()
+
+	audit(r, op, nil)
+	setCompressionExt(w, filepath.Ext(path))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": filepath.Base(path),
+	}))
+	w.Header().Set("ETag", fileETag(info))
+	w.Header().Set("X-File-Size", strconv.FormatInt(info.Size(), 10))
+	// ServeContent only sets it on success; a client told its range
+	// cannot be satisfied should still learn that ranges are supported.
+	w.Header().Set("Accept-Ranges", "bytes")
+	var content io.ReadSeeker = f
+	if bucket != nil {
+		content = throttledReadSeeker{&throttledReader{f, r.Context(), bucket}, f}
+	}
+	defer inflight.Begin(op.Action, path, r.Header.Get("X-Client-ID"))()
+	http.ServeContent(cw, r, filepath.Base(path), info.ModTime(), content)
+}
+
+// followPollInterval is how often a follow looks at its file when no
+// filesystem event has woken it, in case the watch missed a change.
+const followPollInterval = time.Second
+
+// maxFollowLine bounds how much of a line a follow holds back waiting for
+// its newline. A longer line is sent in pieces.
+const maxFollowLine = 64 << 10
+
+// followHandler streams the lines appended to a file as server-sent
+// events, starting from its current end, until the client goes away or
+// the follow has run for its maximum duration. A log that is rotated,
+// by being replaced or truncated, is reopened and followed from its start.
+func followHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	op := Operation{
+		Action: "follow",
+		Parameters: map[string]string{
+			"path":        r.URL.Query().Get("path"),
+			"max_seconds": r.URL.Query().Get("max_seconds"),
+		},
+		Timestamp: time.Now(),
+	}
+
+	var path string
+	var limit time.Duration
+	var f *os.File
+	var info os.FileInfo
+	err := validateParameters(op)
+	if err == nil {
+		path, limit, err = followTarget(claimsFrom(r), op.Parameters)
+	}
+	if err == nil {
+		f, info, err = openFollowed(path)
+	}
+
+	if err != nil {
+		audit(r, op, err)
+		sendError(w, err)
+		return
+	}
+
+	release, err := admitOperation(r.Context(), op.Action, r.Header.Get("X-Client-ID"))
+	audit(r, op, err)
+	if err != nil {
+		f.Close()
+		refuseOperation(w, r, err)
+		return
+	}
+	defer release()
+
+	ctx := r.Context()
+	if limit > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, limit)
+		defer cancel()
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	defer inflight.Begin(op.Action, path, r.Header.Get("X-Client-ID"))()
+	if err := followFile(ctx, w, flusher.Flush, path, f, info); err != nil {
+		log.Printf("follow %s: %v", path, err)
+		return
+	}
+	if r.Context().Err() == nil {
+		fmt.Fprint(w, "event: end\ndata: max duration reached\n\n")
+		flusher.Flush()
+	}
+}
+
+// followTarget authorizes a follow and returns the canonical path to
+// follow and how long it may run, zero meaning until the client goes.
+// max_seconds may shorten the configured follow_max_duration but not
+// extend it.
+func followTarget(claims jwt.MapClaims, params map[string]string) (string, time.Duration, error) {
+	if err := authorize(claims, "follow", params["path"]); err != nil {
+		return "", 0, err
+	}
+
+	path, err := canonicalize(params["path"])
+	if err != nil {
+		return "", 0, err
+	}
+	if !isFileTypeAllowed(path) {
+		return "", 0, opErrorf(codeTypeDenied, "file type not allowed")
+	}
+
+	limit := time.Duration(currentConfig().FollowMaxDuration) * time.Second
+	if s := params["max_seconds"]; s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return "", 0, opErrorf(codeInvalidArgument, "invalid max_seconds value: %s", s)
+		}
+		if d := time.Duration(n) * time.Second; limit == 0 || d < limit {
+			limit = d
+		}
+	}
+	return path, limit, nil
+}
+
+// openFollowed opens the regular file at the canonical path for a follow.
+func openFollowed(path string) (*os.File, os.FileInfo, error) {
+	f, err := openVerified(path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info, err := f.Stat()
+	if err == nil {
+		err = checkNotDir(path, info)
+	}
+	if err == nil && !info.Mode().IsRegular() {
+		err = opErrorf(codeUnsupported, "only regular files can be followed")
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, info, nil
+}
+
+// followFile writes each line appended to f after its current end to w as
+// a "data:" event, calling flush after each batch, until ctx is done. It
+// wakes on filesystem events in the file's directory and on a timer.
+//
+// When a different file takes the place of path, it is reopened; when f
+// shrinks below what was already read, it was truncated. Either way a
+// "rotated" event says which, and the file is followed from its start.
+// followFile closes f, or whatever file it last reopened.
+func followFile(ctx context.Context, w io.Writer, flush func(), path string, f *os.File, info os.FileInfo) error {
+	defer func() { f.Close() }()
+
+	// The directory is watched rather than the file, so a new file created
+	// under the same name is seen.
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		return err
+	}
+	ticker := time.NewTicker(followPollInterval)
+	defer ticker.Stop()
+
+	offset := info.Size()
+	var pending []byte
+	buf := make([]byte, 32<<10)
+	sendLine := func(line []byte) error {
+		_, err := fmt.Fprintf(w, "data: %s\n\n", bytes.TrimSuffix(line, []byte("\r")))
+		return err
+	}
+	rotated := func(how string) error {
+		if len(pending) > 0 {
+			if err := sendLine(pending); err != nil {
+				return err
+			}
+			pending = nil
+		}
+		offset = 0
+		_, err := fmt.Fprintf(w, "event: rotated\ndata: %s\n\n", how)
+		return err
+	}
+
+	for {
+		for {
+			n, readErr := f.ReadAt(buf, offset)
+			offset += int64(n)
+			pending = append(pending, buf[:n]...)
+			for {
+				i := bytes.IndexByte(pending, '\n')
+				if i < 0 {
+					break
+				}
+				if err := sendLine(pending[:i]); err != nil {
+					return err
+				}
+				pending = pending[i+1:]
+			}
+			if len(pending) >= maxFollowLine {
+				if err := sendLine(pending); err != nil {
+					return err
+				}
+				pending = nil
+			}
+			if readErr == io.EOF {
+				break
+			}
+			if readErr != nil {
+				return readErr
+			}
+		}
+
+		// A missing path is left alone: the old file is still followed
+		// until a new one appears in its place.
+		if current, err := os.Stat(path); err == nil {
+			if !os.SameFile(current, info) {
+				nf, ninfo, err := openFollowed(path)
+				if err == nil {
+					f.Close()
+					f, info = nf, ninfo
+					if err := rotated("replaced"); err != nil {
+						return err
+					}
+					continue
+				}
+			} else if current.Size() < offset {
+				if err := rotated("truncated"); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		flush()
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case _, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+		case <-watcher.Errors:
+		case <-ticker.C:
+		}
+	}
+}
+
+// fileETag derives a strong entity tag from a file's size and modification
+// time, which is enough to tell versions apart without hashing the content.
+func fileETag(info os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.Size(), info.ModTime().UnixNano())
+}
+
+// openDownload checks that path may be downloaded and opens it.
+func openDownload(claims jwt.MapClaims, path string) (*os.File, os.FileInfo, error) {
+	if err := authorize(claims, "read_file", path); err != nil {
+		return nil, nil, err
+	}
+
+	canonical, err := canonicalize(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	f, err := openVerified(canonical, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info, err := f.Stat()
+	if err == nil {
+		err = checkNotDir(path, info)
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, info, nil
+}
+
+// tokenBucket paces transfers to rate bytes per second, allowing bursts of
+// up to one second's worth.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// take spends n bytes and returns how long the caller must wait before
+// sending them. The bucket may go into debt, which later callers wait off.
+func (b *tokenBucket) take(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens = math.Min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+var (
+	bucketsMu sync.Mutex
+	buckets   = make(map[string]*tokenBucket)
+)
+
+// bandwidthBucket returns the bucket shared by every request from the
+// token's subject, or nil when BandwidthLimit is off.
+func bandwidthBucket(claims jwt.MapClaims) *tokenBucket {
+	limit := currentConfig().BandwidthLimit
+	if limit <= 0 {
+		return nil
+	}
+	sub, _ := claims["sub"].(string)
+
+	bucketsMu.Lock()
+	defer bucketsMu.Unlock()
+	b, ok := buckets[sub]
+	if !ok || b.rate != float64(limit) {
+		b = newTokenBucket(limit)
+		buckets[sub] = b
+	}
+	return b
+}
+
+// throttledReader limits reads from the underlying reader to the rate of
+// its bucket, giving up early if ctx is cancelled.
+type throttledReader struct {
+	io.Reader
+	ctx    context.Context
+	bucket *tokenBucket
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if burst := int(t.bucket.rate); len(p) > burst {
+		p = p[:burst]
+	}
+	n, err := t.Reader.Read(p)
+	if wait := t.bucket.take(n); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-t.ctx.Done():
+			return n, t.ctx.Err()
+		}
+	}
+	return n, err
+}
+
+// throttledReadSeeker lets http.ServeContent seek a throttled file.
+type throttledReadSeeker struct {
+	*throttledReader
+	io.Seeker
+}
+
+// throttle wraps src in the request's bandwidth limit, if there is one.
+func throttle(r *http.Request, src io.Reader) io.Reader {
+	b := bandwidthBucket(claimsFrom(r))
+	if b == nil {
+		return src
+	}
+	return &throttledReader{src, r.Context(), b}
+}
+
+// buildInfo describes the running server binary.
+type buildInfo struct {
+	Version   string `json:"version"`
+	GitCommit string `json:"git_commit"`
+	GoVersion string `json:"go_version"`
+}
+
+func currentBuildInfo() buildInfo {
+	info := buildInfo{
+		Version:   version,
+		GitCommit: gitCommit,
+		GoVersion: runtime.Version(),
+	}
+
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if info.Version == "" && bi.Main.Version != "" {
+			info.Version = bi.Main.Version
+		}
+		for _, setting := range bi.Settings {
+			if setting.Key == "vcs.revision" && info.GitCommit == "" {
+				info.GitCommit = setting.Value
+			}
+		}
+	}
+	if info.Version == "" {
+		info.Version = "(devel)"
+	}
+	return info
+}
+
+// versionHandler reports what is deployed. It is deliberately
+// unauthenticated so probes and clients can check it before logging in.
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sendResponse(w, Response{
+		Status: "success",
+		Data:   currentBuildInfo(),
+	}, http.StatusOK)
+}
+
+// capabilitiesHandler reports the limits clients should check input against
+// before sending it.
+func capabilitiesHandler(w http.ResponseWriter, r *http.Request) {
+	config := configFrom(r.Context())
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	actions := make([]string, 0, len(config.AllowedActions))
+	for action, allowed := range config.AllowedActions {
+		if allowed {
+			actions = append(actions, action)
+		}
+	}
+	sort.Strings(actions)
+
+	sendResponse(w, Response{
+		Status: "success",
+		Data: map[string]interface{}{
+			"max_file_size":      config.MaxFileSize,
+			"stream_threshold":   config.StreamThreshold,
+			"max_walk_entries":   config.MaxWalkEntries,
+			"allowed_actions":    actions,
+			"allowed_file_types": config.AllowedFileTypes,
+		},
+	}, http.StatusOK)
+}
+
+// rpcRequest is a JSON-RPC 2.0 request. ID is kept raw so it is echoed back
+// exactly as sent, whether it was a number or a string.
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type rpcError struct {
+	Code    int           `json:"code"`
+	Message string        `json:"message"`
+	Data    *rpcErrorData `json:"data,omitempty"`
+}
+
+// rpcErrorData carries the operation error code for server errors.
+type rpcErrorData struct {
+	Code    string            `json:"code"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// JSON-RPC 2.0 error codes. rpcNotAllowed and rpcMaintenance are in the
+// range the specification reserves for implementation-defined server errors.
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcServerError    = -32000
+	rpcNotAllowed     = -32001
+	rpcMaintenance    = -32002
+)
+
+// rpcHandler serves the operations API as JSON-RPC 2.0: the method names the
+// action (aliases included) and params carries the operation parameters.
+// Requests without an id are notifications and get no response body.
+func rpcHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req rpcRequest
+	in := &countingReader{Reader: r.Body}
+	if err := json.NewDecoder(in).Decode(&req); err != nil {
+		sendRPC(w, rpcResponse{Error: &rpcError{Code: rpcParseError, Message: "Parse error"}})
+		return
+	}
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		sendRPC(w, rpcResponse{Error: &rpcError{Code: rpcInvalidRequest, Message: "Invalid Request"}, ID: req.ID})
+		return
+	}
+
+	op := Operation{
+		Action:     resolveAction(req.Method),
+		Parameters: map[string]string{},
+		Timestamp:  time.Now(),
+	}
+	if len(req.Params) > 0 && string(req.Params) != "null" {
+		if err := json.Unmarshal(req.Params, &op.Parameters); err != nil {
+			sendRPC(w, rpcResponse{Error: &rpcError{Code: rpcInvalidParams, Message: "Invalid params"}, ID: req.ID})
+			return
+		}
+	}
+
+	var paramErr, authErr error
+	if knownActions[op.Action] {
+		if paramErr = validateParameters(op); paramErr == nil {
+			authErr = authorizeOperation(claimsFrom(r), op)
+		}
+	}
+
+	resp := rpcResponse{ID: req.ID}
+	switch {
+	case !knownActions[op.Action]:
+		resp.Error = &rpcError{Code: rpcMethodNotFound, Message: "Method not found"}
+	case paramErr != nil:
+		e := asOpError(paramErr)
+		resp.Error = &rpcError{Code: rpcInvalidParams, Message: e.Message, Data: &rpcErrorData{Code: e.Code, Details: e.Details}}
+	case authErr != nil:
+		e := asOpError(authErr)
+		resp.Error = &rpcError{Code: rpcNotAllowed, Message: e.Message, Data: &rpcErrorData{Code: e.Code, Details: e.Details}}
+	case blockedByMaintenance(op.Action):
+		resp.Error = &rpcError{Code: rpcMaintenance, Message: errMaintenance.Message, Data: &rpcErrorData{Code: codeMaintenance}}
+	default:
+		release, err := admitOperation(r.Context(), op.Action, r.Header.Get("X-Client-ID"))
+		if err != nil && r.Context().Err() != nil {
+			// The client went away while waiting for a slot.
+			audit(r, op, err)
+			return
+		}
+		var result interface{}
+		if err == nil {
+			defer release()
+			done := inflight.Begin(op.Action, op.Parameters["path"], r.Header.Get("X-Client-ID"))
+			result, err = processOperation(claimsFrom(r), op)
+			done()
+		}
+		audit(r, op, err)
+		if err != nil {
+			e := asOpError(err)
+			resp.Error = &rpcError{
+				Code:    rpcServerError,
+				Message: e.Message,
+				Data:    &rpcErrorData{Code: e.Code, Details: e.Details},
+			}
+		} else {
+			resp.Result = result
+		}
+	}
+
+	cw := newCountingWriter(w)
+	defer func() {
+		pathMetrics.Record(metricsRoot(op.Parameters["path"]), resp.Error != nil, in.n, cw.n)
+	}()
+	if len(req.ID) == 0 {
+		cw.WriteHeader(http.StatusNoContent)
+		return
+	}
+	sendRPC(cw, resp)
+}
+
+func sendRPC(w http.ResponseWriter, resp rpcResponse) {
+	resp.JSONRPC = "2.0"
+	if len(resp.ID) == 0 {
+		resp.ID = json.RawMessage("null")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// processOperation runs an authorized operation. claims are only consulted
+// by actions whose results span paths not named in the request.
+func processOperation(claims jwt.MapClaims, op Operation) (interface{}, error) {
+	switch op.Action {
+	case "list_files":
+		return listFiles(op.Parameters["path"])
+	case "read_file":
+		return readFile(op.Parameters["path"])
+	case "write_file":
+		return writeFile(op.Parameters["path"], op.Parameters["content"], op.Parameters["sha256"], op.Parameters["line_ending"], op.Parameters["encoding"], op.Parameters["if_match"], op.Parameters["durable"] == "true", op.Parameters["exclusive"] == "true")
+	case "create_folder":
+		return createFolder(op.Parameters["path"], op.Parameters["exclusive"] == "true")
+	case "disk_usage":
+		return diskUsageOf(op.Parameters["path"])
+	case "rotate":
+		return rotateFile(op.Parameters["path"], op.Parameters["compress"] == "true", op.Parameters["keep"])
+	case "copy_dir":
+		return copyDir(op.Parameters["path"], op.Parameters["destination"])
+	case "manifest":
+		return manifest(op.Parameters["path"])
+	case "preview":
+		return previewFile(op.Parameters["path"], op.Parameters["bytes"])
+	case "read_lines":
+		return readLines(op.Parameters["path"], op.Parameters["start"], op.Parameters["count"])
+	case "line_count":
+		return countLines(op.Parameters["path"])
+	case "retype":
+		return retypeFile(op.Parameters["path"], op.Parameters["extension"])
+	case "swap":
+		return swapFiles(op.Parameters["path"], op.Parameters["destination"])
+	case "move":
+		return movePath(op.Parameters["path"], op.Parameters["destination"])
+	case "walk_dir":
+		return walkDir(op.Parameters["path"], op.Parameters["limit"], op.Parameters["cursor"])
+	case "find_duplicates":
+		return findDuplicates(op.Parameters["path"])
+	case "can_write":
+		return canWrite(claims, op.Parameters["path"], op.Parameters["size"])
+	case "recent":
+		return recentFiles(claims, op.Parameters["limit"], op.Parameters["within"], time.Now())
+	case "chmod":
+		return chmodPaths(op.Parameters["path"], op.Parameters["mode"], op.Parameters["recursive"] == "true")
+	case "symlink":
+		return createSymlink(op.Parameters["path"], op.Parameters["target"])
+	case "verify":
+		return verifyChecksum(op.Parameters["path"], op.Parameters["checksum"], op.Parameters["algorithm"])
+	case "search":
+		return searchAll(op.Parameters["path"], op.Parameters["pattern"], op.Parameters["max"])
+	case "tar_stream":
+		return nil, opErrorf(codeUnsupported, "tar_stream writes a raw archive and is only served by /api/operation")
+	case "exec":
+		return nil, opErrorf(codeUnsupported, "exec streams framed output and is only served by /api/operation")
+	case "follow":
+		return nil, opErrorf(codeUnsupported, "follow streams lines as they are written and is only served by /api/follow")
+	case "dir_etag":
+		return dirETag(op.Parameters["path"])
+	case "read_multi":
+		return readMulti(op.Parameters["paths"])
+	case "sync_plan":
+		return syncPlanFor(op.Parameters["path"], op.Parameters["manifest"], op.Parameters["mode"])
+	default:
+		return nil, opErrorf(codeUnsupported, "unsupported operation")
+	}
+}
+
+func listFiles(path string) ([]string, error) {
+	path, err := canonicalize(path)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := openVerified(path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	files := make([]string, 0, len(names))
+	for _, name := range names {
+		if p := filepath.Join(path, name); !isDenied(p) {
+			files = append(files, p)
+		}
+	}
+	return files, nil
+}
+
+// walkEntry is one entry of a walk_dir page, its path relative to the
+// directory walked, with "/" as separator.
+type walkEntry struct {
+	Path  string `json:"path"`
+	IsDir bool   `json:"is_dir"`
+	Size  int64  `json:"size"`
+}
+
+// walkPage is one page of a walk_dir. Next is the cursor to pass for the
+// following page; it is empty on the last one.
+type walkPage struct {
+	Entries []walkEntry `json:"entries"`
+	Next    string      `json:"next,omitempty"`
+}
+
+// errWalkPageFull stops a walk once its page is full.
+var errWalkPageFull = errors.New("walk page full")
+
+// walkDir lists the tree under path depth first, each directory's
+// entries in lexical order and each directory before what it holds, a
+// page of at most limit entries at a time. Symlinks are listed but not
+// followed, and denied paths are left out.
+//
+// The cursor is the last path a page returned, base64-encoded. Entries
+// come in the order of their paths compared component by component, so
+// a walk resumes by skipping whatever sorts before the cursor without
+// reading it. Entries created or removed between pages are seen or
+// missed as the walk passes them, but none is returned twice.
+func walkDir(path, limit, cursor string) (walkPage, error) {
+	root, err := canonicalize(path)
+	if err != nil {
+		return walkPage{}, err
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return walkPage{}, err
+	}
+	if !info.IsDir() {
+		return walkPage{}, opErrorf(codeInvalidArgument, "not a directory: %s", root)
+	}
+
+	n := currentConfig().MaxWalkEntries
+	if limit != "" {
+		parsed, err := strconv.Atoi(limit)
+		if err != nil || parsed <= 0 {
+			return walkPage{}, opErrorf(codeInvalidArgument, "invalid limit value: %s", limit)
+		}
+		n = min(n, parsed)
+	}
+	after, err := decodeWalkCursor(cursor)
+	if err != nil {
+		return walkPage{}, err
+	}
+
+	page := walkPage{Entries: []walkEntry{}}
+	err = walkFrom(root, "", after, func(rel string, d fs.DirEntry) error {
+		if len(page.Entries) == n {
+			page.Next = encodeWalkCursor(page.Entries[n-1].Path)
+			return errWalkPageFull
+		}
+		e := walkEntry{Path: rel, IsDir: d.IsDir()}
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				e.Size = info.Size()
+			}
+		}
+		page.Entries = append(page.Entries, e)
+		return nil
+	})
+	if err != nil && err != errWalkPageFull {
+		return walkPage{}, err
+	}
+	return page, nil
+}
+
+// walkFrom walks dir, whose path relative to the walk's root is rel,
+// handing fn every entry that sorts after the cursor components in after.
+// An entry named like after[0] was returned before, so only what follows
+// after[1:] inside it is walked.
+func walkFrom(dir, rel string, after []string, fn func(rel string, d fs.DirEntry) error) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, d := range entries {
+		p := filepath.Join(dir, d.Name())
+		if isDenied(p) {
+			continue
+		}
+		var rest []string
+		if len(after) > 0 {
+			if d.Name() < after[0] {
+				continue
+			}
+			if d.Name() == after[0] {
+				rest = after[1:]
+			}
+		}
+		entryRel := d.Name()
+		if rel != "" {
+			entryRel = rel + "/" + d.Name()
+		}
+		if len(after) == 0 || d.Name() != after[0] {
+			if err := fn(entryRel, d); err != nil {
+				return err
+			}
+		}
+		if d.IsDir() {
+			if err := walkFrom(p, entryRel, rest, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// encodeWalkCursor turns the last path of a page into a cursor.
+func encodeWalkCursor(rel string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(rel))
+}
+
+// decodeWalkCursor returns the components of the path a cursor holds, or
+// nil for the empty cursor of a first page.
+func decodeWalkCursor(cursor string) ([]string, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, opErrorf(codeInvalidArgument, "invalid cursor")
+	}
+	parts := strings.Split(string(b), "/")
+	for _, part := range parts {
+		if part == "" || part == "." || part == ".." {
+			return nil, opErrorf(codeInvalidArgument, "invalid cursor")
+		}
+	}
+	return parts, nil
+}
+
+func readFile(path string) (string, error) {
+	path, err := canonicalize(path)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := openVerified(path, os.O_RDONLY, 0)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if err := checkNotDir(path, info); err != nil {
+		return "", err
+	}
+	content, err, _ := sharedReads.Do(readKey("read", path, info), func() (interface{}, error) {
+		release, err := readBuffers.Reserve(info.Size(), currentConfig().ReadBudget)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+		content, err := io.ReadAll(f)
+		return string(content), err
+	})
+	if err != nil {
+		return "", err
+	}
+	return content.(string), nil
+}
+
+// readModeHeader tells the client how read_file answered: "stream" when
+// the body is the raw file rather than a JSON Response.
+const readModeHeader = "X-Read-Mode"
+
+// shouldStream reports whether a read of a file of size is streamed: when
+// the client asked for it, or when the file is over a threshold that is
+// set.
+func shouldStream(size, threshold int64, requested bool) bool {
+	return requested || (threshold > 0 && size > threshold)
+}
+
+// openStreamedRead opens the file at path for read_file if the read is to
+// be streamed. It returns a nil file when the read is buffered instead, so
+// readFile does it as before.
+func openStreamedRead(path string, requested bool) (*os.File, os.FileInfo, error) {
+	config := currentConfig()
+	if !requested && config.StreamThreshold == 0 {
+		return nil, nil, nil
+	}
+	path, err := canonicalize(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := openVerified(path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err == nil {
+		err = checkNotDir(path, info)
+	}
+	if err != nil || !shouldStream(info.Size(), config.StreamThreshold, requested) {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, info, nil
+}
+
+// streamRead sends the file f as the raw body of a read_file response,
+// marked with readModeHeader, and closes it. The body is paced like a
+// download and does not count against ReadBudget.
+func streamRead(w http.ResponseWriter, r *http.Request, f *os.File, info os.FileInfo) error {
+	defer f.Close()
+	w.Header().Set(readModeHeader, "stream")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("ETag", fileETag(info))
+	w.Header().Set("X-File-Size", strconv.FormatInt(info.Size(), 10))
+	w.WriteHeader(http.StatusOK)
+	var content io.Reader = f
+	if bucket := bandwidthBucket(claimsFrom(r)); bucket != nil {
+		content = &throttledReader{f, r.Context(), bucket}
+	}
+	_, err := io.Copy(w, content)
+	return err
+}
+
+// memoryBudget counts the bytes held by buffered reads in flight.
+type memoryBudget struct {
+	mu   sync.Mutex
+	used int64
+}
+
+var readBuffers = &memoryBudget{}
+
+// Reserve sets n bytes aside for a read and returns the func that gives
+// them back. It fails with codeBusy if that would take the total over
+// limit; a limit of zero or less never fails. A single read larger than
+// the whole budget is refused too, however idle the server is.
+func (b *memoryBudget) Reserve(n, limit int64) (func(), error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if limit > 0 && b.used+n > limit {
+		return nil, &OpError{
+			Code:    codeBusy,
+			Message: "too many large reads in progress; try again later or download the file instead",
+			Details: map[string]string{"size": strconv.FormatInt(n, 10), "read_budget": strconv.FormatInt(limit, 10)},
+		}
+	}
+	b.used += n
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			b.used -= n
+		})
+	}, nil
+}
+
+// sharedReads lets concurrent identical reads of one version of a file
+// share a single pass over it: a caller arriving while the read is running
+// waits for its result instead of reading again. Only reads whose whole
+// result is buffered go through it, never streamed downloads.
+var sharedReads singleflight.Group
+
+// readKey identifies a kind of read of one version of a file. The version
+// is its ETag, so a file changed in between is read afresh.
+func readKey(kind, path string, info os.FileInfo) string {
+	return kind + "\x00" + path + "\x00" + fileETag(info)
+}
+
+// dirETag returns a quoted entity tag for the directory at path, computed
+// from the name, size, mode and modification time of each entry. It changes
+// whenever an entry is added, removed or modified.
+func dirETag(path string) (string, error) {
+	path, err := canonicalize(path)
+	if err != nil {
+		return "", err
+	}
+
+	dir, err := openVerified(path, os.O_RDONLY, 0)
+	if err != nil {
+		return "", err
+	}
+	defer dir.Close()
+
+	entries, err := dir.Readdir(-1)
+	if err != nil {
+		return "", err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	// Denied entries are left out as listFiles leaves them out, so the tag
+	// covers exactly what the listing shows.
+	h := sha256.New()
+	for _, e := range entries {
+		if isDenied(filepath.Join(path, e.Name())) {
+			continue
+		}
+		fmt.Fprintf(h, "%s\x00%d\x00%o\x00%d\n", e.Name(), e.Size(), e.Mode(), e.ModTime().UnixNano())
+	}
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`, nil
+}
+
+// etagMatches reports whether an If-None-Match header names etag. Weak
+// tags compare equal to strong ones, as RFC 9110 requires for this header.
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Preview sizes: how much of a file preview returns by default and at most.
+const (
+	defaultPreviewBytes = 4 * 1024
+	maxPreviewBytes     = 64 * 1024
+)
+
+const (
+	defaultLineCount = 100
+	maxLineCount     = 10000
+)
+
+// lineRange is a run of lines read by read_lines. Start is the number of
+// the first line, counting from 1. EOF is set when the file has no lines
+// after the last one returned; Truncated when MaxFileSize bytes of lines
+// were reached before count.
+type lineRange struct {
+	Start     int      `json:"start"`
+	Lines     []string `json:"lines"`
+	EOF       bool     `json:"eof"`
+	Truncated bool     `json:"truncated"`
+}
+
+// readLines returns count lines of path (defaultLineCount if empty, at
+// most maxLineCount) from line start on (1 if empty). The lines before
+// start are skipped as they are read, so only the range is held in
+// memory. A last line without a newline counts as a line. A start past
+// the end returns no lines and EOF.
+func readLines(path, start, count string) (lineRange, error) {
+	first, n := 1, defaultLineCount
+	if start != "" {
+		parsed, err := strconv.Atoi(start)
+		if err != nil || parsed < 1 {
+			return lineRange{}, opErrorf(codeInvalidArgument, "invalid start line: %s", start)
+		}
+		first = parsed
+	}
+	if count != "" {
+		parsed, err := strconv.Atoi(count)
+		if err != nil || parsed < 1 {
+			return lineRange{}, opErrorf(codeInvalidArgument, "invalid line count: %s", count)
+		}
+		n = min(parsed, maxLineCount)
+	}
+
+	path, err := canonicalize(path)
+	if err != nil {
+		return lineRange{}, err
+	}
+	if !isFileTypeAllowed(path) {
+		return lineRange{}, opErrorf(codeTypeDenied, "file type not allowed")
+	}
+
+	f, err := openVerified(path, os.O_RDONLY, 0)
+	if err != nil {
+		return lineRange{}, err
+	}
+	defer f.Close()
+
+	if info, err := f.Stat(); err != nil {
+		return lineRange{}, err
+	} else if err := checkNotDir(path, info); err != nil {
+		return lineRange{}, err
+	} else if !info.Mode().IsRegular() {
+		return lineRange{}, opErrorf(codeInvalidArgument, "not a regular file: %s", path)
+	}
+
+	r := bufio.NewReader(f)
+	result := lineRange{Start: first, Lines: []string{}}
+	// skipLine reads past one line without keeping it, however long.
+	skipLine := func() error {
+		for {
+			_, err := r.ReadSlice('\n')
+			if err != bufio.ErrBufferFull {
+				return err
+			}
+		}
+	}
+	for line := 1; line < first; line++ {
+		if err := skipLine(); err == io.EOF {
+			result.EOF = true
+			return result, nil
+		} else if err != nil {
+			return lineRange{}, err
+		}
+	}
+
+	remaining := currentConfig().MaxFileSize
+	for len(result.Lines) < n {
+		// Read the line in pieces, so one huge line stops at the limit
+		// instead of being read whole.
+		var text []byte
+		var err error
+		for {
+			var chunk []byte
+			chunk, err = r.ReadSlice('\n')
+			if int64(len(text)+len(chunk)) > remaining {
+				result.Truncated = true
+				return result, nil
+			}
+			text = append(text, chunk...)
+			if err != bufio.ErrBufferFull {
+				break
+			}
+		}
+		if err != nil && err != io.EOF {
+			return lineRange{}, err
+		}
+		if len(text) == 0 && err == io.EOF {
+			result.EOF = true
+			break
+		}
+		remaining -= int64(len(text))
+		text = bytes.TrimSuffix(bytes.TrimSuffix(text, []byte("\n")), []byte("\r"))
+		result.Lines = append(result.Lines, string(text))
+		if err == io.EOF {
+			result.EOF = true
+			break
+		}
+	}
+	if !result.EOF && !result.Truncated {
+		if _, err := r.Peek(1); err == io.EOF {
+			result.EOF = true
+		}
+	}
+	return result, nil
+}
+
+// lineCount is the result of line_count.
+type lineCount struct {
+	Lines int64 `json:"lines"`
+	Size  int64 `json:"size"`
+}
+
+// countLines counts the lines of path by reading it through a fixed
+// buffer and counting newlines, so the file is never held in memory. As
+// with read_lines, a last line without a newline counts as a line, and an
+// empty file has none. Files over MaxFileSize are refused.
+func countLines(path string) (lineCount, error) {
+	config := currentConfig()
+	path, err := canonicalize(path)
+	if err != nil {
+		return lineCount{}, err
+	}
+	if !isFileTypeAllowed(path) {
+		return lineCount{}, opErrorf(codeTypeDenied, "file type not allowed")
+	}
+
+	f, err := openVerified(path, os.O_RDONLY, 0)
+	if err != nil {
+		return lineCount{}, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return lineCount{}, err
+	}
+	if err := checkNotDir(path, info); err != nil {
+		return lineCount{}, err
+	}
+	if !info.Mode().IsRegular() {
+		return lineCount{}, opErrorf(codeInvalidArgument, "not a regular file: %s", path)
+	}
+	if info.Size() > config.MaxFileSize {
+		return lineCount{}, &OpError{
+			Code:    codeTooLarge,
+			Message: fmt.Sprintf("file exceeds maximum file size of %d bytes", config.MaxFileSize),
+			Details: map[string]string{"max_file_size": strconv.FormatInt(config.MaxFileSize, 10)},
+		}
+	}
+
+	var result lineCount
+	buf := make([]byte, 64<<10)
+	var last byte
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			result.Lines += int64(bytes.Count(buf[:n], []byte{'\n'}))
+			result.Size += int64(n)
+			last = buf[n-1]
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return lineCount{}, err
+		}
+	}
+	if result.Size > 0 && last != '\n' {
+		result.Lines++
+	}
+	return result, nil
+}
+
+// filePreview is a quick look at a file: its metadata and, for text, the
+// first bytes.
+type filePreview struct {
+	ContentType    string `json:"content_type"`
+	Size           int64  `json:"size"`
+	Binary         bool   `json:"binary"`
+	Text           string `json:"text,omitempty"`
+	Truncated      bool   `json:"truncated"`
+	EstimatedLines int64  `json:"estimated_lines"`
+}
+
+// previewFile reads up to n bytes (defaultPreviewBytes if empty, at most
+// maxPreviewBytes) from the start of path. Binary files report metadata
+// only. For a truncated text file the line count is extrapolated from the
+// lines in the preview.
+func previewFile(path, n string) (filePreview, error) {
+	limit := int64(defaultPreviewBytes)
+	if n != "" {
+		parsed, err := strconv.ParseInt(n, 10, 64)
+		if err != nil || parsed <= 0 {
+			return filePreview{}, opErrorf(codeInvalidArgument, "invalid bytes value: %s", n)
+		}
+		limit = min(parsed, maxPreviewBytes)
+	}
+
+	path, err := canonicalize(path)
+	if err != nil {
+		return filePreview{}, err
+	}
+	if !isFileTypeAllowed(path) {
+		return filePreview{}, opErrorf(codeTypeDenied, "file type not allowed")
+	}
+
+	f, err := openVerified(path, os.O_RDONLY, 0)
+	if err != nil {
+		return filePreview{}, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return filePreview{}, err
+	}
+	if err := checkNotDir(path, info); err != nil {
+		return filePreview{}, err
+	}
+	if !info.Mode().IsRegular() {
+		return filePreview{}, opErrorf(codeInvalidArgument, "not a regular file: %s", path)
+	}
+
+	head, err := io.ReadAll(io.LimitReader(f, limit))
+	if err != nil {
+		return filePreview{}, err
+	}
+
+	p := filePreview{
+		ContentType: mime.TypeByExtension(filepath.Ext(path)),
+		Size:        info.Size(),
+		Truncated:   int64(len(head)) < info.Size(),
+	}
+	if p.ContentType == "" {
+		p.ContentType = http.DetectContentType(head)
+	}
+
+	text := head
+	if p.Truncated {
+		// The cut may fall inside a multi-byte character.
+		for i := 0; i < utf8.UTFMax-1 && len(text) > 0 && !utf8.Valid(text); i++ {
+			text = text[:len(text)-1]
+		}
+	}
+	if !utf8.Valid(text) || bytes.IndexByte(text, 0) >= 0 {
+		p.Binary = true
+		return p, nil
+	}
+
+	p.Text = string(text)
+	lines := int64(bytes.Count(text, []byte("\n")))
+	if len(text) > 0 && text[len(text)-1] != '\n' {
+		lines++
+	}
+	if p.Truncated && len(text) > 0 {
+		lines = lines * info.Size() / int64(len(text))
+	}
+	p.EstimatedLines = lines
+	return p, nil
+}
+
+// readMultiResult is the outcome of reading one file for read_multi.
+type readMultiResult struct {
+	Content string `json:"content,omitempty"`
+	Base64  bool   `json:"base64,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// readMulti reads each path in the JSON array paths, validating them
+// independently so one denied path does not fail the rest. Content that is
+// not valid UTF-8 is base64-encoded. Once MaxFileSize bytes have been read
+// in total, the remaining files report an error instead.
+func readMulti(paths string) (map[string]readMultiResult, error) {
+	var list []string
+	if err := json.Unmarshal([]byte(paths), &list); err != nil {
+		return nil, opErrorf(codeInvalidArgument, "paths must be a JSON array of strings: %v", err)
+	}
+
+	results := make(map[string]readMultiResult, len(list))
+	remaining := currentConfig().MaxFileSize
+	for _, p := range list {
+		content, err := readUpTo(p, remaining)
+		if err != nil {
+			results[p] = readMultiResult{Error: err.Error()}
+			continue
+		}
+		remaining -= int64(len(content))
+
+		if utf8.Valid(content) {
+			results[p] = readMultiResult{Content: string(content)}
+		} else {
+			results[p] = readMultiResult{Content: base64.StdEncoding.EncodeToString(content), Base64: true}
+		}
+	}
+	return results, nil
+}
+
+// readUpTo reads the file at path, failing if it is longer than limit.
+func readUpTo(path string, limit int64) ([]byte, error) {
+	path, err := canonicalize(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := openVerified(path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkNotDir(path, info); err != nil {
+		return nil, err
+	}
+	release, err := readBuffers.Reserve(min(info.Size(), limit+1), currentConfig().ReadBudget)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	content, err := io.ReadAll(io.LimitReader(f, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(content)) > limit {
+		return nil, opErrorf(codeTooLarge, "response size limit reached")
+	}
+	return content, nil
+}
+
+// contentEncodings are the encodings write_file can store content in.
+var contentEncodings = map[string]encoding.Encoding{
+	"utf-8":  encoding.Nop,
+	"latin1": charmap.ISO8859_1,
+}
+
+// encodeContent converts content to the bytes write_file stores. lineEnding
+// is "lf" or "crlf" and rewrites every line break to it; empty leaves the
+// line breaks as sent. enc is "utf-8", the default, or "latin1".
+func encodeContent(content, lineEnding, enc string) ([]byte, error) {
+	switch lineEnding {
+	case "":
+	case "lf":
+		content = strings.ReplaceAll(content, "\r\n", "\n")
+	case "crlf":
+		content = strings.ReplaceAll(strings.ReplaceAll(content, "\r\n", "\n"), "\n", "\r\n")
+	default:
+		return nil, opErrorf(codeInvalidArgument, "line_ending must be lf or crlf")
+	}
+
+	if enc == "" {
+		enc = "utf-8"
+	}
+	e, ok := contentEncodings[strings.ToLower(enc)]
+	if !ok {
+		return nil, opErrorf(codeInvalidArgument, "encoding must be utf-8 or latin1")
+	}
+	data, err := e.NewEncoder().Bytes([]byte(content))
+	if err != nil {
+		return nil, opErrorf(codeInvalidArgument, "content has characters %s cannot represent", enc)
+	}
+	return data, nil
+}
+
+// writeFile replaces the file at path with content. When expectedSHA256 is
+// set, the content is only written if it hashes to that value, so a
+// transfer garbled or cut short on the way is rejected rather than stored.
+// When ifMatch is set, an ETag as a download of the file reported it, the
+// write only goes ahead while the file is still that version, so an edit
+// based on an older read does not clobber a newer one. When exclusive is
+// set, the write only creates the file: it fails with codeAlreadyExists
+// if the file is there already, even if it appears while the write runs.
+func writeFile(path, content, expectedSHA256, lineEnding, enc, ifMatch string, durable, exclusive bool) (bool, error) {
+	config := currentConfig()
+	path, err := canonicalizeWritable(path)
+	if err != nil {
+		return false, err
+	}
+	if err := validateNewPath(path); err != nil {
+		return false, err
+	}
+	if exclusive && ifMatch != "" {
+		return false, opErrorf(codeInvalidArgument, "exclusive and if_match cannot be combined")
+	}
+	info, err := os.Stat(path)
+	exists := err == nil
+	if exists && exclusive {
+		return false, errExists(path)
+	}
+	if exists {
+		if err := checkNotDir(path, info); err != nil {
+			return false, err
+		}
+	}
+	if ifMatch != "" {
+		current := ""
+		if exists {
+			current = fileETag(info)
+		}
+		if current == "" || !etagMatches(decodedETags(ifMatch), current) {
+			return false, &OpError{
+				Code:    codeConflict,
+				Message: fmt.Sprintf("file has changed since it was read: %s", path),
+				Details: map[string]string{"path": path, "etag": current},
+			}
+		}
+	}
+
+	if !isFileTypeAllowed(path) {
+		return false, opErrorf(codeTypeDenied, "file type not allowed")
+	}
+
+	// The checksum covers the content as sent, before it is converted.
+	if expectedSHA256 != "" {
+		sum := sha256.Sum256([]byte(content))
+		if actual := hex.EncodeToString(sum[:]); !strings.EqualFold(actual, expectedSHA256) {
+			return false, &OpError{
+				Code:    codeChecksumMismatch,
+				Message: "content does not match the expected sha256",
+				Details: map[string]string{"expected": expectedSHA256, "actual": actual},
+			}
+		}
+	}
+
+	data, err := encodeContent(content, lineEnding, enc)
+	if err != nil {
+		return false, err
+	}
+
+	if int64(len(data)) > config.MaxFileSize {
+		return false, &OpError{
+			Code:    codeTooLarge,
+			Message: fmt.Sprintf("content exceeds maximum file size of %d bytes", config.MaxFileSize),
+			Details: map[string]string{"max_file_size": strconv.FormatInt(config.MaxFileSize, 10)},
+		}
+	}
+
+	if durable {
+		return true, durableWrite(path, data, exclusive)
+	}
+
+	_, statErr := os.Lstat(path)
+	created := errors.Is(statErr, fs.ErrNotExist)
+
+	// Truncate through the verified handle rather than with O_TRUNC, so a
+	// swapped-in symlink never gets its target emptied.
+	flag := os.O_WRONLY | os.O_CREATE
+	if exclusive {
+		flag |= os.O_EXCL
+		created = true
+	}
+	f, err := openVerified(path, flag, 0644)
+	if exclusive && errors.Is(err, fs.ErrExist) {
+		return false, errExists(path)
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	if err := f.Truncate(0); err != nil {
+		return false, err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		// A file this write created is only a fragment; don't leave it
+		// behind, e.g. when the disk filled up part way.
+		if created {
+			os.Remove(path)
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// writeCheck is the answer of can_write: whether a write_file to the path
+// would be let through and, when not, the code and message of the error
+// it would fail with.
+type writeCheck struct {
+	Writable bool   `json:"writable"`
+	Reason   string `json:"reason,omitempty"`
+	Message  string `json:"message,omitempty"`
+}
+
+// canWrite reports whether the token with claims could write size bytes,
+// a decimal count that may be empty, to path, without touching the file.
+// It runs the checks write_file would: the action and the path are
+// permitted, the root is read-write, the file type is allowed, the size
+// is within max_file_size and the free space, and the parent directory
+// exists. A blocked write is a result, not an error; only a bad size is.
+func canWrite(claims jwt.MapClaims, path, size string) (writeCheck, error) {
+	var n int64
+	if size != "" {
+		var err error
+		if n, err = strconv.ParseInt(size, 10, 64); err != nil || n < 0 {
+			return writeCheck{}, opErrorf(codeInvalidArgument, "invalid size value: %s", size)
+		}
+	}
+	if err := checkWritable(claims, path, n); err != nil {
+		e := asOpError(err)
+		return writeCheck{Reason: e.Code, Message: e.Message}, nil
+	}
+	return writeCheck{Writable: true}, nil
+}
+
+// checkWritable returns the first reason a write of size bytes to path
+// would be refused, or nil.
+func checkWritable(claims jwt.MapClaims, path string, size int64) error {
+	config := currentConfig()
+	if blockedByMaintenance("write_file") {
+		return errMaintenance
+	}
+	if err := authorize(claims, "write_file", path); err != nil {
+		return err
+	}
+	path, err := canonicalizeWritable(path)
+	if err != nil {
+		return err
+	}
+	if err := validateNewPath(path); err != nil {
+		return err
+	}
+	if info, err := os.Stat(path); err == nil {
+		if err := checkNotDir(path, info); err != nil {
+			return err
+		}
+	}
+	if !isFileTypeAllowed(path) {
+		return opErrorf(codeTypeDenied, "file type not allowed")
+	}
+	if size > config.MaxFileSize {
+		return &OpError{
+			Code:    codeTooLarge,
+			Message: fmt.Sprintf("content exceeds maximum file size of %d bytes", config.MaxFileSize),
+			Details: map[string]string{"max_file_size": strconv.FormatInt(config.MaxFileSize, 10)},
+		}
+	}
+
+	parent := filepath.Dir(path)
+	info, err := os.Stat(parent)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return &OpError{
+				Code:    codeNotFound,
+				Message: fmt.Sprintf("parent directory does not exist: %s", parent),
+				Details: map[string]string{"path": parent},
+			}
+		}
+		return err
+	}
+	if !info.IsDir() {
+		return opErrorf(codeInvalidArgument, "parent is not a directory: %s", parent)
+	}
+	// Where free space cannot be told, the write is let through, as the
+	// write itself would be.
+	if usage, err := statDisk(parent); err == nil && uint64(size) > usage.Free {
+		return &OpError{
+			Code:    codeNoSpace,
+			Message: fmt.Sprintf("not enough space on the server: %d bytes needed, %d free", size, usage.Free),
+			Details: map[string]string{"free": strconv.FormatUint(usage.Free, 10)},
+		}
+	}
+	return nil
+}
+
+// syncer flushes files and directories to stable storage.
+type syncer interface {
+	SyncFile(f *os.File) error
+	SyncDir(dir string) error
+}
+
+type osSyncer struct{}
+
+func (osSyncer) SyncFile(f *os.File) error {
+	return f.Sync()
+}
+
+func (osSyncer) SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// fsyncer is the syncer durable writes go through.
+var fsyncer syncer = osSyncer{}
+
+// durableWrite replaces the file at path with data so that it survives a
+// crash: the data goes to a temporary file beside it, which is synced
+// and renamed over path, and then the directory is synced so the rename
+// itself is on disk. Readers see the old content or the new, never a
+// mix. The file keeps the permissions of the one it replaces. When
+// exclusive is set, the temporary file is linked to path instead of
+// renamed, so the write fails rather than replace a file that is there.
+func durableWrite(path string, data []byte, exclusive bool) error {
+	perm := os.FileMode(0644)
+	if info, err := os.Lstat(path); err == nil {
+		if !info.Mode().IsRegular() {
+			return opErrorf(codeInvalidArgument, "not a regular file: %s", path)
+		}
+		perm = info.Mode().Perm()
+	}
+
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	renamed := false
+	defer func() {
+		tmp.Close()
+		if !renamed {
+			os.Remove(tmp.Name())
+		}
+	}()
+	// The directory may have been swapped for a symlink since path was
+	// checked.
+	if err := verifyHandle(tmp, tmp.Name()); err != nil {
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		return err
+	}
+	if err := fsyncer.SyncFile(tmp); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if exclusive {
+		// The link leaves the temporary name behind, which the deferred
+		// cleanup removes.
+		if err := os.Link(tmp.Name(), path); err != nil {
+			if errors.Is(err, fs.ErrExist) {
+				return errExists(path)
+			}
+			return err
+		}
+		return fsyncer.SyncDir(dir)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	renamed = true
+	return fsyncer.SyncDir(dir)
+}
+
+// createFolder creates the directory at path and any missing parents. An
+// existing directory is fine unless exclusive is set; then the last
+// component must be created by this call, or it fails with
+// codeAlreadyExists.
+func createFolder(path string, exclusive bool) (bool, error) {
+	path, err := canonicalizeWritable(path)
+	if err != nil {
+		return false, err
+	}
+	if err := validateNewPath(path); err != nil {
+		return false, err
+	}
+	if err := checkFolderDepth(path, 0); err != nil {
+		return false, err
+	}
+
+	if exclusive {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return false, err
+		}
+		if err := os.Mkdir(path, 0755); err != nil {
+			if errors.Is(err, fs.ErrExist) {
+				return false, errExists(path)
+			}
+			return false, err
+		}
+	} else if err := os.MkdirAll(path, 0755); err != nil {
+		return false, err
+	}
+
+	// MkdirAll follows symlinks, so confirm afterwards that what was created
+	// is still the directory that was checked.
+	dir, err := openVerified(path, os.O_RDONLY, 0)
+	if err != nil {
+		return false, err
+	}
+	return true, dir.Close()
+}
+
+// retypeTarget returns path with its extension replaced by ext, which may be
+// given with or without the leading dot.
+func retypeTarget(path, ext string) (string, error) {
+	if ext != "" && !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	if len(ext) < 2 || strings.ContainsAny(ext[1:], `./\`) {
+		return "", opErrorf(codeInvalidArgument, "invalid extension: %q", ext)
+	}
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ext, nil
+}
+
+// retypeFile renames a file to the same base name with a new extension, e.g.
+// app.log to app.txt. Both names must be allowed file types, and an existing
+// file is never replaced.
+func retypeFile(path, ext string) (map[string]string, error) {
+	path, err := canonicalizeWritable(path)
+	if err != nil {
+		return nil, err
+	}
+	if !isFileTypeAllowed(path) {
+		return nil, opErrorf(codeTypeDenied, "file type not allowed")
+	}
+
+	target, err := retypeTarget(path, ext)
+	if err != nil {
+		return nil, err
+	}
+	if !isPathAllowed(target) {
+		return nil, opErrorf(codePathDenied, "access denied to path: %s", target)
+	}
+	if err := validateNewPath(target); err != nil {
+		return nil, err
+	}
+	if !isFileTypeAllowed(target) {
+		return nil, &OpError{
+			Code:    codeTypeDenied,
+			Message: fmt.Sprintf("file type not allowed: %s", filepath.Ext(target)),
+			Details: map[string]string{"extension": filepath.Ext(target)},
+		}
+	}
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, opErrorf(codeInvalidArgument, "not a regular file: %s", path)
+	}
+	if target == path {
+		return map[string]string{"path": target}, nil
+	}
+	if _, err := os.Lstat(target); err == nil {
+		return nil, opErrorf(codeAlreadyExists, "target already exists: %s", target)
+	}
+	if err := os.Rename(path, target); err != nil {
+		return nil, err
+	}
+	return map[string]string{"path": target}, nil
+}
+
+// parseMode parses an octal permission string such as "0644". Only the
+// permission bits are accepted; setuid, setgid and sticky are not.
+func parseMode(s string) (os.FileMode, error) {
+	n, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || n > 0777 {
+		return 0, fmt.Errorf("%q is not an octal permission mode between 0000 and 0777", s)
+	}
+	return os.FileMode(n), nil
+}
+
+// chmodPaths sets the permission bits of path, and with recursive of
+// everything below it, to mode. The mode may not grant anything
+// config.MaxMode does not. Every entry is checked before any is changed,
+// so a rejected entry leaves the whole tree as it was. Symlinks are
+// skipped rather than followed. It returns how many entries changed.
+func chmodPaths(path, mode string, recursive bool) (int, error) {
+	perm, err := parseMode(mode)
+	if err != nil {
+		return 0, opErrorf(codeInvalidArgument, "mode: %v", err)
+	}
+	limit, err := parseMode(currentConfig().MaxMode)
+	if err != nil {
+		return 0, err
+	}
+	if perm&^limit != 0 {
+		return 0, &OpError{
+			Code:    codeInvalidArgument,
+			Message: fmt.Sprintf("mode %04o grants more than the maximum %04o", perm, limit),
+			Details: map[string]string{"max_mode": fmt.Sprintf("%04o", limit)},
+		}
+	}
+
+	root, err := canonicalizeWritable(path)
+	if err != nil {
+		return 0, err
+	}
+
+	targets := []string{root}
+	if recursive {
+		targets = targets[:0]
+		err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.Type()&fs.ModeSymlink != 0 {
+				return nil
+			}
+			if isDenied(p) {
+				return skipDenied(d)
+			}
+			targets = append(targets, p)
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	for _, p := range targets {
+		// A read-only root nested below the target stays read-only.
+		if _, err := canonicalizeWritable(p); err != nil {
+			return 0, err
+		}
+		info, err := os.Lstat(p)
+		if err != nil {
+			return 0, err
+		}
+		if info.Mode().IsRegular() && !isFileTypeAllowed(p) {
+			return 0, opErrorf(codeTypeDenied, "file type not allowed: %s", p)
+		}
+	}
+
+	// Children go first, so a mode without search permission on a
+	// directory does not lock the server out of what is below it.
+	changed := 0
+	for i := len(targets) - 1; i >= 0; i-- {
+		p := targets[i]
+		info, err := os.Lstat(p)
+		if err != nil {
+			return changed, err
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return changed, opErrorf(codeConflict, "path changed during operation: %s", p)
+		}
+		if info.Mode().Perm() == perm {
+			continue
+		}
+		if err := chmodEntry(p, info, perm); err != nil {
+			return changed, err
+		}
+		changed++
+	}
+	return changed, nil
+}
+
+// chmodEntry sets the permission bits of path, the entry Lstat reported as
+// info, without following a symlink swapped in since. It needs no access
+// to the entry itself, so a mode that locks the server out of a file can
+// still be fixed. Server_chmod_linux.go replaces it with one that changes
+// the very entry it checked.
+var chmodEntry = chmodLstat
+
+// chmodLstat changes the mode by path once Lstat shows it still names the
+// entry, leaving a short window in which it could be swapped.
+func chmodLstat(path string, info os.FileInfo, perm os.FileMode) error {
+	current, err := os.Lstat(path)
+	if err != nil || !os.SameFile(info, current) {
+		return opErrorf(codeConflict, "path changed during operation: %s", path)
+	}
+	return os.Chmod(path, perm)
+}
+
+// symlinkTarget returns where a link at link pointing to target leads: a
+// relative target is taken from the link's directory.
+func symlinkTarget(link, target string) string {
+	if filepath.IsAbs(target) {
+		return target
+	}
+	return filepath.Join(filepath.Dir(filepath.Clean(link)), target)
+}
+
+// createSymlink creates a symlink at link pointing to target. The link
+// must be a new path in a writable root and the target, followed through
+// any symlinks of its own, must lie within the allowed roots; it need not
+// exist yet. target is stored as given, so a relative link stays relative.
+// Later operations canonicalize through the link as usual, so it never
+// grants more than its target's root allows.
+func createSymlink(link, target string) (bool, error) {
+	if target == "" {
+		return false, opErrorf(codeInvalidArgument, "target is required")
+	}
+	name := link
+	link, err := canonicalizeWritable(link)
+	if err != nil {
+		return false, err
+	}
+	if err := validateNewPath(link); err != nil {
+		return false, err
+	}
+	if _, err := os.Lstat(link); err == nil {
+		return false, opErrorf(codeAlreadyExists, "already exists: %s", name)
+	}
+
+	if _, err := canonicalize(symlinkTarget(link, target)); err != nil {
+		var opErr *OpError
+		if errors.As(err, &opErr) && opErr.Code == codePathDenied {
+			return false, &OpError{
+				Code:    codePathDenied,
+				Message: fmt.Sprintf("symlink target is outside the allowed paths: %s", target),
+				Details: map[string]string{"target": target},
+			}
+		}
+		return false, err
+	}
+
+	if err := os.Symlink(target, link); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// swapFiles exchanges the contents of two files. Each path always holds a
+// complete file: both are hard-linked to temporary names first, then each
+// temporary name is renamed over the other path. Between the two renames
+// both paths briefly hold b's content. If a step fails, the links made so
+// far are undone and a is restored, leaving both files as they were. Both
+// files must be on the same filesystem.
+func swapFiles(a, b string) (bool, error) {
+	a, err := canonicalizeWritable(a)
+	if err != nil {
+		return false, err
+	}
+	if b == "" {
+		return false, opErrorf(codeInvalidArgument, "destination is required")
+	}
+	b, err = canonicalizeWritable(b)
+	if err != nil {
+		return false, err
+	}
+	if a == b {
+		return false, opErrorf(codeInvalidArgument, "cannot swap a file with itself")
+	}
+	for _, p := range []string{a, b} {
+		if !isFileTypeAllowed(p) {
+			return false, opErrorf(codeTypeDenied, "file type not allowed: %s", p)
+		}
+		info, err := os.Lstat(p)
+		if err != nil {
+			return false, err
+		}
+		if !info.Mode().IsRegular() {
+			return false, opErrorf(codeInvalidArgument, "not a regular file: %s", p)
+		}
+	}
+
+	// tmpA will replace b and tmpB will replace a, so each lives next to
+	// the path it is renamed over.
+	tmpA, tmpB := swapTempName(b), swapTempName(a)
+	if err := os.Link(a, tmpA); err != nil {
+		return false, err
+	}
+	if err := os.Link(b, tmpB); err != nil {
+		os.Remove(tmpA)
+		return false, err
+	}
+	if err := swapRename(tmpB, a); err != nil {
+		os.Remove(tmpA)
+		os.Remove(tmpB)
+		return false, err
+	}
+	if err := swapRename(tmpA, b); err != nil {
+		// a already holds b's content; put the original back.
+		if rerr := swapRename(tmpA, a); rerr != nil {
+			log.Printf("swap: could not restore %s, original kept at %s: %v", a, tmpA, rerr)
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// swapRename makes the renames of swapFiles. Tests replace it to make a
+// step fail.
+var swapRename = os.Rename
+
+// swapTempName returns an unused-looking name next to path for swapFiles.
+func swapTempName(path string) string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".swap-"+hex.EncodeToString(buf))
+}
+
+// movePath moves the file or directory at src to dst, which must not
+// exist yet. The two may be in different allowed roots, e.g. a staging
+// root and a published one; both must be read-write, as the move removes
+// src. A file on another filesystem is copied and then removed; a
+// directory there is refused.
+func movePath(src, dst string) (bool, error) {
+	src, err := canonicalizeWritable(src)
+	if err != nil {
+		return false, err
+	}
+	if dst == "" {
+		return false, opErrorf(codeInvalidArgument, "destination is required")
+	}
+	dst, err = canonicalizeWritable(dst)
+	if err != nil {
+		return false, err
+	}
+	if err := validateNewPath(dst); err != nil {
+		return false, err
+	}
+	for _, allowed := range currentConfig().AllowedPaths {
+		if root, err := resolveExisting(filepath.Clean(allowed.Path)); err == nil && root == src {
+			return false, opErrorf(codeInvalidArgument, "cannot move an allowed root: %s", src)
+		}
+	}
+
+	info, err := os.Lstat(src)
+	if err != nil {
+		return false, err
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		return false, opErrorf(codeAlreadyExists, "destination already exists: %s", dst)
+	}
+
+	switch {
+	case info.Mode().IsRegular():
+		for _, p := range []string{src, dst} {
+			if !isFileTypeAllowed(p) {
+				return false, opErrorf(codeTypeDenied, "file type not allowed: %s", p)
+			}
+		}
+		// A link fails if dst has appeared since it was checked, where
+		// a rename would replace it; so does the copy across filesystems.
+		err := os.Link(src, dst)
+		if errors.Is(err, syscall.EXDEV) {
+			err = copyFile(src, dst, true)
+		}
+		if err != nil {
+			return false, err
+		}
+		return true, os.Remove(src)
+
+	case info.IsDir():
+		if isWithin(dst, src) {
+			return false, opErrorf(codeInvalidArgument, "cannot move a directory into itself")
+		}
+		deepest := 0
+		err := filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+			if err == nil && d.IsDir() {
+				deepest = max(deepest, pathDepth(src, p))
+			}
+			return err
+		})
+		if err != nil {
+			return false, err
+		}
+		if err := checkFolderDepth(dst, deepest); err != nil {
+			return false, err
+		}
+		if err := os.Rename(src, dst); err != nil {
+			if errors.Is(err, syscall.EXDEV) {
+				return false, opErrorf(codeUnsupported, "cannot move a directory to another filesystem: %s", dst)
+			}
+			return false, err
+		}
+		return true, nil
+	}
+	return false, opErrorf(codeInvalidArgument, "not a regular file or directory: %s", src)
+}
+
+// diskUsage is the capacity of the filesystem backing a path, in bytes.
+type diskUsage struct {
+	Total uint64 `json:"total"`
+	Free  uint64 `json:"free"`
+	Used  uint64 `json:"used"`
+}
+
+// statDisk queries the filesystem holding path. Platform implementations in
+// Server_statfs.go and Server_windows.go replace it; built without them,
+// disk_usage reports that it is unsupported instead of failing to compile.
+var statDisk = func(path string) (diskUsage, error) {
+	return diskUsage{}, opErrorf(codeUnsupported, "disk usage is not supported on %s", runtime.GOOS)
+}
+
+func diskUsageOf(path string) (diskUsage, error) {
+	path, err := canonicalize(path)
+	if err != nil {
+		return diskUsage{}, err
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		return diskUsage{}, err
+	}
+	return statDisk(path)
+}
+
+// rotationLayout is the timestamp inserted into rotated file names. It is
+// fixed-width so names sort lexically in time order, which pruning relies on.
+const rotationLayout = "20060102T150405.000Z"
+
+// rotateResult reports what a rotate operation did.
+type rotateResult struct {
+	Rotated string   `json:"rotated"`
+	Pruned  []string `json:"pruned"`
+}
+
+// rotateFile renames the file at path to stem-<timestamp>.ext, optionally
+// gzips it, and leaves a fresh empty file at path with the same mode. When
+// keep is a positive number, older rotations beyond the newest keep are
+// deleted.
+func rotateFile(path string, compress bool, keep string) (rotateResult, error) {
+	path, err := canonicalizeWritable(path)
+	if err != nil {
+		return rotateResult{}, err
+	}
+
+	if !isFileTypeAllowed(path) {
+		return rotateResult{}, opErrorf(codeTypeDenied, "file type not allowed")
+	}
+
+	retain := 0
+	if keep != "" {
+		retain, err = strconv.Atoi(keep)
+		if err != nil || retain < 0 {
+			return rotateResult{}, opErrorf(codeInvalidArgument, "invalid keep value: %s", keep)
+		}
+	}
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		return rotateResult{}, err
+	}
+	if !info.Mode().IsRegular() {
+		return rotateResult{}, opErrorf(codeInvalidArgument, "not a regular file: %s", path)
+	}
+
+	rotated, err := rotatedName(path, time.Now())
+	if err != nil {
+		return rotateResult{}, err
+	}
+	if err := os.Rename(path, rotated); err != nil {
+		return rotateResult{}, err
+	}
+
+	fresh, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return rotateResult{}, err
+	}
+	if err := fresh.Close(); err != nil {
+		return rotateResult{}, err
+	}
+
+	if compress {
+		if rotated, err = gzipFile(rotated, info.Mode().Perm()); err != nil {
+			return rotateResult{}, err
+		}
+	}
+
+	result := rotateResult{Rotated: rotated, Pruned: []string{}}
+	if retain > 0 {
+		if result.Pruned, err = pruneRotations(path, retain); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// rotatedName returns the name path is rotated to at t.
+func rotatedName(path string, t time.Time) (string, error) {
+	ext := filepath.Ext(path)
+	name := strings.TrimSuffix(path, ext) + "-" + t.UTC().Format(rotationLayout) + ext
+
+	for _, candidate := range []string{name, name + ".gz"} {
+		if _, err := os.Lstat(candidate); !os.IsNotExist(err) {
+			return "", opErrorf(codeAlreadyExists, "rotation target already exists: %s", candidate)
+		}
+	}
+	return name, nil
+}
+
+// gzipFile compresses path to path+".gz", created with perm, and removes
+// the original.
+func gzipFile(path string, perm os.FileMode) (string, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	target := path + ".gz"
+	dst, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return "", err
+	}
+
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(target)
+		return "", err
+	}
+
+	src.Close()
+	return target, os.Remove(path)
+}
+
+// pruneRotations deletes all but the newest keep rotations of path and
+// returns the removed names.
+func pruneRotations(path string, keep int) ([]string, error) {
+	ext := filepath.Ext(path)
+	prefix := filepath.Base(strings.TrimSuffix(path, ext)) + "-"
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+
+	var rotations []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		stamp := strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".gz")
+		if !strings.HasSuffix(stamp, ext) {
+			continue
+		}
+		if _, err := time.Parse(rotationLayout, strings.TrimSuffix(stamp, ext)); err != nil {
+			continue
+		}
+		rotations = append(rotations, name)
+	}
+
+	// Newest first; the layout sorts chronologically.
+	sort.Sort(sort.Reverse(sort.StringSlice(rotations)))
+
+	pruned := []string{}
+	if len(rotations) <= keep {
+		return pruned, nil
+	}
+	for _, name := range rotations[keep:] {
+		full := filepath.Join(filepath.Dir(path), name)
+		if err := os.Remove(full); err != nil {
+			return pruned, err
+		}
+		pruned = append(pruned, full)
+	}
+	return pruned, nil
+}
+
+// copyDir starts copying the directory tree at src to dst in the background
+// and returns the operation ID to follow its progress at /api/progress.
+// Files whose type is not allowed and anything that is not a regular file or
+// directory are skipped.
+func copyDir(src, dst string) (map[string]string, error) {
+	src, err := canonicalize(src)
+	if err != nil {
+		return nil, err
+	}
+	dst, err = canonicalizeWritable(dst)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateNewPath(dst); err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(src)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, opErrorf(codeInvalidArgument, "not a directory: %s", src)
+	}
+	if isWithin(dst, src) {
+		return nil, opErrorf(codeInvalidArgument, "cannot copy a directory into itself")
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		return nil, opErrorf(codeAlreadyExists, "destination already exists: %s", dst)
+	}
+
+	var files []string
+	deepest := 0
+	err = filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if isDenied(p) {
+			return skipDenied(d)
+		}
+		if d.IsDir() {
+			deepest = max(deepest, pathDepth(src, p))
+		}
+		if d.Type().IsRegular() && isFileTypeAllowed(p) {
+			files = append(files, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := checkFolderDepth(dst, deepest); err != nil {
+		return nil, err
+	}
+
+	id, events := progress.Start()
+	done := inflight.Begin("copy_dir", src, "")
+	go func() {
+		defer done()
+		defer close(events)
+		err := copyTree(src, dst, len(files), events)
+		final := progressEvent{Percent: 100, Done: true}
+		if err != nil {
+			final.Error = err.Error()
+		}
+		events <- final
+	}()
+
+	return map[string]string{"operation_id": id}, nil
+}
+
+// copyTree does the work of copyDir, reporting each copied file on events.
+func copyTree(src, dst string, total int, events chan<- progressEvent) error {
+	copied := 0
+	return filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if isDenied(p) {
+			return skipDenied(d)
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, 0755)
+		case d.Type().IsRegular() && isFileTypeAllowed(p):
+			if err := copyFile(p, target, false); err != nil {
+				return err
+			}
+			copied++
+			events <- progressEvent{
+				Percent:     100 * float64(copied) / float64(total),
+				CurrentFile: rel,
+			}
+		}
+		return nil
+	})
+}
+
+// copyFile copies src to dst, which is created with src's permission
+// bits. With exclusive it fails if dst exists rather than replacing it.
+func copyFile(src, dst string, exclusive bool) error {
+	in, err := openVerified(src, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	flag := os.O_WRONLY | os.O_CREATE
+	if exclusive {
+		flag |= os.O_EXCL
+	}
+	out, err := openVerified(dst, flag, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if err := out.Truncate(0); err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		// Don't leave a partial copy that looks like a complete one.
+		os.Remove(dst)
+	}
+	return err
+}
+
+// manifestEntry describes one file in a directory manifest.
+type manifestEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	SHA256  string    `json:"sha256"`
+}
+
+// manifest returns every file under path keyed by its slash-separated path
+// relative to it, so a client can diff its local tree against the server's.
+func manifest(path string) (map[string]manifestEntry, error) {
+	entries := make(map[string]manifestEntry)
+	err := walkManifest(path, func(rel string, e manifestEntry) error {
+		entries[rel] = e
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// walkManifest hashes each file under path in lexical order and hands it to
+// fn. As with copyDir, only regular files of an allowed type are included.
+func walkManifest(path string, fn func(rel string, e manifestEntry) error) error {
+	root, err := canonicalize(path)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return opErrorf(codeInvalidArgument, "not a directory: %s", root)
+	}
+
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if isDenied(p) {
+			return skipDenied(d)
+		}
+		if !d.Type().IsRegular() || !isFileTypeAllowed(p) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		e, err := hashFile(p)
+		if err != nil {
+			return err
+		}
+		return fn(filepath.ToSlash(rel), e)
+	})
+}
+
+// duplicateGroup is a set of files with the same content.
+type duplicateGroup struct {
+	SHA256 string   `json:"sha256"`
+	Size   int64    `json:"size"`
+	Paths  []string `json:"paths"`
+}
+
+// duplicateReport is the result of find_duplicates. Truncated is set when
+// the directory held more than MaxDuplicateScan files and only the first
+// ones, in lexical order, were compared.
+type duplicateReport struct {
+	Groups    []duplicateGroup `json:"groups"`
+	Scanned   int              `json:"scanned"`
+	Truncated bool             `json:"truncated"`
+}
+
+// findDuplicates groups the files under path by content and returns the
+// groups with more than one member, largest files first, with paths
+// relative to path as in a manifest. Files are compared by size first and
+// only those sharing a size are hashed, each one streamed through SHA-256.
+// As with walkManifest, only regular files of an allowed type count.
+func findDuplicates(path string) (duplicateReport, error) {
+	root, err := canonicalize(path)
+	if err != nil {
+		return duplicateReport{}, err
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return duplicateReport{}, err
+	}
+	if !info.IsDir() {
+		return duplicateReport{}, opErrorf(codeInvalidArgument, "not a directory: %s", root)
+	}
+
+	report := duplicateReport{Groups: []duplicateGroup{}}
+	bySize := make(map[int64][]string)
+	err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if isDenied(p) {
+			return skipDenied(d)
+		}
+		if !d.Type().IsRegular() || !isFileTypeAllowed(p) {
+			return nil
+		}
+		if report.Scanned == currentConfig().MaxDuplicateScan {
+			report.Truncated = true
+			return filepath.SkipAll
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		report.Scanned++
+		bySize[info.Size()] = append(bySize[info.Size()], p)
+		return nil
+	})
+	if err != nil {
+		return duplicateReport{}, err
+	}
+
+	for size, paths := range bySize {
+		if len(paths) < 2 {
+			continue
+		}
+		bySum := make(map[string][]string)
+		for _, p := range paths {
+			e, err := hashFile(p)
+			if err != nil {
+				return duplicateReport{}, err
+			}
+			rel, err := filepath.Rel(root, p)
+			if err != nil {
+				return duplicateReport{}, err
+			}
+			bySum[e.SHA256] = append(bySum[e.SHA256], filepath.ToSlash(rel))
+		}
+		for sum, rels := range bySum {
+			if len(rels) > 1 {
+				report.Groups = append(report.Groups, duplicateGroup{SHA256: sum, Size: size, Paths: rels})
+			}
+		}
+	}
+	sort.Slice(report.Groups, func(i, j int) bool {
+		a, b := report.Groups[i], report.Groups[j]
+		if a.Size != b.Size {
+			return a.Size > b.Size
+		}
+		return a.SHA256 < b.SHA256
+	})
+	return report, nil
+}
+
+// streamTar writes every allowed file below path to w as a tar archive,
+// gzipped if compress is set. Files are copied one at a time straight into
+// the response, so nothing is staged on disk. Symlinks, files that resolve
+// outside the allowed roots and files over MaxFileSize are left out with a
+// warning in the log. Errors before the first byte is sent are reported as
+// usual; after that the archive is cut short and the error only returned.
+func streamTar(w http.ResponseWriter, r *http.Request, path string, compress bool) error {
+	root, err := canonicalize(path)
+	if err == nil {
+		var info os.FileInfo
+		if info, err = os.Stat(root); err == nil && !info.IsDir() {
+			err = opErrorf(codeInvalidArgument, "not a directory: %s", root)
+		}
+	}
+	if err != nil {
+		sendError(w, err)
+		return err
+	}
+
+	name, contentType := filepath.Base(root)+".tar", "application/x-tar"
+	if compress {
+		name, contentType = name+".gz", "application/gzip"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	// Clients measure progress against the size of the file contents.
+	if size, err := tarContentSize(root); err == nil {
+		w.Header().Set("X-Archive-Size", strconv.FormatInt(size, 10))
+	}
+
+	var out io.Writer = w
+	if compress {
+		zw := gzip.NewWriter(w)
+		defer zw.Close()
+		out = zw
+	}
+	tw := tar.NewWriter(out)
+
+	err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := r.Context().Err(); err != nil {
+			return err
+		}
+		if d.Type()&fs.ModeSymlink != 0 {
+			log.Printf("tar_stream: skipping symlink %s", p)
+			return nil
+		}
+		if isDenied(p) {
+			return skipDenied(d)
+		}
+		if !d.Type().IsRegular() || !isFileTypeAllowed(p) {
+			return nil
+		}
+		return addTarFile(tw, r, root, p)
+	})
+	if err != nil {
+		log.Printf("tar_stream of %s aborted: %v", root, err)
+		return err
+	}
+	return tw.Close()
+}
+
+// tarContentSize adds up the sizes of the files streamTar would send from
+// root, without opening them.
+func tarContentSize(root string) (int64, error) {
+	var total int64
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && isDenied(p) {
+			return skipDenied(d)
+		}
+		if err != nil || !d.Type().IsRegular() || !isFileTypeAllowed(p) {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.Size() <= currentConfig().MaxFileSize {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total, err
+}
+
+// addTarFile appends the file at p to tw under its path relative to root.
+// Files that cannot be verified or are too large are skipped, not fatal.
+func addTarFile(tw *tar.Writer, r *http.Request, root, p string) error {
+	config := configFrom(r.Context())
+	f, err := openVerified(p, os.O_RDONLY, 0)
+	if err != nil {
+		log.Printf("tar_stream: skipping %s: %v", p, err)
+		return nil
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() > config.MaxFileSize {
+		log.Printf("tar_stream: skipping %s: %d bytes exceeds the %d byte limit", p, info.Size(), config.MaxFileSize)
+		return nil
+	}
+
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return err
+	}
+	hdr.Name = filepath.ToSlash(rel)
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	// A file that grows while it is read is cut at the size in its header.
+	_, err = io.Copy(tw, throttle(r, io.LimitReader(f, info.Size())))
+	return err
+}
+
+// An exec response body is a sequence of frames: a stream id byte, the
+// payload length as a big-endian uint32 and the payload. Output frames
+// carry bytes as the command wrote them; the last frame is execExit, with
+// the exit code as a big-endian int32, or -1 if the command was killed.
+const (
+	execStdout byte = 1
+	execStderr byte = 2
+	execExit   byte = 3
+)
+
+const execContentType = "application/x-exec-frames"
+
+// frameWriter writes exec frames to w one at a time and flushes each, so
+// output reaches the client while the command runs. Once limit bytes of
+// output have been written, further output is dropped and overflow is
+// called.
+type frameWriter struct {
+	mu        sync.Mutex
+	w         io.Writer
+	flusher   http.Flusher
+	remaining int64
+	overflow  func()
+	truncated bool
+}
+
+func (fw *frameWriter) WriteFrame(stream byte, payload []byte) error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	return fw.writeFrame(stream, payload)
+}
+
+func (fw *frameWriter) writeFrame(stream byte, payload []byte) error {
+	var header [5]byte
+	header[0] = stream
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	if _, err := fw.w.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := fw.w.Write(payload); err != nil {
+		return err
+	}
+	if fw.flusher != nil {
+		fw.flusher.Flush()
+	}
+	return nil
+}
+
+// output writes p as a frame on stream, counting it against the output
+// limit.
+func (fw *frameWriter) output(stream byte, p []byte) (int, error) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	if fw.truncated {
+		return len(p), nil
+	}
+	n := len(p)
+	if int64(len(p)) > fw.remaining {
+		p = p[:fw.remaining]
+		fw.truncated = true
+	}
+	fw.remaining -= int64(len(p))
+	if len(p) > 0 {
+		if err := fw.writeFrame(stream, p); err != nil {
+			return 0, err
+		}
+	}
+	if fw.truncated && fw.overflow != nil {
+		fw.overflow()
+	}
+	return n, nil
+}
+
+// WriteExit writes the final frame.
+func (fw *frameWriter) WriteExit(code int) error {
+	var payload [4]byte
+	binary.BigEndian.PutUint32(payload[:], uint32(int32(code)))
+	return fw.WriteFrame(execExit, payload[:])
+}
+
+// streamWriter is the io.Writer a command writes one of its streams to.
+type streamWriter struct {
+	fw     *frameWriter
+	stream byte
+}
+
+func (s streamWriter) Write(p []byte) (int, error) {
+	return s.fw.output(s.stream, p)
+}
+
+// execCommand resolves the exec parameters: the configured binary for
+// "command", the arguments in the JSON array "args" and the working
+// directory "path", which must be an allowed directory.
+func execCommand(params map[string]string) (bin string, args []string, dir string, err error) {
+	config := currentConfig()
+	bin, ok := config.ExecCommands[params["command"]]
+	if !ok {
+		return "", nil, "", opErrorf(codeNotAllowed, "command %q is not allowed", params["command"])
+	}
+	if raw := params["args"]; raw != "" {
+		if err := json.Unmarshal([]byte(raw), &args); err != nil {
+			return "", nil, "", opErrorf(codeInvalidArgument, "args must be a JSON array of strings: %v", err)
+		}
+	}
+	if dir, err = canonicalize(params["path"]); err != nil {
+		return "", nil, "", err
+	}
+	if info, err := os.Stat(dir); err != nil {
+		return "", nil, "", err
+	} else if !info.IsDir() {
+		return "", nil, "", opErrorf(codeInvalidArgument, "not a directory: %s", dir)
+	}
+	if args, _, err = checkExecArgs(config.ExecArgs[params["command"]], args, dir); err != nil {
+		return "", nil, "", err
+	}
+	return bin, args, dir, nil
+}
+
+// execArgsPath is the ExecArgPolicy.Args value that admits allowed paths.
+const execArgsPath = "path"
+
+// fullMatch compiles pattern so that it must match a whole argument.
+func fullMatch(pattern string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + pattern + ")$")
+}
+
+func (p ExecArgPolicy) validate() error {
+	for flag, pattern := range p.Flags {
+		if !strings.HasPrefix(flag, "-") || flag == "-" || flag == "--" {
+			return fmt.Errorf("%q is not a flag", flag)
+		}
+		if _, err := fullMatch(pattern); err != nil {
+			return fmt.Errorf("flag %s: %v", flag, err)
+		}
+	}
+	if p.Args != "" && p.Args != execArgsPath {
+		if _, err := fullMatch(p.Args); err != nil {
+			return fmt.Errorf("args: %v", err)
+		}
+	}
+	if p.MaxArgs < 0 {
+		return fmt.Errorf("max_args must not be negative")
+	}
+	return nil
+}
+
+// checkExecArgs checks args against policy and returns them with every
+// path argument replaced by its canonical form, so the command opens
+// exactly the file that was checked. The paths are also returned on
+// their own. Anything after "--" is never taken as a flag.
+func checkExecArgs(policy ExecArgPolicy, args []string, dir string) (checked, paths []string, err error) {
+	denied := func(arg, format string, a ...interface{}) error {
+		return &OpError{
+			Code:    codeArgumentDenied,
+			Message: fmt.Sprintf(format, a...),
+			Details: map[string]string{"argument": arg},
+		}
+	}
+
+	checked = make([]string, 0, len(args))
+	positional, flagsDone := 0, false
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !flagsDone && arg == "--" {
+			flagsDone = true
+			checked = append(checked, arg)
+			continue
+		}
+		if !flagsDone && strings.HasPrefix(arg, "-") && arg != "-" {
+			flag, value, inline := strings.Cut(arg, "=")
+			pattern, ok := policy.Flags[flag]
+			if !ok {
+				return nil, nil, denied(arg, "flag %s is not allowed", flag)
+			}
+			if pattern == "" {
+				if inline {
+					return nil, nil, denied(arg, "flag %s takes no value", flag)
+				}
+				checked = append(checked, arg)
+				continue
+			}
+			if !inline {
+				if i+1 == len(args) {
+					return nil, nil, denied(arg, "flag %s needs a value", flag)
+				}
+				i++
+				value = args[i]
+			}
+			if re, _ := fullMatch(pattern); !re.MatchString(value) {
+				return nil, nil, denied(value, "value %q is not allowed for flag %s", value, flag)
+			}
+			if inline {
+				checked = append(checked, arg)
+			} else {
+				checked = append(checked, flag, value)
+			}
+			continue
+		}
+
+		positional++
+		if policy.Args == "" || (policy.MaxArgs > 0 && positional > policy.MaxArgs) {
+			return nil, nil, denied(arg, "argument %q is not allowed", arg)
+		}
+		if policy.Args != execArgsPath {
+			if re, _ := fullMatch(policy.Args); !re.MatchString(arg) {
+				return nil, nil, denied(arg, "argument %q is not allowed", arg)
+			}
+			checked = append(checked, arg)
+			continue
+		}
+		p := arg
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(dir, p)
+		}
+		resolved, err := canonicalize(p)
+		if err != nil {
+			return nil, nil, denied(arg, "path %q is not allowed: %v", arg, err)
+		}
+		checked = append(checked, resolved)
+		paths = append(paths, resolved)
+	}
+	return checked, paths, nil
+}
+
+// streamExec runs a configured command and streams its stdout and stderr
+// to w as exec frames, ending with its exit code. The command gets only
+// PATH from the server's environment, so secrets such as JWT_SECRET do
+// not leak into it. It is killed after ExecTimeout, when the client goes
+// away or once it has written MaxFileSize bytes; the reason is sent as a
+// last stderr frame. Errors before the command starts are sent as a
+// normal JSON error.
+func streamExec(w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	config := configFrom(r.Context())
+	bin, args, dir, err := execCommand(params)
+	if err != nil {
+		sendError(w, err)
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	timeout := time.Duration(config.ExecTimeout) * time.Second
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	flusher, _ := w.(http.Flusher)
+	fw := &frameWriter{w: w, flusher: flusher, remaining: config.MaxFileSize, overflow: cancel}
+	cmd := exec.CommandContext(ctx, bin, args...)
+	cmd.Dir = dir
+	cmd.Env = []string{"PATH=" + os.Getenv("PATH")}
+	// A child the command left behind may hold its output open; Wait
+	// gives up on it this long after the command itself is gone.
+	cmd.WaitDelay = time.Second
+	cmd.Stdout = streamWriter{fw, execStdout}
+	cmd.Stderr = streamWriter{fw, execStderr}
+	// The command's first output waits for the header to be written.
+	fw.mu.Lock()
+	if err := cmd.Start(); err != nil {
+		fw.mu.Unlock()
+		err = opErrorf(codeInternal, "starting %s: %v", params["command"], err)
+		sendError(w, err)
+		return err
+	}
+	w.Header().Set("Content-Type", execContentType)
+	w.WriteHeader(http.StatusOK)
+	fw.mu.Unlock()
+
+	err = cmd.Wait()
+	var reason string
+	switch {
+	case fw.truncated:
+		reason = fmt.Sprintf("output limit of %d bytes reached; command killed", config.MaxFileSize)
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		reason = fmt.Sprintf("timed out after %s; command killed", timeout)
+	}
+	if reason != "" {
+		fw.WriteFrame(execStderr, []byte("exec: "+reason+"\n"))
+		err = errors.New(reason)
+	}
+	code := cmd.ProcessState.ExitCode()
+	if werr := fw.WriteExit(code); werr != nil {
+		return werr
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		// A command that ran and failed is reported through its exit
+		// code, not as a failed operation.
+		return nil
+	}
+	return err
+}
+
+// recentFile is one entry of a recent result.
+type recentFile struct {
+	Path    string    `json:"path"`
+	ModTime time.Time `json:"mtime"`
+	Size    int64     `json:"size"`
+}
+
+const (
+	// defaultRecentFiles is how many files recent returns without a
+	// "limit" parameter.
+	defaultRecentFiles = 50
+	// maxRecentFiles caps the "limit" parameter of recent.
+	maxRecentFiles = 500
+)
+
+// recentFiles returns the most recently modified files across all allowed
+// roots, newest first, keeping at most limit of them. within, a duration
+// such as "24h", drops files not modified in that window before now.
+// Symlinks are not followed, and files the token may not run recent on are
+// left out.
+func recentFiles(claims jwt.MapClaims, limit, within string, now time.Time) ([]recentFile, error) {
+	n := defaultRecentFiles
+	if limit != "" {
+		var err error
+		if n, err = strconv.Atoi(limit); err != nil || n <= 0 {
+			return nil, opErrorf(codeInvalidArgument, "invalid limit value: %s", limit)
+		}
+		n = min(n, maxRecentFiles)
+	}
+	var since time.Time
+	if within != "" {
+		d, err := time.ParseDuration(within)
+		if err != nil || d <= 0 {
+			return nil, opErrorf(codeInvalidArgument, "invalid within value: %s", within)
+		}
+		since = now.Add(-d)
+	}
+
+	byNewest := func(files []recentFile) {
+		sort.Slice(files, func(i, j int) bool {
+			if !files[i].ModTime.Equal(files[j].ModTime) {
+				return files[i].ModTime.After(files[j].ModTime)
+			}
+			return files[i].Path < files[j].Path
+		})
+	}
+
+	var files []recentFile
+	seen := make(map[string]bool)
+	for _, allowed := range currentConfig().AllowedPaths {
+		root, err := resolveExisting(filepath.Clean(allowed.Path))
+		if err != nil {
+			continue
+		}
+		err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				// An unreadable subtree should not hide the rest.
+				return nil
+			}
+			if isDenied(p) {
+				return skipDenied(d)
+			}
+			if !d.Type().IsRegular() || !isFileTypeAllowed(p) || seen[p] {
+				return nil
+			}
+			seen[p] = true
+			info, err := d.Info()
+			if err != nil || info.ModTime().Before(since) {
+				return nil
+			}
+			if authorize(claims, "recent", p) != nil {
+				return nil
+			}
+			files = append(files, recentFile{Path: p, ModTime: info.ModTime().UTC(), Size: info.Size()})
+			// Trim as we go so a large tree does not pile up in memory.
+			if len(files) >= 2*n {
+				byNewest(files)
+				files = files[:n]
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	byNewest(files)
+	if len(files) > n {
+		files = files[:n]
+	}
+	if files == nil {
+		files = []recentFile{}
+	}
+	return files, nil
+}
+
+// searchMatch is one line matching a search pattern.
+type searchMatch struct {
+	Path string `json:"path"`
+	Line int    `json:"line"`
+	Text string `json:"text"`
+}
+
+// maxSearchMatches caps the matches one search returns; a request may ask
+// for fewer with the "max" parameter.
+const maxSearchMatches = 1000
+
+// maxSearchLine is the longest line a search reads; longer lines end the
+// scan of their file.
+const maxSearchLine = 1 << 20
+
+// searchLimit parses the "max" parameter.
+func searchLimit(max string) (int, error) {
+	if max == "" {
+		return maxSearchMatches, nil
+	}
+	n, err := strconv.Atoi(max)
+	if err != nil || n <= 0 {
+		return 0, opErrorf(codeInvalidArgument, "invalid max value: %s", max)
+	}
+	return min(n, maxSearchMatches), nil
+}
+
+// searchFiles scans every allowed file below path for lines matching the
+// regular expression pattern and passes each match to fn as it is found.
+// It stops after limit matches, reporting truncated, or as soon as ctx is
+// done. Files over MaxFileSize are skipped.
+func searchFiles(ctx context.Context, path, pattern string, limit int, fn func(searchMatch) error) (truncated bool, err error) {
+	config := configFrom(ctx)
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return false, opErrorf(codeInvalidArgument, "invalid pattern: %v", err)
+	}
+	root, err := canonicalize(path)
+	if err != nil {
+		return false, err
+	}
+
+	found := 0
+	errLimit := errors.New("search limit reached")
+	err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if isDenied(p) {
+			return skipDenied(d)
+		}
+		if !d.Type().IsRegular() || !isFileTypeAllowed(p) {
+			return nil
+		}
+		f, err := openVerified(p, os.O_RDONLY, 0)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if info, err := f.Stat(); err != nil || info.Size() > config.MaxFileSize {
+			return err
+		}
+
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, maxSearchLine)
+		for line := 1; scanner.Scan(); line++ {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if !re.Match(scanner.Bytes()) {
+				continue
+			}
+			if found == limit {
+				return errLimit
+			}
+			found++
+			if err := fn(searchMatch{Path: p, Line: line, Text: scanner.Text()}); err != nil {
+				return err
+			}
+		}
+		if err := scanner.Err(); err != nil && err != bufio.ErrTooLong {
+			return err
+		}
+		return nil
+	})
+	if err == errLimit {
+		return true, nil
+	}
+	return false, err
+}
+
+// searchAll is search for callers that cannot stream: it collects the
+// matches and returns them in one result.
+func searchAll(path, pattern, max string) (map[string]interface{}, error) {
+	limit, err := searchLimit(max)
+	if err != nil {
+		return nil, err
+	}
+	matches := []searchMatch{}
+	truncated, err := searchFiles(context.Background(), path, pattern, limit, func(m searchMatch) error {
+		matches = append(matches, m)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"matches": matches, "truncated": truncated}, nil
+}
+
+// searchHandler streams search matches as NDJSON from /api/search, one
+// line per match flushed as soon as it is found. A search cut off by the
+// match cap ends with {"truncated": true}; one that fails part way ends
+// with an error object, as in manifestHandler.
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	op := Operation{
+		Action:     "search",
+		Parameters: map[string]string{"path": query.Get("path"), "pattern": query.Get("pattern"), "max": query.Get("max")},
+		Timestamp:  time.Now(),
+	}
+	err := validateParameters(op)
+	if err == nil {
+		err = authorize(claimsFrom(r), op.Action, op.Parameters["path"])
+	}
+	if err != nil {
+		audit(r, op, err)
+		sendError(w, err)
+		return
+	}
+	limit, err := searchLimit(op.Parameters["max"])
+	if err == nil {
+		_, err = regexp.Compile(op.Parameters["pattern"])
+		if err != nil {
+			err = opErrorf(codeInvalidArgument, "invalid pattern: %v", err)
+		}
+	}
+	if err == nil {
+		_, err = canonicalize(op.Parameters["path"])
+	}
+	if err != nil {
+		audit(r, op, err)
+		sendError(w, err)
+		return
+	}
+
+	release, err := admitOperation(r.Context(), op.Action, r.Header.Get("X-Client-ID"))
+	if err != nil {
+		audit(r, op, err)
+		refuseOperation(w, r, err)
+		return
+	}
+	defer release()
+	done := inflight.Begin(op.Action, op.Parameters["path"], r.Header.Get("X-Client-ID"))
+	defer done()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	truncated, err := searchFiles(r.Context(), op.Parameters["path"], op.Parameters["pattern"], limit, func(m searchMatch) error {
+		if err := enc.Encode(m); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+	audit(r, op, err)
+	switch {
+	case err != nil:
+		enc.Encode(map[string]string{"error": err.Error()})
+	case truncated:
+		enc.Encode(map[string]bool{"truncated": true})
+	}
+}
+
+// checksumAlgorithms are the digests verify can compute. md5 and sha1 are
+// only there to check against checksums published with them.
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+	"sha1":   sha1.New,
+	"md5":    md5.New,
+}
+
+// verifyResult is what verify reports: whether the file's digest matches
+// the expected one, and the digest itself.
+type verifyResult struct {
+	Match     bool   `json:"match"`
+	Algorithm string `json:"algorithm"`
+	Expected  string `json:"expected"`
+	Actual    string `json:"actual"`
+}
+
+// verifyChecksum hashes the file at path with algorithm, sha256 by
+// default, and compares the hex digest with expected. The file is
+// streamed through the hash, never held in memory, and concurrent checks
+// of the same unchanged file share one pass.
+func verifyChecksum(path, expected, algorithm string) (verifyResult, error) {
+	if algorithm == "" {
+		algorithm = "sha256"
+	}
+	algorithm = strings.ToLower(algorithm)
+	newHash, ok := checksumAlgorithms[algorithm]
+	if !ok {
+		return verifyResult{}, opErrorf(codeInvalidArgument, "unsupported algorithm %q; use sha256, sha512, sha1 or md5", algorithm)
+	}
+	if expected == "" {
+		return verifyResult{}, opErrorf(codeInvalidArgument, "checksum is required")
+	}
+
+	path, err := canonicalize(path)
+	if err != nil {
+		return verifyResult{}, err
+	}
+	f, err := openVerified(path, os.O_RDONLY, 0)
+	if err != nil {
+		return verifyResult{}, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return verifyResult{}, err
+	}
+	if err := checkNotDir(path, info); err != nil {
+		return verifyResult{}, err
+	}
+	if !info.Mode().IsRegular() {
+		return verifyResult{}, opErrorf(codeInvalidArgument, "not a regular file: %s", path)
+	}
+
+	sum, err, _ := sharedReads.Do(readKey(algorithm, path, info), func() (interface{}, error) {
+		h := newHash()
+		if _, err := io.Copy(h, f); err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(h.Sum(nil)), nil
+	})
+	if err != nil {
+		return verifyResult{}, err
+	}
+	actual := sum.(string)
+	return verifyResult{
+		Match:     strings.EqualFold(actual, strings.TrimSpace(expected)),
+		Algorithm: algorithm,
+		Expected:  expected,
+		Actual:    actual,
+	}, nil
+}
+
+func hashFile(path string) (manifestEntry, error) {
+	f, err := openVerified(path, os.O_RDONLY, 0)
+	if err != nil {
+		return manifestEntry{}, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return manifestEntry{}, err
+	}
+
+	sum, err, _ := sharedReads.Do(readKey("sha256", path, info), func() (interface{}, error) {
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(h.Sum(nil)), nil
+	})
+	if err != nil {
+		return manifestEntry{}, err
+	}
+	return manifestEntry{
+		Size:    info.Size(),
+		ModTime: info.ModTime().UTC(),
+		SHA256:  sum.(string),
+	}, nil
+}
+
+// syncPlan lists the relative paths a client has to transfer to reconcile
+// its tree with the server's. Delete holds paths to remove from the side
+// being made to match: the server for a push, the client for a pull.
+type syncPlan struct {
+	Upload   []string `json:"upload"`
+	Download []string `json:"download"`
+	Delete   []string `json:"delete"`
+}
+
+// syncPlanFor diffs the client's manifest, sent as JSON in the same shape
+// manifest returns, against the server's manifest of path. Nothing is
+// transferred; the client carries out the plan with the usual operations.
+func syncPlanFor(path, clientManifest, mode string) (syncPlan, error) {
+	var local map[string]manifestEntry
+	if err := json.Unmarshal([]byte(clientManifest), &local); err != nil {
+		return syncPlan{}, opErrorf(codeInvalidArgument, "invalid manifest: %v", err)
+	}
+
+	remote, err := manifest(path)
+	if err != nil {
+		return syncPlan{}, err
+	}
+	return planSync(local, remote, mode)
+}
+
+// planSync works out how to reconcile local (the client) with remote (the
+// server). mode is "push" to make the server match the client, "pull" to
+// make the client match the server, or "" for a two-way sync where the most
+// recently modified copy wins and nothing is deleted.
+func planSync(local, remote map[string]manifestEntry, mode string) (syncPlan, error) {
+	if mode != "" && mode != "push" && mode != "pull" {
+		return syncPlan{}, opErrorf(codeInvalidArgument, "unknown sync mode: %s", mode)
+	}
+
+	plan := syncPlan{Upload: []string{}, Download: []string{}, Delete: []string{}}
+	for rel, l := range local {
+		r, ok := remote[rel]
+		switch {
+		case !ok && mode == "pull":
+			plan.Delete = append(plan.Delete, rel)
+		case !ok:
+			plan.Upload = append(plan.Upload, rel)
+		case l.SHA256 == r.SHA256:
+		case mode == "push":
+			plan.Upload = append(plan.Upload, rel)
+		case mode == "pull":
+			plan.Download = append(plan.Download, rel)
+		case l.ModTime.After(r.ModTime):
+			plan.Upload = append(plan.Upload, rel)
+		default:
+			plan.Download = append(plan.Download, rel)
+		}
+	}
+	for rel := range remote {
+		if _, ok := local[rel]; ok {
+			continue
+		}
+		if mode == "push" {
+			plan.Delete = append(plan.Delete, rel)
+		} else {
+			plan.Download = append(plan.Download, rel)
+		}
+	}
+
+	sort.Strings(plan.Upload)
+	sort.Strings(plan.Download)
+	sort.Strings(plan.Delete)
+	return plan, nil
+}
+
+// manifestHandler streams the manifest of a large tree as newline-delimited
+// JSON, one {"path", "size", "mtime", "sha256"} object per file, so neither
+// side has to hold the whole tree in memory.
+func manifestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	op := Operation{
+		Action:     "manifest",
+		Parameters: map[string]string{"path": r.URL.Query().Get("path")},
+		Timestamp:  time.Now(),
+	}
+	err := validateParameters(op)
+	if err == nil {
+		err = authorize(claimsFrom(r), op.Action, op.Parameters["path"])
+	}
+	if err != nil {
+		audit(r, op, err)
+		sendError(w, err)
+		return
+	}
+
+	root, err := canonicalize(op.Parameters["path"])
+	if err == nil {
+		var info os.FileInfo
+		if info, err = os.Stat(root); err == nil && !info.IsDir() {
+			err = opErrorf(codeInvalidArgument, "not a directory: %s", root)
+		}
+	}
+	if err != nil {
+		audit(r, op, err)
+		sendError(w, err)
+		return
+	}
+
+	release, err := admitOperation(r.Context(), op.Action, r.Header.Get("X-Client-ID"))
+	if err != nil {
+		audit(r, op, err)
+		refuseOperation(w, r, err)
+		return
+	}
+	defer release()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	err = walkManifest(root, func(rel string, e manifestEntry) error {
+		line := struct {
+			Path string `json:"path"`
+			manifestEntry
+		}{rel, e}
+		if err := enc.Encode(line); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return r.Context().Err()
+	})
+	// The status line has already gone out, so a failure part way through
+	// is reported as a final error object.
+	if err != nil {
+		enc.Encode(map[string]string{"error": err.Error()})
+	}
+	audit(r, op, err)
+}
+
+// progressEvent is one update from a long-running operation.
+type progressEvent struct {
+	Percent     float64 `json:"percent"`
+	CurrentFile string  `json:"current_file,omitempty"`
+	Done        bool    `json:"done"`
+	Error       string  `json:"error,omitempty"`
+}
+
+// progressHub relays progress from background operations to /api/progress
+// subscribers. Operations only write to the channel Start gives them and
+// know nothing about who is listening.
+type progressHub struct {
+	mu  sync.Mutex
+	ops map[string]*progressState
+}
+
+type progressState struct {
+	last progressEvent
+	done bool
+	subs map[chan struct{}]struct{}
+}
+
+var progress = &progressHub{ops: make(map[string]*progressState)}
+
+// progressRetention is how long a finished operation's final state stays
+// available to subscribers that connect late.
+const progressRetention = time.Minute
+
+// Start registers a new operation and returns its ID and the channel it
+// reports on. The operation must close the channel when it finishes.
+func (h *progressHub) Start() (string, chan<- progressEvent) {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	id := hex.EncodeToString(buf)
+
+	events := make(chan progressEvent)
+	state := &progressState{subs: make(map[chan struct{}]struct{})}
+	h.mu.Lock()
+	h.ops[id] = state
+	h.mu.Unlock()
+
+	go func() {
+		for ev := range events {
+			h.mu.Lock()
+			state.last = ev
+			h.notify(state)
+			h.mu.Unlock()
+		}
+
+		h.mu.Lock()
+		state.done = true
+		for sub := range state.subs {
+			close(sub)
+		}
+		state.subs = nil
+		h.mu.Unlock()
+
+		time.AfterFunc(progressRetention, func() {
+			h.mu.Lock()
+			delete(h.ops, id)
+			h.mu.Unlock()
+		})
+	}()
+	return id, events
+}
+
+// notify wakes subscribers without blocking; a subscriber that has not
+// caught up yet simply reads the newer snapshot. Callers hold h.mu.
+func (h *progressHub) notify(state *progressState) {
+	for sub := range state.subs {
+		select {
+		case sub <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel that signals whenever operation id reports
+// progress and is closed when it finishes, plus a function to unsubscribe.
+// ok is false for unknown IDs.
+func (h *progressHub) Subscribe(id string) (updates <-chan struct{}, cancel func(), ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	state, ok := h.ops[id]
+	if !ok {
+		return nil, nil, false
+	}
+
+	sub := make(chan struct{}, 1)
+	if state.done {
+		close(sub)
+		return sub, func() {}, true
+	}
+	state.subs[sub] = struct{}{}
+	sub <- struct{}{} // deliver the current state straight away
+	return sub, func() {
+		h.mu.Lock()
+		delete(state.subs, sub)
+		h.mu.Unlock()
+	}, true
+}
+
+// Snapshot returns the latest event reported by operation id.
+func (h *progressHub) Snapshot(id string) progressEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if state, ok := h.ops[id]; ok {
+		return state.last
+	}
+	return progressEvent{}
+}
+
+// progressHandler streams the progress of a long operation as server-sent
+// events until it finishes or the client goes away.
+func progressHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	updates, cancel, ok := progress.Subscribe(id)
+	if !ok {
+		http.Error(w, "Unknown operation", http.StatusNotFound)
+		return
+	}
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	var sent *progressEvent
+	for {
+		select {
+		case _, open := <-updates:
+			if ev := progress.Snapshot(id); sent == nil || ev != *sent {
+				data, _ := json.Marshal(ev)
+				fmt.Fprintf(w, "data: %s\n\n", data)
+				flusher.Flush()
+				sent = &ev
+			}
+			if !open {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// canonicalize cleans path, makes it absolute and resolves any symlinks, then
+// verifies the result lies within one of the allowed roots. Operations must
+// use the returned path rather than the caller-supplied one so the value that
+// was checked is the value that reaches the filesystem.
+func canonicalize(path string) (string, error) {
+	if path == "" {
+		return "", opErrorf(codeInvalidArgument, "path is required")
+	}
+	// The filesystem would refuse it anyway, but with a vaguer error.
+	if strings.ContainsRune(path, 0) {
+		return "", opErrorf(codeInvalidName, "path contains a NUL byte")
+	}
+
+	abs, err := filepath.Abs(filepath.Clean(path))
+	if err != nil {
+		return "", opErrorf(codeInvalidArgument, "invalid path: %s", path)
+	}
+
+	resolved, err := resolveExisting(abs)
+	if err != nil {
+		return "", opErrorf(codeInvalidArgument, "invalid path: %s", path)
+	}
+
+	// A denied path is refused just like one outside the roots, so the
+	// answer does not tell whether it exists.
+	if _, ok := allowedRoot(resolved); !ok || isDenied(resolved) {
+		return "", &OpError{
+			Code:    codePathDenied,
+			Message: fmt.Sprintf("access denied to path: %s", path),
+			Details: map[string]string{"path": path},
+		}
+	}
+	return resolved, nil
+}
+
+// canonicalizeWritable is canonicalize for paths an operation changes: the
+// root they lie in must also be read-write.
+func canonicalizeWritable(path string) (string, error) {
+	resolved, err := canonicalize(path)
+	if err != nil {
+		return "", err
+	}
+	if root, _ := allowedRoot(resolved); root.Mode != modeReadWrite {
+		return "", &OpError{
+			Code:    codePathDenied,
+			Message: fmt.Sprintf("path is read-only: %s", path),
+			Details: map[string]string{"path": path, "root": root.Path},
+		}
+	}
+	return resolved, nil
+}
+
+// checkFolderDepth rejects creating the canonical directory path, with
+// extra levels of subdirectories below it, if that nests deeper below its
+// allowed root than MaxFolderDepth.
+func checkFolderDepth(path string, extra int) error {
+	config := currentConfig()
+	if config.MaxFolderDepth == 0 {
+		return nil
+	}
+	allowed, _ := allowedRoot(path)
+	root, err := resolveExisting(filepath.Clean(allowed.Path))
+	if err != nil {
+		return err
+	}
+	if depth := pathDepth(root, path) + extra; depth > config.MaxFolderDepth {
+		return &OpError{
+			Code:    codeInvalidArgument,
+			Message: fmt.Sprintf("folder would be %d levels deep, limit is %d", depth, config.MaxFolderDepth),
+			Details: map[string]string{"path": path, "max_depth": strconv.Itoa(config.MaxFolderDepth)},
+		}
+	}
+	return nil
+}
+
+// pathDepth counts the components of path below root; root itself is 0.
+func pathDepth(root, path string) int {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == "." {
+		return 0
+	}
+	return strings.Count(rel, string(filepath.Separator)) + 1
+}
+
+// windowsReserved are the device names Windows will not use as a file
+// name, with or without an extension.
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// validateName rejects a file or folder name that would be unsafe or
+// unportable: one with a NUL byte or other control character, or one of
+// the Windows device names.
+func validateName(name string) error {
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return &OpError{
+				Code:    codeInvalidName,
+				Message: fmt.Sprintf("name contains control character %U: %q", r, name),
+				Details: map[string]string{"name": name},
+			}
+		}
+	}
+	base := strings.ToUpper(strings.TrimRight(name, " ."))
+	if i := strings.IndexByte(base, '.'); i >= 0 {
+		base = base[:i]
+	}
+	if windowsReserved[strings.TrimRight(base, " ")] {
+		return &OpError{
+			Code:    codeInvalidName,
+			Message: fmt.Sprintf("name is reserved on Windows: %q", name),
+			Details: map[string]string{"name": name},
+		}
+	}
+	return nil
+}
+
+// validateNewPath applies validateName to every component of the canonical
+// path below its allowed root, since operations such as create_folder make
+// the missing parents too.
+func validateNewPath(path string) error {
+	allowed, _ := allowedRoot(path)
+	root, err := resolveExisting(filepath.Clean(allowed.Path))
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == "." {
+		return nil
+	}
+	for _, name := range strings.Split(rel, string(filepath.Separator)) {
+		if err := validateName(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// allowedRoot returns the allowed root that contains the canonical path.
+// When roots are nested, the innermost one decides.
+func allowedRoot(resolved string) (AllowedPath, bool) {
+	var best AllowedPath
+	var bestRoot string
+	for _, allowed := range currentConfig().AllowedPaths {
+		root, err := resolveExisting(filepath.Clean(allowed.Path))
+		if err != nil {
+			continue
+		}
+		if isWithin(resolved, root) && len(root) > len(bestRoot) {
+			best, bestRoot = allowed, root
+		}
+	}
+	return best, bestRoot != ""
+}
+
+// resolveExisting evaluates symlinks in the longest existing prefix of path
+// and re-appends the components that do not exist yet, so targets of
+// write_file and create_folder can be canonicalized before they are created.
+func resolveExisting(path string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err == nil {
+		return resolved, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+	if _, lerr := os.Lstat(path); lerr == nil {
+		// A dangling symlink: its target cannot be verified.
+		return "", opErrorf(codePathDenied, "unresolvable symlink: %s", path)
+	}
+
+	parent := filepath.Dir(path)
+	if parent == path {
+		return path, nil
+	}
+	resolvedParent, err := resolveExisting(parent)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(resolvedParent, filepath.Base(path)), nil
+}
+
+// isWithin reports whether path is root itself or a descendant of it.
+func isWithin(path, root string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
+
+// openNoFollow is or'ed into every openVerified open so the last element
+// of the path is never followed if it is a symlink. A canonicalized path
+// never ends in one, so finding one means it was swapped in. It is 0 where
+// the platform has no such flag.
+var openNoFollow int
+
+// openVerified opens an already canonicalized path and checks that the handle
+// refers to the file the path still resolves to. A symlink swapped into the
+// path between canonicalize and the open is caught here, and callers then
+// work only through the returned handle. A file the open created is removed
+// again when the check fails, so a swap cannot leave one outside the roots.
+func openVerified(path string, flag int, perm os.FileMode) (*os.File, error) {
+	f, created, err := openCreating(path, flag|openNoFollow, perm)
+	if errors.Is(err, syscall.ELOOP) {
+		return nil, opErrorf(codeConflict, "path changed during operation: %s", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := verifyHandle(f, path); err != nil {
+		if created {
+			removeOpened(f, path)
+		}
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// openCreating opens path and reports whether the open created the file.
+// Without O_EXCL, O_CREATE is tried exclusively first, since afterwards
+// there is no telling whether the file was already there.
+func openCreating(path string, flag int, perm os.FileMode) (*os.File, bool, error) {
+	if flag&os.O_CREATE == 0 || flag&os.O_EXCL != 0 {
+		f, err := os.OpenFile(path, flag, perm)
+		return f, err == nil && flag&os.O_CREATE != 0, err
+	}
+	f, err := os.OpenFile(path, flag|os.O_EXCL, perm)
+	if !errors.Is(err, fs.ErrExist) {
+		return f, err == nil, err
+	}
+	f, err = os.OpenFile(path, flag&^os.O_CREATE, perm)
+	return f, false, err
+}
+
+// removeOpened removes the file f was opened as, if path still names it.
+// When it does not, path may now lead somewhere else entirely, and removing
+// it could take a file that was never ours.
+func removeOpened(f *os.File, path string) {
+	opened, err := f.Stat()
+	if err != nil {
+		return
+	}
+	if current, err := os.Lstat(path); err == nil && os.SameFile(opened, current) {
+		os.Remove(path)
+	}
+}
+
+func verifyHandle(f *os.File, path string) error {
+	opened, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	resolved, err := canonicalize(path)
+	if err != nil {
+		return err
+	}
+	if resolved != path {
+		return opErrorf(codeConflict, "path changed during operation: %s", path)
+	}
+
+	current, err := os.Lstat(path)
+	if err != nil || !os.SameFile(opened, current) {
+		return opErrorf(codeConflict, "path changed during operation: %s", path)
+	}
+	return nil
+}
+
+func isPathAllowed(path string) bool {
+	_, err := canonicalize(path)
+	return err == nil
+}
+
+func isFileTypeAllowed(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, allowedType := range currentConfig().AllowedFileTypes {
+		if ext == allowedType {
+			return true
+		}
+	}
+	return false
+}
+
+// deniedPrefixRegexp marks a DeniedPatterns entry as a regular expression.
+const deniedPrefixRegexp = "re:"
+
+// deniedRegexps caches the compiled regular expressions of DeniedPatterns,
+// which are matched on every path an operation resolves.
+var deniedRegexps sync.Map // pattern -> *regexp.Regexp
+
+// isDenied reports whether the canonical path, or any directory it lies
+// in, matches one of the DeniedPatterns, so a denied directory hides
+// everything below it too.
+func isDenied(path string) bool {
+	config := currentConfig()
+	if len(config.DeniedPatterns) == 0 {
+		return false
+	}
+	for p := path; ; p = filepath.Dir(p) {
+		slashed := filepath.ToSlash(p)
+		for _, pattern := range config.DeniedPatterns {
+			if matchDenied(pattern, slashed) {
+				return true
+			}
+		}
+		if filepath.Dir(p) == p {
+			return false
+		}
+	}
+}
+
+// matchDenied reports whether the slash-separated path matches a
+// DeniedPatterns entry. Patterns starting with "re:" are regular
+// expressions searched for anywhere in the path. Others are globs where
+// "**" as a whole component matches any number of components; one that is
+// not absolute may match at any depth, as if it started with "**/".
+func matchDenied(pattern, path string) bool {
+	if expr, ok := strings.CutPrefix(pattern, deniedPrefixRegexp); ok {
+		re, ok := deniedRegexps.Load(expr)
+		if !ok {
+			compiled, err := regexp.Compile(expr)
+			if err != nil {
+				return false
+			}
+			re, _ = deniedRegexps.LoadOrStore(expr, compiled)
+		}
+		return re.(*regexp.Regexp).MatchString(path)
+	}
+	if !strings.HasPrefix(pattern, "/") {
+		pattern = "**/" + pattern
+	}
+	return matchGlobParts(strings.Split(strings.TrimPrefix(pattern, "/"), "/"), strings.Split(strings.TrimPrefix(path, "/"), "/"))
+}
+
+// matchGlobParts matches path components against glob components.
+func matchGlobParts(pattern, parts []string) bool {
+	if len(pattern) == 0 {
+		return len(parts) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(parts); i++ {
+			if matchGlobParts(pattern[1:], parts[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(parts) == 0 {
+		return false
+	}
+	matched, _ := filepath.Match(pattern[0], parts[0])
+	return matched && matchGlobParts(pattern[1:], parts[1:])
+}
+
+// validateDeniedPattern reports a DeniedPatterns entry that could never be
+// matched as intended.
+func validateDeniedPattern(pattern string) error {
+	if expr, ok := strings.CutPrefix(pattern, deniedPrefixRegexp); ok {
+		_, err := regexp.Compile(expr)
+		return err
+	}
+	if strings.Trim(pattern, "/") == "" {
+		return fmt.Errorf("empty pattern")
+	}
+	for _, part := range strings.Split(strings.Trim(pattern, "/"), "/") {
+		if _, err := filepath.Match(part, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// skipDenied is what a walk returns for an entry it reached that is
+// denied: the entry is left out and, for a directory, so is everything
+// below it.
+func skipDenied(d fs.DirEntry) error {
+	if d.IsDir() {
+		return fs.SkipDir
+	}
+	return nil
+}
+
+// auditEntry is one line of the audit log.
+type auditEntry struct {
+	Time        time.Time `json:"time"`
+	Subject     string    `json:"subject,omitempty"`
+	ClientID    string    `json:"client_id,omitempty"`
+	Action      string    `json:"action"`
+	Path        string    `json:"path,omitempty"`
+	Destination string    `json:"destination,omitempty"`
+	Status      string    `json:"status"`
+	Error       string    `json:"error,omitempty"`
+}
+
+var auditMu sync.Mutex
+
+// audit appends the outcome of op to the audit log as a JSON line. Auditing
+// is disabled when no AuditLogPath is configured.
+func audit(r *http.Request, op Operation, opErr error) {
+	auditEvent(claimsFrom(r), r.Header.Get("X-Client-ID"), op, opErr)
+}
+
+// auditEvent is audit for callers that are not plain HTTP handlers.
+func auditEvent(claims jwt.MapClaims, clientID string, op Operation, opErr error) {
+	config := currentConfig()
+	if config.AuditLogPath == "" {
+		return
+	}
+
+	entry := auditEntry{
+		Time:        time.Now().UTC(),
+		ClientID:    clientID,
+		Action:      op.Action,
+		Path:        op.Parameters["path"],
+		Destination: op.Parameters["destination"],
+		Status:      "success",
+	}
+	if sub, ok := claims["sub"].(string); ok {
+		entry.Subject = sub
+	}
+	if opErr != nil {
+		entry.Status = "error"
+		entry.Error = opErr.Error()
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Println("audit: marshal:", err)
+		return
+	}
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	f, err := os.OpenFile(config.AuditLogPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		log.Println("audit:", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		log.Println("audit:", err)
+	}
+}
+
+// tailLines returns up to n final lines of the file at path, reading
+// backwards from the end in blocks so large logs are not loaded whole.
+func tailLines(path string, n int) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	const blockSize = 32 * 1024
+	var buf []byte
+	offset := info.Size()
+	for offset > 0 && bytes.Count(buf, []byte{'\n'}) <= n {
+		size := int64(blockSize)
+		if offset < size {
+			size = offset
+		}
+		offset -= size
+
+		block := make([]byte, size)
+		if _, err := f.ReadAt(block, offset); err != nil {
+			return nil, err
+		}
+		buf = append(block, buf...)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(buf), "\n"), "\n")
+	if len(lines) == 1 && lines[0] == "" {
+		return []string{}, nil
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines, nil
+}
+
+// maintenanceHandler reports maintenance mode on GET and sets it on POST
+// with a body of {"enabled": true|false}.
+func maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req struct {
+			Enabled *bool `json:"enabled"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Enabled == nil {
+			sendResponse(w, Response{
+				Status:  "error",
+				Message: "Invalid request format",
+			}, http.StatusBadRequest)
+			return
+		}
+		setMaintenance(*req.Enabled)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sendResponse(w, Response{
+		Status: "success",
+		Data:   map[string]bool{"enabled": maintenance.Load()},
+	}, http.StatusOK)
+}
+
+// adminConfig is the subset of the configuration that can be changed at
+// runtime through /api/admin/config. Fields left out of a PATCH are kept.
+type adminConfig struct {
+	Maintenance    *bool         `json:"maintenance,omitempty"`
+	BandwidthLimit *int64        `json:"bandwidth_limit,omitempty"`
+	MaxFileSize    *int64        `json:"max_file_size,omitempty"`
+	AllowedPaths   []AllowedPath `json:"allowed_paths,omitempty"`
+}
+
+// validate rejects edits to current that would leave the server unsafe or
+// unusable. Allowed paths being added must be existing directories; paths
+// already allowed are kept as they are, though their mode may change.
+func (a adminConfig) validate(current Config) error {
+	if a.BandwidthLimit != nil && *a.BandwidthLimit < 0 {
+		return fmt.Errorf("bandwidth_limit must not be negative")
+	}
+	if a.MaxFileSize != nil && *a.MaxFileSize <= 0 {
+		return fmt.Errorf("max_file_size must be positive")
+	}
+	if a.AllowedPaths != nil && len(a.AllowedPaths) == 0 {
+		return fmt.Errorf("allowed_paths must not be empty")
+	}
+	for _, p := range a.AllowedPaths {
+		if p.Mode != modeReadOnly && p.Mode != modeReadWrite {
+			return fmt.Errorf("allowed path %q has mode %q, want %q or %q", p.Path, p.Mode, modeReadOnly, modeReadWrite)
+		}
+		known := slices.ContainsFunc(current.AllowedPaths, func(c AllowedPath) bool { return c.Path == p.Path })
+		if known {
+			continue
+		}
+		if !filepath.IsAbs(p.Path) {
+			return fmt.Errorf("allowed path %q is not absolute", p.Path)
+		}
+		info, err := os.Stat(p.Path)
+		if err != nil {
+			return fmt.Errorf("allowed path %q: %v", p.Path, err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("allowed path %q is not a directory", p.Path)
+		}
+	}
+	return nil
+}
+
+// configHandler shows the runtime-adjustable settings on GET and changes
+// them on PATCH. Changes are validated as a whole, applied without waiting
+// for requests in flight, and written to CONFIG_FILE when one is set.
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPatch:
+		var patch adminConfig
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			sendResponse(w, Response{
+				Status:  "error",
+				Message: "Invalid request format",
+			}, http.StatusBadRequest)
+			return
+		}
+		status, err := applyAdminConfig(patch)
+		if err != nil {
+			sendResponse(w, Response{
+				Status:  "error",
+				Message: err.Error(),
+			}, status)
+			return
+		}
+		log.Printf("Configuration updated by %v", claimsFrom(r)["sub"])
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	config := currentConfig()
+	current := adminConfig{
+		BandwidthLimit: &config.BandwidthLimit,
+		MaxFileSize:    &config.MaxFileSize,
+		AllowedPaths:   config.AllowedPaths,
+	}
+	enabled := maintenance.Load()
+	current.Maintenance = &enabled
+	data, _ := json.Marshal(current)
+
+	sendResponse(w, Response{
+		Status: "success",
+		Data:   json.RawMessage(data),
+	}, http.StatusOK)
+}
+
+// applyAdminConfig validates and applies patch, returning the HTTP status
+// to report if it fails.
+func applyAdminConfig(patch adminConfig) (int, error) {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	config := *currentConfig()
+	if err := patch.validate(config); err != nil {
+		return http.StatusUnprocessableEntity, err
+	}
+
+	next := config
+	if patch.BandwidthLimit != nil {
+		next.BandwidthLimit = *patch.BandwidthLimit
+	}
+	if patch.MaxFileSize != nil {
+		next.MaxFileSize = *patch.MaxFileSize
+	}
+	if patch.AllowedPaths != nil {
+		next.AllowedPaths = append([]AllowedPath(nil), patch.AllowedPaths...)
+	}
+	if err := saveConfigFile(next); err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("failed to save configuration: %v", err)
+	}
+	setConfig(next)
+
+	if patch.Maintenance != nil {
+		setMaintenance(*patch.Maintenance)
+	}
+	return http.StatusOK, nil
+}
+
+// reloadHandler re-reads CONFIG_FILE on POST.
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := reloadConfig(); err != nil {
+		sendResponse(w, Response{
+			Status:  "error",
+			Message: err.Error(),
+		}, http.StatusUnprocessableEntity)
+		return
+	}
+	sendResponse(w, Response{Status: "success"}, http.StatusOK)
+}
+
+// selfTestCheck is the outcome of one self-test check: "ok", "warning" or
+// "fail".
+type selfTestCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// selfTestReport collects the checks run by /api/admin/selftest. OK is
+// false if any check failed; warnings do not count.
+type selfTestReport struct {
+	OK     bool            `json:"ok"`
+	Checks []selfTestCheck `json:"checks"`
+}
+
+func (r *selfTestReport) add(name, status, detail string) {
+	r.Checks = append(r.Checks, selfTestCheck{Name: name, Status: status, Detail: detail})
+	if status == "fail" {
+		r.OK = false
+	}
+}
+
+// selfTest checks that every allowed path can be reached, that the
+// read-write ones accept a new file, that every allowed action and alias
+// leads to an operation the server can run, and that the certificate is
+// valid and not about to expire.
+func selfTest(c Config, cert *x509.Certificate, certErr error, now time.Time) selfTestReport {
+	report := selfTestReport{OK: true}
+
+	for _, p := range c.AllowedPaths {
+		name := "path " + p.Path
+		info, err := os.Stat(p.Path)
+		switch {
+		case err != nil:
+			report.add(name, "fail", err.Error())
+		case !info.IsDir():
+			report.add(name, "fail", "not a directory")
+		case p.Mode == modeReadOnly:
+			report.add(name, "ok", "read-only")
+		case maintenance.Load():
+			report.add(name, "warning", "maintenance mode; write probe skipped")
+		default:
+			if err := probeWritable(p.Path); err != nil {
+				report.add(name, "fail", "not writable: "+err.Error())
+			} else {
+				report.add(name, "ok", "writable")
+			}
+		}
+	}
+
+	actions := make([]string, 0, len(c.AllowedActions))
+	for action, allowed := range c.AllowedActions {
+		if allowed {
+			actions = append(actions, action)
+		}
+	}
+	sort.Strings(actions)
+	for _, action := range actions {
+		if knownActions[action] {
+			report.add("action "+action, "ok", "")
+		} else {
+			report.add("action "+action, "fail", "no operation handles this action")
+		}
+	}
+	aliases := make([]string, 0, len(c.ActionAliases))
+	for alias := range c.ActionAliases {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	for _, alias := range aliases {
+		if action := c.ActionAliases[alias]; !c.AllowedActions[action] {
+			report.add("alias "+alias, "warning", action+" is not allowed")
+		}
+	}
+
+	report.add(checkCert(cert, certErr, now, c.CertWarnDays))
+	return report
+}
+
+// probeWritable creates and removes a file in dir.
+func probeWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".selftest-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	f.Close()
+	return os.Remove(name)
+}
+
+// checkCert reports whether cert is valid at now and how long it has left,
+// warning once it is within the largest of warnDays.
+func checkCert(cert *x509.Certificate, loadErr error, now time.Time, warnDays []int) (name, status, detail string) {
+	name = "certificate"
+	switch {
+	case loadErr != nil:
+		return name, "fail", loadErr.Error()
+	case now.Before(cert.NotBefore):
+		return name, "fail", "not valid until " + cert.NotBefore.UTC().Format(time.RFC3339)
+	case !now.Before(cert.NotAfter):
+		return name, "fail", "expired at " + cert.NotAfter.UTC().Format(time.RFC3339)
 	}
+	left := cert.NotAfter.Sub(now)
+	detail = fmt.Sprintf("expires %s (in %d days)", cert.NotAfter.UTC().Format(time.RFC3339), int(left.Hours()/24))
+	if expiryThreshold(left, warnDays) > 0 {
+		return name, "warning", detail
+	}
+	return name, "ok", detail
 }
 
-func validateToken(token string) (*jwt.Token, error) {
-	return jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+// expiryThreshold returns the smallest of warnDays that left has fallen
+// below, or zero if it is outside all of them.
+func expiryThreshold(left time.Duration, warnDays []int) int {
+	crossed := 0
+	for _, days := range warnDays {
+		if left < time.Duration(days)*24*time.Hour && (crossed == 0 || days < crossed) {
+			crossed = days
 		}
-		return jwtSecret, nil
-	})
+	}
+	return crossed
 }
 
-func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		authHeader := r.Header.Get("Authorization")
-		if !strings.HasPrefix(authHeader, "Bearer ") {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
+// certExpiresIn is the seconds left until the serving certificate expires,
+// published through expvar and reported by /readyz.
+var certExpiresIn = expvar.NewInt("cert_expires_in_seconds")
+
+// certCheckInterval is how often watchCertExpiry looks at the certificate.
+const certCheckInterval = time.Hour
+
+// watchCertExpiry keeps certExpiresIn current for the certificate the
+// server was started with and logs a warning each time expiry crosses
+// another of the configured CertWarnDays.
+func watchCertExpiry(cert *x509.Certificate) {
+	warned := 0
+	for {
+		left := time.Until(cert.NotAfter)
+		certExpiresIn.Set(int64(left / time.Second))
+
+		crossed := expiryThreshold(left, currentConfig().CertWarnDays)
+		switch {
+		case left <= 0:
+			log.Printf("WARNING: TLS certificate expired at %s", cert.NotAfter.UTC().Format(time.RFC3339))
+		case crossed > 0 && (warned == 0 || crossed < warned):
+			log.Printf("WARNING: TLS certificate expires in less than %d days, at %s",
+				crossed, cert.NotAfter.UTC().Format(time.RFC3339))
+			warned = crossed
 		}
+		time.Sleep(certCheckInterval)
+	}
+}
 
-		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-		token, err := validateToken(tokenString)
-		if err != nil || !token.Valid {
-			http.Error(w, "Invalid token", http.StatusUnauthorized)
-			return
+// readyzHandler tells orchestration whether to send traffic here. It is
+// unauthenticated like /version. The server is not ready once its
+// certificate has expired; while shutting down, refuseWhileDraining
+// answers for it.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	left := certExpiresIn.Value()
+	crossed := expiryThreshold(time.Duration(left)*time.Second, currentConfig().CertWarnDays)
+
+	data := map[string]interface{}{
+		"cert_expires_in_seconds": left,
+		"cert_warning":            crossed > 0,
+	}
+	if left <= 0 {
+		sendResponse(w, Response{
+			Status:  "error",
+			Message: "TLS certificate has expired",
+			Data:    data,
+		}, http.StatusServiceUnavailable)
+		return
+	}
+	sendResponse(w, Response{
+		Status: "success",
+		Data:   data,
+	}, http.StatusOK)
+}
+
+// rootCounters are the totals for the operations on one allowed root.
+// Bytes are counted before compression: BytesIn as read from request
+// bodies, BytesOut as written to responses.
+type rootCounters struct {
+	Operations int64
+	Errors     int64
+	BytesIn    int64
+	BytesOut   int64
+}
+
+// noRootLabel is the root operations on no allowed root count under,
+// e.g. read_multi, which names no single path, or a request for a path
+// outside them all.
+const noRootLabel = "none"
+
+// rootMetrics counts operations per allowed root. Counting by root
+// rather than by path keeps the number of series bounded by the config.
+type rootMetrics struct {
+	mu    sync.Mutex
+	roots map[string]*rootCounters
+}
+
+var pathMetrics = &rootMetrics{roots: make(map[string]*rootCounters)}
+
+// Record counts one operation on root that failed or not, and the bytes
+// it received and sent.
+func (m *rootMetrics) Record(root string, failed bool, in, out int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := m.roots[root]
+	if c == nil {
+		c = &rootCounters{}
+		m.roots[root] = c
+	}
+	c.Operations++
+	if failed {
+		c.Errors++
+	}
+	c.BytesIn += in
+	c.BytesOut += out
+}
+
+// Snapshot returns a copy of the counters of every root seen so far.
+func (m *rootMetrics) Snapshot() map[string]rootCounters {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	snap := make(map[string]rootCounters, len(m.roots))
+	for root, c := range m.roots {
+		snap[root] = *c
+	}
+	return snap
+}
+
+// metricsRoot returns the allowed root path is under, as it is written
+// in the config, or noRootLabel.
+func metricsRoot(path string) string {
+	if path == "" {
+		return noRootLabel
+	}
+	resolved, err := resolveExisting(filepath.Clean(path))
+	if err != nil {
+		return noRootLabel
+	}
+	if root, ok := allowedRoot(resolved); ok {
+		return root.Path
+	}
+	return noRootLabel
+}
+
+// countingWriter is a statusRecorder that also counts the bytes written.
+type countingWriter struct {
+	statusRecorder
+	n int64
+}
+
+func newCountingWriter(w http.ResponseWriter) *countingWriter {
+	return &countingWriter{statusRecorder: statusRecorder{ResponseWriter: w}}
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.statusRecorder.Write(b)
+	cw.n += int64(n)
+	return n, err
+}
+
+// Failed reports whether the response was an error status.
+func (cw *countingWriter) Failed() bool {
+	return cw.status >= http.StatusBadRequest
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.Reader.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// promLabel escapes v for use as a Prometheus label value.
+var promLabel = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricsHandler reports the server's counters in the Prometheus text
+// format: totals over all operations, and the same counters per allowed
+// root under a "root" label.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	snap := pathMetrics.Snapshot()
+	roots := make([]string, 0, len(snap))
+	var total rootCounters
+	for root, c := range snap {
+		roots = append(roots, root)
+		total.Operations += c.Operations
+		total.Errors += c.Errors
+		total.BytesIn += c.BytesIn
+		total.BytesOut += c.BytesOut
+	}
+	sort.Strings(roots)
+
+	counters := []struct {
+		name, help string
+		value      func(rootCounters) int64
+	}{
+		{"operations_total", "Operations run.", func(c rootCounters) int64 { return c.Operations }},
+		{"operation_errors_total", "Operations that failed.", func(c rootCounters) int64 { return c.Errors }},
+		{"received_bytes_total", "Bytes read from request bodies.", func(c rootCounters) int64 { return c.BytesIn }},
+		{"sent_bytes_total", "Bytes written to responses, before compression.", func(c rootCounters) int64 { return c.BytesOut }},
+	}
+
+	var b strings.Builder
+	for _, c := range counters {
+		fmt.Fprintf(&b, "# HELP quicssh_%s %s\n# TYPE quicssh_%s counter\n", c.name, c.help, c.name)
+		fmt.Fprintf(&b, "quicssh_%s %d\n", c.name, c.value(total))
+	}
+	for _, c := range counters {
+		fmt.Fprintf(&b, "# HELP quicssh_root_%s %s, per allowed root.\n# TYPE quicssh_root_%s counter\n", c.name, strings.TrimSuffix(c.help, "."), c.name)
+		for _, root := range roots {
+			fmt.Fprintf(&b, "quicssh_root_%s{root=\"%s\"} %d\n", c.name, promLabel.Replace(root), c.value(snap[root]))
 		}
+	}
+	fmt.Fprintf(&b, "# HELP quicssh_operations_in_flight Operations running now.\n# TYPE quicssh_operations_in_flight gauge\n")
+	fmt.Fprintf(&b, "quicssh_operations_in_flight %d\n", len(inflight.List()))
+	fmt.Fprintf(&b, "# HELP quicssh_operations_queued Operations waiting for a slot under max_concurrent_ops.\n# TYPE quicssh_operations_queued gauge\n")
+	fmt.Fprintf(&b, "quicssh_operations_queued %d\n", opSlots.Queued())
+	fmt.Fprintf(&b, "# HELP quicssh_cert_expires_in_seconds Seconds until the TLS certificate expires.\n# TYPE quicssh_cert_expires_in_seconds gauge\n")
+	fmt.Fprintf(&b, "quicssh_cert_expires_in_seconds %d\n", certExpiresIn.Value())
 
-		next.ServeHTTP(w, r)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	io.WriteString(w, b.String())
+}
+
+// pprofPrefix is where the runtime profiles of net/http/pprof are served,
+// e.g. /api/admin/pprof/heap or /api/admin/pprof/profile?seconds=30.
+const pprofPrefix = "/api/admin/pprof/"
+
+// pprofHandler serves the pprof index and profiles under pprofPrefix. The
+// package also registers itself on http.DefaultServeMux, which the server
+// never serves, so the profiles are only reachable here, behind the admin
+// scope.
+func pprofHandler(w http.ResponseWriter, r *http.Request) {
+	switch name := strings.TrimPrefix(r.URL.Path, pprofPrefix); name {
+	case "":
+		pprof.Index(w, r)
+	case "cmdline":
+		pprof.Cmdline(w, r)
+	case "profile":
+		pprof.Profile(w, r)
+	case "symbol":
+		pprof.Symbol(w, r)
+	case "trace":
+		pprof.Trace(w, r)
+	default:
+		pprof.Handler(name).ServeHTTP(w, r)
 	}
 }
 
-func operationHandler(w http.ResponseWriter, r *http.Request) {
+// loadCertificate parses the leaf certificate in certFile.
+func loadCertificate(certFile string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%s holds no PEM certificate", certFile)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// selfTestHandler runs the self-test on POST; it writes probe files, so it
+// is not a GET. Operators run it after a deployment.
+func selfTestHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	var op Operation
-	if err := json.NewDecoder(r.Body).Decode(&op); err != nil {
-		sendResponse(w, Response{
-			Status:  "error",
-			Message: "Invalid request format",
-		}, http.StatusBadRequest)
+	cert, err := loadCertificate(certFile)
+	report := selfTest(*currentConfig(), cert, err, time.Now())
+
+	sendResponse(w, Response{
+		Status: "success",
+		Data:   report,
+	}, http.StatusOK)
+}
+
+func setMaintenance(enabled bool) {
+	if maintenance.Swap(enabled) != enabled {
+		log.Printf("Maintenance mode enabled: %v", enabled)
+	}
+}
+
+// logTailHandler returns the most recent audit log lines. It only ever reads
+// the configured audit log; the request cannot name another file.
+func logTailHandler(w http.ResponseWriter, r *http.Request) {
+	config := configFrom(r.Context())
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// Validate operation
-	if !config.AllowedActions[op.Action] {
+	if config.AuditLogPath == "" {
 		sendResponse(w, Response{
 			Status:  "error",
-			Message: "Operation not allowed",
-		}, http.StatusForbidden)
+			Message: "Audit log is not configured",
+		}, http.StatusNotFound)
 		return
 	}
 
-	// Process operation
-	result, err := processOperation(op)
-	if err != nil {
+	n := 100
+	if v := r.URL.Query().Get("lines"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed <= 0 {
+			sendResponse(w, Response{
+				Status:  "error",
+				Message: "Invalid lines parameter",
+			}, http.StatusBadRequest)
+			return
+		}
+		n = parsed
+	}
+	if n > 1000 {
+		n = 1000
+	}
+
+	lines, err := tailLines(config.AuditLogPath, n)
+	if err != nil && !os.IsNotExist(err) {
 		sendResponse(w, Response{
 			Status:  "error",
 			Message: err.Error(),
 		}, http.StatusInternalServerError)
 		return
 	}
+	if lines == nil {
+		lines = []string{}
+	}
 
 	sendResponse(w, Response{
 		Status: "success",
-		Data:   result,
+		Data:   lines,
 	}, http.StatusOK)
 }
 
-func processOperation(op Operation) (interface{}, error) {
-	switch op.Action {
-	case "list_files":
-		return listFiles(op.Parameters["path"])
-	case "read_file":
-		return readFile(op.Parameters["path"])
-	case "write_file":
-		return writeFile(op.Parameters["path"], op.Parameters["content"])
-	case "create_folder":
-		return createFolder(op.Parameters["path"])
-	default:
-		return nil, fmt.Errorf("unsupported operation")
+// sendError reports err with its code and the HTTP status for that code.
+func sendError(w http.ResponseWriter, err error) {
+	e := asOpError(err)
+	sendResponse(w, Response{
+		Status:  "error",
+		Message: e.Message,
+		Code:    e.Code,
+		Details: e.Details,
+	}, codeStatus[e.Code])
+}
+
+func sendResponse(w http.ResponseWriter, resp Response, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// activeOp is one operation in flight.
+type activeOp struct {
+	ID       int       `json:"id"`
+	Action   string    `json:"action"`
+	Path     string    `json:"path,omitempty"`
+	ClientID string    `json:"client_id,omitempty"`
+	Started  time.Time `json:"started"`
+}
+
+// activeOps tracks the operations in flight, so a shutdown can wait for
+// them and report the ones it had to cut off.
+type activeOps struct {
+	mu      sync.Mutex
+	next    int
+	ops     map[int]activeOp
+	drained chan struct{}
+}
+
+var inflight = &activeOps{ops: make(map[int]activeOp)}
+
+// Begin records an operation and returns the func that ends it.
+func (a *activeOps) Begin(action, path, clientID string) func() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.next++
+	id := a.next
+	a.ops[id] = activeOp{ID: id, Action: action, Path: path, ClientID: clientID, Started: time.Now()}
+	markActivity()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			markActivity()
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			delete(a.ops, id)
+			if len(a.ops) == 0 && a.drained != nil {
+				close(a.drained)
+				a.drained = nil
+			}
+		})
 	}
 }
 
-func listFiles(path string) ([]string, error) {
-	if !isPathAllowed(path) {
-		return nil, fmt.Errorf("access denied to path: %s", path)
+// List returns the operations in flight, oldest first.
+func (a *activeOps) List() []activeOp {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	list := make([]activeOp, 0, len(a.ops))
+	for _, op := range a.ops {
+		list = append(list, op)
 	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Started.Before(list[j].Started) })
+	return list
+}
 
-	files, err := filepath.Glob(filepath.Join(path, "*"))
-	if err != nil {
-		return nil, err
+// activeHandler lists the operations in flight, oldest first, with how
+// long each has been running, to find the ones that are stuck.
+func activeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
 
-	return files, nil
+	type entry struct {
+		activeOp
+		ElapsedSeconds float64 `json:"elapsed_seconds"`
+	}
+	now := time.Now()
+	ops := inflight.List()
+	entries := make([]entry, len(ops))
+	for i, op := range ops {
+		entries[i] = entry{op, now.Sub(op.Started).Seconds()}
+	}
+	sendResponse(w, Response{
+		Status: "success",
+		Data:   entries,
+	}, http.StatusOK)
 }
 
-func readFile(path string) (string, error) {
-	if !isPathAllowed(path) {
-		return "", fmt.Errorf("access denied to path: %s", path)
+// Wait blocks until no operation is in flight or timeout passes, and
+// returns whatever is still running.
+func (a *activeOps) Wait(timeout time.Duration) []activeOp {
+	a.mu.Lock()
+	if len(a.ops) == 0 {
+		a.mu.Unlock()
+		return nil
 	}
+	if a.drained == nil {
+		a.drained = make(chan struct{})
+	}
+	drained := a.drained
+	a.mu.Unlock()
 
-	content, err := os.ReadFile(path)
-	if err != nil {
-		return "", err
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-drained:
+		return nil
+	case <-timer.C:
+		return a.List()
+	}
+}
+
+// priorityAging is how long a waiting operation takes to gain one level
+// of priority, so low-priority operations are not starved by a steady
+// stream of higher ones.
+const priorityAging = 2 * time.Second
+
+// maxPriority bounds priorities either way. A waiter of the highest
+// priority goes ahead of one of the lowest queued up to
+// 2*maxPriority*priorityAging later, and no further, so nothing waits
+// much longer than that behind a stream of higher ones.
+const maxPriority = 5
+
+// opPriority returns the admission priority of action for a token: its
+// "priority" claim when it has one, else the configured priority of the
+// action, limited to maxPriority either way.
+func opPriority(claims jwt.MapClaims, action string) int {
+	p := float64(currentConfig().ActionPriorities[action])
+	if claimed, ok := claims["priority"].(float64); ok && !math.IsNaN(claimed) {
+		p = claimed
 	}
+	return int(min(max(p, -maxPriority), maxPriority))
+}
 
-	return string(content), nil
+// opWaiter is an operation waiting for a slot. Waiters are admitted in
+// order of due: the time they were queued, brought forward by
+// priorityAging for each level of priority. A waiter of priority p thus
+// goes ahead of one of priority p-1 queued up to priorityAging later,
+// but never ahead of one that has waited priorityAging longer.
+type opWaiter struct {
+	due   time.Time
+	seq   int
+	index int
+	ready chan struct{}
 }
 
-func writeFile(path, content string) (bool, error) {
-	if !isPathAllowed(path) {
-		return false, fmt.Errorf("access denied to path: %s", path)
+// opQueue is a heap of waiters, the one to admit next on top.
+type opQueue []*opWaiter
+
+func (q opQueue) Len() int { return len(q) }
+
+func (q opQueue) Less(i, j int) bool {
+	if !q[i].due.Equal(q[j].due) {
+		return q[i].due.Before(q[j].due)
 	}
+	return q[i].seq < q[j].seq
+}
 
-	if !isFileTypeAllowed(path) {
-		return false, fmt.Errorf("file type not allowed")
+func (q opQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *opQueue) Push(x interface{}) {
+	w := x.(*opWaiter)
+	w.index = len(*q)
+	*q = append(*q, w)
+}
+
+func (q *opQueue) Pop() interface{} {
+	old := *q
+	w := old[len(old)-1]
+	*q = old[:len(old)-1]
+	w.index = -1
+	return w
+}
+
+// opScheduler admits operations up to a limit, queueing the rest by
+// priority.
+type opScheduler struct {
+	mu      sync.Mutex
+	running int
+	limit   int
+	seq     int
+	queue   opQueue
+}
+
+var opSlots = &opScheduler{}
+
+// Acquire waits for a slot under limit, zero meaning none is needed, and
+// returns the func that gives it back. It fails only when ctx ends first.
+func (s *opScheduler) Acquire(ctx context.Context, limit, priority int) (func(), error) {
+	s.mu.Lock()
+	s.limit = limit
+	if limit <= 0 || (s.running < limit && len(s.queue) == 0) {
+		s.running++
+		s.mu.Unlock()
+		return s.releaser(), nil
 	}
+	s.seq++
+	w := &opWaiter{
+		due:   time.Now().Add(-time.Duration(priority) * priorityAging),
+		seq:   s.seq,
+		ready: make(chan struct{}),
+	}
+	heap.Push(&s.queue, w)
+	s.mu.Unlock()
 
-	err := os.WriteFile(path, []byte(content), 0644)
-	return err == nil, err
+	select {
+	case <-w.ready:
+		return s.releaser(), nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if w.index < 0 {
+			// Admitted just as ctx ended; pass the slot on.
+			s.running--
+			s.admit()
+		} else {
+			heap.Remove(&s.queue, w.index)
+		}
+		return nil, ctx.Err()
+	}
 }
 
-func createFolder(path string) (bool, error) {
-	if !isPathAllowed(path) {
-		return false, fmt.Errorf("access denied to path: %s", path)
+func (s *opScheduler) releaser() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.running--
+			s.admit()
+		})
 	}
+}
 
-	err := os.MkdirAll(path, 0755)
-	return err == nil, err
+// admit hands free slots to the waiters first in line. Callers hold s.mu.
+func (s *opScheduler) admit() {
+	for len(s.queue) > 0 && (s.limit <= 0 || s.running < s.limit) {
+		w := heap.Pop(&s.queue).(*opWaiter)
+		s.running++
+		close(w.ready)
+	}
 }
 
-func isPathAllowed(path string) bool {
-	path = filepath.Clean(path)
-	for _, allowedPath := range config.AllowedPaths {
-		if strings.HasPrefix(path, allowedPath) {
-			return true
+// admitOperation takes the slots an operation of action runs in and
+// returns the func that gives them back: first one of its client's share,
+// failing with codeTooManyOps when that is used up, then one under
+// MaxConcurrentOps, waiting by priority. Every entry point that runs an
+// operation calls it once the operation is authorized. It otherwise fails
+// only when ctx ends first.
+func admitOperation(ctx context.Context, action, clientID string) (func(), error) {
+	claims := claimsFromContext(ctx)
+	releaseClient, err := clientSlots.Acquire(clientOpsKey(claims, credentialFrom(ctx), clientID), clientOpLimit(claims))
+	if err != nil {
+		return nil, err
+	}
+	release, err := opSlots.Acquire(ctx, configFrom(ctx).MaxConcurrentOps, opPriority(claims, action))
+	if err != nil {
+		releaseClient()
+		return nil, err
+	}
+	return func() {
+		release()
+		releaseClient()
+	}, nil
+}
+
+// refuseOperation answers a request admitOperation turned away. One whose
+// client went away while it waited for a slot gets no answer.
+func refuseOperation(w http.ResponseWriter, r *http.Request, err error) {
+	if r.Context().Err() != nil {
+		return
+	}
+	w.Header().Set("Retry-After", "1")
+	sendError(w, err)
+}
+
+// Queued returns how many operations are waiting for a slot.
+func (s *opScheduler) Queued() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.queue)
+}
+
+// clientOps counts the operations each client has running or waiting.
+type clientOps struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+var clientSlots = &clientOps{counts: make(map[string]int)}
+
+// clientOpsKey returns whose share an operation counts against: the token
+// subject, else the credential, so tokens and API keys without a subject
+// are still capped each, else the client ID. "" means none is known and
+// the operation is not counted.
+func clientOpsKey(claims jwt.MapClaims, credential, clientID string) string {
+	if sub, _ := claims["sub"].(string); sub != "" {
+		return "sub:" + sub
+	}
+	if credential != "" {
+		return "credential:" + credential
+	}
+	if clientID != "" {
+		return "client:" + clientID
+	}
+	return ""
+}
+
+// clientOpLimit returns the cap on concurrent operations for a token:
+// the most generous RoleOpLimits entry among its roles, else
+// MaxOpsPerClient. Zero means no cap.
+func clientOpLimit(claims jwt.MapClaims) int {
+	config := currentConfig()
+	limit, found := 0, false
+	for _, role := range claimRoles(claims) {
+		n, ok := config.RoleOpLimits[role]
+		if !ok {
+			continue
+		}
+		if n == 0 {
+			return 0
 		}
+		limit, found = max(limit, n), true
 	}
-	return false
+	if !found {
+		return config.MaxOpsPerClient
+	}
+	return limit
 }
 
-func isFileTypeAllowed(path string) bool {
-	ext := strings.ToLower(filepath.Ext(path))
-	for _, allowedType := range config.AllowedFileTypes {
-		if ext == allowedType {
-			return true
+// Acquire counts one more operation for key and returns the func that
+// ends it. It fails with codeTooManyOps when key already has limit
+// operations; a limit of zero or an empty key never fails.
+func (c *clientOps) Acquire(key string, limit int) (func(), error) {
+	if key == "" || limit <= 0 {
+		return func() {}, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts[key] >= limit {
+		return nil, &OpError{
+			Code:    codeTooManyOps,
+			Message: fmt.Sprintf("too many operations in progress for this client (limit %d); wait for one to finish", limit),
+			Details: map[string]string{"limit": strconv.Itoa(limit)},
 		}
 	}
-	return false
+	c.counts[key]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if c.counts[key]--; c.counts[key] == 0 {
+				delete(c.counts, key)
+			}
+		})
+	}, nil
 }
 
-func sendResponse(w http.ResponseWriter, resp Response, status int) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	json.NewEncoder(w).Encode(resp)
+// draining is set once a shutdown has begun; new requests are refused from
+// then on.
+var draining atomic.Bool
+
+func refuseWhileDraining(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if draining.Load() {
+			http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		markActivity()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// lastActivity is when, in Unix nanoseconds, a request last came in or an
+// operation last started or ended.
+var lastActivity atomic.Int64
+
+func markActivity() {
+	lastActivity.Store(time.Now().UnixNano())
+}
+
+// idleFor returns how long the server has had nothing to do at now. An
+// operation still in flight counts as activity, so a long transfer keeps
+// the server up however long it runs.
+func idleFor(now time.Time) time.Duration {
+	if len(inflight.List()) > 0 {
+		lastActivity.Store(now.UnixNano())
+		return 0
+	}
+	return now.Sub(time.Unix(0, lastActivity.Load()))
+}
+
+// watchIdle shuts server down once it has been idle for IdleShutdown
+// seconds. The setting is read on every tick, so a reload can turn it on
+// or off.
+func watchIdle(server *http3.Server) {
+	markActivity()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		limit := time.Duration(currentConfig().IdleShutdown) * time.Second
+		if limit <= 0 || draining.Load() {
+			continue
+		}
+		if idle := idleFor(now); idle >= limit {
+			log.Printf("No requests for %s; shutting down", idle.Round(time.Second))
+			shutdown(server)
+			return
+		}
+	}
+}
+
+// shutdown stops taking requests, gives the operations in flight up to
+// ShutdownTimeout to finish and then closes the server, dropping the
+// connections that are left. Operations cut off that way are logged. Only
+// the first call does anything.
+func shutdown(server *http3.Server) {
+	if draining.Swap(true) {
+		return
+	}
+	timeout := time.Duration(currentConfig().ShutdownTimeout) * time.Second
+
+	log.Printf("Shutting down; waiting up to %s for operations in flight", timeout)
+	for _, op := range inflight.Wait(timeout) {
+		log.Printf("Interrupted %s of %q for client %q after %s",
+			op.Action, op.Path, op.ClientID, time.Since(op.Started).Round(time.Millisecond))
+	}
+	if err := server.Close(); err != nil {
+		log.Println("Closing server:", err)
+	}
 }
 
 func main() {
+	loaded, err := readConfigFile()
+	if err != nil {
+		log.Fatal("Failed to load configuration: ", err)
+	}
+	if err := validateConfig(loaded); err != nil {
+		log.Fatal("Invalid configuration: ", err)
+	}
+	setConfig(loaded)
+	config := currentConfig()
+
 	// Set up routes
 	mux := http.NewServeMux()
-	mux.HandleFunc("/api/operation", authMiddleware(operationHandler))
+	mux.HandleFunc("/api/operation", authMiddleware(withConfig(signatureMiddleware(operationHandler))))
+	mux.HandleFunc("/api/rpc", authMiddleware(withConfig(signatureMiddleware(rpcHandler))))
+	mux.HandleFunc("/api/file", authMiddleware(downloadHandler))
+	mux.HandleFunc("/api/follow", authMiddleware(followHandler))
+	mux.HandleFunc("/api/progress", authMiddleware(progressHandler))
+	mux.HandleFunc("/api/manifest", authMiddleware(withConfig(manifestHandler)))
+	mux.HandleFunc("/api/search", authMiddleware(withConfig(searchHandler)))
+	mux.HandleFunc("/api/capabilities", authMiddleware(withConfig(capabilitiesHandler)))
+	mux.HandleFunc("/api/auth/verify", verifyTokenHandler)
+	mux.HandleFunc("/api/logtail", adminMiddleware(logTailHandler))
+	mux.HandleFunc("/api/admin/maintenance", adminMiddleware(maintenanceHandler))
+	mux.HandleFunc("/api/admin/config", adminMiddleware(configHandler))
+	mux.HandleFunc("/api/admin/reload", adminMiddleware(reloadHandler))
+	mux.HandleFunc("/api/admin/selftest", adminMiddleware(selfTestHandler))
+	mux.HandleFunc("/api/admin/active", adminMiddleware(activeHandler))
+	mux.HandleFunc("/version", versionHandler)
+	mux.HandleFunc("/readyz", readyzHandler)
+	mux.HandleFunc("/metrics", adminMiddleware(metricsHandler))
+	mux.HandleFunc(pprofPrefix, adminMiddleware(pprofHandler))
+
+	if watchSignals != nil {
+		go watchSignals()
+	}
+
+	cert, err := loadCertificate(certFile)
+	if err != nil {
+		log.Fatal("Failed to load certificate: ", err)
+	}
+	certExpiresIn.Set(int64(time.Until(cert.NotAfter) / time.Second))
+	go watchCertExpiry(cert)
+
+	if config.GRPCAddr != "" {
+		if serveGRPC == nil {
+			log.Fatal("GRPC_ADDR is set but this server was built without Server_grpc.go")
+		}
+		go func() {
+			log.Println("Starting gRPC server on", config.GRPCAddr+"...")
+			log.Fatal("gRPC server failed: ", serveGRPC(config.GRPCAddr))
+		}()
+	}
 
 	// Configure HTTP/3 server
 	server := &http3.Server{
 		Addr:    ":443",
-		Handler: mux,
+		Handler: refuseWhileDraining(logRequests(compressMiddleware(mux))),
 	}
 
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-stop
+		shutdown(server)
+	}()
+	go watchIdle(server)
+
 	// Start server
 	log.Println("Starting secure HTTP/3 server on :443...")
-	err := server.ListenAndServeTLS("server.crt", "server.key")
-	if err != nil {
+	err = server.ListenAndServeTLS(certFile, keyFile)
+	if err != nil && !draining.Load() {
 		log.Fatal("Server failed to start:", err)
 	}
 }
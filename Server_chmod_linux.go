@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// oPath is O_PATH, which the syscall package does not define. It has
+// the same value on every architecture Go supports.
+const oPath = 0x200000
+
+func init() {
+	chmodEntry = chmodOpenPath
+}
+
+// chmodOpenPath opens path with O_PATH, which needs no access to the entry
+// and does not follow a symlink, checks that the handle is the entry
+// checked as info, and changes the mode through the handle's /proc entry,
+// as glibc does for fchmodat with AT_SYMLINK_NOFOLLOW.
+func chmodOpenPath(path string, info os.FileInfo, perm os.FileMode) error {
+	f, err := os.OpenFile(path, oPath|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := verifyHandle(f, path); err != nil {
+		return err
+	}
+	opened, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(info, opened) || opened.Mode()&fs.ModeSymlink != 0 {
+		return opErrorf(codeConflict, "path changed during operation: %s", path)
+	}
+
+	err = os.Chmod("/proc/self/fd/"+strconv.Itoa(int(f.Fd())), perm)
+	if errors.Is(err, fs.ErrNotExist) {
+		// /proc is not mounted.
+		return chmodLstat(path, opened, perm)
+	}
+	return err
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func init() {
+	serveGRPC = startGRPCServer
+}
+
+// operationsServer implements quicssh.Operations (see operations.proto) by
+// running each RPC as the action of the same name.
+type operationsServer struct {
+	UnimplementedOperationsServer
+}
+
+func (operationsServer) ListFiles(ctx context.Context, req *ListFilesRequest) (*ListFilesResponse, error) {
+	result, err := runGRPCOperation(ctx, "list_files", grpcParams("path", req.GetPath()))
+	if err != nil {
+		return nil, err
+	}
+	return &ListFilesResponse{Paths: result.([]string)}, nil
+}
+
+func (operationsServer) ReadFile(ctx context.Context, req *ReadFileRequest) (*ReadFileResponse, error) {
+	result, err := runGRPCOperation(ctx, "read_file", grpcParams("path", req.GetPath()))
+	if err != nil {
+		return nil, err
+	}
+	return &ReadFileResponse{Content: []byte(result.(string))}, nil
+}
+
+func (operationsServer) WriteFile(ctx context.Context, req *WriteFileRequest) (*WriteFileResponse, error) {
+	_, err := runGRPCOperation(ctx, "write_file", grpcParams(
+		"path", req.GetPath(),
+		"content", string(req.GetContent()),
+		"sha256", req.GetSha256(),
+		"if_match", req.GetIfMatch(),
+		"line_ending", req.GetLineEnding(),
+		"encoding", req.GetEncoding(),
+		"durable", grpcFlag(req.GetDurable()),
+		"exclusive", grpcFlag(req.GetExclusive()),
+	))
+	if err != nil {
+		return nil, err
+	}
+	return &WriteFileResponse{}, nil
+}
+
+func (operationsServer) CreateFolder(ctx context.Context, req *CreateFolderRequest) (*CreateFolderResponse, error) {
+	_, err := runGRPCOperation(ctx, "create_folder", grpcParams(
+		"path", req.GetPath(),
+		"exclusive", grpcFlag(req.GetExclusive()),
+	))
+	if err != nil {
+		return nil, err
+	}
+	return &CreateFolderResponse{}, nil
+}
+
+func (operationsServer) DiskUsage(ctx context.Context, req *DiskUsageRequest) (*DiskUsageResponse, error) {
+	result, err := runGRPCOperation(ctx, "disk_usage", grpcParams("path", req.GetPath()))
+	if err != nil {
+		return nil, err
+	}
+	usage := result.(diskUsage)
+	return &DiskUsageResponse{Total: usage.Total, Free: usage.Free, Used: usage.Used}, nil
+}
+
+func (operationsServer) Rotate(ctx context.Context, req *RotateRequest) (*RotateResponse, error) {
+	keep := ""
+	if req.GetKeep() > 0 {
+		keep = strconv.FormatUint(uint64(req.GetKeep()), 10)
+	}
+	result, err := runGRPCOperation(ctx, "rotate", grpcParams(
+		"path", req.GetPath(),
+		"compress", grpcFlag(req.GetCompress()),
+		"keep", keep,
+	))
+	if err != nil {
+		return nil, err
+	}
+	rotated := result.(rotateResult)
+	return &RotateResponse{Rotated: rotated.Rotated, Pruned: rotated.Pruned}, nil
+}
+
+// grpcParams builds operation parameters from key, value pairs, leaving
+// out empty values as a JSON request would leave out the key.
+func grpcParams(pairs ...string) map[string]string {
+	params := make(map[string]string, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if pairs[i+1] != "" {
+			params[pairs[i]] = pairs[i+1]
+		}
+	}
+	return params
+}
+
+// grpcFlag is a bool field as the operation parameter reads it.
+func grpcFlag(set bool) string {
+	if set {
+		return "true"
+	}
+	return ""
+}
+
+// runGRPCOperation applies the same checks as operationHandler and runs the
+// action through processOperation.
+func runGRPCOperation(ctx context.Context, action string, params map[string]string) (interface{}, error) {
+	if draining.Load() {
+		return nil, status.Error(codes.Unavailable, "Server is shutting down")
+	}
+	// gRPC requests carry no body signature, so a subject that must sign
+	// its requests cannot use this API at all.
+	if subject, _ := claimsFromContext(ctx)["sub"].(string); subject != "" {
+		if _, ok := currentConfig().SigningKeys[subject]; ok {
+			return nil, status.Error(codes.Unauthenticated, "requests from this subject must be signed; use /api/operation")
+		}
+	}
+
+	op := Operation{Action: action, Parameters: params}
+	if err := validateParameters(op); err != nil {
+		return nil, status.Error(codes.InvalidArgument, asOpError(err).Message)
+	}
+	if err := authorizeOperation(claimsFromContext(ctx), op); err != nil {
+		e := asOpError(err)
+		return nil, status.Error(grpcCodes[e.Code], e.Message)
+	}
+	if blockedByMaintenance(action) {
+		return nil, status.Error(codes.Unavailable, errMaintenance.Message)
+	}
+
+	var clientID string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ids := md.Get("x-client-id"); len(ids) > 0 {
+			clientID = ids[0]
+		}
+	}
+
+	release, err := admitOperation(ctx, action, clientID)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
+		e := asOpError(err)
+		return nil, status.Error(grpcCodes[e.Code], e.Message)
+	}
+	defer release()
+	done := inflight.Begin(action, op.Parameters["path"], clientID)
+	result, err := processOperation(claimsFromContext(ctx), op)
+	done()
+	auditEvent(claimsFromContext(ctx), clientID, op, err)
+	if err != nil {
+		e := asOpError(err)
+		return nil, status.Error(grpcCodes[e.Code], e.Message)
+	}
+
+	return result, nil
+}
+
+// grpcCodes maps operation error codes to their gRPC equivalents.
+var grpcCodes = map[string]codes.Code{
+	codeInvalidArgument:  codes.InvalidArgument,
+	codeInvalidName:      codes.InvalidArgument,
+	codeInvalidToken:     codes.Unauthenticated,
+	codeBadSignature:     codes.Unauthenticated,
+	codePathDenied:       codes.PermissionDenied,
+	codeTypeDenied:       codes.PermissionDenied,
+	codePermissionDenied: codes.PermissionDenied,
+	codeNotAllowed:       codes.PermissionDenied,
+	codeArgumentDenied:   codes.PermissionDenied,
+	codeNotFound:         codes.NotFound,
+	codeAlreadyExists:    codes.AlreadyExists,
+	codeIsDirectory:      codes.FailedPrecondition,
+	codeTooLarge:         codes.ResourceExhausted,
+	codeNoSpace:          codes.ResourceExhausted,
+	codeChecksumMismatch: codes.DataLoss,
+	codeConflict:         codes.Aborted,
+	codeUnsupported:      codes.Unimplemented,
+	codeMaintenance:      codes.Unavailable,
+	codeBusy:             codes.Unavailable,
+	codeTooManyOps:       codes.ResourceExhausted,
+	codeInternal:         codes.Internal,
+}
+
+// grpcAuthInterceptor is authMiddleware for gRPC: it requires a valid
+// "authorization: Bearer <token>" entry in the call metadata, or an
+// "x-api-key" one.
+func grpcAuthInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	first := func(key string) string {
+		if values := md.Get(key); len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+	claims, ok, err := credentialClaims(first("authorization"), first(apiKeyHeader))
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "Unauthorized")
+	}
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "Invalid token")
+	}
+
+	return handler(withCredential(ctx, claims, first("authorization"), first(apiKeyHeader)), req)
+}
+
+func newGRPCServer(opts ...grpc.ServerOption) *grpc.Server {
+	opts = append(opts, grpc.UnaryInterceptor(grpcAuthInterceptor))
+	s := grpc.NewServer(opts...)
+	RegisterOperationsServer(s, operationsServer{})
+	return s
+}
+
+// startGRPCServer serves quicssh.Operations over TLS on TCP. gRPC has no
+// HTTP/3 transport, so it runs as a sidecar next to the QUIC listener and
+// shares its certificate, token validation and operation logic.
+func startGRPCServer(addr string) error {
+	creds, err := credentials.NewServerTLSFromFile(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return newGRPCServer(grpc.Creds(creds)).Serve(lis)
+}
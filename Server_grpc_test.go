@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// dialGRPC serves newGRPCServer over an in-memory listener and returns a
+// connection to it.
+func dialGRPC(t *testing.T) *grpc.ClientConn {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	s := newGRPCServer()
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// withToken returns a context that sends token as the call's bearer token,
+// or sends none if it is empty.
+func withToken(token string) context.Context {
+	if token == "" {
+		return context.Background()
+	}
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+}
+
+func TestGRPCOperations(t *testing.T) {
+	root := testRoot(t)
+	conn := dialGRPC(t)
+	token := testToken(t, jwt.MapClaims{"sub": "tester"})
+	path := filepath.Join(root, "a.txt")
+
+	client := NewOperationsClient(conn)
+	ctx := withToken(token)
+
+	if _, err := client.WriteFile(ctx, &WriteFileRequest{Path: path, Content: []byte("over grpc")}); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if _, err := client.WriteFile(ctx, &WriteFileRequest{Path: path, Content: []byte("again"), Exclusive: true}); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("exclusive WriteFile over a file: %v", err)
+	}
+	read, err := client.ReadFile(ctx, &ReadFileRequest{Path: path})
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if got := string(read.GetContent()); got != "over grpc" {
+		t.Errorf("ReadFile content = %q", got)
+	}
+
+	if _, err := client.CreateFolder(ctx, &CreateFolderRequest{Path: filepath.Join(root, "sub")}); err != nil {
+		t.Fatalf("CreateFolder: %v", err)
+	}
+	list, err := client.ListFiles(ctx, &ListFilesRequest{Path: root})
+	if err != nil {
+		t.Fatalf("ListFiles: %v", err)
+	}
+	if want := []string{path, filepath.Join(root, "sub")}; !reflect.DeepEqual(list.GetPaths(), want) {
+		t.Errorf("ListFiles = %q, want %q", list.GetPaths(), want)
+	}
+
+	usage, err := client.DiskUsage(ctx, &DiskUsageRequest{Path: root})
+	if err != nil {
+		t.Fatalf("DiskUsage: %v", err)
+	}
+	if usage.GetTotal() == 0 || usage.GetFree() > usage.GetTotal() {
+		t.Errorf("DiskUsage = %v", usage)
+	}
+
+	_, err = client.ReadFile(ctx, &ReadFileRequest{Path: filepath.Join(filepath.Dir(root), "elsewhere")})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("path outside the root: %v", err)
+	}
+}
+
+func TestGRPCRequiresValidToken(t *testing.T) {
+	root := testRoot(t)
+	conn := dialGRPC(t)
+	client := NewOperationsClient(conn)
+	req := &ListFilesRequest{Path: root}
+
+	if _, err := client.ListFiles(withToken(""), req); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("no token: %v", err)
+	}
+	if _, err := client.ListFiles(withToken("not-a-token"), req); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("invalid token: %v", err)
+	}
+	token := testToken(t, jwt.MapClaims{"sub": "tester"})
+	if _, err := client.ListFiles(withToken(token+"x"), req); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("tampered token: %v", err)
+	}
+}
+
+func TestGRPCCodesCoverEveryErrorCode(t *testing.T) {
+	for code := range codeStatus {
+		if _, ok := grpcCodes[code]; !ok {
+			t.Errorf("%s has no gRPC code", code)
+		}
+	}
+}
+
+func TestGRPCRefusesSubjectsThatMustSign(t *testing.T) {
+	root := testRoot(t)
+	editConfig(t, func(c *Config) { c.SigningKeys = map[string]string{"signer": "signing key"} })
+	client := NewOperationsClient(dialGRPC(t))
+	path := filepath.Join(root, "a.txt")
+	writeTestFile(t, path, "x")
+	req := &ReadFileRequest{Path: path}
+
+	_, err := client.ReadFile(withToken(testToken(t, jwt.MapClaims{"sub": "signer"})), req)
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("subject with a signing key: %v", err)
+	}
+	if _, err := client.ReadFile(withToken(testToken(t, jwt.MapClaims{"sub": "someone"})), req); err != nil {
+		t.Errorf("subject without a signing key: %v", err)
+	}
+}
+
+func TestGRPCRefusesOversizedParameters(t *testing.T) {
+	root := testRoot(t)
+	client := NewOperationsClient(dialGRPC(t))
+	token := testToken(t, jwt.MapClaims{"sub": "tester"})
+	_, err := client.ReadFile(withToken(token), &ReadFileRequest{Path: filepath.Join(root, strings.Repeat("a", 5000))})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("oversized path: %v", err)
+	}
+}
+
+func TestGRPCReleasesSlotsWhenClientLeaves(t *testing.T) {
+	root := testRoot(t)
+	editConfig(t, func(c *Config) {
+		c.MaxConcurrentOps = 1
+		c.MaxOpsPerClient = 1
+	})
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), claimsKey{}, jwt.MapClaims{"sub": "leaver"}))
+	cancel()
+	runGRPCOperation(ctx, "list_files", map[string]string{"path": root})
+	if running, counted := slotsHeld(); running != 0 || counted != 0 {
+		t.Fatalf("after the client left: %d slots and %d client operations held", running, counted)
+	}
+}
+
+func TestGRPCRotate(t *testing.T) {
+	root := testRoot(t)
+	enableActions(t, "rotate")
+	client := NewOperationsClient(dialGRPC(t))
+	path := filepath.Join(root, "app.log")
+	writeTestFile(t, path, "current\n")
+	older := filepath.Join(root, "app-20200101T000000.000Z.log")
+	writeTestFile(t, older, "older\n")
+
+	out, err := client.Rotate(withToken(testToken(t, jwt.MapClaims{"sub": "tester"})), &RotateRequest{Path: path, Compress: true, Keep: 1})
+	if err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+	if !strings.HasSuffix(out.GetRotated(), ".log.gz") {
+		t.Errorf("rotated %q is not compressed", out.GetRotated())
+	}
+	if want := []string{older}; !reflect.DeepEqual(out.GetPruned(), want) {
+		t.Errorf("pruned %q, want %q", out.GetPruned(), want)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import "syscall"
+
+func init() {
+	openNoFollow = syscall.O_NOFOLLOW
+}
@@ -0,0 +1,31 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func init() {
+	watchSignals = handleSignals
+}
+
+// handleSignals flips maintenance mode on SIGUSR1, e.g. from `kill -USR1`
+// in a backup script, and reloads CONFIG_FILE on SIGHUP.
+func handleSignals() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR1, syscall.SIGHUP)
+	for s := range sig {
+		switch s {
+		case syscall.SIGUSR1:
+			setMaintenance(!maintenance.Load())
+		case syscall.SIGHUP:
+			if err := reloadConfig(); err != nil {
+				log.Println("Config reload failed:", err)
+			}
+		}
+	}
+}
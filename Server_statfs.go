@@ -0,0 +1,24 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import "syscall"
+
+func init() {
+	statDisk = statfsDisk
+}
+
+func statfsDisk(path string) (diskUsage, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return diskUsage{}, err
+	}
+
+	bsize := uint64(st.Bsize)
+	total := uint64(st.Blocks) * bsize
+	// Report what an unprivileged writer can use, but count reserved blocks
+	// as used so Total = Free + Used + reserved stays consistent with df.
+	free := uint64(st.Bavail) * bsize
+	used := total - uint64(st.Bfree)*bsize
+	return diskUsage{Total: total, Free: free, Used: used}, nil
+}
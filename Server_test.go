@@ -0,0 +1,5960 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"container/heap"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"maps"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/lucas-clemente/quic-go/http3"
+)
+
+// useConfig makes c the config in effect until t ends.
+func useConfig(t *testing.T, c Config) {
+	t.Helper()
+	prev := currentConfig()
+	setConfig(c)
+	t.Cleanup(func() { liveConfig.Store(prev) })
+}
+
+// testRoot returns a new directory and makes it the only allowed path,
+// read-write, under the default config.
+func testRoot(t *testing.T) string {
+	t.Helper()
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := defaultConfig()
+	c.AllowedPaths = []AllowedPath{{Path: dir, Mode: modeReadWrite}}
+	useConfig(t, c)
+	return dir
+}
+
+// editConfig applies edit to a copy of the config in effect and makes the
+// copy the config until t ends.
+func editConfig(t *testing.T, edit func(c *Config)) {
+	t.Helper()
+	c := *currentConfig()
+	edit(&c)
+	useConfig(t, c)
+}
+
+// enableActions turns on actions that are off by default, until t ends.
+func enableActions(t *testing.T, actions ...string) {
+	t.Helper()
+	editConfig(t, func(c *Config) {
+		enabled := maps.Clone(c.AllowedActions)
+		for _, action := range actions {
+			enabled[action] = true
+		}
+		c.AllowedActions = enabled
+	})
+}
+
+// writeTestFile creates path with content, and any missing parents.
+func writeTestFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// withClaims returns r as authMiddleware would pass it on for a token
+// with claims.
+func withClaims(r *http.Request, claims jwt.MapClaims) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), claimsKey{}, claims))
+}
+
+// postOperation runs op through operationHandler for a token with claims.
+func postOperation(t *testing.T, claims jwt.MapClaims, op Operation) *httptest.ResponseRecorder {
+	t.Helper()
+	body, err := json.Marshal(op)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := withClaims(httptest.NewRequest(http.MethodPost, "/api/operation", bytes.NewReader(body)), claims)
+	rec := httptest.NewRecorder()
+	operationHandler(rec, req)
+	return rec
+}
+
+// testToken signs claims as an HS256 JWT under a secret it installs
+// until t ends.
+func testToken(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+	prev := jwtSecret
+	jwtSecret = []byte("test secret")
+	t.Cleanup(func() { jwtSecret = prev })
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(jwtSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// decodeResponse decodes the Response in rec.
+func decodeResponse(t *testing.T, rec *httptest.ResponseRecorder) Response {
+	t.Helper()
+	var resp Response
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body.String(), err)
+	}
+	return resp
+}
+
+// errCode returns the code of err as an OpError, or "" for nil.
+func errCode(err error) string {
+	if err == nil {
+		return ""
+	}
+	return asOpError(err).Code
+}
+
+func TestCanonicalizeResolvesInsideRoot(t *testing.T) {
+	root := testRoot(t)
+	writeTestFile(t, filepath.Join(root, "a", "b.txt"), "x")
+
+	tests := []struct {
+		name, path, want string
+	}{
+		{"clean path", filepath.Join(root, "a", "b.txt"), filepath.Join(root, "a", "b.txt")},
+		{"dot segments", root + "/a/./../a/b.txt", filepath.Join(root, "a", "b.txt")},
+		{"trailing separator", root + "/a/", filepath.Join(root, "a")},
+		{"missing file", filepath.Join(root, "a", "new.txt"), filepath.Join(root, "a", "new.txt")},
+		{"missing parents", filepath.Join(root, "x", "y", "z.txt"), filepath.Join(root, "x", "y", "z.txt")},
+		{"root itself", root, root},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := canonicalize(tt.path)
+			if err != nil {
+				t.Fatalf("canonicalize(%q): %v", tt.path, err)
+			}
+			if got != tt.want {
+				t.Errorf("canonicalize(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCanonicalizeRefusesTraversal(t *testing.T) {
+	root := testRoot(t)
+
+	for _, path := range []string{
+		root + "/../",
+		root + "/a/../../etc/passwd",
+		filepath.Dir(root),
+		root + "2",
+		"/etc/passwd",
+	} {
+		if _, err := canonicalize(path); errCode(err) != codePathDenied {
+			t.Errorf("canonicalize(%q) error = %v, want %s", path, err, codePathDenied)
+		}
+	}
+}
+
+func TestCanonicalizeRelativeInput(t *testing.T) {
+	root := testRoot(t)
+	writeTestFile(t, filepath.Join(root, "f.txt"), "x")
+	t.Chdir(root)
+
+	got, err := canonicalize("f.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(root, "f.txt"); got != want {
+		t.Errorf("canonicalize(%q) = %q, want %q", "f.txt", got, want)
+	}
+	if _, err := canonicalize("../outside.txt"); errCode(err) != codePathDenied {
+		t.Errorf("canonicalize of a relative path out of the root: %v, want %s", err, codePathDenied)
+	}
+}
+
+func TestCanonicalizeSymlinks(t *testing.T) {
+	root := testRoot(t)
+	outside, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(root, "real", "f.txt"), "x")
+	writeTestFile(t, filepath.Join(outside, "secret.txt"), "x")
+	mustSymlink(t, filepath.Join(root, "real"), filepath.Join(root, "inside"))
+	mustSymlink(t, outside, filepath.Join(root, "escape"))
+	mustSymlink(t, filepath.Join(root, "nowhere"), filepath.Join(root, "dangling"))
+
+	got, err := canonicalize(filepath.Join(root, "inside", "f.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(root, "real", "f.txt"); got != want {
+		t.Errorf("symlink inside the root resolved to %q, want %q", got, want)
+	}
+	if _, err := canonicalize(filepath.Join(root, "escape", "secret.txt")); errCode(err) != codePathDenied {
+		t.Errorf("symlink out of the root: %v, want %s", err, codePathDenied)
+	}
+	if _, err := canonicalize(filepath.Join(root, "escape", "new.txt")); errCode(err) != codePathDenied {
+		t.Errorf("new file behind a symlink out of the root: %v, want %s", err, codePathDenied)
+	}
+	if _, err := canonicalize(filepath.Join(root, "dangling")); err == nil {
+		t.Error("dangling symlink was accepted")
+	}
+}
+
+func TestCanonicalizeRejectsEmptyAndNUL(t *testing.T) {
+	root := testRoot(t)
+
+	if _, err := canonicalize(""); errCode(err) != codeInvalidArgument {
+		t.Errorf("empty path: %v, want %s", err, codeInvalidArgument)
+	}
+	if _, err := canonicalize(root + "/a\x00b"); err == nil {
+		t.Error("path with a NUL byte was accepted")
+	}
+}
+
+func TestIsWithin(t *testing.T) {
+	tests := []struct {
+		path, root string
+		want       bool
+	}{
+		{"/data/shared", "/data/shared", true},
+		{"/data/shared/a", "/data/shared", true},
+		{"/data/shared2", "/data/shared", false},
+		{"/data", "/data/shared", false},
+		{"/data/shared/../x", "/data/shared", false},
+		{"/data/shared/..x", "/data/shared", true},
+	}
+	for _, tt := range tests {
+		if got := isWithin(tt.path, tt.root); got != tt.want {
+			t.Errorf("isWithin(%q, %q) = %v, want %v", tt.path, tt.root, got, tt.want)
+		}
+	}
+}
+
+func mustSymlink(t *testing.T, target, link string) {
+	t.Helper()
+	if err := os.Symlink(target, link); err != nil {
+		t.Skipf("symlinks unavailable: %v", err)
+	}
+}
+
+func TestOpenVerifiedCatchesSwappedSymlink(t *testing.T) {
+	root := testRoot(t)
+	outside, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(outside, "secret.txt"), "secret")
+	path := filepath.Join(root, "f.txt")
+	writeTestFile(t, path, "mine")
+
+	canonical, err := canonicalize(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Swap the checked file for a symlink out of the root.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	mustSymlink(t, filepath.Join(outside, "secret.txt"), path)
+
+	if f, err := openVerified(canonical, os.O_RDONLY, 0); err == nil {
+		f.Close()
+		t.Fatal("read through a swapped-in symlink was allowed")
+	}
+	if f, err := openVerified(canonical, os.O_WRONLY|os.O_CREATE, 0644); err == nil {
+		f.Close()
+		t.Fatal("write through a swapped-in symlink was allowed")
+	}
+	if data, _ := os.ReadFile(filepath.Join(outside, "secret.txt")); string(data) != "secret" {
+		t.Errorf("target of the symlink was changed to %q", data)
+	}
+}
+
+func TestOpenVerifiedCreatesNothingOutsideRoot(t *testing.T) {
+	root := testRoot(t)
+	outside, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A symlink to a file that does not exist yet: O_CREATE would make it.
+	link := filepath.Join(root, "new.txt")
+	canonical, err := canonicalize(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustSymlink(t, filepath.Join(outside, "created.txt"), link)
+	if f, err := openVerified(canonical, os.O_WRONLY|os.O_CREATE, 0644); err == nil {
+		f.Close()
+		t.Fatal("create through a swapped-in symlink was allowed")
+	}
+
+	// A parent directory swapped for a symlink out of the root.
+	dir := filepath.Join(root, "sub")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	canonical, err = canonicalize(filepath.Join(dir, "created2.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(dir, dir+".old"); err != nil {
+		t.Fatal(err)
+	}
+	mustSymlink(t, outside, dir)
+	if f, err := openVerified(canonical, os.O_WRONLY|os.O_CREATE, 0644); err == nil {
+		f.Close()
+		t.Fatal("create under a swapped-in directory symlink was allowed")
+	}
+
+	entries, err := os.ReadDir(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		t.Errorf("%s was left outside the root", e.Name())
+	}
+}
+
+func TestOpenVerifiedCreatesInsideRoot(t *testing.T) {
+	root := testRoot(t)
+	path := filepath.Join(root, "new.txt")
+
+	f, err := openVerified(path, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("file was not created: %v", err)
+	}
+	// Opening an existing file with O_CREATE must not fail on it.
+	f, err = openVerified(path, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatalf("reopening an existing file: %v", err)
+	}
+	f.Close()
+}
+
+func TestWriteFileEnforcesMaxFileSize(t *testing.T) {
+	root := testRoot(t)
+	editConfig(t, func(c *Config) { c.MaxFileSize = 5 })
+	claims := jwt.MapClaims{"sub": "tester"}
+
+	rec := postOperation(t, claims, Operation{Action: "write_file", Parameters: map[string]string{
+		"path": filepath.Join(root, "big.txt"), "content": "123456",
+	}})
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("oversized write: status %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+	if resp := decodeResponse(t, rec); resp.Code != codeTooLarge {
+		t.Errorf("oversized write: code %q, want %q", resp.Code, codeTooLarge)
+	}
+	if _, err := os.Stat(filepath.Join(root, "big.txt")); err == nil {
+		t.Error("oversized write created the file")
+	}
+
+	rec = postOperation(t, claims, Operation{Action: "write_file", Parameters: map[string]string{
+		"path": filepath.Join(root, "small.txt"), "content": "12345",
+	}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("write at the limit: status %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestCapabilitiesReportLimits(t *testing.T) {
+	testRoot(t)
+	editConfig(t, func(c *Config) { c.MaxFileSize = 1234 })
+
+	rec := httptest.NewRecorder()
+	capabilitiesHandler(rec, httptest.NewRequest(http.MethodGet, "/api/capabilities", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d", rec.Code)
+	}
+	var resp struct {
+		Data struct {
+			MaxFileSize    int64    `json:"max_file_size"`
+			AllowedActions []string `json:"allowed_actions"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Data.MaxFileSize != 1234 {
+		t.Errorf("max_file_size = %d, want 1234", resp.Data.MaxFileSize)
+	}
+	if !slices.Contains(resp.Data.AllowedActions, "write_file") {
+		t.Errorf("allowed_actions %v lacks write_file", resp.Data.AllowedActions)
+	}
+}
+
+func TestDiskUsage(t *testing.T) {
+	root := testRoot(t)
+
+	usage, err := diskUsageOf(root)
+	if errCode(err) == codeUnsupported {
+		t.Skip("disk usage is not supported on this platform")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Total == 0 {
+		t.Error("total is 0")
+	}
+	if usage.Free > usage.Total || usage.Used > usage.Total {
+		t.Errorf("free %d or used %d exceeds total %d", usage.Free, usage.Used, usage.Total)
+	}
+
+	if _, err := diskUsageOf(filepath.Join(root, "missing")); err == nil {
+		t.Error("disk usage of a missing path succeeded")
+	}
+	if _, err := diskUsageOf("/"); errCode(err) != codePathDenied {
+		t.Errorf("disk usage outside the roots: %v, want %s", err, codePathDenied)
+	}
+}
+
+func TestIsCompressible(t *testing.T) {
+	tests := []struct {
+		contentType, ext string
+		want             bool
+	}{
+		{"application/json", "", true},
+		{"application/json; charset=utf-8", ".txt", true},
+		{"text/plain; charset=utf-8", ".log", true},
+		{"text/csv", ".csv", true},
+		{"application/vnd.api+json", "", true},
+		{"image/svg+xml", ".svg", true},
+		{"application/json", ".gz", false},
+		{"text/plain", ".ZIP", false},
+		{"image/png", ".png", false},
+		{"application/octet-stream", ".bin", false},
+		{"text/event-stream", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		if got := isCompressible(tt.contentType, tt.ext); got != tt.want {
+			t.Errorf("isCompressible(%q, %q) = %v, want %v", tt.contentType, tt.ext, got, tt.want)
+		}
+	}
+}
+
+func TestCompressMiddleware(t *testing.T) {
+	body := strings.Repeat("compressible text ", 100)
+	handler := compressMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setCompressionExt(w, r.URL.Query().Get("ext"))
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, body)
+	}))
+
+	serve := func(ext, acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/?ext="+ext, nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := serve(".txt", "gzip, br")
+	if rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("text was not gzipped: %v", rec.Header())
+	}
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(zr); string(got) != body {
+		t.Error("gzipped body does not decompress to the original")
+	}
+	if rec.Header().Get("Vary") != "Accept-Encoding" {
+		t.Errorf("Vary = %q, want Accept-Encoding", rec.Header().Get("Vary"))
+	}
+
+	for _, tt := range []struct{ ext, acceptEncoding string }{
+		{".zip", "gzip"},
+		{".txt", ""},
+		{".txt", "br"},
+	} {
+		rec := serve(tt.ext, tt.acceptEncoding)
+		if rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != body {
+			t.Errorf("ext %q, Accept-Encoding %q: response was changed", tt.ext, tt.acceptEncoding)
+		}
+	}
+}
+
+func TestTailLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	var b strings.Builder
+	for i := 1; i <= 5000; i++ {
+		fmt.Fprintf(&b, "line %d\n", i)
+	}
+	writeTestFile(t, path, b.String())
+
+	lines, err := tailLines(path, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"line 4998", "line 4999", "line 5000"}; !slices.Equal(lines, want) {
+		t.Errorf("tailLines = %q, want %q", lines, want)
+	}
+
+	writeTestFile(t, path, "")
+	if lines, err := tailLines(path, 3); err != nil || len(lines) != 0 {
+		t.Errorf("tailLines of an empty file = %q, %v", lines, err)
+	}
+}
+
+func TestLogTailRequiresAdmin(t *testing.T) {
+	testRoot(t)
+	logPath := filepath.Join(t.TempDir(), "audit.log")
+	editConfig(t, func(c *Config) { c.AuditLogPath = logPath })
+	auditEvent(jwt.MapClaims{"sub": "alice"}, "", Operation{Action: "read_file", Parameters: map[string]string{"path": "/a"}}, nil)
+	auditEvent(jwt.MapClaims{"sub": "bob"}, "", Operation{Action: "write_file", Parameters: map[string]string{"path": "/b"}}, errNotAllowed)
+	handler := adminMiddleware(logTailHandler)
+
+	get := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/logtail?lines=1", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+
+	if rec := get(""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("no token: status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if rec := get(testToken(t, jwt.MapClaims{"sub": "user", "scope": "read"})); rec.Code != http.StatusForbidden {
+		t.Errorf("non-admin token: status %d, want %d", rec.Code, http.StatusForbidden)
+	}
+
+	rec := get(testToken(t, jwt.MapClaims{"sub": "root", "scope": "admin"}))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("admin token: status %d: %s", rec.Code, rec.Body)
+	}
+	var resp struct{ Data []string }
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Data) != 1 {
+		t.Fatalf("got %d lines, want 1", len(resp.Data))
+	}
+	var entry auditEntry
+	if err := json.Unmarshal([]byte(resp.Data[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Subject != "bob" || entry.Action != "write_file" || entry.Status != "error" {
+		t.Errorf("last entry = %+v, want bob's failed write_file", entry)
+	}
+}
+
+func TestVersionEndpoint(t *testing.T) {
+	prevVersion, prevCommit := version, gitCommit
+	version, gitCommit = "v1.2.3", "abc123"
+	t.Cleanup(func() { version, gitCommit = prevVersion, prevCommit })
+
+	rec := httptest.NewRecorder()
+	versionHandler(rec, httptest.NewRequest(http.MethodGet, "/version", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d", rec.Code)
+	}
+	var resp struct{ Data map[string]string }
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"version": "v1.2.3", "git_commit": "abc123", "go_version": runtime.Version()}
+	if !maps.Equal(resp.Data, want) {
+		t.Errorf("data = %v, want %v", resp.Data, want)
+	}
+
+	rec = httptest.NewRecorder()
+	versionHandler(rec, httptest.NewRequest(http.MethodPost, "/version", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: status %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestBuildInfoFallsBackToDevel(t *testing.T) {
+	prevVersion := version
+	version = ""
+	t.Cleanup(func() { version = prevVersion })
+
+	if info := currentBuildInfo(); info.Version == "" || info.GoVersion == "" {
+		t.Errorf("build info %+v has empty fields", info)
+	}
+}
+
+// getFile runs downloadHandler for path with the Range header rng, if any.
+func getFile(t *testing.T, method, path, rng string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := withClaims(httptest.NewRequest(method, "/api/file?path="+url.QueryEscape(path), nil), jwt.MapClaims{"sub": "tester"})
+	if rng != "" {
+		req.Header.Set("Range", rng)
+	}
+	rec := httptest.NewRecorder()
+	downloadHandler(rec, req)
+	return rec
+}
+
+func TestDownloadRanges(t *testing.T) {
+	root := testRoot(t)
+	path := filepath.Join(root, "data.txt")
+	writeTestFile(t, path, "0123456789")
+
+	tests := []struct {
+		name, rng    string
+		status       int
+		body, cRange string
+	}{
+		{"whole file", "", http.StatusOK, "0123456789", ""},
+		{"single range", "bytes=2-5", http.StatusPartialContent, "2345", "bytes 2-5/10"},
+		{"open-ended range", "bytes=7-", http.StatusPartialContent, "789", "bytes 7-9/10"},
+		{"suffix range", "bytes=-3", http.StatusPartialContent, "789", "bytes 7-9/10"},
+		{"unsatisfiable range", "bytes=20-", http.StatusRequestedRangeNotSatisfiable, "", "bytes */10"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := getFile(t, http.MethodGet, path, tt.rng)
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d", rec.Code, tt.status)
+			}
+			if rec.Header().Get("Accept-Ranges") != "bytes" {
+				t.Error("Accept-Ranges is not bytes")
+			}
+			if got := rec.Header().Get("Content-Range"); got != tt.cRange {
+				t.Errorf("Content-Range = %q, want %q", got, tt.cRange)
+			}
+			if tt.status != http.StatusRequestedRangeNotSatisfiable && rec.Body.String() != tt.body {
+				t.Errorf("body = %q, want %q", rec.Body, tt.body)
+			}
+		})
+	}
+}
+
+func TestDownloadRefusesOutsideRoot(t *testing.T) {
+	testRoot(t)
+	if rec := getFile(t, http.MethodGet, "/etc/passwd", ""); rec.Code != http.StatusForbidden {
+		t.Errorf("status %d, want %d", rec.Code, http.StatusForbidden)
+	}
+}
+
+func TestDefaultConfigIsValid(t *testing.T) {
+	if err := validateConfig(defaultConfig()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDefaultConfigLeavesRiskyActionsOff(t *testing.T) {
+	actions := defaultConfig().AllowedActions
+	for _, action := range []string{"exec", "chmod", "symlink", "rotate", "move", "swap", "retype"} {
+		if actions[action] {
+			t.Errorf("%s is enabled by default", action)
+		}
+	}
+}
+
+func TestResolveAction(t *testing.T) {
+	testRoot(t)
+	editConfig(t, func(c *Config) { c.ActionAliases = map[string]string{"ls": "list_files", "cat": "read_file"} })
+
+	for alias, want := range map[string]string{"ls": "list_files", "cat": "read_file", "read_file": "read_file", "rm": "rm"} {
+		if got := resolveAction(alias); got != want {
+			t.Errorf("resolveAction(%q) = %q, want %q", alias, got, want)
+		}
+	}
+}
+
+func TestAliasRunsCanonicalAction(t *testing.T) {
+	root := testRoot(t)
+	writeTestFile(t, filepath.Join(root, "a.txt"), "hello")
+
+	rec := postOperation(t, jwt.MapClaims{"sub": "tester"}, Operation{Action: "cat", Parameters: map[string]string{"path": filepath.Join(root, "a.txt")}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if resp := decodeResponse(t, rec); resp.Data != "hello" {
+		t.Errorf("data = %v, want hello", resp.Data)
+	}
+
+	// Permissions are granted on canonical names, so disallowing the
+	// action disallows its aliases.
+	editConfig(t, func(c *Config) { c.AllowedActions = map[string]bool{"list_files": true} })
+	rec = postOperation(t, jwt.MapClaims{"sub": "tester"}, Operation{Action: "cat", Parameters: map[string]string{"path": filepath.Join(root, "a.txt")}})
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("alias of a disallowed action: status %d, want %d", rec.Code, http.StatusForbidden)
+	}
+}
+
+func TestValidateConfigRejectsBadAliases(t *testing.T) {
+	for name, aliases := range map[string]map[string]string{
+		"unknown target":  {"rm": "delete_everything"},
+		"shadows action":  {"read_file": "list_files"},
+		"alias to itself": {"ls": "ls"},
+	} {
+		c := defaultConfig()
+		c.ActionAliases = aliases
+		if err := validateConfig(c); err == nil {
+			t.Errorf("%s: %v was accepted", name, aliases)
+		}
+	}
+}
+
+func TestRotateFile(t *testing.T) {
+	root := testRoot(t)
+	path := filepath.Join(root, "app.log")
+	writeTestFile(t, path, "old lines\n")
+	if err := os.Chmod(path, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := rotateFile(path, false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stamp, ok := strings.CutPrefix(filepath.Base(result.Rotated), "app-")
+	if !ok || !strings.HasSuffix(stamp, ".log") {
+		t.Fatalf("rotated name %q is not app-<timestamp>.log", result.Rotated)
+	}
+	if _, err := time.Parse(rotationLayout, strings.TrimSuffix(stamp, ".log")); err != nil {
+		t.Errorf("rotated name %q has no timestamp: %v", result.Rotated, err)
+	}
+	if data, _ := os.ReadFile(result.Rotated); string(data) != "old lines\n" {
+		t.Errorf("rotated file holds %q", data)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("no fresh file: %v", err)
+	}
+	if info.Size() != 0 {
+		t.Errorf("fresh file has %d bytes", info.Size())
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("fresh file mode %v, want 0640", info.Mode().Perm())
+	}
+}
+
+func TestRotateFileCompressesAndPrunes(t *testing.T) {
+	root := testRoot(t)
+	path := filepath.Join(root, "app.log")
+	writeTestFile(t, path, "current\n")
+	os.Chmod(path, 0640)
+	var old []string
+	for _, stamp := range []string{"20200101T000000.000Z", "20210101T000000.000Z", "20220101T000000.000Z"} {
+		name := filepath.Join(root, "app-"+stamp+".log")
+		writeTestFile(t, name, "older\n")
+		old = append(old, name)
+	}
+	// Neither is a rotation of app.log, so neither may be pruned.
+	writeTestFile(t, filepath.Join(root, "app-notes.log"), "keep me")
+	writeTestFile(t, filepath.Join(root, "other-20190101T000000.000Z.log"), "keep me")
+
+	result, err := rotateFile(path, true, "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(result.Rotated, ".log.gz") {
+		t.Fatalf("rotated %q is not compressed", result.Rotated)
+	}
+	// The compressed rotation is no more readable than the log was.
+	if runtime.GOOS != "windows" {
+		if got := modeOf(t, result.Rotated); got != 0640 {
+			t.Errorf("compressed rotation has mode %o, want 640", got)
+		}
+	}
+	f, err := os.Open(result.Rotated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := io.ReadAll(zr); string(data) != "current\n" {
+		t.Errorf("compressed rotation holds %q", data)
+	}
+
+	// The new rotation and the newest old one are kept.
+	if want := []string{old[1], old[0]}; !slices.Equal(result.Pruned, want) {
+		t.Errorf("pruned %q, want %q", result.Pruned, want)
+	}
+	for _, name := range []string{old[2], result.Rotated, filepath.Join(root, "app-notes.log"), filepath.Join(root, "other-20190101T000000.000Z.log")} {
+		if _, err := os.Stat(name); err != nil {
+			t.Errorf("%s was removed", filepath.Base(name))
+		}
+	}
+}
+
+func TestRotateFileRejectsBadInput(t *testing.T) {
+	root := testRoot(t)
+	writeTestFile(t, filepath.Join(root, "app.log"), "x")
+	writeTestFile(t, filepath.Join(root, "app.exe"), "x")
+
+	if _, err := rotateFile(filepath.Join(root, "app.log"), false, "-1"); errCode(err) != codeInvalidArgument {
+		t.Errorf("negative keep: %v", err)
+	}
+	if _, err := rotateFile(filepath.Join(root, "app.exe"), false, ""); errCode(err) != codeTypeDenied {
+		t.Errorf("disallowed file type: %v", err)
+	}
+	if _, err := rotateFile(root, false, ""); err == nil {
+		t.Error("rotating a directory succeeded")
+	}
+}
+
+// postRPC sends body to rpcHandler as claims.
+func postRPC(t *testing.T, claims jwt.MapClaims, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := withClaims(httptest.NewRequest(http.MethodPost, "/api/rpc", strings.NewReader(body)), claims)
+	rec := httptest.NewRecorder()
+	rpcHandler(rec, req)
+	return rec
+}
+
+func decodeRPC(t *testing.T, rec *httptest.ResponseRecorder) rpcResponse {
+	t.Helper()
+	var resp rpcResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body, err)
+	}
+	return resp
+}
+
+func TestRPCCall(t *testing.T) {
+	root := testRoot(t)
+	path := filepath.Join(root, "a.txt")
+	writeTestFile(t, path, "hello")
+	params, _ := json.Marshal(map[string]string{"path": path})
+
+	rec := postRPC(t, jwt.MapClaims{"sub": "tester"}, `{"jsonrpc":"2.0","method":"read_file","params":`+string(params)+`,"id":"abc"}`)
+	resp := decodeRPC(t, rec)
+	if resp.Error != nil {
+		t.Fatalf("error %+v", resp.Error)
+	}
+	if resp.JSONRPC != "2.0" || string(resp.ID) != `"abc"` {
+		t.Errorf("envelope = %q, id %s", resp.JSONRPC, resp.ID)
+	}
+	if !strings.Contains(fmt.Sprint(resp.Result), "hello") {
+		t.Errorf("result %v lacks the file content", resp.Result)
+	}
+}
+
+func TestRPCErrors(t *testing.T) {
+	testRoot(t)
+	claims := jwt.MapClaims{"sub": "tester"}
+	tests := []struct {
+		name, body string
+		code       int
+		id         string
+	}{
+		{"unknown method", `{"jsonrpc":"2.0","method":"nope","id":7}`, rpcMethodNotFound, "7"},
+		{"string id", `{"jsonrpc":"2.0","method":"nope","id":"x-1"}`, rpcMethodNotFound, `"x-1"`},
+		{"bad version", `{"jsonrpc":"1.0","method":"read_file","id":3}`, rpcInvalidRequest, "3"},
+		{"bad params", `{"jsonrpc":"2.0","method":"read_file","params":[1],"id":4}`, rpcInvalidParams, "4"},
+		{"not json", `{"jsonrpc":`, rpcParseError, "null"},
+	}
+	for _, tt := range tests {
+		resp := decodeRPC(t, postRPC(t, claims, tt.body))
+		if resp.Error == nil || resp.Error.Code != tt.code {
+			t.Errorf("%s: error %+v, want code %d", tt.name, resp.Error, tt.code)
+		}
+		if string(resp.ID) != tt.id {
+			t.Errorf("%s: id %s, want %s", tt.name, resp.ID, tt.id)
+		}
+	}
+}
+
+func TestRPCNotification(t *testing.T) {
+	testRoot(t)
+	rec := postRPC(t, jwt.MapClaims{"sub": "tester"}, `{"jsonrpc":"2.0","method":"nope"}`)
+	if rec.Code != http.StatusNoContent || rec.Body.Len() != 0 {
+		t.Errorf("notification got %d %q", rec.Code, rec.Body)
+	}
+}
+
+// readEvent returns the next progress event from an SSE stream.
+func readEvent(t *testing.T, r *bufio.Reader) progressEvent {
+	t.Helper()
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading the stream: %v", err)
+		}
+		if data, ok := strings.CutPrefix(line, "data: "); ok {
+			var ev progressEvent
+			if err := json.Unmarshal([]byte(data), &ev); err != nil {
+				t.Fatal(err)
+			}
+			return ev
+		}
+	}
+}
+
+func TestProgressStream(t *testing.T) {
+	id, events := progress.Start()
+	srv := httptest.NewServer(http.HandlerFunc(progressHandler))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "?id=" + id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type %q", ct)
+	}
+	stream := bufio.NewReader(resp.Body)
+
+	if ev := readEvent(t, stream); ev.Percent != 0 || ev.Done {
+		t.Errorf("initial event %+v", ev)
+	}
+	events <- progressEvent{Percent: 50, CurrentFile: "a.txt"}
+	if ev := readEvent(t, stream); ev.Percent != 50 || ev.CurrentFile != "a.txt" {
+		t.Errorf("progress event %+v", ev)
+	}
+	events <- progressEvent{Percent: 100, Done: true}
+	close(events)
+	if ev := readEvent(t, stream); !ev.Done {
+		t.Errorf("final event %+v", ev)
+	}
+	if rest, _ := io.ReadAll(stream); strings.TrimSpace(string(rest)) != "" {
+		t.Errorf("stream went on after the operation finished: %q", rest)
+	}
+}
+
+func TestProgressStreamUnknownID(t *testing.T) {
+	rec := httptest.NewRecorder()
+	progressHandler(rec, httptest.NewRequest(http.MethodGet, "/api/progress?id=nope", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("unknown operation got %d", rec.Code)
+	}
+}
+
+func TestProgressStreamClientDisconnect(t *testing.T) {
+	id, events := progress.Start()
+	defer close(events)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	returned := make(chan struct{})
+	go func() {
+		defer close(returned)
+		progressHandler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/progress?id="+id, nil).WithContext(ctx))
+	}()
+	cancel()
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler kept streaming to a client that went away")
+	}
+
+	progress.mu.Lock()
+	subs := len(progress.ops[id].subs)
+	progress.mu.Unlock()
+	if subs != 0 {
+		t.Errorf("%d subscribers left behind", subs)
+	}
+}
+
+// waitForProgress waits for the background operation whose start returned
+// data to finish, and returns its final event.
+func waitForProgress(t *testing.T, data interface{}) progressEvent {
+	t.Helper()
+	var id string
+	switch d := data.(type) {
+	case map[string]string:
+		id = d["operation_id"]
+	case map[string]interface{}:
+		id, _ = d["operation_id"].(string)
+	}
+	updates, cancel, ok := progress.Subscribe(id)
+	if !ok {
+		t.Fatalf("operation %q is unknown to the progress hub", id)
+	}
+	defer cancel()
+	for range updates {
+	}
+	return progress.Snapshot(id)
+}
+
+func TestCopyDirReportsProgress(t *testing.T) {
+	root := testRoot(t)
+	src, dst := filepath.Join(root, "src"), filepath.Join(root, "dst")
+	writeTestFile(t, filepath.Join(src, "a.txt"), "a")
+	writeTestFile(t, filepath.Join(src, "sub", "b.txt"), "b")
+	os.Chmod(filepath.Join(src, "a.txt"), 0600)
+
+	result, err := copyDir(src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev := waitForProgress(t, result); !ev.Done || ev.Percent != 100 || ev.Error != "" {
+		t.Errorf("final event %+v", ev)
+	}
+	for _, name := range []string{"a.txt", filepath.Join("sub", "b.txt")} {
+		if _, err := os.Stat(filepath.Join(dst, name)); err != nil {
+			t.Errorf("%s was not copied: %v", name, err)
+		}
+	}
+	if runtime.GOOS != "windows" {
+		if got := modeOf(t, filepath.Join(dst, "a.txt")); got != 0600 {
+			t.Errorf("copy of a 0600 file has mode %o", got)
+		}
+	}
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestManifest(t *testing.T) {
+	root := testRoot(t)
+	writeTestFile(t, filepath.Join(root, "a.txt"), "alpha")
+	writeTestFile(t, filepath.Join(root, "sub", "b.txt"), "bravo!")
+	writeTestFile(t, filepath.Join(root, "tool.exe"), "not an allowed type")
+
+	got, err := manifest(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"a.txt": "alpha", "sub/b.txt": "bravo!"}
+	if len(got) != len(want) {
+		t.Fatalf("manifest has %d entries, want %d: %v", len(got), len(want), got)
+	}
+	for rel, content := range want {
+		e, ok := got[rel]
+		if !ok {
+			t.Errorf("manifest lacks %s", rel)
+			continue
+		}
+		info, err := os.Stat(filepath.Join(root, filepath.FromSlash(rel)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Size != int64(len(content)) || e.SHA256 != sha256Hex(content) || !e.ModTime.Equal(info.ModTime()) {
+			t.Errorf("%s = %+v", rel, e)
+		}
+	}
+
+	if _, err := manifest(filepath.Join(root, "a.txt")); errCode(err) != codeInvalidArgument {
+		t.Errorf("manifest of a file: %v", err)
+	}
+	if _, err := manifest(filepath.Dir(root)); errCode(err) != codePathDenied {
+		t.Errorf("manifest outside the root: %v", err)
+	}
+}
+
+func TestManifestStream(t *testing.T) {
+	root := testRoot(t)
+	writeTestFile(t, filepath.Join(root, "a.txt"), "alpha")
+	writeTestFile(t, filepath.Join(root, "sub", "b.txt"), "bravo!")
+
+	req := withClaims(httptest.NewRequest(http.MethodGet, "/api/manifest?path="+url.QueryEscape(root), nil), jwt.MapClaims{"sub": "tester"})
+	rec := httptest.NewRecorder()
+	manifestHandler(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body)
+	}
+
+	var paths []string
+	dec := json.NewDecoder(rec.Body)
+	for dec.More() {
+		var line struct {
+			Path   string `json:"path"`
+			SHA256 string `json:"sha256"`
+			Error  string `json:"error"`
+		}
+		if err := dec.Decode(&line); err != nil {
+			t.Fatal(err)
+		}
+		if line.Error != "" {
+			t.Fatalf("stream ended with %q", line.Error)
+		}
+		paths = append(paths, line.Path)
+	}
+	if want := []string{"a.txt", "sub/b.txt"}; !slices.Equal(paths, want) {
+		t.Errorf("streamed %q, want %q", paths, want)
+	}
+}
+
+func TestPlanSync(t *testing.T) {
+	older := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	newer := older.Add(time.Hour)
+	local := map[string]manifestEntry{
+		"same.txt":     {SHA256: "s", ModTime: older},
+		"added.txt":    {SHA256: "a", ModTime: older},
+		"edited-here":  {SHA256: "l1", ModTime: newer},
+		"edited-there": {SHA256: "l2", ModTime: older},
+	}
+	remote := map[string]manifestEntry{
+		"same.txt":     {SHA256: "s", ModTime: newer},
+		"removed.txt":  {SHA256: "r", ModTime: older},
+		"edited-here":  {SHA256: "r1", ModTime: older},
+		"edited-there": {SHA256: "r2", ModTime: newer},
+	}
+
+	tests := []struct {
+		mode string
+		want syncPlan
+	}{
+		{"", syncPlan{
+			Upload:   []string{"added.txt", "edited-here"},
+			Download: []string{"edited-there", "removed.txt"},
+			Delete:   []string{},
+		}},
+		{"push", syncPlan{
+			Upload:   []string{"added.txt", "edited-here", "edited-there"},
+			Download: []string{},
+			Delete:   []string{"removed.txt"},
+		}},
+		{"pull", syncPlan{
+			Upload:   []string{},
+			Download: []string{"edited-here", "edited-there", "removed.txt"},
+			Delete:   []string{"added.txt"},
+		}},
+	}
+	for _, tt := range tests {
+		got, err := planSync(local, remote, tt.mode)
+		if err != nil {
+			t.Fatalf("mode %q: %v", tt.mode, err)
+		}
+		if !slices.Equal(got.Upload, tt.want.Upload) || !slices.Equal(got.Download, tt.want.Download) || !slices.Equal(got.Delete, tt.want.Delete) {
+			t.Errorf("mode %q: plan %+v, want %+v", tt.mode, got, tt.want)
+		}
+	}
+
+	if _, err := planSync(local, remote, "mirror"); errCode(err) != codeInvalidArgument {
+		t.Errorf("unknown mode: %v", err)
+	}
+}
+
+func TestSyncPlanFor(t *testing.T) {
+	root := testRoot(t)
+	writeTestFile(t, filepath.Join(root, "a.txt"), "alpha")
+	writeTestFile(t, filepath.Join(root, "b.txt"), "bravo")
+	client, _ := json.Marshal(map[string]manifestEntry{
+		"a.txt": {SHA256: sha256Hex("alpha")},
+		"c.txt": {SHA256: sha256Hex("charlie")},
+	})
+
+	plan, err := syncPlanFor(root, string(client), "push")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(plan.Upload, []string{"c.txt"}) || !slices.Equal(plan.Delete, []string{"b.txt"}) || len(plan.Download) != 0 {
+		t.Errorf("plan %+v", plan)
+	}
+	if _, err := syncPlanFor(root, "{", ""); errCode(err) != codeInvalidArgument {
+		t.Errorf("invalid manifest: %v", err)
+	}
+}
+
+func TestThrottledReaderPacesTransfer(t *testing.T) {
+	// The first second's worth is a free burst; the rest must wait.
+	const rate, size = 4000, 6000
+	r := &throttledReader{bytes.NewReader(make([]byte, size)), context.Background(), newTokenBucket(rate)}
+	start := time.Now()
+	n, err := io.Copy(io.Discard, r)
+	if err != nil || n != size {
+		t.Fatalf("copied %d, %v", n, err)
+	}
+	if least := time.Duration(size-rate) * time.Second / rate; time.Since(start) < least {
+		t.Errorf("%d bytes at %d B/s took %v, want at least %v", size, rate, time.Since(start), least)
+	}
+}
+
+func TestThrottledReaderStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &throttledReader{bytes.NewReader(make([]byte, 1<<20)), ctx, newTokenBucket(100)}
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	if _, err := io.Copy(io.Discard, r); err != context.Canceled {
+		t.Errorf("copy ended with %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("cancelled transfer ran for %v", time.Since(start))
+	}
+}
+
+func TestBandwidthBucketPerSubject(t *testing.T) {
+	testRoot(t)
+	if b := bandwidthBucket(jwt.MapClaims{"sub": "alice"}); b != nil {
+		t.Error("a bucket was handed out with no limit configured")
+	}
+	editConfig(t, func(c *Config) { c.BandwidthLimit = 1000 })
+	alice := bandwidthBucket(jwt.MapClaims{"sub": "alice"})
+	if alice == nil || alice.rate != 1000 {
+		t.Fatalf("bucket %+v", alice)
+	}
+	if bandwidthBucket(jwt.MapClaims{"sub": "alice"}) != alice {
+		t.Error("requests from one subject got separate buckets")
+	}
+	if bandwidthBucket(jwt.MapClaims{"sub": "bob"}) == alice {
+		t.Error("two subjects share a bucket")
+	}
+}
+
+func TestDownloadIsThrottled(t *testing.T) {
+	root := testRoot(t)
+	path := filepath.Join(root, "big.txt")
+	writeTestFile(t, path, strings.Repeat("x", 6000))
+	editConfig(t, func(c *Config) { c.BandwidthLimit = 4000 })
+	// Start from a full bucket whatever earlier tests spent.
+	bucketsMu.Lock()
+	delete(buckets, "tester")
+	bucketsMu.Unlock()
+
+	start := time.Now()
+	rec := getFile(t, http.MethodGet, path, "")
+	if rec.Code != http.StatusOK || rec.Body.Len() != 6000 {
+		t.Fatalf("got %d with %d bytes", rec.Code, rec.Body.Len())
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Errorf("capped download took %v, want at least 500ms", elapsed)
+	}
+}
+
+func TestReadMulti(t *testing.T) {
+	root := testRoot(t)
+	text, binary := filepath.Join(root, "a.txt"), filepath.Join(root, "b.txt")
+	outside, missing := filepath.Join(filepath.Dir(root), "secret.txt"), filepath.Join(root, "missing.txt")
+	writeTestFile(t, text, "hello")
+	writeTestFile(t, binary, "\xff\xfe\x00")
+	paths, _ := json.Marshal([]string{text, binary, outside, missing})
+
+	results, err := readMulti(string(paths))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := results[text]; r != (readMultiResult{Content: "hello"}) {
+		t.Errorf("text file: %+v", r)
+	}
+	if r := results[binary]; r != (readMultiResult{Content: "//4A", Base64: true}) {
+		t.Errorf("binary file: %+v", r)
+	}
+	for _, p := range []string{outside, missing} {
+		if r := results[p]; r.Error == "" || r.Content != "" {
+			t.Errorf("%s: %+v", p, r)
+		}
+	}
+
+	if _, err := readMulti(`"not a list"`); errCode(err) != codeInvalidArgument {
+		t.Errorf("paths that are not a list: %v", err)
+	}
+}
+
+func TestReadMultiCapsTotalSize(t *testing.T) {
+	root := testRoot(t)
+	editConfig(t, func(c *Config) { c.MaxFileSize = 8 })
+	first, second := filepath.Join(root, "a.txt"), filepath.Join(root, "b.txt")
+	writeTestFile(t, first, "12345")
+	writeTestFile(t, second, "12345")
+	paths, _ := json.Marshal([]string{first, second})
+
+	results, err := readMulti(string(paths))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := results[first]; r.Content != "12345" {
+		t.Errorf("first file: %+v", r)
+	}
+	if r := results[second]; r.Content != "" || !strings.Contains(r.Error, "limit") {
+		t.Errorf("file past the total limit: %+v", r)
+	}
+}
+
+func TestDirETag(t *testing.T) {
+	root := testRoot(t)
+	path := filepath.Join(root, "a.txt")
+	writeTestFile(t, path, "one")
+	etag := func() string {
+		t.Helper()
+		tag, err := dirETag(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tag
+	}
+
+	first := etag()
+	if etag() != first {
+		t.Error("etag of an unchanged directory changed")
+	}
+
+	writeTestFile(t, filepath.Join(root, "b.txt"), "two")
+	added := etag()
+	if added == first {
+		t.Error("etag did not change when a file was added")
+	}
+
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if etag() == added {
+		t.Error("etag did not change when a file was modified")
+	}
+}
+
+func TestListFilesIfNoneMatch(t *testing.T) {
+	root := testRoot(t)
+	writeTestFile(t, filepath.Join(root, "a.txt"), "one")
+	list := func(inm string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(Operation{Action: "list_files", Parameters: map[string]string{"path": root}})
+		req := withClaims(httptest.NewRequest(http.MethodPost, "/api/operation", bytes.NewReader(body)), jwt.MapClaims{"sub": "tester"})
+		if inm != "" {
+			req.Header.Set("If-None-Match", inm)
+		}
+		rec := httptest.NewRecorder()
+		operationHandler(rec, req)
+		return rec
+	}
+
+	rec := list("")
+	etag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK || etag == "" {
+		t.Fatalf("listing got %d with ETag %q", rec.Code, etag)
+	}
+	if rec := list("W/" + etag); rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Errorf("current etag got %d %q", rec.Code, rec.Body)
+	}
+
+	writeTestFile(t, filepath.Join(root, "b.txt"), "two")
+	if rec := list(etag); rec.Code != http.StatusOK {
+		t.Errorf("stale etag got %d", rec.Code)
+	}
+}
+
+func TestMaintenanceBlocksWritesOnly(t *testing.T) {
+	root := testRoot(t)
+	path := filepath.Join(root, "a.txt")
+	writeTestFile(t, path, "before")
+	setMaintenance(true)
+	t.Cleanup(func() { setMaintenance(false) })
+
+	claims := jwt.MapClaims{"sub": "tester"}
+	rec := postOperation(t, claims, Operation{Action: "write_file", Parameters: map[string]string{"path": path, "content": "after"}})
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("write got %d, Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if resp := decodeResponse(t, rec); resp.Code != codeMaintenance {
+		t.Errorf("write failed with code %q", resp.Code)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "before" {
+		t.Errorf("file was written during maintenance: %q", data)
+	}
+
+	if rec := postOperation(t, claims, Operation{Action: "read_file", Parameters: map[string]string{"path": path}}); rec.Code != http.StatusOK {
+		t.Errorf("read got %d: %s", rec.Code, rec.Body)
+	}
+	params, _ := json.Marshal(map[string]string{"path": filepath.Join(root, "new")})
+	rec = postRPC(t, claims, `{"jsonrpc":"2.0","method":"create_folder","params":`+string(params)+`,"id":1}`)
+	if resp := decodeRPC(t, rec); resp.Error == nil || resp.Error.Code != rpcMaintenance {
+		t.Errorf("RPC write got %s", rec.Body)
+	}
+
+	setMaintenance(false)
+	if rec := postOperation(t, claims, Operation{Action: "write_file", Parameters: map[string]string{"path": path, "content": "after"}}); rec.Code != http.StatusOK {
+		t.Errorf("write after maintenance got %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestMaintenanceHandler(t *testing.T) {
+	t.Cleanup(func() { setMaintenance(false) })
+	toggle := func(method, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		maintenanceHandler(rec, httptest.NewRequest(method, "/api/admin/maintenance", strings.NewReader(body)))
+		return rec
+	}
+
+	if rec := toggle(http.MethodPost, `{"enabled": true}`); rec.Code != http.StatusOK || !maintenance.Load() {
+		t.Errorf("enabling got %d, maintenance %v", rec.Code, maintenance.Load())
+	}
+	if rec := toggle(http.MethodGet, ""); !strings.Contains(rec.Body.String(), `"enabled":true`) {
+		t.Errorf("status %s", rec.Body)
+	}
+	if rec := toggle(http.MethodPost, `{}`); rec.Code != http.StatusBadRequest || !maintenance.Load() {
+		t.Errorf("request without enabled got %d", rec.Code)
+	}
+	if toggle(http.MethodPost, `{"enabled": false}`); maintenance.Load() {
+		t.Error("maintenance is still on")
+	}
+}
+
+// patchConfig sends body to configHandler as a PATCH.
+func patchConfig(t *testing.T, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := withClaims(httptest.NewRequest(http.MethodPatch, "/api/admin/config", strings.NewReader(body)), jwt.MapClaims{"sub": "root", "scope": "admin"})
+	rec := httptest.NewRecorder()
+	configHandler(rec, req)
+	return rec
+}
+
+func TestAdminConfigPatch(t *testing.T) {
+	testRoot(t)
+	t.Cleanup(func() { setMaintenance(false) })
+	saved := filepath.Join(t.TempDir(), "config.json")
+	prevPath := configPath
+	configPath = saved
+	t.Cleanup(func() { configPath = prevPath })
+
+	rec := patchConfig(t, `{"maintenance": true, "bandwidth_limit": 2048}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body)
+	}
+	if !maintenance.Load() || currentConfig().BandwidthLimit != 2048 {
+		t.Errorf("maintenance %v, bandwidth limit %d", maintenance.Load(), currentConfig().BandwidthLimit)
+	}
+	var onDisk Config
+	if data, err := os.ReadFile(saved); err != nil || json.Unmarshal(data, &onDisk) != nil || onDisk.BandwidthLimit != 2048 {
+		t.Errorf("saved config %+v, %v", onDisk, err)
+	}
+}
+
+func TestAdminConfigRejectsUnsafeEdits(t *testing.T) {
+	root := testRoot(t)
+	before := currentConfig()
+	for _, body := range []string{
+		`{"bandwidth_limit": -1}`,
+		`{"max_file_size": 0}`,
+		`{"allowed_paths": []}`,
+		`{"allowed_paths": [{"path": "` + filepath.ToSlash(filepath.Join(root, "missing")) + `", "mode": "rw"}]}`,
+		`{"allowed_paths": [{"path": "relative", "mode": "rw"}]}`,
+		`{"allowed_paths": [{"path": "` + filepath.ToSlash(root) + `", "mode": "everything"}]}`,
+	} {
+		if rec := patchConfig(t, body); rec.Code != http.StatusUnprocessableEntity {
+			t.Errorf("%s got %d", body, rec.Code)
+		}
+	}
+	if currentConfig() != before {
+		t.Error("a rejected edit changed the config")
+	}
+	if rec := patchConfig(t, `{"bandwidth_limit":`); rec.Code != http.StatusBadRequest {
+		t.Errorf("malformed patch got %d", rec.Code)
+	}
+}
+
+func TestReloadLetsOperationsInFlightFinish(t *testing.T) {
+	root := testRoot(t)
+	other, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(root, "big.txt")
+	content := strings.Repeat("0123456789", 600)
+	writeTestFile(t, path, content)
+	// Throttling keeps the download in flight across the reload.
+	editConfig(t, func(c *Config) { c.BandwidthLimit = 4000 })
+	bucketsMu.Lock()
+	delete(buckets, "tester")
+	bucketsMu.Unlock()
+
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	prevPath := configPath
+	configPath = configFile
+	t.Cleanup(func() { configPath = prevPath })
+	next := *currentConfig()
+	next.AllowedPaths = []AllowedPath{{Path: other, Mode: modeReadWrite}}
+	data, _ := json.Marshal(next)
+	writeTestFile(t, configFile, string(data))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downloadHandler(w, withClaims(r, jwt.MapClaims{"sub": "tester"}))
+	}))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/api/file?path=" + url.QueryEscape(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	head := make([]byte, 100)
+	if _, err := io.ReadFull(resp.Body, head); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	rest, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(head) + string(rest); got != content {
+		t.Errorf("download in flight returned %d of %d bytes", len(got), len(content))
+	}
+
+	if rec := getFile(t, http.MethodGet, path, ""); rec.Code != http.StatusForbidden {
+		t.Errorf("new request after the reload got %d", rec.Code)
+	}
+}
+
+func TestAsOpError(t *testing.T) {
+	tests := []struct {
+		err  error
+		code string
+	}{
+		{opErrorf(codeTooLarge, "big"), codeTooLarge},
+		{fmt.Errorf("wrapped: %w", opErrorf(codeConflict, "x")), codeConflict},
+		{&os.PathError{Op: "open", Path: "/x", Err: os.ErrNotExist}, codeNotFound},
+		{&os.PathError{Op: "mkdir", Path: "/x", Err: os.ErrExist}, codeAlreadyExists},
+		{&os.PathError{Op: "open", Path: "/x", Err: os.ErrPermission}, codePermissionDenied},
+		{io.ErrUnexpectedEOF, codeInternal},
+	}
+	for _, tt := range tests {
+		if got := asOpError(tt.err).Code; got != tt.code {
+			t.Errorf("asOpError(%v) = %q, want %q", tt.err, got, tt.code)
+		}
+	}
+}
+
+func TestOperationErrorCodes(t *testing.T) {
+	root := testRoot(t)
+	writeTestFile(t, filepath.Join(root, "a.txt"), "hello")
+	if err := os.Mkdir(filepath.Join(root, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	op := func(action string, params ...string) Operation {
+		o := Operation{Action: action, Parameters: map[string]string{}}
+		for i := 0; i+1 < len(params); i += 2 {
+			o.Parameters[params[i]] = params[i+1]
+		}
+		return o
+	}
+
+	tests := []struct {
+		name string
+		op   Operation
+		code string
+	}{
+		{"missing file", op("read_file", "path", filepath.Join(root, "missing.txt")), codeNotFound},
+		{"outside the root", op("read_file", "path", filepath.Join(filepath.Dir(root), "x.txt")), codePathDenied},
+		{"type not allowed", op("write_file", "path", filepath.Join(root, "tool.exe"), "content", "x"), codeTypeDenied},
+		{"directory", op("read_file", "path", filepath.Join(root, "dir")), codeIsDirectory},
+		{"exclusive create", op("create_folder", "path", filepath.Join(root, "dir"), "exclusive", "true"), codeAlreadyExists},
+		{"no path", op("read_file"), codeInvalidArgument},
+		{"checksum", op("write_file", "path", filepath.Join(root, "b.txt"), "content", "x", "sha256", strings.Repeat("0", 64)), codeChecksumMismatch},
+	}
+	for _, tt := range tests {
+		rec := postOperation(t, jwt.MapClaims{"sub": "tester"}, tt.op)
+		resp := decodeResponse(t, rec)
+		if resp.Code != tt.code {
+			t.Errorf("%s: code %q (%s), want %q", tt.name, resp.Code, resp.Message, tt.code)
+		}
+		if want := codeStatus[tt.code]; rec.Code != want {
+			t.Errorf("%s: status %d, want %d", tt.name, rec.Code, want)
+		}
+	}
+}
+
+func TestDirectoryTargets(t *testing.T) {
+	root := testRoot(t)
+	// The directory has an allowed extension so the type check passes and
+	// the directory check is what refuses it.
+	dir := filepath.Join(root, "notes.txt")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	ops := []Operation{
+		{Action: "write_file", Parameters: map[string]string{"path": dir, "content": "x"}},
+		{Action: "write_file", Parameters: map[string]string{"path": dir, "content": "x", "durable": "true"}},
+		{Action: "read_file", Parameters: map[string]string{"path": dir}},
+		{Action: "read_lines", Parameters: map[string]string{"path": dir}},
+		{Action: "preview", Parameters: map[string]string{"path": dir}},
+		{Action: "line_count", Parameters: map[string]string{"path": dir}},
+	}
+	for _, op := range ops {
+		rec := postOperation(t, jwt.MapClaims{"sub": "tester"}, op)
+		resp := decodeResponse(t, rec)
+		if resp.Code != codeIsDirectory {
+			t.Errorf("%s %v: code %q (%s), want %q", op.Action, op.Parameters, resp.Code, resp.Message, codeIsDirectory)
+			continue
+		}
+		if want := "target is a directory: " + dir; resp.Message != want {
+			t.Errorf("%s: message %q, want %q", op.Action, resp.Message, want)
+		}
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		t.Errorf("directory was replaced: %v, %v", info, err)
+	}
+
+	check, err := canWrite(jwt.MapClaims{"sub": "tester"}, dir, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if check.Writable || check.Reason != codeIsDirectory {
+		t.Errorf("can_write = %+v, want reason %q", check, codeIsDirectory)
+	}
+
+	if rec := getFile(t, http.MethodGet, dir, ""); rec.Code != codeStatus[codeIsDirectory] {
+		t.Errorf("download status %d, want %d", rec.Code, codeStatus[codeIsDirectory])
+	}
+}
+
+func TestDownloadHeadMatchesGet(t *testing.T) {
+	root := testRoot(t)
+	path := filepath.Join(root, "a.txt")
+	writeTestFile(t, path, "hello, world")
+
+	get := getFile(t, http.MethodGet, path, "")
+	head := getFile(t, http.MethodHead, path, "")
+	if get.Code != http.StatusOK || head.Code != http.StatusOK {
+		t.Fatalf("GET %d, HEAD %d", get.Code, head.Code)
+	}
+	if head.Body.Len() != 0 {
+		t.Errorf("HEAD sent a body: %q", head.Body)
+	}
+	for _, name := range []string{"Content-Length", "Content-Type", "ETag", "Last-Modified", "Accept-Ranges"} {
+		if g, h := get.Header().Get(name), head.Header().Get(name); g == "" || g != h {
+			t.Errorf("%s: GET %q, HEAD %q", name, g, h)
+		}
+	}
+}
+
+func TestDownloadRejectsOtherMethods(t *testing.T) {
+	root := testRoot(t)
+	path := filepath.Join(root, "a.txt")
+	writeTestFile(t, path, "x")
+	if rec := getFile(t, http.MethodDelete, path, ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE got %d", rec.Code)
+	}
+}
+
+func TestAuthorizePermissionMatrix(t *testing.T) {
+	root := testRoot(t)
+	docs := filepath.Join(root, "docs")
+	editConfig(t, func(c *Config) {
+		c.Permissions = map[string]map[string][]string{
+			"viewer": {"read_file": {root + "/**"}, "list_files": {root + "/**"}},
+			"editor": {"*": {docs + "/**"}},
+			"logs":   {"read_file": {filepath.Join(root, "*.log")}},
+		}
+	})
+	viewer := jwt.MapClaims{"sub": "v", "role": "viewer"}
+	editor := jwt.MapClaims{"sub": "e", "roles": []interface{}{"editor", "logs"}}
+
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		action string
+		path   string
+		code   string
+	}{
+		{"viewer reads", viewer, "read_file", filepath.Join(root, "a.txt"), ""},
+		{"viewer lists the root", viewer, "list_files", root, ""},
+		{"viewer writes", viewer, "write_file", filepath.Join(root, "a.txt"), codePathDenied},
+		{"editor writes docs", editor, "write_file", filepath.Join(docs, "a.txt"), ""},
+		{"editor writes elsewhere", editor, "write_file", filepath.Join(root, "a.txt"), codePathDenied},
+		{"second role's glob", editor, "read_file", filepath.Join(root, "app.log"), ""},
+		{"glob does not cross directories", editor, "read_file", filepath.Join(root, "sub", "app.log"), codePathDenied},
+		{"no role", jwt.MapClaims{"sub": "x"}, "read_file", filepath.Join(root, "a.txt"), codePathDenied},
+		{"no path, action granted", viewer, "read_file", "", ""},
+		{"no path, action not granted", viewer, "write_file", "", codeNotAllowed},
+		{"outside the allowed paths", editor, "read_file", filepath.Join(filepath.Dir(root), "a.log"), codePathDenied},
+	}
+	for _, tt := range tests {
+		if got := errCode(authorize(tt.claims, tt.action, tt.path)); got != tt.code {
+			t.Errorf("%s: code %q, want %q", tt.name, got, tt.code)
+		}
+	}
+
+	editConfig(t, func(c *Config) { delete(c.AllowedActions, "read_file") })
+	if err := authorize(viewer, "read_file", filepath.Join(root, "a.txt")); errCode(err) != codeNotAllowed {
+		t.Errorf("disabled action: %v", err)
+	}
+}
+
+func TestValidateConfigRejectsBadPermissions(t *testing.T) {
+	for name, perms := range map[string]map[string]map[string][]string{
+		"empty role":       {"": {"read_file": {"/data/**"}}},
+		"unknown action":   {"viewer": {"format_disk": {"/data/**"}}},
+		"relative pattern": {"viewer": {"read_file": {"data/**"}}},
+		"bad pattern":      {"viewer": {"read_file": {"/data/[/**"}}},
+	} {
+		c := defaultConfig()
+		c.Permissions = perms
+		if err := validateConfig(c); err == nil {
+			t.Errorf("%s was accepted", name)
+		}
+	}
+}
+
+func TestPreviewText(t *testing.T) {
+	root := testRoot(t)
+	path := filepath.Join(root, "notes.txt")
+	writeTestFile(t, path, "one\ntwo\nthree")
+
+	p, err := previewFile(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Binary || p.Truncated || p.Text != "one\ntwo\nthree" || p.EstimatedLines != 3 || p.Size != 13 {
+		t.Errorf("preview %+v", p)
+	}
+	if !strings.HasPrefix(p.ContentType, "text/plain") {
+		t.Errorf("content type %q", p.ContentType)
+	}
+}
+
+func TestPreviewTruncatesAndEstimatesLines(t *testing.T) {
+	root := testRoot(t)
+	path := filepath.Join(root, "app.log")
+	// 100 lines of 10 bytes; the preview sees the first 5.
+	writeTestFile(t, path, strings.Repeat("123456789\n", 100))
+
+	p, err := previewFile(path, "50")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.Truncated || len(p.Text) != 50 || p.EstimatedLines != 100 {
+		t.Errorf("preview truncated %v, %d bytes, %d lines", p.Truncated, len(p.Text), p.EstimatedLines)
+	}
+
+	// The cut falls inside "é", which is left out rather than shown as a
+	// broken character.
+	writeTestFile(t, path, "abcé"+strings.Repeat("x", 10))
+	if p, err := previewFile(path, "4"); err != nil || p.Binary || p.Text != "abc" {
+		t.Errorf("preview cut inside a character: %+v, %v", p, err)
+	}
+}
+
+func TestPreviewBinaryReportsMetadataOnly(t *testing.T) {
+	root := testRoot(t)
+	path := filepath.Join(root, "data.json")
+	writeTestFile(t, path, "\x00\x01\x02binary")
+
+	p, err := previewFile(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.Binary || p.Text != "" || p.Size != 9 || p.ContentType == "" {
+		t.Errorf("preview %+v", p)
+	}
+}
+
+func TestPreviewRejectsBadInput(t *testing.T) {
+	root := testRoot(t)
+	writeTestFile(t, filepath.Join(root, "a.txt"), "x")
+	writeTestFile(t, filepath.Join(root, "tool.exe"), "x")
+
+	if _, err := previewFile(filepath.Join(root, "a.txt"), "-5"); errCode(err) != codeInvalidArgument {
+		t.Errorf("negative size: %v", err)
+	}
+	if _, err := previewFile(filepath.Join(root, "tool.exe"), ""); errCode(err) != codeTypeDenied {
+		t.Errorf("disallowed type: %v", err)
+	}
+	if _, err := previewFile(filepath.Join(filepath.Dir(root), "a.txt"), ""); errCode(err) != codePathDenied {
+		t.Errorf("outside the root: %v", err)
+	}
+}
+
+func TestWriteFileVerifiesChecksum(t *testing.T) {
+	root := testRoot(t)
+	path := filepath.Join(root, "a.txt")
+	writeTestFile(t, path, "original")
+	claims := jwt.MapClaims{"sub": "tester"}
+	write := func(content, sum string) *httptest.ResponseRecorder {
+		return postOperation(t, claims, Operation{Action: "write_file", Parameters: map[string]string{"path": path, "content": content, "sha256": sum}})
+	}
+
+	if rec := write("garbled", sha256Hex("intended")); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("mismatch got %d: %s", rec.Code, rec.Body)
+	} else if resp := decodeResponse(t, rec); resp.Code != codeChecksumMismatch || resp.Details["actual"] != sha256Hex("garbled") {
+		t.Errorf("mismatch reported as %+v", resp)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "original" {
+		t.Errorf("file was written despite the mismatch: %q", data)
+	}
+
+	if rec := write("intended", strings.ToUpper(sha256Hex("intended"))); rec.Code != http.StatusOK {
+		t.Errorf("matching hash got %d: %s", rec.Code, rec.Body)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "intended" {
+		t.Errorf("file holds %q", data)
+	}
+}
+
+func TestActiveOpsWait(t *testing.T) {
+	ops := &activeOps{ops: make(map[int]activeOp)}
+	if left := ops.Wait(time.Hour); left != nil {
+		t.Errorf("idle Wait returned %v", left)
+	}
+
+	done := ops.Begin("read_file", "/data/a.txt", "c1")
+	time.AfterFunc(20*time.Millisecond, done)
+	if left := ops.Wait(5 * time.Second); left != nil {
+		t.Errorf("Wait returned %v after the operation finished", left)
+	}
+
+	defer ops.Begin("tar_stream", "/data", "c2")()
+	start := time.Now()
+	left := ops.Wait(50 * time.Millisecond)
+	if len(left) != 1 || left[0].Action != "tar_stream" || left[0].ClientID != "c2" {
+		t.Errorf("Wait returned %+v", left)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Errorf("Wait gave up after %v", time.Since(start))
+	}
+}
+
+func TestShutdownInterruptsLongOperations(t *testing.T) {
+	testRoot(t)
+	editConfig(t, func(c *Config) { c.ShutdownTimeout = 1 })
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+		draining.Store(false)
+	})
+
+	done := inflight.Begin("tar_stream", "/data/site", "slow-client")
+	defer done()
+	start := time.Now()
+	shutdown(&http3.Server{})
+	if elapsed := time.Since(start); elapsed < time.Second || elapsed > 10*time.Second {
+		t.Errorf("shutdown took %v with a 1s timeout", elapsed)
+	}
+	if !draining.Load() {
+		t.Error("server is not draining")
+	}
+	if !strings.Contains(logs.String(), `Interrupted tar_stream of "/data/site" for client "slow-client"`) {
+		t.Errorf("interrupted operation was not logged: %s", logs.String())
+	}
+}
+
+func TestAllowedPathUnmarshal(t *testing.T) {
+	var paths []AllowedPath
+	if err := json.Unmarshal([]byte(`["/data", {"path": "/srv"}, {"path": "/archive", "mode": "ro"}]`), &paths); err != nil {
+		t.Fatal(err)
+	}
+	want := []AllowedPath{{"/data", modeReadWrite}, {"/srv", modeReadWrite}, {"/archive", modeReadOnly}}
+	if !slices.Equal(paths, want) {
+		t.Errorf("got %+v, want %+v", paths, want)
+	}
+}
+
+func TestReadOnlyRoots(t *testing.T) {
+	rw := testRoot(t)
+	enableActions(t, "chmod", "rotate", "move", "retype")
+	ro, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A read-only subtree of a read-write root is read-only too.
+	frozen := filepath.Join(rw, "frozen")
+	if err := os.Mkdir(frozen, 0755); err != nil {
+		t.Fatal(err)
+	}
+	editConfig(t, func(c *Config) {
+		c.AllowedPaths = append(c.AllowedPaths, AllowedPath{ro, modeReadOnly}, AllowedPath{frozen, modeReadOnly})
+	})
+	file := filepath.Join(ro, "a.txt")
+	writeTestFile(t, file, "keep")
+	writeTestFile(t, filepath.Join(frozen, "b.txt"), "keep")
+	if err := os.Mkdir(filepath.Join(ro, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	claims := jwt.MapClaims{"sub": "tester"}
+	op := func(action string, params ...string) Operation {
+		o := Operation{Action: action, Parameters: map[string]string{}}
+		for i := 0; i+1 < len(params); i += 2 {
+			o.Parameters[params[i]] = params[i+1]
+		}
+		return o
+	}
+
+	if rec := postOperation(t, claims, op("read_file", "path", file)); rec.Code != http.StatusOK {
+		t.Errorf("read from a read-only root got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := postOperation(t, claims, op("copy_dir", "path", filepath.Join(ro, "dir"), "destination", filepath.Join(rw, "copy"))); rec.Code != http.StatusOK {
+		t.Errorf("copy out of a read-only root got %d: %s", rec.Code, rec.Body)
+	} else {
+		waitForProgress(t, decodeResponse(t, rec).Data)
+	}
+
+	for _, o := range []Operation{
+		op("write_file", "path", file, "content", "changed"),
+		op("write_file", "path", filepath.Join(frozen, "b.txt"), "content", "changed"),
+		op("write_file", "path", filepath.Join(ro, "new.txt"), "content", "x"),
+		op("create_folder", "path", filepath.Join(ro, "new")),
+		op("move", "path", file, "destination", filepath.Join(rw, "a.txt")),
+		op("move", "path", filepath.Join(rw, "missing.txt"), "destination", filepath.Join(ro, "b.txt")),
+		op("retype", "path", file, "extension", "log"),
+		op("rotate", "path", file),
+		op("chmod", "path", file, "mode", "0600"),
+		op("copy_dir", "path", rw, "destination", filepath.Join(ro, "copy")),
+	} {
+		rec := postOperation(t, claims, o)
+		if resp := decodeResponse(t, rec); resp.Code != codePathDenied {
+			t.Errorf("%s %v: got %d %q (%s)", o.Action, o.Parameters, rec.Code, resp.Code, resp.Message)
+		}
+	}
+
+	if data, _ := os.ReadFile(file); string(data) != "keep" {
+		t.Errorf("read-only file holds %q", data)
+	}
+	entries, _ := os.ReadDir(ro)
+	if len(entries) != 2 {
+		t.Errorf("read-only root holds %d entries, want 2", len(entries))
+	}
+}
+
+func TestRetype(t *testing.T) {
+	root := testRoot(t)
+	path := filepath.Join(root, "app.log")
+	writeTestFile(t, path, "entries")
+
+	result, err := retypeFile(path, "txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := filepath.Join(root, "app.txt")
+	if result["path"] != target {
+		t.Errorf("retyped to %q, want %q", result["path"], target)
+	}
+	if data, err := os.ReadFile(target); err != nil || string(data) != "entries" {
+		t.Errorf("retyped file holds %q, %v", data, err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("old name still exists: %v", err)
+	}
+}
+
+func TestRetypeRejectsBadTargets(t *testing.T) {
+	root := testRoot(t)
+	path := filepath.Join(root, "app.log")
+	writeTestFile(t, path, "entries")
+	writeTestFile(t, filepath.Join(root, "app.csv"), "taken")
+
+	tests := []struct {
+		ext, code string
+	}{
+		{"exe", codeTypeDenied},
+		{".csv", codeAlreadyExists},
+		{"", codeInvalidArgument},
+		{"tar.gz", codeInvalidArgument},
+		{"../x", codeInvalidArgument},
+	}
+	for _, tt := range tests {
+		if _, err := retypeFile(path, tt.ext); errCode(err) != tt.code {
+			t.Errorf("retype to %q: %v, want %s", tt.ext, err, tt.code)
+		}
+	}
+	if data, _ := os.ReadFile(path); string(data) != "entries" {
+		t.Errorf("file holds %q after rejected retypes", data)
+	}
+}
+
+func TestSwapFiles(t *testing.T) {
+	root := testRoot(t)
+	a, b := filepath.Join(root, "blue.json"), filepath.Join(root, "green.json")
+	writeTestFile(t, a, `{"v": 1}`)
+	writeTestFile(t, b, `{"v": 2}`)
+
+	if _, err := swapFiles(a, b); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]string{a: `{"v": 2}`, b: `{"v": 1}`} {
+		if data, _ := os.ReadFile(path); string(data) != want {
+			t.Errorf("%s holds %q, want %q", filepath.Base(path), data, want)
+		}
+	}
+	if entries, _ := os.ReadDir(root); len(entries) != 2 {
+		t.Errorf("swap left %d entries behind", len(entries)-2)
+	}
+}
+
+// assertUnswapped checks that a failed swap left both files as they were
+// and no temporary files in their directories.
+func assertUnswapped(t *testing.T, files map[string]string) {
+	t.Helper()
+	for path, want := range files {
+		if data, _ := os.ReadFile(path); string(data) != want {
+			t.Errorf("%s holds %q, want %q", path, data, want)
+		}
+		entries, _ := os.ReadDir(filepath.Dir(path))
+		for _, e := range entries {
+			if strings.Contains(e.Name(), ".swap-") {
+				t.Errorf("temporary file %s left behind", e.Name())
+			}
+		}
+	}
+}
+
+func TestSwapFilesRejectsBadInput(t *testing.T) {
+	root := testRoot(t)
+	a := filepath.Join(root, "a.txt")
+	writeTestFile(t, a, "a")
+	if err := os.Mkdir(filepath.Join(root, "dir.txt"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(root, "tool.exe"), "x")
+
+	tests := []struct {
+		b, code string
+	}{
+		{"", codeInvalidArgument},
+		{a, codeInvalidArgument},
+		{filepath.Join(root, "missing.txt"), codeNotFound},
+		{filepath.Join(root, "dir.txt"), codeInvalidArgument},
+		{filepath.Join(root, "tool.exe"), codeTypeDenied},
+		{filepath.Join(filepath.Dir(root), "x.txt"), codePathDenied},
+	}
+	for _, tt := range tests {
+		if _, err := swapFiles(a, tt.b); errCode(err) != tt.code {
+			t.Errorf("swap with %q: %v, want %s", tt.b, err, tt.code)
+		}
+	}
+	assertUnswapped(t, map[string]string{a: "a"})
+}
+
+func TestSwapFilesFailureLeavesOriginals(t *testing.T) {
+	// Hard links cannot cross filesystems, so a swap between a root on
+	// tmpfs and one on disk fails once the files have been checked.
+	shm, err := os.MkdirTemp("/dev/shm", "swap")
+	if err != nil {
+		t.Skip("no /dev/shm:", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(shm) })
+	root := testRoot(t)
+	editConfig(t, func(c *Config) { c.AllowedPaths = append(c.AllowedPaths, AllowedPath{shm, modeReadWrite}) })
+	a, b := filepath.Join(root, "a.txt"), filepath.Join(shm, "b.txt")
+	writeTestFile(t, a, "a")
+	writeTestFile(t, b, "b")
+
+	if _, err := swapFiles(a, b); err == nil {
+		t.Skip("/dev/shm is on the same filesystem as the temporary directory")
+	}
+	assertUnswapped(t, map[string]string{a: "a", b: "b"})
+}
+
+func TestSwapFilesFailedRenameLeavesOriginals(t *testing.T) {
+	root := testRoot(t)
+	a, b := filepath.Join(root, "a.txt"), filepath.Join(root, "b.txt")
+	for _, failing := range []int{1, 2} {
+		writeTestFile(t, a, "a")
+		writeTestFile(t, b, "b")
+		calls := 0
+		swapRename = func(from, to string) error {
+			if calls++; calls == failing {
+				return &os.LinkError{Op: "rename", Old: from, New: to, Err: syscall.EIO}
+			}
+			return os.Rename(from, to)
+		}
+		t.Cleanup(func() { swapRename = os.Rename })
+
+		if _, err := swapFiles(a, b); !errors.Is(err, syscall.EIO) {
+			t.Errorf("rename %d failing: %v, want the rename's error", failing, err)
+		}
+		assertUnswapped(t, map[string]string{a: "a", b: "b"})
+	}
+}
+
+// readTar returns the files in a tar archive by name.
+func readTar(t *testing.T, r io.Reader) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[hdr.Name] = string(data)
+	}
+}
+
+func TestTarStream(t *testing.T) {
+	root := testRoot(t)
+	site := filepath.Join(root, "site")
+	writeTestFile(t, filepath.Join(site, "a.txt"), "alpha")
+	writeTestFile(t, filepath.Join(site, "sub", "b.json"), "{}")
+	writeTestFile(t, filepath.Join(site, "tool.exe"), "not an allowed type")
+	writeTestFile(t, filepath.Join(site, "big.log"), strings.Repeat("x", 100))
+	writeTestFile(t, filepath.Join(root, "secret.txt"), "outside the directory")
+	mustSymlink(t, filepath.Join(root, "secret.txt"), filepath.Join(site, "link.txt"))
+	editConfig(t, func(c *Config) { c.MaxFileSize = 50 })
+
+	want := map[string]string{"a.txt": "alpha", "sub/b.json": "{}"}
+	for _, compress := range []bool{false, true} {
+		rec := postOperation(t, jwt.MapClaims{"sub": "tester"}, Operation{Action: "tar_stream", Parameters: map[string]string{"path": site, "gzip": fmt.Sprint(compress)}})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("gzip %v: got %d: %s", compress, rec.Code, rec.Body)
+		}
+
+		var body io.Reader = rec.Body
+		name, contentType := "site.tar", "application/x-tar"
+		if compress {
+			zr, err := gzip.NewReader(rec.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body = zr
+			name, contentType = "site.tar.gz", "application/gzip"
+		}
+		if got := rec.Header().Get("Content-Type"); got != contentType {
+			t.Errorf("gzip %v: Content-Type %q", compress, got)
+		}
+		if got := rec.Header().Get("Content-Disposition"); !strings.Contains(got, name) {
+			t.Errorf("gzip %v: Content-Disposition %q", compress, got)
+		}
+		if got := rec.Header().Get("X-Archive-Size"); got != "7" {
+			t.Errorf("gzip %v: X-Archive-Size %q, want 7", compress, got)
+		}
+		if got := readTar(t, body); !maps.Equal(got, want) {
+			t.Errorf("gzip %v: archive holds %v, want %v", compress, got, want)
+		}
+	}
+}
+
+func TestTarStreamRejectsFiles(t *testing.T) {
+	root := testRoot(t)
+	writeTestFile(t, filepath.Join(root, "a.txt"), "alpha")
+	rec := postOperation(t, jwt.MapClaims{"sub": "tester"}, Operation{Action: "tar_stream", Parameters: map[string]string{"path": filepath.Join(root, "a.txt")}})
+	if resp := decodeResponse(t, rec); resp.Code != codeInvalidArgument {
+		t.Errorf("tar of a file got %d %q", rec.Code, resp.Code)
+	}
+}
+
+// unwritableDir returns a directory the server cannot create files in. A
+// mode of 0555 does not stop root, so as root it falls back to /proc.
+func unwritableDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.Chmod(dir, 0555); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chmod(dir, 0755) })
+	if probeWritable(dir) != nil {
+		return dir
+	}
+	if info, err := os.Stat("/proc"); err == nil && info.IsDir() && probeWritable("/proc") != nil {
+		return "/proc"
+	}
+	t.Skip("no unwritable directory available")
+	return ""
+}
+
+// testCert returns a self-signed certificate valid from notBefore to
+// notAfter.
+func testCert(t *testing.T, notBefore, notAfter time.Time) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// findCheck returns the check called name from report.
+func findCheck(t *testing.T, report selfTestReport, name string) selfTestCheck {
+	t.Helper()
+	for _, c := range report.Checks {
+		if c.Name == name {
+			return c
+		}
+	}
+	t.Fatalf("report has no %q check: %+v", name, report.Checks)
+	return selfTestCheck{}
+}
+
+func TestSelfTest(t *testing.T) {
+	now := time.Now()
+	cert := testCert(t, now.Add(-time.Hour), now.Add(365*24*time.Hour))
+	rw, ro, locked := t.TempDir(), t.TempDir(), unwritableDir(t)
+	file := filepath.Join(rw, "file.txt")
+	writeTestFile(t, file, "x")
+
+	c := defaultConfig()
+	c.AllowedPaths = []AllowedPath{{rw, modeReadWrite}, {ro, modeReadOnly}, {locked, modeReadWrite}, {file, modeReadWrite}, {filepath.Join(rw, "missing"), modeReadOnly}}
+	c.AllowedActions = map[string]bool{"read_file": true, "format_disk": true}
+	report := selfTest(c, cert, nil, now)
+
+	if report.OK {
+		t.Error("report is OK despite failing checks")
+	}
+	for name, status := range map[string]string{
+		"path " + rw:                           "ok",
+		"path " + ro:                           "ok",
+		"path " + locked:                       "fail",
+		"path " + file:                         "fail",
+		"path " + filepath.Join(rw, "missing"): "fail",
+		"action read_file":                     "ok",
+		"action format_disk":                   "fail",
+		"certificate":                          "ok",
+	} {
+		if got := findCheck(t, report, name); got.Status != status {
+			t.Errorf("%s: %s (%s), want %s", name, got.Status, got.Detail, status)
+		}
+	}
+	if entries, _ := os.ReadDir(rw); len(entries) != 1 {
+		t.Errorf("write probe left %d files behind", len(entries)-1)
+	}
+
+	c.AllowedPaths = c.AllowedPaths[:2]
+	c.AllowedActions = map[string]bool{"read_file": true}
+	if report := selfTest(c, cert, nil, now); !report.OK {
+		t.Errorf("healthy setup failed: %+v", report.Checks)
+	}
+}
+
+func TestSelfTestFlagsExpiringCert(t *testing.T) {
+	now := time.Now()
+	c := defaultConfig()
+	c.AllowedPaths = []AllowedPath{{t.TempDir(), modeReadOnly}}
+
+	report := selfTest(c, testCert(t, now.Add(-time.Hour), now.Add(3*24*time.Hour)), nil, now)
+	if check := findCheck(t, report, "certificate"); check.Status != "warning" || !strings.Contains(check.Detail, "in 2 days") {
+		t.Errorf("expiring certificate: %+v", check)
+	}
+	if !report.OK {
+		t.Error("a warning failed the report")
+	}
+}
+
+func TestCheckCert(t *testing.T) {
+	now := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	warn := []int{30, 7}
+	tests := []struct {
+		name   string
+		cert   *x509.Certificate
+		err    error
+		status string
+	}{
+		{"valid", testCert(t, now.AddDate(0, -1, 0), now.AddDate(1, 0, 0)), nil, "ok"},
+		{"expiring", testCert(t, now.AddDate(0, -1, 0), now.AddDate(0, 0, 10)), nil, "warning"},
+		{"expired", testCert(t, now.AddDate(-1, 0, 0), now.Add(-time.Second)), nil, "fail"},
+		{"not yet valid", testCert(t, now.Add(time.Hour), now.AddDate(1, 0, 0)), nil, "fail"},
+		{"unreadable", nil, os.ErrNotExist, "fail"},
+	}
+	for _, tt := range tests {
+		if _, status, detail := checkCert(tt.cert, tt.err, now, warn); status != tt.status {
+			t.Errorf("%s: %s (%s), want %s", tt.name, status, detail, tt.status)
+		}
+	}
+}
+
+func TestExpiryThreshold(t *testing.T) {
+	day := 24 * time.Hour
+	warn := []int{30, 7, 1}
+	tests := []struct {
+		left time.Duration
+		want int
+	}{
+		{60 * day, 0},
+		{30 * day, 0},
+		{29 * day, 30},
+		{6 * day, 7},
+		{time.Hour, 1},
+		{-time.Hour, 1},
+	}
+	for _, tt := range tests {
+		if got := expiryThreshold(tt.left, warn); got != tt.want {
+			t.Errorf("expiryThreshold(%v) = %d, want %d", tt.left, got, tt.want)
+		}
+	}
+	if got := expiryThreshold(time.Hour, nil); got != 0 {
+		t.Errorf("no thresholds gave %d", got)
+	}
+}
+
+func TestReadyzReportsCertExpiry(t *testing.T) {
+	testRoot(t)
+	prev := certExpiresIn.Value()
+	t.Cleanup(func() { certExpiresIn.Set(prev) })
+	readyz := func(left time.Duration) (int, map[string]interface{}) {
+		certExpiresIn.Set(int64(left / time.Second))
+		rec := httptest.NewRecorder()
+		readyzHandler(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		resp := decodeResponse(t, rec)
+		data, _ := resp.Data.(map[string]interface{})
+		return rec.Code, data
+	}
+
+	if code, data := readyz(90 * 24 * time.Hour); code != http.StatusOK || data["cert_warning"] != false {
+		t.Errorf("fresh certificate: %d %v", code, data)
+	}
+	if code, data := readyz(3 * 24 * time.Hour); code != http.StatusOK || data["cert_warning"] != true {
+		t.Errorf("expiring certificate: %d %v", code, data)
+	}
+	if code, _ := readyz(-time.Minute); code != http.StatusServiceUnavailable {
+		t.Errorf("expired certificate: %d", code)
+	}
+}
+
+func TestWatchCertExpiryWarns(t *testing.T) {
+	testRoot(t)
+	prev := certExpiresIn.Value()
+	t.Cleanup(func() { certExpiresIn.Set(prev) })
+	logs := &syncBuffer{}
+	log.SetOutput(logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	cert := testCert(t, time.Now().Add(-time.Hour), time.Now().Add(3*24*time.Hour))
+	go watchCertExpiry(cert)
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(logs.String(), "expires in less than 7 days") {
+		if time.Now().After(deadline) {
+			t.Fatalf("no expiry warning logged: %q", logs.String())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if left := certExpiresIn.Value(); left <= 0 || left > 3*24*3600 {
+		t.Errorf("cert_expires_in_seconds = %d", left)
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for a logger and a test to share.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestPathDepth(t *testing.T) {
+	root := filepath.FromSlash("/data")
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/data", 0},
+		{"/data/a", 1},
+		{"/data/a/b/c", 3},
+	}
+	for _, tt := range tests {
+		if got := pathDepth(root, filepath.FromSlash(tt.path)); got != tt.want {
+			t.Errorf("pathDepth(%q) = %d, want %d", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestCreateFolderDepthLimit(t *testing.T) {
+	root := testRoot(t)
+	editConfig(t, func(c *Config) { c.MaxFolderDepth = 2 })
+
+	if _, err := createFolder(filepath.Join(root, "a", "b"), false); err != nil {
+		t.Errorf("create at the limit: %v", err)
+	}
+	if _, err := createFolder(filepath.Join(root, "a", "b", "c"), false); err == nil || !strings.Contains(err.Error(), "levels deep") {
+		t.Errorf("create beyond the limit: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "a", "b", "c")); !os.IsNotExist(err) {
+		t.Errorf("folder beyond the limit exists: %v", err)
+	}
+
+	editConfig(t, func(c *Config) { c.MaxFolderDepth = 0 })
+	if _, err := createFolder(filepath.Join(root, "a", "b", "c", "d"), false); err != nil {
+		t.Errorf("create with no limit: %v", err)
+	}
+}
+
+func TestMoveAndCopyDepthLimit(t *testing.T) {
+	root := testRoot(t)
+	writeTestFile(t, filepath.Join(root, "tree", "x", "y", "f.txt"), "f")
+	editConfig(t, func(c *Config) { c.MaxFolderDepth = 3 })
+
+	// tree/x/y is three levels deep; below "deep" it would be four.
+	if _, err := movePath(filepath.Join(root, "tree"), filepath.Join(root, "deep", "tree")); err == nil || !strings.Contains(err.Error(), "levels deep") {
+		t.Errorf("move beyond the limit: %v", err)
+	}
+	if _, err := copyDir(filepath.Join(root, "tree"), filepath.Join(root, "deep", "tree")); err == nil || !strings.Contains(err.Error(), "levels deep") {
+		t.Errorf("copy beyond the limit: %v", err)
+	}
+	if _, err := movePath(filepath.Join(root, "tree"), filepath.Join(root, "moved")); err != nil {
+		t.Errorf("move within the limit: %v", err)
+	}
+}
+
+// flushRecorder records the body as it stood at each flush.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushed []string
+}
+
+func (f *flushRecorder) Flush() {
+	f.flushed = append(f.flushed, f.Body.String())
+}
+
+// searchTree creates three files with two TODO lines each.
+func searchTree(t *testing.T) string {
+	root := testRoot(t)
+	for _, name := range []string{"a.txt", filepath.Join("sub", "b.txt"), filepath.Join("sub", "c.log")} {
+		writeTestFile(t, filepath.Join(root, name), "TODO one\nnothing\nTODO two\n")
+	}
+	writeTestFile(t, filepath.Join(root, "tool.exe"), "TODO not searched\n")
+	return root
+}
+
+func getSearch(t *testing.T, root, pattern, max string) *flushRecorder {
+	t.Helper()
+	q := url.Values{"path": {root}, "pattern": {pattern}, "max": {max}}
+	req := withClaims(httptest.NewRequest(http.MethodGet, "/api/search?"+q.Encode(), nil), jwt.MapClaims{"sub": "tester"})
+	rec := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	searchHandler(rec, req)
+	return rec
+}
+
+func TestSearchStreamsMatches(t *testing.T) {
+	root := searchTree(t)
+	rec := getSearch(t, root, "^TODO", "")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("got %d, %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	if len(lines) != 6 {
+		t.Fatalf("got %d lines: %q", len(lines), lines)
+	}
+	var first searchMatch
+	if err := json.Unmarshal([]byte(lines[0]), &first); err != nil {
+		t.Fatal(err)
+	}
+	if first != (searchMatch{Path: filepath.Join(root, "a.txt"), Line: 1, Text: "TODO one"}) {
+		t.Errorf("first match %+v", first)
+	}
+	// Each match went out in a flush of its own.
+	if len(rec.flushed) != 6 {
+		t.Fatalf("%d flushes for 6 matches", len(rec.flushed))
+	}
+	for i, body := range rec.flushed {
+		if n := strings.Count(body, "\n"); n != i+1 {
+			t.Errorf("flush %d carried %d lines", i, n)
+		}
+	}
+}
+
+func TestSearchCapsMatches(t *testing.T) {
+	root := searchTree(t)
+	rec := getSearch(t, root, "TODO", "4")
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	if len(lines) != 5 || lines[4] != `{"truncated":true}` {
+		t.Errorf("got %q", lines)
+	}
+
+	result, err := searchAll(root, "TODO", "6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if matches := result["matches"].([]searchMatch); len(matches) != 6 || result["truncated"] != false {
+		t.Errorf("exactly max matches: %d, truncated %v", len(matches), result["truncated"])
+	}
+	if rec := getSearch(t, root, "TODO", "0"); rec.Code != http.StatusBadRequest {
+		t.Errorf("max=0 got %d", rec.Code)
+	}
+	if rec := getSearch(t, root, "(", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid pattern got %d", rec.Code)
+	}
+}
+
+func TestSearchStopsWhenCancelled(t *testing.T) {
+	root := searchTree(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	var got []searchMatch
+	_, err := searchFiles(ctx, root, "TODO", maxSearchMatches, func(m searchMatch) error {
+		got = append(got, m)
+		cancel()
+		return nil
+	})
+	if err != context.Canceled || len(got) != 1 {
+		t.Errorf("search went on after cancellation: %d matches, %v", len(got), err)
+	}
+}
+
+func TestValidateName(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"notes.txt", true},
+		{"console.txt", true},
+		{"CONFIG", true},
+		{"café.txt", true},
+		{"a\x00b.txt", false},
+		{"tab\there.txt", false},
+		{"bell\a.txt", false},
+		{"line\nbreak.txt", false},
+		{"del\x7f.txt", false},
+		{"CON", false},
+		{"nul.txt", false},
+		{"Com1.tar.gz", false},
+		{"LPT9", false},
+		{"aux. ", false},
+		{"PRN .txt", false},
+	}
+	for _, tt := range tests {
+		err := validateName(tt.name)
+		if tt.ok && err != nil {
+			t.Errorf("validateName(%q) = %v", tt.name, err)
+		}
+		if !tt.ok && errCode(err) != codeInvalidName {
+			t.Errorf("validateName(%q) = %v, want %s", tt.name, err, codeInvalidName)
+		}
+	}
+}
+
+func TestMutatingOperationsRejectBadNames(t *testing.T) {
+	root := testRoot(t)
+	enableActions(t, "move")
+	src := filepath.Join(root, "src.txt")
+	writeTestFile(t, src, "x")
+	writeTestFile(t, filepath.Join(root, "dir", "a.txt"), "x")
+	claims := jwt.MapClaims{"sub": "tester"}
+
+	tests := []struct {
+		name   string
+		action string
+		params map[string]string
+	}{
+		{"embedded NUL", "write_file", map[string]string{"path": filepath.Join(root, "a\x00b.txt"), "content": "x"}},
+		{"control character", "write_file", map[string]string{"path": filepath.Join(root, "a\x1bb.txt"), "content": "x"}},
+		{"reserved name", "write_file", map[string]string{"path": filepath.Join(root, "NUL.txt"), "content": "x"}},
+		{"reserved parent", "create_folder", map[string]string{"path": filepath.Join(root, "con", "inner")}},
+		{"move destination", "move", map[string]string{"path": src, "destination": filepath.Join(root, "aux.log")}},
+		{"copy destination", "copy_dir", map[string]string{"path": filepath.Join(root, "dir"), "destination": filepath.Join(root, "new\nline")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := postOperation(t, claims, Operation{Action: tt.action, Parameters: tt.params})
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("status %d: %s", rec.Code, rec.Body)
+			}
+			if resp := decodeResponse(t, rec); resp.Code != codeInvalidName {
+				t.Errorf("code %q, want %q", resp.Code, codeInvalidName)
+			}
+		})
+	}
+
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("rejected operations left entries behind: %v", entries)
+	}
+}
+
+// holdSharedRead stands in for a read of the current version of path that
+// is already running, until the returned function is called. The fake read
+// answers with result.
+func holdSharedRead(t *testing.T, kind, path string, result interface{}) (release func()) {
+	t.Helper()
+	path, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	started, done := make(chan struct{}), make(chan struct{})
+	go sharedReads.Do(readKey(kind, path, info), func() (interface{}, error) {
+		close(started)
+		<-done
+		return result, nil
+	})
+	<-started
+	return sync.OnceFunc(func() { close(done) })
+}
+
+func TestConcurrentReadsShareOneRead(t *testing.T) {
+	root := testRoot(t)
+	path := filepath.Join(root, "big.txt")
+	writeTestFile(t, path, "from disk")
+
+	// Every read arriving while one is in flight takes its result rather
+	// than reading the file itself.
+	release := holdSharedRead(t, "read", path, "from the shared read")
+	defer release()
+	var wg sync.WaitGroup
+	results := make([]string, 8)
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			content, err := readFile(path)
+			if err != nil {
+				t.Error(err)
+			}
+			results[i] = content
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	release()
+	wg.Wait()
+	for i, got := range results {
+		if got != "from the shared read" {
+			t.Errorf("read %d went to disk: %q", i, got)
+		}
+	}
+
+	// Once it finishes, the next read is a read of its own.
+	if got, err := readFile(path); err != nil || got != "from disk" {
+		t.Errorf("read after the shared one: %q, %v", got, err)
+	}
+}
+
+func TestReadsNotSharedAcrossVersionsOrStreams(t *testing.T) {
+	root := testRoot(t)
+	path := filepath.Join(root, "data.txt")
+	writeTestFile(t, path, "version one")
+	release := holdSharedRead(t, "read", path, "stale")
+	defer release()
+
+	// A streamed read never joins the shared one.
+	rec := postOperation(t, jwt.MapClaims{"sub": "tester"}, Operation{Action: "read_file", Parameters: map[string]string{
+		"path": path, "stream": "true",
+	}})
+	if rec.Header().Get(readModeHeader) != "stream" || rec.Body.String() != "version one" {
+		t.Errorf("streamed read: %q %q", rec.Header().Get(readModeHeader), rec.Body)
+	}
+
+	// Nor does a read of a changed file, whose ETag differs.
+	writeTestFile(t, path, "version two, longer")
+	got := make(chan string, 1)
+	go func() {
+		content, _ := readFile(path)
+		got <- content
+	}()
+	select {
+	case content := <-got:
+		if content != "version two, longer" {
+			t.Errorf("read of the new version got %q", content)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read of the new version waited on the old one")
+	}
+}
+
+func TestChecksumsShareOneRead(t *testing.T) {
+	root := testRoot(t)
+	path := filepath.Join(root, "sum.txt")
+	writeTestFile(t, path, "content")
+
+	release := holdSharedRead(t, "sha256", path, strings.Repeat("ab", 32))
+	done := make(chan manifestEntry)
+	go func() {
+		resolved, _ := filepath.EvalSymlinks(path)
+		entry, err := hashFile(resolved)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- entry
+	}()
+	time.Sleep(50 * time.Millisecond)
+	release()
+	if entry := <-done; entry.SHA256 != strings.Repeat("ab", 32) {
+		t.Errorf("checksum hashed the file again: %s", entry.SHA256)
+	}
+}
+
+func TestRecentFiles(t *testing.T) {
+	root := testRoot(t)
+	root, _ = filepath.EvalSymlinks(root)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	ages := map[string]time.Duration{
+		"a.txt":                        5 * time.Minute,
+		filepath.Join("sub", "b.log"):  1 * time.Minute,
+		filepath.Join("sub", "c.json"): 3 * time.Hour,
+		"d.csv":                        30 * time.Minute,
+		"e.txt":                        48 * time.Hour,
+		"skipped.exe":                  0,
+	}
+	for name, age := range ages {
+		p := filepath.Join(root, name)
+		writeTestFile(t, p, name)
+		if err := os.Chtimes(p, now.Add(-age), now.Add(-age)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	outside := filepath.Join(t.TempDir(), "secret.txt")
+	writeTestFile(t, outside, "secret")
+	mustSymlink(t, outside, filepath.Join(root, "escape.txt"))
+	claims := jwt.MapClaims{"sub": "tester"}
+
+	paths := func(files []recentFile) []string {
+		var out []string
+		for _, f := range files {
+			rel, _ := filepath.Rel(root, f.Path)
+			out = append(out, rel)
+		}
+		return out
+	}
+
+	files, err := recentFiles(claims, "", "", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{filepath.Join("sub", "b.log"), "a.txt", "d.csv", filepath.Join("sub", "c.json"), "e.txt"}
+	if got := paths(files); !slices.Equal(got, want) {
+		t.Errorf("newest first: got %v, want %v", got, want)
+	}
+	if files[0].Size != int64(len(filepath.Join("sub", "b.log"))) || !files[0].ModTime.Equal(now.Add(-time.Minute)) {
+		t.Errorf("first entry %+v", files[0])
+	}
+
+	files, _ = recentFiles(claims, "2", "", now)
+	if got := paths(files); !slices.Equal(got, want[:2]) {
+		t.Errorf("limit 2: got %v", got)
+	}
+	files, _ = recentFiles(claims, "", "1h", now)
+	if got := paths(files); !slices.Equal(got, want[:3]) {
+		t.Errorf("within 1h: got %v", got)
+	}
+	for _, bad := range [][2]string{{"0", ""}, {"x", ""}, {"", "-1h"}, {"", "soon"}} {
+		if _, err := recentFiles(claims, bad[0], bad[1], now); errCode(err) != codeInvalidArgument {
+			t.Errorf("limit %q within %q: %v", bad[0], bad[1], err)
+		}
+	}
+
+	// A token narrowed to sub sees only what is under it.
+	editConfig(t, func(c *Config) {
+		c.Permissions = map[string]map[string][]string{"sub": {"recent": {filepath.Join(root, "sub") + "/**"}}}
+	})
+	files, _ = recentFiles(jwt.MapClaims{"sub": "s", "role": "sub"}, "", "", now)
+	if got := paths(files); !slices.Equal(got, []string{filepath.Join("sub", "b.log"), filepath.Join("sub", "c.json")}) {
+		t.Errorf("narrowed token: got %v", got)
+	}
+}
+
+func TestWriteFileConvertsEncoding(t *testing.T) {
+	root := testRoot(t)
+	claims := jwt.MapClaims{"sub": "tester"}
+	write := func(name string, params map[string]string) (*httptest.ResponseRecorder, []byte) {
+		t.Helper()
+		p := filepath.Join(root, name)
+		params["path"] = p
+		rec := postOperation(t, claims, Operation{Action: "write_file", Parameters: params})
+		raw, _ := os.ReadFile(p)
+		return rec, raw
+	}
+
+	tests := []struct {
+		name   string
+		params map[string]string
+		want   string
+	}{
+		{"defaults", map[string]string{"content": "a\nb\r\nc"}, "a\nb\r\nc"},
+		{"crlf", map[string]string{"content": "a\nb\r\nc\n", "line_ending": "crlf"}, "a\r\nb\r\nc\r\n"},
+		{"lf", map[string]string{"content": "a\r\nb\nc\r\n", "line_ending": "lf"}, "a\nb\nc\n"},
+		{"latin1", map[string]string{"content": "café ÷ ü", "encoding": "latin1"}, "caf\xe9 \xf7 \xfc"},
+		{"both", map[string]string{"content": "é\n", "encoding": "LATIN1", "line_ending": "crlf"}, "\xe9\r\n"},
+		{"explicit utf-8", map[string]string{"content": "café", "encoding": "utf-8"}, "café"},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, raw := write(fmt.Sprintf("f%d.txt", i), tt.params)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", rec.Code, rec.Body)
+			}
+			if string(raw) != tt.want {
+				t.Errorf("stored %q, want %q", raw, tt.want)
+			}
+		})
+	}
+
+	// The checksum is of the content as sent, not as stored.
+	content := "x\ny\n"
+	rec, raw := write("sum.txt", map[string]string{"content": content, "line_ending": "crlf", "sha256": sha256Hex(content)})
+	if rec.Code != http.StatusOK || string(raw) != "x\r\ny\r\n" {
+		t.Errorf("checksummed write: %d %q", rec.Code, raw)
+	}
+
+	for _, params := range []map[string]string{
+		{"content": "x", "line_ending": "cr"},
+		{"content": "x", "encoding": "utf-16"},
+		{"content": "price: €5", "encoding": "latin1"},
+	} {
+		rec, raw := write("bad.txt", params)
+		if resp := decodeResponse(t, rec); rec.Code != http.StatusBadRequest || resp.Code != codeInvalidArgument {
+			t.Errorf("%v: status %d code %q", params, rec.Code, resp.Code)
+		}
+		if raw != nil {
+			t.Errorf("%v: rejected write stored %q", params, raw)
+		}
+	}
+}
+
+// verifyToken calls /api/auth/verify with authorization as the
+// Authorization header.
+func verifyToken(t *testing.T, authorization string) (*httptest.ResponseRecorder, Response) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/api/auth/verify", nil)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	rec := httptest.NewRecorder()
+	verifyTokenHandler(rec, req)
+	return rec, decodeResponse(t, rec)
+}
+
+func TestVerifyTokenReportsClaims(t *testing.T) {
+	testRoot(t)
+	editConfig(t, func(c *Config) { c.Audience = "quic-ssh" })
+	exp := time.Now().Add(time.Hour).Truncate(time.Second).UTC()
+	token := testToken(t, jwt.MapClaims{
+		"sub": "alice", "aud": "quic-ssh", "roles": []interface{}{"viewer", "logs"},
+		"exp": exp.Unix(),
+	})
+
+	rec, resp := verifyToken(t, "Bearer "+token)
+	if rec.Code != http.StatusOK || resp.Status != "success" {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var summary tokenSummary
+	data, _ := json.Marshal(resp.Data)
+	if err := json.Unmarshal(data, &summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.Subject != "alice" || summary.Audience != "quic-ssh" || !slices.Equal(summary.Roles, []string{"viewer", "logs"}) {
+		t.Errorf("summary %+v", summary)
+	}
+	if summary.ExpiresAt == nil || !summary.ExpiresAt.Equal(exp) || summary.NotBefore != nil {
+		t.Errorf("times exp=%v nbf=%v", summary.ExpiresAt, summary.NotBefore)
+	}
+}
+
+func TestVerifyTokenReportsFailureReason(t *testing.T) {
+	testRoot(t)
+	editConfig(t, func(c *Config) { c.Audience = "quic-ssh" })
+	now := time.Now()
+	valid := jwt.MapClaims{"sub": "alice", "aud": "quic-ssh", "exp": now.Add(time.Hour).Unix()}
+	with := func(key string, value interface{}) jwt.MapClaims {
+		c := maps.Clone(valid)
+		c[key] = value
+		return c
+	}
+	token := testToken(t, valid)
+	forged, err := jwt.NewWithClaims(jwt.SigningMethodHS256, valid).SignedString([]byte("another secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, authorization, reason string
+	}{
+		{"expired", "Bearer " + testToken(t, with("exp", now.Add(-time.Minute).Unix())), "expired"},
+		{"wrong audience", "Bearer " + testToken(t, with("aud", "someone-else")), "wrong_audience"},
+		{"no audience", "Bearer " + testToken(t, with("aud", nil)), "wrong_audience"},
+		{"not yet valid", "Bearer " + testToken(t, with("nbf", now.Add(time.Hour).Unix())), "not_yet_valid"},
+		{"bad signature", "Bearer " + forged, "bad_signature"},
+		{"malformed", "Bearer not.a.token", "malformed"},
+		{"missing", "", "missing"},
+		{"not bearer", "Basic " + token, "missing"},
+	}
+	reasons := make(map[string]bool)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, resp := verifyToken(t, tt.authorization)
+			if rec.Code != http.StatusUnauthorized || resp.Code != codeInvalidToken {
+				t.Fatalf("status %d code %q", rec.Code, resp.Code)
+			}
+			if resp.Details["reason"] != tt.reason {
+				t.Errorf("reason %q, want %q", resp.Details["reason"], tt.reason)
+			}
+		})
+		reasons[tt.reason] = true
+	}
+	if len(reasons) != 6 {
+		t.Errorf("reasons are not distinct: %v", reasons)
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, "/api/auth/verify", nil)
+	rec := httptest.NewRecorder()
+	verifyTokenHandler(rec, req)
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE got %d", rec.Code)
+	}
+}
+
+// pasetoToken signs claims as a PASETO public token of version ("v2" or
+// "v4") under priv, with an optional footer.
+func pasetoToken(t *testing.T, version string, priv ed25519.PrivateKey, claims map[string]interface{}, footer string) string {
+	t.Helper()
+	msg, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := version + ".public."
+	pieces := [][]byte{[]byte(header), msg, []byte(footer)}
+	if version == "v4" {
+		pieces = append(pieces, nil)
+	}
+	sig := ed25519.Sign(priv, preAuthEncode(pieces...))
+	token := header + base64.RawURLEncoding.EncodeToString(append(msg, sig...))
+	if footer != "" {
+		token += "." + base64.RawURLEncoding.EncodeToString([]byte(footer))
+	}
+	return token
+}
+
+// usePASETO switches the server to PASETO tokens under a new key pair and
+// returns its private key.
+func usePASETO(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	editConfig(t, func(c *Config) {
+		c.TokenFormat = tokenFormatPASETO
+		c.PasetoPublicKey = hex.EncodeToString(pub)
+	})
+	return priv
+}
+
+func TestPASETOTokens(t *testing.T) {
+	testRoot(t)
+	priv := usePASETO(t)
+	exp := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+
+	for _, version := range []string{"v2", "v4"} {
+		for _, footer := range []string{"", `{"kid":"1"}`} {
+			token := pasetoToken(t, version, priv, map[string]interface{}{"sub": "alice", "exp": exp, "role": "viewer"}, footer)
+			claims, err := validateToken(token)
+			if err != nil {
+				t.Errorf("%s footer %q: %v", version, footer, err)
+				continue
+			}
+			if claims["sub"] != "alice" || !slices.Equal(claimRoles(claims), []string{"viewer"}) {
+				t.Errorf("%s claims %v", version, claims)
+			}
+			// Times come back in the form the rest of the server uses.
+			if _, ok := claims["exp"].(float64); !ok {
+				t.Errorf("%s exp is %T", version, claims["exp"])
+			}
+		}
+	}
+
+	// The same token goes through the HTTP middleware.
+	token := pasetoToken(t, "v4", priv, map[string]interface{}{"sub": "alice", "exp": exp}, "")
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	authMiddleware(func(w http.ResponseWriter, r *http.Request) {})(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("middleware rejected a valid PASETO token: %d", rec.Code)
+	}
+}
+
+func TestPASETORejectsTampering(t *testing.T) {
+	testRoot(t)
+	priv := usePASETO(t)
+	exp := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	claims := map[string]interface{}{"sub": "alice", "exp": exp}
+	token := pasetoToken(t, "v4", priv, claims, `{"kid":"1"}`)
+	header, rest, _ := strings.Cut(strings.TrimPrefix(token, "v4.public."), ".")
+
+	// Swap the payload for one granting more, keeping the signature.
+	signed, _ := base64.RawURLEncoding.DecodeString(header)
+	forgedMsg, _ := json.Marshal(map[string]interface{}{"sub": "admin", "exp": exp})
+	forged := append(forgedMsg, signed[len(signed)-ed25519.SignatureSize:]...)
+	flipped := slices.Clone(signed)
+	flipped[0] ^= 1
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	tests := []struct {
+		name, token, reason string
+	}{
+		{"payload swapped", "v4.public." + base64.RawURLEncoding.EncodeToString(forged) + "." + rest, "bad_signature"},
+		{"payload bit flipped", "v4.public." + base64.RawURLEncoding.EncodeToString(flipped) + "." + rest, "bad_signature"},
+		{"footer changed", "v4.public." + header + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"kid":"2"}`)), "bad_signature"},
+		{"version changed", "v2.public." + header + "." + rest, "bad_signature"},
+		{"other key", pasetoToken(t, "v4", otherKey, claims, ""), "bad_signature"},
+		{"local token", "v4.local." + header, "malformed"},
+		{"jwt", testToken(t, jwt.MapClaims{"sub": "alice"}), "malformed"},
+		{"truncated", "v4.public.AAAA", "malformed"},
+		{"expired", pasetoToken(t, "v4", priv, map[string]interface{}{"sub": "alice", "exp": time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)}, ""), "expired"},
+		{"bad time", pasetoToken(t, "v4", priv, map[string]interface{}{"sub": "alice", "exp": "tomorrow"}, ""), "malformed"},
+	}
+	for _, tt := range tests {
+		_, err := validateToken(tt.token)
+		if err == nil {
+			t.Errorf("%s: accepted", tt.name)
+			continue
+		}
+		if got := tokenFailure(err); got != tt.reason {
+			t.Errorf("%s: reason %q, want %q (%v)", tt.name, got, tt.reason, err)
+		}
+	}
+}
+
+func TestPASETOSpecVector(t *testing.T) {
+	// Test vector 4-S-1 from the PASETO specification: signed correctly,
+	// but with an exp long past.
+	pub, _ := hex.DecodeString("1eb9dbbbbc047c03fd70604e0071f0987e16b28b757225c11f00415d0e20b1a2")
+	v := pasetoVerifier{key: pub}
+	token := "v4.public.eyJkYXRhIjoidGhpcyBpcyBhIHNpZ25lZCBtZXNzYWdlIiwiZXhwIjoiMjAyMi0wMS0wMVQwMDowMDowMCswMDowMCJ9bg_XBBzds8lTZShVlwwKSgeKpLT3yukTw6JUz3W4h_ExsQV-P0V54zemZDcAxFaSeef1QlXEFtkqxT1ciiQEDA"
+	if _, err := v.Verify(token); tokenFailure(err) != "expired" {
+		t.Errorf("got %v, want the signature accepted and the token expired", err)
+	}
+}
+
+func TestTokenFormatConfig(t *testing.T) {
+	if _, err := tokenVerifierFor(Config{TokenFormat: "paseto", PasetoPublicKey: "abcd"}); err == nil {
+		t.Error("short PASETO key accepted")
+	}
+	if _, err := tokenVerifierFor(Config{TokenFormat: "saml"}); err == nil {
+		t.Error("unknown token format accepted")
+	}
+	if v, err := tokenVerifierFor(Config{}); err != nil {
+		t.Error(err)
+	} else if _, ok := v.(jwtVerifier); !ok {
+		t.Errorf("default verifier is %T", v)
+	}
+}
+
+// modeOf returns the permission bits of the file at p.
+func modeOf(t *testing.T, p string) os.FileMode {
+	t.Helper()
+	info, err := os.Lstat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Mode().Perm()
+}
+
+func TestChmod(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permission bits are not kept on Windows")
+	}
+	root := testRoot(t)
+	enableActions(t, "chmod")
+	dir := filepath.Join(root, "dir")
+	files := []string{filepath.Join(dir, "a.txt"), filepath.Join(dir, "sub", "b.log"), filepath.Join(root, "single.txt")}
+	for _, f := range files {
+		writeTestFile(t, f, "x")
+		os.Chmod(f, 0644)
+	}
+	outside := filepath.Join(t.TempDir(), "outside.txt")
+	writeTestFile(t, outside, "x")
+	os.Chmod(outside, 0644)
+	mustSymlink(t, outside, filepath.Join(dir, "link.txt"))
+	claims := jwt.MapClaims{"sub": "tester"}
+	chmod := func(params map[string]string) (*httptest.ResponseRecorder, Response) {
+		t.Helper()
+		rec := postOperation(t, claims, Operation{Action: "chmod", Parameters: params})
+		return rec, decodeResponse(t, rec)
+	}
+
+	rec, resp := chmod(map[string]string{"path": files[2], "mode": "0600"})
+	if rec.Code != http.StatusOK || resp.Data != float64(1) || modeOf(t, files[2]) != 0600 {
+		t.Fatalf("single file: %d %v %o", rec.Code, resp.Data, modeOf(t, files[2]))
+	}
+	if _, resp := chmod(map[string]string{"path": files[2], "mode": "600"}); resp.Data != float64(0) {
+		t.Errorf("unchanged mode counted: %v", resp.Data)
+	}
+
+	// Recursive: dir, sub and both files, but not the symlink's target.
+	os.Chmod(filepath.Join(dir, "sub"), 0755)
+	os.Chmod(dir, 0700)
+	rec, resp = chmod(map[string]string{"path": dir, "mode": "0750", "recursive": "true"})
+	if rec.Code != http.StatusOK || resp.Data != float64(4) {
+		t.Fatalf("recursive: %d %v: %s", rec.Code, resp.Data, rec.Body)
+	}
+	for _, p := range []string{dir, filepath.Join(dir, "sub"), files[0], files[1]} {
+		if got := modeOf(t, p); got != 0750 {
+			t.Errorf("%s: mode %o", p, got)
+		}
+	}
+	if got := modeOf(t, outside); got != 0644 {
+		t.Errorf("symlink followed out of the root: %o", got)
+	}
+
+	for _, params := range []map[string]string{
+		{"path": files[2], "mode": "0777"},
+		{"path": dir, "mode": "0757", "recursive": "true"},
+		{"path": files[2], "mode": "4755"},
+		{"path": files[2], "mode": "rw-r--r--"},
+		{"path": files[2], "mode": "0800"},
+	} {
+		rec, resp := chmod(params)
+		if rec.Code != http.StatusBadRequest || resp.Code != codeInvalidArgument {
+			t.Errorf("mode %s: %d %q", params["mode"], rec.Code, resp.Code)
+		}
+	}
+	if modeOf(t, files[2]) != 0600 || modeOf(t, files[0]) != 0750 {
+		t.Error("rejected mode was applied")
+	}
+
+	// A stricter policy is enforced as configured.
+	editConfig(t, func(c *Config) { c.MaxMode = "0700" })
+	if _, resp := chmod(map[string]string{"path": files[2], "mode": "0640"}); resp.Details["max_mode"] != "0700" {
+		t.Errorf("MaxMode 0700: %+v", resp)
+	}
+}
+
+func TestChmodRecursiveChecksEveryEntryFirst(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permission bits are not kept on Windows")
+	}
+	root := testRoot(t)
+	enableActions(t, "chmod")
+	dir := filepath.Join(root, "dir")
+	ok := filepath.Join(dir, "ok.txt")
+	writeTestFile(t, ok, "x")
+	writeTestFile(t, filepath.Join(dir, "z.exe"), "x")
+	os.Chmod(ok, 0644)
+
+	rec := postOperation(t, jwt.MapClaims{"sub": "tester"}, Operation{Action: "chmod", Parameters: map[string]string{
+		"path": dir, "mode": "0600", "recursive": "true",
+	}})
+	if resp := decodeResponse(t, rec); resp.Code != codeTypeDenied {
+		t.Fatalf("got %d %q", rec.Code, resp.Code)
+	}
+	if got := modeOf(t, ok); got != 0644 {
+		t.Errorf("entry changed before the rejection: %o", got)
+	}
+}
+
+func TestChmodRestoresLockedEntries(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permission bits are not kept on Windows")
+	}
+	root := testRoot(t)
+	enableActions(t, "chmod")
+	locked := filepath.Join(root, "locked.txt")
+	writeOnly := filepath.Join(root, "write-only.txt")
+	dir := filepath.Join(root, "dir")
+	inner := filepath.Join(dir, "inner.txt")
+	for _, f := range []string{locked, writeOnly, inner} {
+		writeTestFile(t, f, "x")
+	}
+	os.Chmod(locked, 0000)
+	os.Chmod(writeOnly, 0200)
+	os.Chmod(inner, 0000)
+	os.Chmod(dir, 0300)
+	t.Cleanup(func() { os.Chmod(dir, 0755) })
+	claims := jwt.MapClaims{"sub": "tester"}
+
+	// Modes the server cannot read the entry under are what need fixing.
+	for _, tt := range []struct {
+		path, mode string
+		want       os.FileMode
+	}{
+		{locked, "0644", 0644},
+		{writeOnly, "0600", 0600},
+		{dir, "0755", 0755},
+	} {
+		rec := postOperation(t, claims, Operation{Action: "chmod", Parameters: map[string]string{"path": tt.path, "mode": tt.mode}})
+		if resp := decodeResponse(t, rec); rec.Code != http.StatusOK || resp.Data != float64(1) {
+			t.Fatalf("%s: %d %s", tt.path, rec.Code, rec.Body)
+		}
+		if got := modeOf(t, tt.path); got != tt.want {
+			t.Errorf("%s: mode %o, want %o", tt.path, got, tt.want)
+		}
+	}
+	if _, err := os.ReadFile(locked); err != nil {
+		t.Errorf("restored file unreadable: %v", err)
+	}
+
+	rec := postOperation(t, claims, Operation{Action: "chmod", Parameters: map[string]string{"path": dir, "mode": "0700", "recursive": "true"}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("recursive: %d %s", rec.Code, rec.Body)
+	}
+	if got := modeOf(t, inner); got != 0700 {
+		t.Errorf("locked entry below the directory: mode %o", got)
+	}
+}
+
+// signedRequest builds a POST of body to /api/operation authenticated as
+// sub, signed under key at timestamp unless key is empty.
+func signedRequest(t *testing.T, sub string, body []byte, key, timestamp string) *http.Request {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/api/operation", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testToken(t, jwt.MapClaims{"sub": sub}))
+	if key != "" {
+		req.Header.Set("X-Signature-Timestamp", timestamp)
+		req.Header.Set("X-Signature", bodySignature([]byte(key), timestamp, body))
+	}
+	return req
+}
+
+func TestRequestSignatures(t *testing.T) {
+	root := testRoot(t)
+	editConfig(t, func(c *Config) { c.SigningKeys = map[string]string{"signer": "signing key"} })
+	handler := authMiddleware(withConfig(signatureMiddleware(operationHandler)))
+	path := filepath.Join(root, "a.txt")
+	body, _ := json.Marshal(Operation{Action: "write_file", Parameters: map[string]string{"path": path, "content": "signed"}})
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+
+	serve := func(req *http.Request) (*httptest.ResponseRecorder, Response) {
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec, decodeResponse(t, rec)
+	}
+
+	rec, _ := serve(signedRequest(t, "signer", body, "signing key", now))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("valid signature: %d %s", rec.Code, rec.Body)
+	}
+	if content, _ := os.ReadFile(path); string(content) != "signed" {
+		t.Fatalf("signed write stored %q", content)
+	}
+
+	// Subjects without a key are not asked to sign.
+	other, _ := json.Marshal(Operation{Action: "write_file", Parameters: map[string]string{"path": path, "content": "unsigned"}})
+	if rec, _ := serve(signedRequest(t, "someone", other, "", "")); rec.Code != http.StatusOK {
+		t.Errorf("subject without a key: %d %s", rec.Code, rec.Body)
+	}
+
+	tampered := bytes.Replace(body, []byte(`"signed"`), []byte(`"evil!!"`), 1)
+	missing := signedRequest(t, "signer", body, "", "")
+	onlyTimestamp := signedRequest(t, "signer", body, "", "")
+	onlyTimestamp.Header.Set("X-Signature-Timestamp", now)
+	retimed := signedRequest(t, "signer", body, "signing key", now)
+	retimed.Header.Set("X-Signature-Timestamp", strconv.FormatInt(time.Now().Unix()+1, 10))
+	tamperedReq := signedRequest(t, "signer", body, "signing key", now)
+	tamperedReq.Body = io.NopCloser(bytes.NewReader(tampered))
+
+	tests := []struct {
+		name   string
+		req    *http.Request
+		reason string
+	}{
+		{"tampered body", tamperedReq, "mismatch"},
+		{"timestamp changed", retimed, "mismatch"},
+		{"wrong key", signedRequest(t, "signer", body, "another key", now), "mismatch"},
+		{"missing signature", missing, "missing"},
+		{"timestamp only", onlyTimestamp, "missing"},
+		{"stale", signedRequest(t, "signer", body, "signing key", strconv.FormatInt(time.Now().Add(-10*time.Minute).Unix(), 10)), "stale"},
+		{"future", signedRequest(t, "signer", body, "signing key", strconv.FormatInt(time.Now().Add(10*time.Minute).Unix(), 10)), "stale"},
+		{"malformed timestamp", signedRequest(t, "signer", body, "signing key", "yesterday"), "malformed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, resp := serve(tt.req)
+			if rec.Code != codeStatus[codeBadSignature] || resp.Code != codeBadSignature || resp.Details["reason"] != tt.reason {
+				t.Errorf("got %d %q %v, want reason %q", rec.Code, resp.Code, resp.Details, tt.reason)
+			}
+		})
+	}
+	if content, _ := os.ReadFile(path); string(content) != "unsigned" {
+		t.Errorf("a rejected request was applied: %q", content)
+	}
+}
+
+// failingSyncer fails every file sync with err, as a filesystem that
+// allocates space late can.
+type failingSyncer struct{ err error }
+
+func (s failingSyncer) SyncFile(*os.File) error { return s.err }
+
+func (failingSyncer) SyncDir(string) error { return nil }
+
+func TestNoSpaceErrors(t *testing.T) {
+	for _, err := range []error{
+		syscall.ENOSPC,
+		syscall.EDQUOT,
+		&fs.PathError{Op: "write", Path: "/srv/a.txt", Err: syscall.ENOSPC},
+		fmt.Errorf("copying: %w", &os.LinkError{Op: "link", Old: "a", New: "b", Err: syscall.EDQUOT}),
+	} {
+		opErr := asOpError(err)
+		if opErr.Code != codeNoSpace || codeStatus[opErr.Code] != http.StatusInsufficientStorage {
+			t.Errorf("%v: code %q", err, opErr.Code)
+		}
+		if !strings.Contains(opErr.Message, err.Error()) {
+			t.Errorf("%v: message %q drops the cause", err, opErr.Message)
+		}
+	}
+	if code := asOpError(syscall.EIO).Code; code != codeInternal {
+		t.Errorf("EIO: code %q", code)
+	}
+}
+
+func TestDurableWriteOutOfSpace(t *testing.T) {
+	root := testRoot(t)
+	path := filepath.Join(root, "a.txt")
+	writeTestFile(t, path, "original")
+	prev := fsyncer
+	fsyncer = failingSyncer{&fs.PathError{Op: "sync", Path: path, Err: syscall.ENOSPC}}
+	t.Cleanup(func() { fsyncer = prev })
+
+	for _, exclusive := range []string{"false", "true"} {
+		target := path
+		if exclusive == "true" {
+			target = filepath.Join(root, "new.txt")
+		}
+		rec := postOperation(t, jwt.MapClaims{"sub": "tester"}, Operation{Action: "write_file", Parameters: map[string]string{
+			"path": target, "content": "replacement", "durable": "true", "exclusive": exclusive,
+		}})
+		if resp := decodeResponse(t, rec); rec.Code != http.StatusInsufficientStorage || resp.Code != codeNoSpace {
+			t.Errorf("exclusive %s: %d %q", exclusive, rec.Code, resp.Code)
+		}
+	}
+
+	if content, _ := os.ReadFile(path); string(content) != "original" {
+		t.Errorf("failed write changed the file: %q", content)
+	}
+	entries, _ := os.ReadDir(root)
+	if len(entries) != 1 {
+		t.Errorf("temporary files left behind: %v", entries)
+	}
+}
+
+func TestLogSamplerRatio(t *testing.T) {
+	var s logSampler
+	logged := 0
+	for range 1000 {
+		if s.Sample(http.StatusOK, 10) {
+			logged++
+		}
+	}
+	if logged != 100 {
+		t.Errorf("1 in 10: logged %d of 1000", logged)
+	}
+
+	s = logSampler{}
+	var got []bool
+	for range 4 {
+		got = append(got, s.Sample(http.StatusNoContent, 3))
+	}
+	if !slices.Equal(got, []bool{true, false, false, true}) {
+		t.Errorf("1 in 3 picked %v", got)
+	}
+
+	for _, n := range []int{0, 1} {
+		for range 5 {
+			if !s.Sample(http.StatusOK, n) {
+				t.Errorf("rate %d skipped a request", n)
+			}
+		}
+	}
+	for _, status := range []int{http.StatusBadRequest, http.StatusNotFound, http.StatusInternalServerError, http.StatusInsufficientStorage} {
+		for range 5 {
+			if !s.Sample(status, 1000) {
+				t.Errorf("status %d not logged", status)
+			}
+		}
+	}
+}
+
+func TestLogRequestsSamples(t *testing.T) {
+	testRoot(t)
+	editConfig(t, func(c *Config) { c.LogSampleRate = 5 })
+	requestLogSampler.seen.Store(0)
+	logs := &syncBuffer{}
+	log.SetOutput(logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	handler := logRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			http.Error(w, "nope", http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	for range 20 {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/ok", nil))
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/fail", nil))
+	}
+
+	out := logs.String()
+	if n := strings.Count(out, "GET /ok 200"); n != 4 {
+		t.Errorf("logged %d of 20 successes at 1 in 5", n)
+	}
+	if n := strings.Count(out, "GET /fail 403"); n != 20 {
+		t.Errorf("logged %d of 20 failures", n)
+	}
+}
+
+func TestCreateSymlink(t *testing.T) {
+	root := testRoot(t)
+	enableActions(t, "symlink")
+	doc := filepath.Join(root, "docs", "a.txt")
+	writeTestFile(t, doc, "linked")
+	os.MkdirAll(filepath.Join(root, "links"), 0755)
+	outside := filepath.Join(t.TempDir(), "secret.txt")
+	writeTestFile(t, outside, "secret")
+	mustSymlink(t, filepath.Dir(outside), filepath.Join(root, "escape"))
+	claims := jwt.MapClaims{"sub": "tester"}
+	symlink := func(link, target string) (*httptest.ResponseRecorder, Response) {
+		t.Helper()
+		rec := postOperation(t, claims, Operation{Action: "symlink", Parameters: map[string]string{"path": link, "target": target}})
+		return rec, decodeResponse(t, rec)
+	}
+
+	for _, tt := range []struct{ link, target string }{
+		{filepath.Join(root, "links", "abs.txt"), doc},
+		{filepath.Join(root, "links", "rel.txt"), filepath.Join("..", "docs", "a.txt")},
+		{filepath.Join(root, "links", "dir"), filepath.Join(root, "docs")},
+	} {
+		if rec, _ := symlink(tt.link, tt.target); rec.Code != http.StatusOK {
+			t.Fatalf("link to %s: %d %s", tt.target, rec.Code, rec.Body)
+		}
+		if got, _ := os.Readlink(tt.link); got != tt.target {
+			t.Errorf("link stores %q, want %q as given", got, tt.target)
+		}
+	}
+	if content, err := readFile(filepath.Join(root, "links", "rel.txt")); err != nil || content != "linked" {
+		t.Errorf("reading through the link gave %q", content)
+	}
+
+	tests := []struct {
+		name, link, target, code string
+	}{
+		{"absolute outside", filepath.Join(root, "out1"), outside, codePathDenied},
+		{"relative outside", filepath.Join(root, "links", "out2"), filepath.Join("..", "..", filepath.Base(filepath.Dir(outside)), "secret.txt"), codePathDenied},
+		{"through an escaping link", filepath.Join(root, "out3"), filepath.Join(root, "escape", "secret.txt"), codePathDenied},
+		{"link outside", filepath.Join(filepath.Dir(outside), "link"), doc, codePathDenied},
+		{"link exists", filepath.Join(root, "links", "abs.txt"), doc, codeAlreadyExists},
+		{"no target", filepath.Join(root, "out4"), "", codeInvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, resp := symlink(tt.link, tt.target); resp.Code != tt.code {
+				t.Errorf("code %q, want %q: %s", resp.Code, tt.code, resp.Message)
+			}
+			if tt.code != codeAlreadyExists {
+				if _, err := os.Lstat(tt.link); err == nil {
+					t.Error("link was created")
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyChecksum(t *testing.T) {
+	root := testRoot(t)
+	path := filepath.Join(root, "abc.txt")
+	writeTestFile(t, path, "abc")
+	claims := jwt.MapClaims{"sub": "tester"}
+	verify := func(params map[string]string) (verifyResult, Response, int) {
+		t.Helper()
+		rec := postOperation(t, claims, Operation{Action: "verify", Parameters: params})
+		resp := decodeResponse(t, rec)
+		var result verifyResult
+		data, _ := json.Marshal(resp.Data)
+		json.Unmarshal(data, &result)
+		return result, resp, rec.Code
+	}
+
+	digests := map[string]string{
+		"":       "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+		"SHA512": "ddaf35a193617abacc417349ae20413112e6fa4e89a97ea20a9eeee64b55d39a2192992a274fc1a836ba3c23a3feebbd454d4423643ce80e2a9ac94fa54ca49f",
+		"sha1":   "a9993e364706816aba3e25717850c26c9cd0d89d",
+		"md5":    "900150983cd24fb0d6963f7d28e17f72",
+	}
+	for algorithm, digest := range digests {
+		// Case and surrounding space in the expected digest do not matter.
+		result, _, code := verify(map[string]string{"path": path, "checksum": " " + strings.ToUpper(digest) + "\n", "algorithm": algorithm})
+		if code != http.StatusOK || !result.Match || result.Actual != digest {
+			t.Errorf("%q match: %d %+v", algorithm, code, result)
+		}
+		if want := strings.ToLower(cmp.Or(algorithm, "sha256")); result.Algorithm != want {
+			t.Errorf("%q reported as %q", algorithm, result.Algorithm)
+		}
+	}
+
+	result, _, code := verify(map[string]string{"path": path, "checksum": strings.Repeat("0", 64)})
+	if code != http.StatusOK || result.Match || result.Actual != digests[""] || result.Expected != strings.Repeat("0", 64) {
+		t.Errorf("mismatch: %d %+v", code, result)
+	}
+
+	for _, tt := range []struct {
+		params map[string]string
+		code   string
+	}{
+		{map[string]string{"path": path, "checksum": "x", "algorithm": "crc32"}, codeInvalidArgument},
+		{map[string]string{"path": path}, codeInvalidArgument},
+		{map[string]string{"path": root, "checksum": "x"}, codeIsDirectory},
+		{map[string]string{"path": filepath.Join(root, "missing.txt"), "checksum": "x"}, codeNotFound},
+		{map[string]string{"path": filepath.Join(filepath.Dir(root), "x.txt"), "checksum": "x"}, codePathDenied},
+	} {
+		if _, resp, _ := verify(tt.params); resp.Code != tt.code {
+			t.Errorf("%v: code %q, want %q", tt.params, resp.Code, tt.code)
+		}
+	}
+}
+
+func TestIdleFor(t *testing.T) {
+	markActivity()
+	now := time.Now()
+	if idle := idleFor(now.Add(5 * time.Second)); idle < 4*time.Second || idle > 6*time.Second {
+		t.Errorf("idle for %v, want about 5s", idle)
+	}
+
+	// A request coming in resets the clock.
+	lastActivity.Store(now.Add(-time.Hour).UnixNano())
+	refuseWhileDraining(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})).
+		ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if idle := idleFor(time.Now()); idle > time.Second {
+		t.Errorf("idle for %v right after a request", idle)
+	}
+
+	// So does an operation in flight, for as long as it runs.
+	lastActivity.Store(now.Add(-time.Hour).UnixNano())
+	done := inflight.Begin("copy_dir", "/data", "client")
+	if idle := idleFor(now.Add(time.Minute)); idle != 0 {
+		t.Errorf("idle for %v during an operation", idle)
+	}
+	lastActivity.Store(now.Add(-time.Hour).UnixNano())
+	done()
+	if idle := idleFor(time.Now()); idle > time.Second {
+		t.Errorf("idle for %v right after the operation ended", idle)
+	}
+}
+
+func TestIdleShutdown(t *testing.T) {
+	testRoot(t)
+	editConfig(t, func(c *Config) { c.IdleShutdown = 1 })
+	logs := &syncBuffer{}
+	log.SetOutput(logs)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+		draining.Store(false)
+	})
+
+	stopped := make(chan struct{})
+	go func() {
+		watchIdle(&http3.Server{})
+		close(stopped)
+	}()
+
+	// Steady activity keeps it running past the idle window.
+	for range 12 {
+		time.Sleep(200 * time.Millisecond)
+		markActivity()
+	}
+	if draining.Load() {
+		t.Fatal("shut down while requests were coming in")
+	}
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no shutdown after the idle window")
+	}
+	if !draining.Load() || !strings.Contains(logs.String(), "shutting down") {
+		t.Errorf("draining %v, log %q", draining.Load(), logs.String())
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	var b memoryBudget
+	release, err := b.Reserve(60, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Reserve(41, 100); errCode(err) != codeBusy {
+		t.Errorf("over the budget: %v", err)
+	}
+	second, err := b.Reserve(40, 100)
+	if err != nil {
+		t.Fatalf("up to the budget: %v", err)
+	}
+	release()
+	release() // a second release gives nothing back twice
+	if b.used != 40 {
+		t.Errorf("used %d after release, want 40", b.used)
+	}
+	second()
+	if _, err := b.Reserve(101, 100); errCode(err) != codeBusy {
+		t.Errorf("read larger than the budget: %v", err)
+	}
+	if _, err := b.Reserve(1<<40, 0); err != nil {
+		t.Errorf("no budget: %v", err)
+	}
+}
+
+func TestConcurrentReservationsStayWithinBudget(t *testing.T) {
+	var b memoryBudget
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	granted := 0
+	hold := make(chan struct{})
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := b.Reserve(30, 100)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			granted++
+			mu.Unlock()
+			<-hold
+			release()
+		}()
+	}
+	// Holders keep their share until the budget is full, so every later
+	// reservation has to fail.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		g := granted
+		mu.Unlock()
+		if g == 3 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(hold)
+	wg.Wait()
+	if granted != 3 || b.used != 0 {
+		t.Errorf("granted %d reads of 30 under 100, %d still used", granted, b.used)
+	}
+}
+
+func TestReadBudgetRefusesBufferedReads(t *testing.T) {
+	root := testRoot(t)
+	editConfig(t, func(c *Config) { c.ReadBudget = 100 })
+	path := filepath.Join(root, "big.txt")
+	writeTestFile(t, path, strings.Repeat("x", 60))
+	claims := jwt.MapClaims{"sub": "tester"}
+	read := func(stream string) *httptest.ResponseRecorder {
+		return postOperation(t, claims, Operation{Action: "read_file", Parameters: map[string]string{"path": path, "stream": stream}})
+	}
+
+	// Another buffered read is holding half the budget.
+	release, err := readBuffers.Reserve(50, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	rec := read("")
+	if rec.Code != http.StatusServiceUnavailable || decodeResponse(t, rec).Code != codeBusy {
+		t.Errorf("buffered read over the budget: %d %s", rec.Code, rec.Body)
+	}
+	if rec := read("true"); rec.Code != http.StatusOK || rec.Body.Len() != 60 {
+		t.Errorf("streamed read: %d, %d bytes", rec.Code, rec.Body.Len())
+	}
+	release()
+	if rec := read(""); rec.Code != http.StatusOK {
+		t.Errorf("read once the budget frees up: %d %s", rec.Code, rec.Body)
+	}
+	if readBuffers.used != 0 {
+		t.Errorf("finished reads still hold %d bytes", readBuffers.used)
+	}
+}
+
+// execResult is a decoded exec response body.
+type execResult struct {
+	frames []string // "1:text" for stdout, "2:text" for stderr
+	exit   int32
+	exited bool
+}
+
+func readExecFrames(t *testing.T, body []byte) execResult {
+	t.Helper()
+	var res execResult
+	for len(body) > 0 {
+		if len(body) < 5 {
+			t.Fatalf("%d bytes left, short of a frame header", len(body))
+		}
+		stream, n := body[0], int(binary.BigEndian.Uint32(body[1:5]))
+		payload := body[5 : 5+n]
+		body = body[5+n:]
+		if res.exited {
+			t.Fatalf("frame on stream %d after the exit frame", stream)
+		}
+		if stream == execExit {
+			res.exit, res.exited = int32(binary.BigEndian.Uint32(payload)), true
+			continue
+		}
+		res.frames = append(res.frames, fmt.Sprintf("%d:%s", stream, payload))
+	}
+	return res
+}
+
+func TestFrameWriterFraming(t *testing.T) {
+	var buf bytes.Buffer
+	fw := &frameWriter{w: &buf, remaining: 1 << 20}
+	streamWriter{fw, execStdout}.Write([]byte("out\n"))
+	streamWriter{fw, execStderr}.Write([]byte("err\n"))
+	streamWriter{fw, execStdout}.Write([]byte("more"))
+	fw.WriteExit(-1)
+
+	if got := buf.Bytes()[:9]; !bytes.Equal(got, []byte{1, 0, 0, 0, 4, 'o', 'u', 't', '\n'}) {
+		t.Errorf("first frame % x", got)
+	}
+	res := readExecFrames(t, buf.Bytes())
+	if !slices.Equal(res.frames, []string{"1:out\n", "2:err\n", "1:more"}) || !res.exited || res.exit != -1 {
+		t.Errorf("got %+v", res)
+	}
+}
+
+func TestFrameWriterOutputLimit(t *testing.T) {
+	var buf bytes.Buffer
+	overflowed := 0
+	fw := &frameWriter{w: &buf, remaining: 8, overflow: func() { overflowed++ }}
+	out, errs := streamWriter{fw, execStdout}, streamWriter{fw, execStderr}
+	for _, w := range []struct {
+		w streamWriter
+		s string
+	}{{out, "12345"}, {errs, "67890"}, {out, "dropped"}} {
+		if n, err := w.w.Write([]byte(w.s)); n != len(w.s) || err != nil {
+			t.Errorf("Write(%q) = %d, %v", w.s, n, err)
+		}
+	}
+	fw.WriteExit(0)
+
+	res := readExecFrames(t, buf.Bytes())
+	if !slices.Equal(res.frames, []string{"1:12345", "2:678"}) || !res.exited {
+		t.Errorf("got %+v", res)
+	}
+	if !fw.truncated || overflowed != 1 {
+		t.Errorf("truncated %v, overflow called %d times", fw.truncated, overflowed)
+	}
+}
+
+func TestExecStreamsStdoutAndStderr(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil || runtime.GOOS == "windows" {
+		t.Skip("needs a POSIX shell")
+	}
+	root := testRoot(t)
+	editConfig(t, func(c *Config) {
+		c.AllowedActions = maps.Clone(c.AllowedActions)
+		c.AllowedActions["exec"] = true
+		c.ExecCommands = map[string]string{"sh": sh}
+		c.ExecArgs = map[string]ExecArgPolicy{"sh": {Flags: map[string]string{"-c": ".*"}}}
+	})
+	run := func(script string) (*httptest.ResponseRecorder, execResult) {
+		t.Helper()
+		args, _ := json.Marshal([]string{"-c", script})
+		rec := postOperation(t, jwt.MapClaims{"sub": "tester"}, Operation{Action: "exec", Parameters: map[string]string{
+			"command": "sh", "path": root, "args": string(args),
+		}})
+		if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != execContentType {
+			t.Fatalf("status %d, %q: %s", rec.Code, rec.Header().Get("Content-Type"), rec.Body)
+		}
+		return rec, readExecFrames(t, rec.Body.Bytes())
+	}
+
+	_, res := run("echo out1; sleep 0.2; echo err1 >&2; sleep 0.2; echo out2; exit 3")
+	want := []string{"1:out1\n", "2:err1\n", "1:out2\n"}
+	if !slices.Equal(res.frames, want) || !res.exited || res.exit != 3 {
+		t.Errorf("got %+v, want %q and exit 3", res, want)
+	}
+
+	// The command sees only PATH, and runs in the given directory.
+	_, res = run(`echo "$JWT_SECRET|$PWD"`)
+	if resolved, _ := filepath.EvalSymlinks(root); !slices.Equal(res.frames, []string{"1:|" + resolved + "\n"}) {
+		t.Errorf("environment and directory: %q", res.frames)
+	}
+}
+
+func TestCheckExecArgs(t *testing.T) {
+	root := testRoot(t)
+	root, _ = filepath.EvalSymlinks(root)
+	logFile := filepath.Join(root, "app.log")
+	writeTestFile(t, logFile, "x")
+	outside := filepath.Join(filepath.Dir(root), "other.log")
+
+	tail := ExecArgPolicy{Flags: map[string]string{"-n": "[0-9]{1,6}", "-q": ""}, Args: execArgsPath, MaxArgs: 1}
+	grep := ExecArgPolicy{Flags: map[string]string{"-i": "", "-e": "[A-Za-z0-9 ]+"}, Args: "[a-z]+"}
+
+	allowed := []struct {
+		name   string
+		policy ExecArgPolicy
+		args   []string
+		want   []string
+	}{
+		{"tail -n N path", tail, []string{"-n", "20", logFile}, []string{"-n", "20", logFile}},
+		{"inline value", tail, []string{"-n=5", "app.log"}, []string{"-n=5", logFile}},
+		{"flag without value", tail, []string{"-q", "./app.log"}, []string{"-q", logFile}},
+		{"no arguments", tail, nil, []string{}},
+		{"pattern arguments", grep, []string{"-i", "-e", "two words", "abc", "def"}, []string{"-i", "-e", "two words", "abc", "def"}},
+		{"after --", ExecArgPolicy{Args: ".*"}, []string{"--", "-rf"}, []string{"--", "-rf"}},
+		{"stdin dash", ExecArgPolicy{Args: "-"}, []string{"-"}, []string{"-"}},
+	}
+	for _, tt := range allowed {
+		got, _, err := checkExecArgs(tt.policy, tt.args, root)
+		if err != nil || !slices.Equal(got, tt.want) {
+			t.Errorf("%s: got %q, %v; want %q", tt.name, got, err, tt.want)
+		}
+	}
+
+	denied := []struct {
+		name   string
+		policy ExecArgPolicy
+		args   []string
+		arg    string
+	}{
+		{"unknown flag", tail, []string{"-f", logFile}, "-f"},
+		{"bad flag value", tail, []string{"-n", "1;rm"}, "1;rm"},
+		{"value too long", tail, []string{"-n", "1234567"}, "1234567"},
+		{"missing value", tail, []string{"-n"}, "-n"},
+		{"value on a bare flag", tail, []string{"-q=1"}, "-q=1"},
+		{"path outside the roots", tail, []string{outside}, outside},
+		{"relative escape", tail, []string{"../other.log"}, "../other.log"},
+		{"too many paths", tail, []string{logFile, logFile}, logFile},
+		{"pattern mismatch", grep, []string{"ABC"}, "ABC"},
+		{"pattern is anchored", grep, []string{"abc def"}, "abc def"},
+		{"no policy takes no arguments", ExecArgPolicy{}, []string{"x"}, "x"},
+		{"flag hidden after an allowed value", tail, []string{"-n", "5", "--follow"}, "--follow"},
+	}
+	for _, tt := range denied {
+		_, _, err := checkExecArgs(tt.policy, tt.args, root)
+		opErr := asOpError(err)
+		if err == nil || opErr.Code != codeArgumentDenied || opErr.Details["argument"] != tt.arg {
+			t.Errorf("%s: %v, want %s for %q", tt.name, err, codeArgumentDenied, tt.arg)
+		}
+	}
+
+	_, paths, _ := checkExecArgs(tail, []string{"-n", "3", "app.log"}, root)
+	if !slices.Equal(paths, []string{logFile}) {
+		t.Errorf("paths %q", paths)
+	}
+}
+
+func TestExecArgPolicyValidate(t *testing.T) {
+	for _, p := range []ExecArgPolicy{
+		{Flags: map[string]string{"n": ""}},
+		{Flags: map[string]string{"--": ""}},
+		{Flags: map[string]string{"-n": "("}},
+		{Args: "[a-"},
+		{MaxArgs: -1},
+	} {
+		if err := p.validate(); err == nil {
+			t.Errorf("%+v accepted", p)
+		}
+	}
+	if err := (ExecArgPolicy{Flags: map[string]string{"-n": "[0-9]+", "--verbose": ""}, Args: execArgsPath}).validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExecRejectsDisallowedArguments(t *testing.T) {
+	root := testRoot(t)
+	editConfig(t, func(c *Config) {
+		c.AllowedActions = maps.Clone(c.AllowedActions)
+		c.AllowedActions["exec"] = true
+		c.ExecCommands = map[string]string{"tail": "/usr/bin/tail", "date": "/bin/date"}
+		c.ExecArgs = map[string]ExecArgPolicy{"tail": {Flags: map[string]string{"-n": "[0-9]+"}, Args: execArgsPath, MaxArgs: 1}}
+	})
+	for _, tt := range []struct {
+		command string
+		args    []string
+	}{
+		{"tail", []string{"-f", "/etc/passwd"}},
+		{"tail", []string{"-n", "all"}},
+		{"date", []string{"-s", "2000-01-01"}},
+	} {
+		args, _ := json.Marshal(tt.args)
+		rec := postOperation(t, jwt.MapClaims{"sub": "tester"}, Operation{Action: "exec", Parameters: map[string]string{
+			"command": tt.command, "path": root, "args": string(args),
+		}})
+		if resp := decodeResponse(t, rec); rec.Code != http.StatusForbidden || resp.Code != codeArgumentDenied {
+			t.Errorf("%s %q: %d %q", tt.command, tt.args, rec.Code, resp.Code)
+		}
+	}
+}
+
+// recordingSyncer records each sync along with what the file at path held
+// at that moment.
+type recordingSyncer struct {
+	path  string
+	calls []string
+}
+
+func (s *recordingSyncer) SyncFile(f *os.File) error {
+	content, _ := os.ReadFile(f.Name())
+	s.calls = append(s.calls, fmt.Sprintf("file %s %q", filepath.Base(f.Name()), content))
+	return nil
+}
+
+func (s *recordingSyncer) SyncDir(dir string) error {
+	content, _ := os.ReadFile(s.path)
+	s.calls = append(s.calls, fmt.Sprintf("dir %s, file holds %q", dir, content))
+	return nil
+}
+
+func useRecordingSyncer(t *testing.T, path string) *recordingSyncer {
+	s := &recordingSyncer{path: path}
+	prev := fsyncer
+	fsyncer = s
+	t.Cleanup(func() { fsyncer = prev })
+	return s
+}
+
+func TestDurableWriteSyncsFileThenDirectory(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permission bits are not kept on Windows")
+	}
+	root := testRoot(t)
+	root, _ = filepath.EvalSymlinks(root)
+	path := filepath.Join(root, "a.txt")
+	writeTestFile(t, path, "old")
+	os.Chmod(path, 0600)
+	syncs := useRecordingSyncer(t, path)
+	claims := jwt.MapClaims{"sub": "tester"}
+
+	rec := postOperation(t, claims, Operation{Action: "write_file", Parameters: map[string]string{
+		"path": path, "content": "new", "durable": "true",
+	}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	// The temporary file is synced with the new content while path still
+	// holds the old; the directory after the rename.
+	if len(syncs.calls) != 2 ||
+		!strings.HasPrefix(syncs.calls[0], "file .a.txt.tmp-") || !strings.HasSuffix(syncs.calls[0], ` "new"`) ||
+		syncs.calls[1] != fmt.Sprintf("dir %s, file holds %q", root, "new") {
+		t.Errorf("syncs %q", syncs.calls)
+	}
+	if got := modeOf(t, path); got != 0600 {
+		t.Errorf("durable write changed the mode to %o", got)
+	}
+	if entries, _ := os.ReadDir(root); len(entries) != 1 {
+		t.Errorf("temporary file left behind: %v", entries)
+	}
+
+	// Plain writes are not synced.
+	syncs.calls = nil
+	postOperation(t, claims, Operation{Action: "write_file", Parameters: map[string]string{"path": path, "content": "fast"}})
+	if len(syncs.calls) != 0 {
+		t.Errorf("plain write synced: %q", syncs.calls)
+	}
+}
+
+func TestDurableExclusiveWrite(t *testing.T) {
+	root := testRoot(t)
+	path := filepath.Join(root, "new.txt")
+	syncs := useRecordingSyncer(t, path)
+	write := func() *httptest.ResponseRecorder {
+		return postOperation(t, jwt.MapClaims{"sub": "tester"}, Operation{Action: "write_file", Parameters: map[string]string{
+			"path": path, "content": "first", "durable": "true", "exclusive": "true",
+		}})
+	}
+
+	if rec := write(); rec.Code != http.StatusOK || len(syncs.calls) != 2 {
+		t.Fatalf("status %d, syncs %q", rec.Code, syncs.calls)
+	}
+	if rec := write(); decodeResponse(t, rec).Code != codeAlreadyExists {
+		t.Errorf("second exclusive write: %d %s", rec.Code, rec.Body)
+	}
+	if content, _ := os.ReadFile(path); string(content) != "first" {
+		t.Errorf("file holds %q", content)
+	}
+	if entries, _ := os.ReadDir(root); len(entries) != 1 {
+		t.Errorf("temporary files left behind: %v", entries)
+	}
+}
+
+func TestReadLines(t *testing.T) {
+	root := testRoot(t)
+	path := filepath.Join(root, "app.log")
+	var lines []string
+	for i := 1; i <= 10; i++ {
+		lines = append(lines, fmt.Sprintf("line %d", i))
+	}
+	writeTestFile(t, path, strings.Join(lines, "\n")+"\n")
+	noNewline := filepath.Join(root, "partial.log")
+	writeTestFile(t, noNewline, "a\r\n\r\nlast without newline")
+
+	tests := []struct {
+		name, path, start, count string
+		want                     []string
+		eof                      bool
+	}{
+		{"mid-file range", path, "4", "3", lines[3:6], false},
+		{"range ending on the last line", path, "8", "3", lines[7:], true},
+		{"range past the end", path, "8", "50", lines[7:], true},
+		{"defaults", path, "", "", lines, true},
+		{"start past the end", path, "11", "5", []string{}, true},
+		{"start far past the end", path, "1000", "", []string{}, true},
+		{"no trailing newline", noNewline, "2", "5", []string{"", "last without newline"}, true},
+		{"CRLF stripped", noNewline, "1", "1", []string{"a"}, false},
+	}
+	for _, tt := range tests {
+		got, err := readLines(tt.path, tt.start, tt.count)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		wantStart := 1
+		if tt.start != "" {
+			wantStart, _ = strconv.Atoi(tt.start)
+		}
+		if !slices.Equal(got.Lines, tt.want) || got.EOF != tt.eof || got.Start != wantStart || got.Truncated {
+			t.Errorf("%s: got %+v, want lines %q eof %v", tt.name, got, tt.want, tt.eof)
+		}
+	}
+
+	for _, params := range [][2]string{{"0", ""}, {"x", ""}, {"", "0"}, {"", "-3"}} {
+		if _, err := readLines(path, params[0], params[1]); errCode(err) != codeInvalidArgument {
+			t.Errorf("start %q count %q: %v", params[0], params[1], err)
+		}
+	}
+	if _, err := readLines(filepath.Join(root, "tool.exe"), "", ""); errCode(err) != codeTypeDenied {
+		t.Errorf("disallowed type: %v", err)
+	}
+}
+
+func TestReadLinesLongAndLimited(t *testing.T) {
+	root := testRoot(t)
+	path := filepath.Join(root, "long.log")
+	long := strings.Repeat("x", 10000) // longer than the read buffer
+	writeTestFile(t, path, long+"\n"+long+"\nshort\n")
+
+	got, err := readLines(path, "2", "2")
+	if err != nil || len(got.Lines) != 2 || got.Lines[0] != long || got.Lines[1] != "short" || !got.EOF {
+		t.Errorf("long lines: %d lines, eof %v, %v", len(got.Lines), got.EOF, err)
+	}
+
+	editConfig(t, func(c *Config) { c.MaxFileSize = 15000 })
+	got, err = readLines(path, "", "")
+	if err != nil || len(got.Lines) != 1 || !got.Truncated || got.EOF {
+		t.Errorf("over MaxFileSize: %d lines, truncated %v, eof %v, %v", len(got.Lines), got.Truncated, got.EOF, err)
+	}
+
+	many := filepath.Join(root, "many.log")
+	writeTestFile(t, many, strings.Repeat("l\n", maxLineCount+5))
+	editConfig(t, func(c *Config) { c.MaxFileSize = 1 << 20 })
+	got, _ = readLines(many, "", strconv.Itoa(maxLineCount*2))
+	if len(got.Lines) != maxLineCount || got.EOF {
+		t.Errorf("count capped to %d lines, eof %v", len(got.Lines), got.EOF)
+	}
+}
+
+func TestETagEncoding(t *testing.T) {
+	for in, want := range map[string]string{
+		`"5-1a2b"`:      `"5-1a2b-gzip"`,
+		`W/"5-1a2b"`:    `W/"5-1a2b-gzip"`,
+		`"5-1a2b-gzip"`: `"5-1a2b-gzip"`,
+		`unquoted`:      `unquoted`,
+		``:              ``,
+	} {
+		if got := encodedETag(in); got != want {
+			t.Errorf("encodedETag(%s) = %s, want %s", in, got, want)
+		}
+	}
+	if got := decodedETags(`"a-gzip", W/"b-gzip" ,"c", *`); got != `"a", W/"b", "c", *` {
+		t.Errorf("decodedETags = %s", got)
+	}
+}
+
+func TestCompressedDownloadETags(t *testing.T) {
+	root := testRoot(t)
+	path := filepath.Join(root, "notes.txt")
+	writeTestFile(t, path, strings.Repeat("compressible text ", 100))
+	handler := compressMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downloadHandler(w, withClaims(r, jwt.MapClaims{"sub": "tester"}))
+	}))
+	get := func(method, acceptEncoding, ifNoneMatch, rng string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/file?path="+url.QueryEscape(path), nil)
+		for k, v := range map[string]string{"Accept-Encoding": acceptEncoding, "If-None-Match": ifNoneMatch, "Range": rng} {
+			if v != "" {
+				req.Header.Set(k, v)
+			}
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	plain := get(http.MethodGet, "", "", "")
+	gzipped := get(http.MethodGet, "gzip, deflate", "", "")
+	plainTag, gzipTag := plain.Header().Get("ETag"), gzipped.Header().Get("ETag")
+	if plainTag == "" || gzipped.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("plain ETag %q, gzipped encoding %q", plainTag, gzipped.Header().Get("Content-Encoding"))
+	}
+	if gzipTag != encodedETag(plainTag) || gzipTag == plainTag {
+		t.Errorf("same resource, ETags %s and %s", plainTag, gzipTag)
+	}
+	for name, rec := range map[string]*httptest.ResponseRecorder{"plain": plain, "gzipped": gzipped} {
+		if !slices.Contains(rec.Header().Values("Vary"), "Accept-Encoding") {
+			t.Errorf("%s response has Vary %q", name, rec.Header().Values("Vary"))
+		}
+	}
+	if head := get(http.MethodHead, "gzip", "", ""); head.Header().Get("ETag") != gzipTag || head.Body.Len() != 0 {
+		t.Errorf("HEAD: ETag %s, %d body bytes", head.Header().Get("ETag"), head.Body.Len())
+	}
+
+	// A cache revalidating its gzipped copy gets a 304 with that copy's tag.
+	if rec := get(http.MethodGet, "gzip", gzipTag, ""); rec.Code != http.StatusNotModified || rec.Header().Get("ETag") != gzipTag {
+		t.Errorf("revalidating gzipped: %d %s", rec.Code, rec.Header().Get("ETag"))
+	}
+	if rec := get(http.MethodGet, "", plainTag, ""); rec.Code != http.StatusNotModified || rec.Header().Get("ETag") != plainTag {
+		t.Errorf("revalidating plain: %d %s", rec.Code, rec.Header().Get("ETag"))
+	}
+	// The gzipped tag never validates an uncompressed copy.
+	if rec := get(http.MethodGet, "", gzipTag, ""); rec.Code != http.StatusOK || rec.Header().Get("Content-Encoding") != "" {
+		t.Errorf("gzipped tag without gzip: %d %q", rec.Code, rec.Header().Get("Content-Encoding"))
+	}
+
+	// Ranges are of the file itself, so they keep its plain tag.
+	if rec := get(http.MethodGet, "gzip", "", "bytes=0-9"); rec.Code != http.StatusPartialContent || rec.Header().Get("ETag") != plainTag {
+		t.Errorf("range: %d %s", rec.Code, rec.Header().Get("ETag"))
+	}
+}
+
+// metricValue returns the value of the sample named series in the
+// Prometheus text out, or -1 when there is none.
+func metricValue(t *testing.T, out, series string) int64 {
+	t.Helper()
+	for _, line := range strings.Split(out, "\n") {
+		if v, ok := strings.CutPrefix(line, series+" "); ok {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				t.Fatalf("%s: %v", line, err)
+			}
+			return n
+		}
+	}
+	return -1
+}
+
+func TestRootMetrics(t *testing.T) {
+	a := testRoot(t)
+	b, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	editConfig(t, func(c *Config) {
+		c.AllowedPaths = append(c.AllowedPaths, AllowedPath{Path: b, Mode: modeReadWrite})
+	})
+	saved := pathMetrics
+	pathMetrics = &rootMetrics{roots: make(map[string]*rootCounters)}
+	t.Cleanup(func() { pathMetrics = saved })
+
+	writeTestFile(t, filepath.Join(b, "data.txt"), "12345")
+	claims := jwt.MapClaims{"sub": "tester"}
+
+	var received int64
+	for _, op := range []Operation{
+		{Action: "write_file", Parameters: map[string]string{"path": filepath.Join(a, "a.txt"), "content": "hello"}},
+		{Action: "read_file", Parameters: map[string]string{"path": filepath.Join(a, "a.txt")}},
+	} {
+		body, err := json.Marshal(op)
+		if err != nil {
+			t.Fatal(err)
+		}
+		received += int64(len(body))
+		if rec := postOperation(t, claims, op); rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", op.Action, rec.Code, rec.Body)
+		}
+	}
+	if rec := getFile(t, http.MethodGet, filepath.Join(b, "data.txt"), ""); rec.Code != http.StatusOK {
+		t.Fatalf("download: status %d", rec.Code)
+	}
+	outside := filepath.Join(filepath.Dir(a), "elsewhere.txt")
+	if rec := postOperation(t, claims, Operation{Action: "read_file", Parameters: map[string]string{"path": outside}}); rec.Code != http.StatusForbidden {
+		t.Fatalf("outside read: status %d", rec.Code)
+	}
+
+	rec := httptest.NewRecorder()
+	metricsHandler(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	out := rec.Body.String()
+
+	label := func(name, root string) string {
+		return fmt.Sprintf("quicssh_root_%s{root=\"%s\"}", name, root)
+	}
+	tests := []struct {
+		series string
+		want   int64
+	}{
+		{label("operations_total", a), 2},
+		{label("operation_errors_total", a), 0},
+		{label("received_bytes_total", a), received},
+		{label("operations_total", b), 1},
+		{label("sent_bytes_total", b), 5},
+		{label("operations_total", noRootLabel), 1},
+		{label("operation_errors_total", noRootLabel), 1},
+		{"quicssh_operations_total", 4},
+		{"quicssh_operation_errors_total", 1},
+	}
+	for _, tt := range tests {
+		if got := metricValue(t, out, tt.series); got != tt.want {
+			t.Errorf("%s = %d, want %d", tt.series, got, tt.want)
+		}
+	}
+	if n := strings.Count(out, "quicssh_root_operations_total{"); n != 3 {
+		t.Errorf("%d root series, want one per root seen and none per path:\n%s", n, out)
+	}
+	if got := metricValue(t, out, label("sent_bytes_total", a)); got <= 0 {
+		t.Errorf("sent bytes for %s = %d, want the responses counted", a, got)
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	testRoot(t)
+	hash := func(key string) string { return sha256Hex(key) }
+	editConfig(t, func(c *Config) {
+		c.APIKeys = []APIKey{
+			{SHA256: hash("key-one"), Subject: "alice", Roles: []string{"ops"}, Scope: "admin"},
+			{SHA256: hash("key-two"), Subject: "bob"},
+		}
+	})
+	token := testToken(t, jwt.MapClaims{"sub": "carol"})
+
+	call := func(authorization, key string) (int, jwt.MapClaims) {
+		var claims jwt.MapClaims
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		if key != "" {
+			req.Header.Set(apiKeyHeader, key)
+		}
+		rec := httptest.NewRecorder()
+		authMiddleware(func(w http.ResponseWriter, r *http.Request) { claims = claimsFrom(r) })(rec, req)
+		return rec.Code, claims
+	}
+
+	code, claims := call("", "key-one")
+	if code != http.StatusOK {
+		t.Fatalf("valid key: status %d", code)
+	}
+	if claims["sub"] != "alice" || claims["scope"] != "admin" || !reflect.DeepEqual(claims["roles"], []interface{}{"ops"}) {
+		t.Errorf("valid key: claims %v", claims)
+	}
+	if _, claims := call("", "key-two"); claims["sub"] != "bob" {
+		t.Errorf("second key: claims %v", claims)
+	}
+
+	for _, tt := range []struct{ name, authorization, key string }{
+		{"wrong key", "", "key-three"},
+		{"prefix of a key", "", "key-"},
+		{"the hash itself", "", hash("key-one")},
+		{"no credential", "", ""},
+		{"bad token with a good key", "Bearer nonsense", "key-one"},
+	} {
+		if code, _ := call(tt.authorization, tt.key); code != http.StatusUnauthorized {
+			t.Errorf("%s: status %d, want 401", tt.name, code)
+		}
+	}
+
+	// A bearer token is preferred when both are sent.
+	if code, claims := call("Bearer "+token, "key-one"); code != http.StatusOK || claims["sub"] != "carol" {
+		t.Errorf("token and key: status %d, claims %v", code, claims)
+	}
+}
+
+func TestAPIKeyComparison(t *testing.T) {
+	keys := []APIKey{
+		{SHA256: sha256Hex("key-one"), Subject: "alice"},
+		{SHA256: sha256Hex("key-two"), Subject: "bob"},
+		{SHA256: sha256Hex("key-one"), Subject: "shadowed"},
+	}
+	var compared [][]byte
+	prev := compareKeyHash
+	compareKeyHash = func(x, y []byte) int {
+		compared = append(compared, x)
+		return prev(x, y)
+	}
+	t.Cleanup(func() { compareKeyHash = prev })
+
+	for _, key := range []string{"key-one", "key-three"} {
+		compared = nil
+		claims, err := matchAPIKey(keys, key)
+		if key == "key-one" && (err != nil || claims["sub"] != "alice") {
+			t.Errorf("%s: claims %v, %v; want the first entry", key, claims, err)
+		}
+		if key == "key-three" && err != errInvalidAPIKey {
+			t.Errorf("%s: err %v, want %v", key, err, errInvalidAPIKey)
+		}
+		// Every stored hash is compared, in constant time, whether or not
+		// an earlier one matched.
+		if len(compared) != len(keys) {
+			t.Errorf("%s: %d comparisons, want %d", key, len(compared), len(keys))
+		}
+	}
+	if reflect.ValueOf(prev).Pointer() != reflect.ValueOf(subtle.ConstantTimeCompare).Pointer() {
+		t.Error("API key hashes are not compared with subtle.ConstantTimeCompare")
+	}
+
+	base := defaultConfig()
+	base.APIKeys = keys
+	if err := validateConfig(base); err != nil {
+		t.Fatalf("validateConfig rejected valid keys: %v", err)
+	}
+	for _, k := range []APIKey{
+		{SHA256: "abc", Subject: "alice"},
+		{SHA256: strings.Repeat("z", 64), Subject: "alice"},
+		{SHA256: sha256Hex("k")},
+	} {
+		c := base
+		c.APIKeys = []APIKey{k}
+		if err := validateConfig(c); err == nil {
+			t.Errorf("validateConfig accepted %+v", k)
+		}
+	}
+}
+
+func TestCopyFile(t *testing.T) {
+	root := testRoot(t)
+	src, dst := filepath.Join(root, "src.txt"), filepath.Join(root, "dst.txt")
+	writeTestFile(t, src, "new")
+	os.Chmod(src, 0640)
+
+	if err := copyFile(src, dst, true); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(dst); string(got) != "new" {
+		t.Errorf("copy holds %q", got)
+	}
+	if runtime.GOOS != "windows" {
+		if got := modeOf(t, dst); got != 0640 {
+			t.Errorf("copy has mode %o, want 640", got)
+		}
+	}
+
+	// An exclusive copy leaves a file already at dst alone.
+	writeTestFile(t, dst, "someone else's")
+	if err := copyFile(src, dst, true); errCode(err) != codeAlreadyExists {
+		t.Errorf("exclusive copy onto a file: %v, want %s", err, codeAlreadyExists)
+	}
+	if got, _ := os.ReadFile(dst); string(got) != "someone else's" {
+		t.Errorf("exclusive copy replaced the file with %q", got)
+	}
+	if err := copyFile(src, dst, false); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(dst); string(got) != "new" {
+		t.Errorf("copy onto a file left %q", got)
+	}
+}
+
+func TestMoveAcrossFilesystems(t *testing.T) {
+	// A root on tmpfs and one on disk are on different filesystems, so
+	// the move falls back to a copy.
+	shm, err := os.MkdirTemp("/dev/shm", "move")
+	if err != nil {
+		t.Skip("no /dev/shm:", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(shm) })
+	root := testRoot(t)
+	editConfig(t, func(c *Config) { c.AllowedPaths = append(c.AllowedPaths, AllowedPath{shm, modeReadWrite}) })
+	src, dst := filepath.Join(shm, "report.txt"), filepath.Join(root, "report.txt")
+	writeTestFile(t, src, "report")
+	os.Chmod(src, 0600)
+	if err := os.Link(src, filepath.Join(root, "probe.txt")); err == nil {
+		t.Skip("/dev/shm is on the same filesystem as the temporary directory")
+	}
+
+	if _, err := movePath(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(dst); string(got) != "report" {
+		t.Errorf("moved file holds %q", got)
+	}
+	if got := modeOf(t, dst); got != 0600 {
+		t.Errorf("moved file has mode %o, want 600", got)
+	}
+	if _, err := os.Lstat(src); !os.IsNotExist(err) {
+		t.Errorf("source still exists: %v", err)
+	}
+}
+
+func TestMoveAcrossRoots(t *testing.T) {
+	staging := testRoot(t)
+	enableActions(t, "move")
+	var published, readOnly string
+	for _, p := range []*string{&published, &readOnly} {
+		dir, err := filepath.EvalSymlinks(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		*p = dir
+	}
+	logPath := filepath.Join(t.TempDir(), "audit.log")
+	editConfig(t, func(c *Config) {
+		c.AllowedPaths = append(c.AllowedPaths,
+			AllowedPath{Path: published, Mode: modeReadWrite},
+			AllowedPath{Path: readOnly, Mode: modeReadOnly})
+		c.AuditLogPath = logPath
+	})
+	writeTestFile(t, filepath.Join(staging, "report.txt"), "report")
+	writeTestFile(t, filepath.Join(staging, "site", "index.txt"), "index")
+	writeTestFile(t, filepath.Join(staging, "site", "css", "main.txt"), "main")
+	writeTestFile(t, filepath.Join(published, "taken.txt"), "taken")
+
+	move := func(src, dst string) Response {
+		return decodeResponse(t, postOperation(t, jwt.MapClaims{"sub": "tester"}, Operation{
+			Action:     "move",
+			Parameters: map[string]string{"path": src, "destination": dst},
+		}))
+	}
+
+	if resp := move(filepath.Join(staging, "report.txt"), filepath.Join(published, "report.txt")); resp.Status != "success" {
+		t.Fatalf("moving a file: %s", resp.Message)
+	}
+	if resp := move(filepath.Join(staging, "site"), filepath.Join(published, "site")); resp.Status != "success" {
+		t.Fatalf("moving a directory: %s", resp.Message)
+	}
+	for rel, want := range map[string]string{
+		"report.txt":        "report",
+		"site/index.txt":    "index",
+		"site/css/main.txt": "main",
+	} {
+		got, err := os.ReadFile(filepath.Join(published, rel))
+		if err != nil || string(got) != want {
+			t.Errorf("published %s = %q, %v; want %q", rel, got, err, want)
+		}
+		if _, err := os.Lstat(filepath.Join(staging, rel)); !os.IsNotExist(err) {
+			t.Errorf("staging %s still exists: %v", rel, err)
+		}
+	}
+
+	writeTestFile(t, filepath.Join(staging, "draft.txt"), "draft")
+	writeTestFile(t, filepath.Join(readOnly, "old.txt"), "old")
+	tests := []struct {
+		name, src, dst, code string
+	}{
+		{"into a read-only root", filepath.Join(staging, "draft.txt"), filepath.Join(readOnly, "draft.txt"), codePathDenied},
+		{"out of a read-only root", filepath.Join(readOnly, "old.txt"), filepath.Join(staging, "old.txt"), codePathDenied},
+		{"onto an existing file", filepath.Join(staging, "draft.txt"), filepath.Join(published, "taken.txt"), codeAlreadyExists},
+		{"a root itself", published, filepath.Join(staging, "published"), ""},
+		{"into itself", filepath.Join(published, "site"), filepath.Join(published, "site", "css", "site"), ""},
+	}
+	for _, tt := range tests {
+		resp := move(tt.src, tt.dst)
+		if resp.Status != "error" {
+			t.Errorf("%s: moved", tt.name)
+			continue
+		}
+		if tt.code != "" && resp.Code != tt.code {
+			t.Errorf("%s: code %q (%s), want %q", tt.name, resp.Code, resp.Message, tt.code)
+		}
+	}
+	if got, err := os.ReadFile(filepath.Join(staging, "draft.txt")); err != nil || string(got) != "draft" {
+		t.Errorf("draft after refused moves = %q, %v", got, err)
+	}
+	if _, err := os.Lstat(filepath.Join(readOnly, "draft.txt")); !os.IsNotExist(err) {
+		t.Errorf("move into the read-only root left %v", err)
+	}
+
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []auditEntry
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var e auditEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("audit line %q: %v", line, err)
+		}
+		if e.Action == "move" {
+			entries = append(entries, e)
+		}
+	}
+	if len(entries) != 2+len(tests) {
+		t.Fatalf("%d move audit lines, want %d:\n%s", len(entries), 2+len(tests), data)
+	}
+	first := entries[0]
+	if first.Path != filepath.Join(staging, "report.txt") || first.Destination != filepath.Join(published, "report.txt") || first.Status != "success" {
+		t.Errorf("audit of the file move = %+v", first)
+	}
+	denied := entries[2]
+	if denied.Path != tests[0].src || denied.Destination != tests[0].dst || denied.Status != "error" || denied.Error == "" {
+		t.Errorf("audit of the move into the read-only root = %+v", denied)
+	}
+}
+
+func TestStreamThreshold(t *testing.T) {
+	root := testRoot(t)
+	editConfig(t, func(c *Config) { c.StreamThreshold = 100 })
+	large := filepath.Join(root, "large.txt")
+	small := filepath.Join(root, "small.txt")
+	writeTestFile(t, large, strings.Repeat("x", 200))
+	writeTestFile(t, small, "tiny")
+
+	rec := httptest.NewRecorder()
+	capabilitiesHandler(rec, httptest.NewRequest(http.MethodGet, "/api/capabilities", nil))
+	var caps struct {
+		Data struct {
+			StreamThreshold int64 `json:"stream_threshold"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &caps); err != nil {
+		t.Fatal(err)
+	}
+	if caps.Data.StreamThreshold != 100 {
+		t.Errorf("capabilities stream_threshold = %d, want 100", caps.Data.StreamThreshold)
+	}
+
+	read := func(path string, stream bool) *httptest.ResponseRecorder {
+		params := map[string]string{"path": path}
+		if stream {
+			params["stream"] = "true"
+		}
+		return postOperation(t, jwt.MapClaims{"sub": "tester"}, Operation{Action: "read_file", Parameters: params})
+	}
+	streamed := func(name string, rec *httptest.ResponseRecorder, content string) {
+		t.Helper()
+		if rec.Code != http.StatusOK || rec.Header().Get(readModeHeader) != "stream" {
+			t.Errorf("%s: status %d, %s %q; want a stream", name, rec.Code, readModeHeader, rec.Header().Get(readModeHeader))
+			return
+		}
+		if got := rec.Body.String(); got != content {
+			t.Errorf("%s: body %q, want the raw file", name, got)
+		}
+		if rec.Header().Get("Content-Type") != "application/octet-stream" || rec.Header().Get("X-File-Size") != strconv.Itoa(len(content)) || rec.Header().Get("ETag") == "" {
+			t.Errorf("%s: headers %v", name, rec.Header())
+		}
+	}
+	buffered := func(name string, rec *httptest.ResponseRecorder, content string) {
+		t.Helper()
+		if mode := rec.Header().Get(readModeHeader); mode != "" {
+			t.Errorf("%s: %s %q, want a buffered read", name, readModeHeader, mode)
+		}
+		resp := decodeResponse(t, rec)
+		if got, _ := resp.Data.(string); got != content {
+			t.Errorf("%s: data %v, want %q", name, resp.Data, content)
+		}
+	}
+
+	streamed("above the threshold", read(large, false), strings.Repeat("x", 200))
+	buffered("below the threshold", read(small, false), "tiny")
+	streamed("asked for", read(small, true), "tiny")
+
+	// A streamed read does not count against the read budget that a
+	// buffered one of the same size would exceed.
+	editConfig(t, func(c *Config) { c.ReadBudget = 150 })
+	streamed("over the read budget", read(large, false), strings.Repeat("x", 200))
+
+	for name, path := range map[string]string{"missing": filepath.Join(root, "missing.txt"), "directory": root} {
+		if resp := decodeResponse(t, read(path, false)); resp.Status != "error" {
+			t.Errorf("%s: %+v, want an error", name, resp)
+		}
+	}
+
+	editConfig(t, func(c *Config) { c.StreamThreshold = 0; c.ReadBudget = 0 })
+	buffered("threshold off", read(large, false), strings.Repeat("x", 200))
+}
+
+func TestWriteIfMatch(t *testing.T) {
+	root := testRoot(t)
+	path := filepath.Join(root, "config.json")
+	writeTestFile(t, path, `{"a": 1}`)
+	etag := getFile(t, http.MethodGet, path, "").Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("download reported no ETag")
+	}
+
+	write := func(content, ifMatch string, extra ...string) Response {
+		params := map[string]string{"path": path, "content": content, "if_match": ifMatch}
+		for i := 0; i+1 < len(extra); i += 2 {
+			params[extra[i]] = extra[i+1]
+		}
+		return decodeResponse(t, postOperation(t, jwt.MapClaims{"sub": "tester"}, Operation{Action: "write_file", Parameters: params}))
+	}
+	contentOf := func() string {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	if resp := write(`{"a": 22}`, etag); resp.Status != "success" {
+		t.Fatalf("write with the current ETag: %s", resp.Message)
+	}
+
+	// The write above changed the file, so the ETag read before it is
+	// stale, as it would be after a concurrent edit.
+	if resp := write(`{"a": 3}`, etag); resp.Code != codeConflict {
+		t.Errorf("write with a stale ETag: code %q (%s), want %q", resp.Code, resp.Message, codeConflict)
+	}
+	if got := contentOf(); got != `{"a": 22}` {
+		t.Errorf("content after the conflict = %q", got)
+	}
+
+	// A tag from a gzipped download names the same version.
+	current := getFile(t, http.MethodGet, path, "").Header().Get("ETag")
+	if resp := write(`{"a": 4}`, encodedETag(current)); resp.Status != "success" {
+		t.Errorf("write with the gzip form of the current ETag: %s", resp.Message)
+	}
+	if got := contentOf(); got != `{"a": 4}` {
+		t.Errorf("content = %q", got)
+	}
+
+	if resp := write("{}", `"1-1"`, "path", filepath.Join(root, "new.json")); resp.Code != codeConflict {
+		t.Errorf("if_match on a missing file: code %q, want %q", resp.Code, codeConflict)
+	}
+	if resp := write("{}", current, "exclusive", "true"); resp.Code != codeInvalidArgument {
+		t.Errorf("if_match with exclusive: code %q, want %q", resp.Code, codeInvalidArgument)
+	}
+}
+
+// sseEvent is one server-sent event: its name, "" for a plain data
+// event, and its data.
+type sseEvent struct {
+	name, data string
+}
+
+// readSSE reads the next event from a server-sent event stream.
+func readSSE(t *testing.T, r *bufio.Reader) sseEvent {
+	t.Helper()
+	var ev sseEvent
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading the stream after %+v: %v", ev, err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			return ev
+		case strings.HasPrefix(line, "event: "):
+			ev.name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			ev.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+// startFollow opens /api/follow on path with query and returns its
+// stream, which ends after at most max_seconds.
+func startFollow(t *testing.T, path, query string) *bufio.Reader {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		followHandler(w, withClaims(r, jwt.MapClaims{"sub": "tester"}))
+	}))
+	t.Cleanup(srv.Close)
+	resp, err := http.Get(srv.URL + "?path=" + url.QueryEscape(path) + "&" + query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("follow: status %d, Content-Type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	return bufio.NewReader(resp.Body)
+}
+
+func appendTestFile(t *testing.T, path, content string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFollowStreamsAppendedLines(t *testing.T) {
+	root := testRoot(t)
+	path := filepath.Join(root, "app.log")
+	writeTestFile(t, path, "before the follow\n")
+	stream := startFollow(t, path, "max_seconds=30")
+
+	want := func(name, data string) {
+		t.Helper()
+		if ev := readSSE(t, stream); ev != (sseEvent{name, data}) {
+			t.Fatalf("event %+v, want %+v", ev, sseEvent{name, data})
+		}
+	}
+
+	appendTestFile(t, path, "one\r\n")
+	want("", "one")
+	appendTestFile(t, path, "tw")
+	appendTestFile(t, path, "o\nthree\n")
+	want("", "two")
+	want("", "three")
+
+	// Rotation by rename: the old file moves aside and a new one takes
+	// its name.
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, path, "fresh\n")
+	want("rotated", "replaced")
+	want("", "fresh")
+	appendTestFile(t, path+".1", "late write to the old file\n")
+	appendTestFile(t, path, "next\n")
+	want("", "next")
+
+	// Rotation by truncation: the same file starts over.
+	if err := os.WriteFile(path, []byte("a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	want("rotated", "truncated")
+	want("", "a")
+}
+
+func TestFollowEnds(t *testing.T) {
+	root := testRoot(t)
+	path := filepath.Join(root, "app.log")
+	writeTestFile(t, path, "")
+
+	start := time.Now()
+	stream := startFollow(t, path, "max_seconds=1")
+	if ev := readSSE(t, stream); ev.name != "end" {
+		t.Errorf("event %+v, want the end of the follow", ev)
+	}
+	if d := time.Since(start); d < time.Second || d > 10*time.Second {
+		t.Errorf("follow ended after %v, want about a second", d)
+	}
+
+	editConfig(t, func(c *Config) { c.FollowMaxDuration = 5 })
+	limits := []struct {
+		query string
+		want  time.Duration
+	}{
+		{"", 5 * time.Second},
+		{"2", 2 * time.Second},
+		{"60", 5 * time.Second},
+	}
+	for _, tt := range limits {
+		_, limit, err := followTarget(jwt.MapClaims{"sub": "tester"}, map[string]string{"path": path, "max_seconds": tt.query})
+		if err != nil || limit != tt.want {
+			t.Errorf("max_seconds %q: limit %v, %v; want %v", tt.query, limit, err, tt.want)
+		}
+	}
+
+	errs := []struct {
+		name, path, maxSeconds, code string
+	}{
+		{"missing", filepath.Join(root, "missing.log"), "", codeNotFound},
+		{"outside the root", filepath.Join(filepath.Dir(root), "app.log"), "", codePathDenied},
+		{"bad max_seconds", path, "soon", codeInvalidArgument},
+		{"zero max_seconds", path, "0", codeInvalidArgument},
+	}
+	for _, tt := range errs {
+		req := httptest.NewRequest(http.MethodGet, "/api/follow?path="+url.QueryEscape(tt.path)+"&max_seconds="+tt.maxSeconds, nil)
+		rec := httptest.NewRecorder()
+		followHandler(rec, withClaims(req, jwt.MapClaims{"sub": "tester"}))
+		if resp := decodeResponse(t, rec); resp.Code != tt.code {
+			t.Errorf("%s: code %q (%s), want %q", tt.name, resp.Code, resp.Message, tt.code)
+		}
+	}
+}
+
+func TestCanWrite(t *testing.T) {
+	root := testRoot(t)
+	ro, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	editConfig(t, func(c *Config) {
+		c.AllowedPaths = append(c.AllowedPaths, AllowedPath{Path: ro, Mode: modeReadOnly})
+		c.MaxFileSize = 100
+	})
+	if err := os.Mkdir(filepath.Join(root, "dir.txt"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	tester := jwt.MapClaims{"sub": "tester"}
+
+	tests := []struct {
+		name, path, size, reason string
+	}{
+		{"new file", filepath.Join(root, "a.txt"), "", ""},
+		{"within the size limit", filepath.Join(root, "a.txt"), "100", ""},
+		{"too large", filepath.Join(root, "a.txt"), "101", codeTooLarge},
+		{"type not allowed", filepath.Join(root, "tool.exe"), "", codeTypeDenied},
+		{"read-only root", filepath.Join(ro, "a.txt"), "", codePathDenied},
+		{"outside the roots", filepath.Join(filepath.Dir(root), "a.txt"), "", codePathDenied},
+		{"missing parent", filepath.Join(root, "missing", "a.txt"), "", codeNotFound},
+		{"directory", filepath.Join(root, "dir.txt"), "", codeIsDirectory},
+		{"invalid name", filepath.Join(root, "a\x01.txt"), "", codeInvalidName},
+	}
+	for _, tt := range tests {
+		check, err := canWrite(tester, tt.path, tt.size)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if check.Writable != (tt.reason == "") || check.Reason != tt.reason {
+			t.Errorf("%s: %+v, want reason %q", tt.name, check, tt.reason)
+		}
+		if !check.Writable && check.Message == "" {
+			t.Errorf("%s: no message", tt.name)
+		}
+	}
+
+	// Checking never creates anything.
+	if _, err := os.Lstat(filepath.Join(root, "a.txt")); !os.IsNotExist(err) {
+		t.Errorf("can_write created the file: %v", err)
+	}
+
+	for _, size := range []string{"-1", "lots"} {
+		if _, err := canWrite(tester, filepath.Join(root, "a.txt"), size); errCode(err) != codeInvalidArgument {
+			t.Errorf("size %q: %v, want %s", size, err, codeInvalidArgument)
+		}
+	}
+
+	// Through the operation, a blocked write is a successful answer.
+	rec := postOperation(t, tester, Operation{Action: "can_write", Parameters: map[string]string{"path": filepath.Join(ro, "a.txt")}})
+	if resp := decodeResponse(t, rec); rec.Code != http.StatusOK || resp.Status != "success" {
+		t.Errorf("can_write operation: status %d, %+v", rec.Code, resp)
+	}
+
+	path := filepath.Join(root, "a.txt")
+	reason := func() string {
+		t.Helper()
+		check, err := canWrite(jwt.MapClaims{"sub": "v", "role": "viewer"}, path, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return check.Reason
+	}
+	editConfig(t, func(c *Config) {
+		c.Permissions = map[string]map[string][]string{"viewer": {"read_file": {root + "/**"}}}
+	})
+	if got := reason(); got != codePathDenied {
+		t.Errorf("role without write_file: reason %q, want %q", got, codePathDenied)
+	}
+	editConfig(t, func(c *Config) {
+		c.Permissions = map[string]map[string][]string{"viewer": {"write_file": {root + "/**"}}}
+	})
+	if got := reason(); got != "" {
+		t.Errorf("role with write_file: reason %q", got)
+	}
+
+	editConfig(t, func(c *Config) {
+		c.AllowedActions = maps.Clone(c.AllowedActions)
+		delete(c.AllowedActions, "write_file")
+	})
+	if got := reason(); got != codeNotAllowed {
+		t.Errorf("write_file disabled: reason %q, want %q", got, codeNotAllowed)
+	}
+
+	setMaintenance(true)
+	t.Cleanup(func() { setMaintenance(false) })
+	if got := reason(); got != codeMaintenance {
+		t.Errorf("maintenance: reason %q, want %q", got, codeMaintenance)
+	}
+}
+
+func TestDeniedPatterns(t *testing.T) {
+	root := testRoot(t)
+	editConfig(t, func(c *Config) {
+		c.DeniedPatterns = []string{"**/.git/**", "**/secrets/*", "*.pem", `re:\.bak\.txt$`}
+	})
+	visible := []string{"a.txt", "sub/b.txt", "sub/secrets.txt"}
+	hidden := []string{".git/config", ".git/objects/ab.txt", "secrets/token.txt", "secrets/nested/x.txt", "sub/secrets/key.txt", "id.pem", "sub/deep/id.pem", "notes.bak.txt"}
+	for _, name := range append(slices.Clone(visible), hidden...) {
+		writeTestFile(t, filepath.Join(root, filepath.FromSlash(name)), "secret value\n")
+	}
+
+	names, err := listFiles(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{filepath.Join(root, "a.txt"), filepath.Join(root, "secrets"), filepath.Join(root, "sub")}
+	if !slices.Equal(names, want) {
+		t.Errorf("list_files %v, want %v", names, want)
+	}
+	// "secrets/*" hides what is in the directory, not the directory.
+	if names, err := listFiles(filepath.Join(root, "secrets")); err != nil || len(names) != 0 {
+		t.Errorf("list_files of secrets = %v, %v; want it empty", names, err)
+	}
+
+	m, err := manifest(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := slices.Sorted(maps.Keys(m))
+	if !slices.Equal(got, visible) {
+		t.Errorf("manifest %v, want %v", got, visible)
+	}
+
+	page, err := walkDir(root, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err := searchAll(root, "secret", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for what, result := range map[string]interface{}{"walk_dir": page, "search": found} {
+		out, _ := json.Marshal(result)
+		for _, name := range hidden {
+			if strings.Contains(string(out), filepath.Base(name)) {
+				t.Errorf("%s shows %s: %s", what, name, out)
+			}
+		}
+	}
+
+	// A change to a denied file does not change the listing's ETag.
+	before, err := dirETag(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(root, "id.pem"), "rotated key, longer than before\n")
+	if after, err := dirETag(root); err != nil || after != before {
+		t.Errorf("dir_etag changed with a denied file: %q, %v; was %q", after, err, before)
+	}
+
+	tester := jwt.MapClaims{"sub": "tester"}
+	for _, name := range append(hidden, "secrets/missing.txt", ".git") {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		rec := postOperation(t, tester, Operation{Action: "read_file", Parameters: map[string]string{"path": path}})
+		if resp := decodeResponse(t, rec); resp.Code != codePathDenied {
+			t.Errorf("read_file %s: code %q (%s), want %q", name, resp.Code, resp.Message, codePathDenied)
+		}
+	}
+	if rec := getFile(t, http.MethodGet, filepath.Join(root, "secrets", "token.txt"), ""); rec.Code != http.StatusForbidden {
+		t.Errorf("download of a denied file: status %d", rec.Code)
+	}
+	newPath := filepath.Join(root, "secrets", "new.txt")
+	rec := postOperation(t, tester, Operation{Action: "write_file", Parameters: map[string]string{"path": newPath, "content": "x"}})
+	if resp := decodeResponse(t, rec); resp.Code != codePathDenied {
+		t.Errorf("write_file into a denied directory: code %q, want %q", resp.Code, codePathDenied)
+	}
+	if _, err := os.Lstat(newPath); !os.IsNotExist(err) {
+		t.Errorf("denied write created the file: %v", err)
+	}
+	for _, name := range visible {
+		if _, err := readFile(filepath.Join(root, filepath.FromSlash(name))); err != nil {
+			t.Errorf("read_file %s: %v", name, err)
+		}
+	}
+
+	for _, pattern := range []string{"", "/", "re:(", "a/[b"} {
+		c := *currentConfig()
+		c.DeniedPatterns = []string{pattern}
+		if err := validateConfig(c); err == nil {
+			t.Errorf("validateConfig accepted denied pattern %q", pattern)
+		}
+	}
+}
+
+func TestPprofRequiresAdmin(t *testing.T) {
+	testRoot(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc(pprofPrefix, adminMiddleware(pprofHandler))
+	admin := testToken(t, jwt.MapClaims{"sub": "ops", "scope": "admin"})
+	user := testToken(t, jwt.MapClaims{"sub": "user", "scope": "read"})
+
+	get := func(token, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, pprofPrefix+path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	routes := []struct {
+		path  string
+		check func(body []byte) bool
+	}{
+		{"", func(b []byte) bool {
+			return bytes.Contains(b, []byte("heap")) && bytes.Contains(b, []byte("goroutine"))
+		}},
+		{"heap", func(b []byte) bool { return len(b) > 2 && b[0] == 0x1f && b[1] == 0x8b }},
+		{"goroutine?debug=1", func(b []byte) bool { return bytes.HasPrefix(b, []byte("goroutine profile:")) }},
+		{"cmdline", func(b []byte) bool { return bytes.HasPrefix(b, []byte(os.Args[0])) }},
+	}
+	for _, route := range routes {
+		if rec := get("", route.path); rec.Code != http.StatusUnauthorized {
+			t.Errorf("%q without a token: status %d, want %d", route.path, rec.Code, http.StatusUnauthorized)
+		}
+		if rec := get(user, route.path); rec.Code != http.StatusForbidden {
+			t.Errorf("%q without the admin scope: status %d, want %d", route.path, rec.Code, http.StatusForbidden)
+		}
+		rec := get(admin, route.path)
+		if rec.Code != http.StatusOK {
+			t.Errorf("%q as admin: status %d", route.path, rec.Code)
+			continue
+		}
+		if !route.check(rec.Body.Bytes()) {
+			t.Errorf("%q as admin: unexpected profile data %.80q", route.path, rec.Body.String())
+		}
+	}
+	if rec := get(admin, "nonsense"); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown profile: status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestExclusiveCreate(t *testing.T) {
+	root := testRoot(t)
+	tester := jwt.MapClaims{"sub": "tester"}
+	op := func(action string, params ...string) *httptest.ResponseRecorder {
+		o := Operation{Action: action, Parameters: map[string]string{"exclusive": "true"}}
+		for i := 0; i+1 < len(params); i += 2 {
+			o.Parameters[params[i]] = params[i+1]
+		}
+		return postOperation(t, tester, o)
+	}
+
+	for _, durable := range []string{"false", "true"} {
+		path := filepath.Join(root, "durable-"+durable+".txt")
+		if rec := op("write_file", "path", path, "content", "first", "durable", durable); rec.Code != http.StatusOK {
+			t.Fatalf("durable %s: first write: status %d: %s", durable, rec.Code, rec.Body)
+		}
+		rec := op("write_file", "path", path, "content", "second", "durable", durable)
+		if resp := decodeResponse(t, rec); rec.Code != http.StatusConflict || resp.Code != codeAlreadyExists {
+			t.Errorf("durable %s: second write: status %d, code %q", durable, rec.Code, resp.Code)
+		}
+		if data, err := os.ReadFile(path); err != nil || string(data) != "first" {
+			t.Errorf("durable %s: content %q, %v; want the first write kept", durable, data, err)
+		}
+	}
+
+	dir := filepath.Join(root, "a", "b")
+	if rec := op("create_folder", "path", dir); rec.Code != http.StatusOK {
+		t.Fatalf("first create_folder: status %d: %s", rec.Code, rec.Body)
+	}
+	rec := op("create_folder", "path", dir)
+	if resp := decodeResponse(t, rec); rec.Code != http.StatusConflict || resp.Code != codeAlreadyExists {
+		t.Errorf("second create_folder: status %d, code %q", rec.Code, resp.Code)
+	}
+	// Without the flag, both are idempotent as before.
+	if _, err := createFolder(dir, false); err != nil {
+		t.Errorf("plain create_folder of an existing directory: %v", err)
+	}
+
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Errorf("root holds %d entries, want the two files and a directory without temporary files", len(entries))
+	}
+
+	// Of many racing exclusive writes to one name, exactly one wins.
+	path := filepath.Join(root, "race.txt")
+	var wg sync.WaitGroup
+	codes := make([]string, 20)
+	for i := range codes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := writeFile(path, strconv.Itoa(i), "", "", "", "", i%2 == 0, true)
+			codes[i] = errCode(err)
+		}()
+	}
+	wg.Wait()
+	winners := 0
+	for i, code := range codes {
+		switch code {
+		case "":
+			winners++
+			if data, _ := os.ReadFile(path); string(data) != strconv.Itoa(i) {
+				t.Errorf("winner %d, but the file holds %q", i, data)
+			}
+		case codeAlreadyExists:
+		default:
+			t.Errorf("writer %d: code %q", i, code)
+		}
+	}
+	if winners != 1 {
+		t.Errorf("%d writers won, want 1", winners)
+	}
+}
+
+func TestIdempotencyKeys(t *testing.T) {
+	root := testRoot(t)
+	saved := idempotency
+	idempotency = &idempotencyStore{entries: make(map[string]*idempotencyEntry)}
+	t.Cleanup(func() { idempotency = saved })
+
+	send := func(sub, key string, op Operation) *httptest.ResponseRecorder {
+		t.Helper()
+		body, err := json.Marshal(op)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := withClaims(httptest.NewRequest(http.MethodPost, "/api/operation", bytes.NewReader(body)), jwt.MapClaims{"sub": sub})
+		req.Header.Set(idempotencyHeader, key)
+		rec := httptest.NewRecorder()
+		operationHandler(rec, req)
+		return rec
+	}
+	create := func(path string) Operation {
+		return Operation{Action: "create_folder", Parameters: map[string]string{"path": path, "exclusive": "true"}}
+	}
+	dir := filepath.Join(root, "new")
+
+	first := send("alice", "k1", create(dir))
+	if first.Code != http.StatusOK || first.Header().Get("Idempotent-Replayed") != "" {
+		t.Fatalf("first request: status %d, replayed %q", first.Code, first.Header().Get("Idempotent-Replayed"))
+	}
+	// The retry is answered with the first outcome instead of running
+	// again and failing as already_exists.
+	retry := send("alice", "k1", create(dir))
+	if retry.Code != http.StatusOK || retry.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("retry: status %d, replayed %q: %s", retry.Code, retry.Header().Get("Idempotent-Replayed"), retry.Body)
+	}
+	if resp := decodeResponse(t, send("alice", "k2", create(dir))); resp.Code != codeAlreadyExists {
+		t.Errorf("new key: code %q, want %q", resp.Code, codeAlreadyExists)
+	}
+	// Keys are scoped to the subject.
+	if resp := decodeResponse(t, send("bob", "k1", create(dir))); resp.Code != codeAlreadyExists {
+		t.Errorf("another subject's key: code %q, want %q", resp.Code, codeAlreadyExists)
+	}
+	if resp := decodeResponse(t, send("alice", "k1", create(filepath.Join(root, "other")))); resp.Code != codeConflict {
+		t.Errorf("key reused for another request: code %q, want %q", resp.Code, codeConflict)
+	}
+	if resp := decodeResponse(t, send("alice", strings.Repeat("k", maxIdempotencyKeyLen+1), create(dir))); resp.Code != codeInvalidArgument {
+		t.Errorf("overlong key: code %q, want %q", resp.Code, codeInvalidArgument)
+	}
+
+	// A failed run is forgotten, so its retry runs again.
+	path := filepath.Join(root, "sub", "a.txt")
+	write := Operation{Action: "write_file", Parameters: map[string]string{"path": path, "content": "x"}}
+	if rec := send("alice", "k3", write); rec.Code == http.StatusOK {
+		t.Fatal("write into a missing directory succeeded")
+	}
+	if err := os.Mkdir(filepath.Join(root, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if rec := send("alice", "k3", write); rec.Code != http.StatusOK || rec.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("retry after a failure: status %d, replayed %q", rec.Code, rec.Header().Get("Idempotent-Replayed"))
+	}
+
+	// Reads are not deduplicated.
+	read := Operation{Action: "read_file", Parameters: map[string]string{"path": path}}
+	send("alice", "k4", read)
+	if rec := send("alice", "k4", read); rec.Header().Get("Idempotent-Replayed") != "" {
+		t.Error("a read was replayed")
+	}
+}
+
+func TestIdempotencyStore(t *testing.T) {
+	s := &idempotencyStore{entries: make(map[string]*idempotencyEntry)}
+	now := time.Now()
+
+	var runs atomic.Int32
+	release := make(chan struct{})
+	fn := func() (interface{}, error) {
+		runs.Add(1)
+		<-release
+		return "done", nil
+	}
+	var wg sync.WaitGroup
+	results := make([]interface{}, 10)
+	replays := make([]bool, 10)
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], replays[i], _ = s.Do("k", "fp", now, fn)
+		}()
+	}
+	for runs.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	if runs.Load() != 1 {
+		t.Errorf("fn ran %d times, want once", runs.Load())
+	}
+	fresh := 0
+	for i := range results {
+		if results[i] != "done" {
+			t.Errorf("caller %d got %v", i, results[i])
+		}
+		if !replays[i] {
+			fresh++
+		}
+	}
+	if fresh != 1 {
+		t.Errorf("%d callers were not replayed, want 1", fresh)
+	}
+
+	// Once the outcome expires, the key runs again.
+	if _, replayed, _ := s.Do("k", "fp", now.Add(idempotencyTTL), func() (interface{}, error) { return "again", nil }); replayed {
+		t.Error("an expired outcome was replayed")
+	}
+}
+
+// activeFor returns the operations activeHandler lists for clientID.
+func activeFor(t *testing.T, clientID string) []activeOp {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	activeHandler(rec, httptest.NewRequest(http.MethodGet, "/api/admin/active", nil))
+	var resp struct {
+		Data []struct {
+			activeOp
+			ElapsedSeconds float64 `json:"elapsed_seconds"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	var ops []activeOp
+	for _, e := range resp.Data {
+		if e.ClientID == clientID {
+			if e.ElapsedSeconds < 0 {
+				t.Errorf("%+v has negative elapsed time", e)
+			}
+			ops = append(ops, e.activeOp)
+		}
+	}
+	return ops
+}
+
+func TestActiveOperations(t *testing.T) {
+	root := testRoot(t)
+	path := filepath.Join(root, "slow.txt")
+	writeTestFile(t, path, "content")
+
+	// The read blocks behind a shared read that is held open.
+	release := holdSharedRead(t, "read", path, "content")
+	defer release()
+	finished := make(chan int)
+	go func() {
+		body, _ := json.Marshal(Operation{Action: "read_file", Parameters: map[string]string{"path": path}})
+		req := withClaims(httptest.NewRequest(http.MethodPost, "/api/operation", bytes.NewReader(body)), jwt.MapClaims{"sub": "tester"})
+		req.Header.Set("X-Client-ID", "active-test")
+		rec := httptest.NewRecorder()
+		operationHandler(rec, req)
+		finished <- rec.Code
+	}()
+
+	var ops []activeOp
+	for deadline := time.Now().Add(5 * time.Second); len(ops) == 0 && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+		ops = activeFor(t, "active-test")
+	}
+	if len(ops) != 1 || ops[0].Action != "read_file" || ops[0].Path != path || ops[0].ID == 0 || ops[0].Started.IsZero() {
+		t.Fatalf("active operations %+v, want the read", ops)
+	}
+
+	release()
+	if code := <-finished; code != http.StatusOK {
+		t.Errorf("read: status %d", code)
+	}
+	if ops := activeFor(t, "active-test"); len(ops) != 0 {
+		t.Errorf("finished operation still listed: %+v", ops)
+	}
+}
+
+func TestActiveOperationsConcurrent(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			end := inflight.Begin("list_files", "/data", "concurrent-test")
+			inflight.List()
+			end()
+			end()
+		}()
+	}
+	wg.Wait()
+	for _, op := range inflight.List() {
+		if op.ClientID == "concurrent-test" {
+			t.Errorf("ended operation still listed: %+v", op)
+		}
+	}
+}
+
+// walkAll pages through walk_dir of root limit entries at a time and
+// returns every path it was given, in order, and the number of pages.
+func walkAll(t *testing.T, root, limit string) ([]string, int) {
+	t.Helper()
+	var paths []string
+	cursor := ""
+	for pages := 1; ; pages++ {
+		page, err := walkDir(root, limit, cursor)
+		if err != nil {
+			t.Fatalf("limit %s, cursor %q: %v", limit, cursor, err)
+		}
+		for _, e := range page.Entries {
+			paths = append(paths, e.Path)
+		}
+		if page.Next == "" {
+			return paths, pages
+		}
+		if len(page.Entries) == 0 {
+			t.Fatalf("limit %s: empty page with a cursor", limit)
+		}
+		cursor = page.Next
+	}
+}
+
+func TestWalkDirPaging(t *testing.T) {
+	root := testRoot(t)
+	for _, name := range []string{
+		"a/b/c/d/e/deep.txt", "a/b/c/side.txt", "a/b/z.txt", "a/one.txt",
+		"a-b/x.txt", "a.txt", "b/empty/.keep", "b/y.txt", "c.txt",
+	} {
+		writeTestFile(t, filepath.Join(root, filepath.FromSlash(name)), "xx")
+	}
+	if err := os.Mkdir(filepath.Join(root, "b", "hollow"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// A link back up is listed but not followed.
+	mustSymlink(t, root, filepath.Join(root, "a", "b", "loop"))
+
+	var want []string
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == root {
+			return err
+		}
+		rel, _ := filepath.Rel(root, p)
+		want = append(want, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, limit := range []string{"1", "2", "3", "7", "1000"} {
+		got, pages := walkAll(t, root, limit)
+		if !slices.Equal(got, want) {
+			t.Errorf("limit %s: walked\n%v\nwant\n%v", limit, got, want)
+		}
+		n, _ := strconv.Atoi(limit)
+		if wantPages := (len(want) + n - 1) / n; pages != wantPages {
+			t.Errorf("limit %s: %d pages for %d entries", limit, pages, len(want))
+		}
+	}
+
+	page, err := walkDir(root, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range page.Entries {
+		switch e.Path {
+		case "a/b/loop":
+			if e.IsDir {
+				t.Error("the symlink was walked as a directory")
+			}
+		case "a/b/c":
+			if !e.IsDir {
+				t.Error("a/b/c is not marked as a directory")
+			}
+		case "a.txt":
+			if e.Size != 2 {
+				t.Errorf("a.txt size %d", e.Size)
+			}
+		}
+	}
+
+	// The page size is capped by max_walk_entries.
+	editConfig(t, func(c *Config) { c.MaxWalkEntries = 4 })
+	if page, err := walkDir(root, "100", ""); err != nil || len(page.Entries) != 4 || page.Next == "" {
+		t.Errorf("capped page: %d entries, next %q, %v", len(page.Entries), page.Next, err)
+	}
+
+	// Removing the entry a cursor names does not break the resume.
+	first, err := walkDir(root, "2", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(filepath.Join(root, "a", "b")); err != nil {
+		t.Fatal(err)
+	}
+	rest, err := walkDir(root, "", first.Next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rest.Entries) == 0 || rest.Entries[0].Path != "a/one.txt" {
+		t.Errorf("resume after removing a/b starts at %+v, want a/one.txt", rest.Entries)
+	}
+
+	for _, tt := range []struct{ limit, cursor string }{
+		{"0", ""},
+		{"ten", ""},
+		{"", "not base64!"},
+		{"", encodeWalkCursor("../outside")},
+		{"", encodeWalkCursor("a//b")},
+		{"", encodeWalkCursor("/a")},
+	} {
+		if _, err := walkDir(root, tt.limit, tt.cursor); errCode(err) != codeInvalidArgument {
+			t.Errorf("limit %q, cursor %q: %v, want %s", tt.limit, tt.cursor, err, codeInvalidArgument)
+		}
+	}
+	if _, err := walkDir(filepath.Join(root, "c.txt"), "", ""); errCode(err) != codeInvalidArgument {
+		t.Errorf("walk of a file: %v", err)
+	}
+}
+
+func TestSchedulerAdmitsByPriority(t *testing.T) {
+	s := &opScheduler{}
+	ctx := context.Background()
+	hold, err := s.Acquire(ctx, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+	for i, priority := range []int{-1, 0, 1, -1, 1} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := s.Acquire(ctx, 1, priority)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			order = append(order, priority)
+			mu.Unlock()
+			release()
+		}()
+		// Queue them one at a time, so equal priorities keep their order.
+		for s.Queued() != i+1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	hold()
+	wg.Wait()
+	if want := []int{1, 1, 0, -1, -1}; !slices.Equal(order, want) {
+		t.Errorf("admitted in order %v, want %v", order, want)
+	}
+	if s.running != 0 || s.Queued() != 0 {
+		t.Errorf("running %d, queued %d after all finished", s.running, s.Queued())
+	}
+}
+
+func TestSchedulerAging(t *testing.T) {
+	// A waiter of priority 0 that has waited three seconds goes ahead of
+	// a new one of priority 1, which is only brought forward by two.
+	now := time.Now()
+	var q opQueue
+	fresh := &opWaiter{due: now.Add(-1 * priorityAging), seq: 2}
+	old := &opWaiter{due: now.Add(-3 * time.Second), seq: 1}
+	heap.Push(&q, fresh)
+	heap.Push(&q, old)
+	if first := heap.Pop(&q).(*opWaiter); first != old {
+		t.Error("a fresh priority 1 waiter went ahead of a priority 0 one queued 3s earlier")
+	}
+
+	testRoot(t)
+	editConfig(t, func(c *Config) { c.ActionPriorities = map[string]int{"tar_stream": -1, "list_files": 1} })
+	tests := []struct {
+		claims jwt.MapClaims
+		action string
+		want   int
+	}{
+		{jwt.MapClaims{}, "tar_stream", -1},
+		{jwt.MapClaims{}, "list_files", 1},
+		{jwt.MapClaims{}, "read_file", 0},
+		{jwt.MapClaims{"priority": 3.0}, "tar_stream", 3},
+		{jwt.MapClaims{"priority": 1e18}, "read_file", maxPriority},
+		{jwt.MapClaims{"priority": -1e18}, "read_file", -maxPriority},
+		{jwt.MapClaims{"priority": "high"}, "list_files", 1},
+	}
+	for _, tt := range tests {
+		if got := opPriority(tt.claims, tt.action); got != tt.want {
+			t.Errorf("opPriority(%v, %s) = %d, want %d", tt.claims, tt.action, got, tt.want)
+		}
+	}
+
+	c := *currentConfig()
+	c.ActionPriorities = map[string]int{"read_file": maxPriority + 1}
+	if err := validateConfig(c); err == nil {
+		t.Error("validateConfig accepted a priority above maxPriority")
+	}
+}
+
+func TestSchedulerCancelledWaiter(t *testing.T) {
+	s := &opScheduler{}
+	hold, err := s.Acquire(context.Background(), 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error)
+	go func() {
+		_, err := s.Acquire(ctx, 1, 0)
+		errs <- err
+	}()
+	for s.Queued() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-errs; err != context.Canceled {
+		t.Errorf("cancelled waiter: %v", err)
+	}
+	if s.Queued() != 0 {
+		t.Errorf("cancelled waiter still queued")
+	}
+	hold()
+	if s.running != 0 {
+		t.Errorf("running %d after release", s.running)
+	}
+	// Without a limit nothing waits.
+	release, err := s.Acquire(ctx, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+}
+
+func TestSearchWaitsForASlot(t *testing.T) {
+	root := searchTree(t)
+	editConfig(t, func(c *Config) { c.MaxConcurrentOps = 1 })
+	hold, err := opSlots.Acquire(context.Background(), 1, maxPriority)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hold()
+
+	done := make(chan int)
+	go func() { done <- getSearch(t, root, "TODO", "").Code }()
+	for opSlots.Queued() != 1 {
+		select {
+		case code := <-done:
+			t.Fatalf("search ran while every slot was taken: status %d", code)
+		case <-time.After(time.Millisecond):
+		}
+	}
+	hold()
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("search after the slot freed up: status %d", code)
+	}
+}
+
+func TestFindDuplicates(t *testing.T) {
+	root := testRoot(t)
+	files := map[string]string{
+		"a/pair.txt":      "pair content",
+		"b/pair-copy.txt": "pair content",
+		"t1.txt":          "triple content, the longest",
+		"x/t2.txt":        "triple content, the longest",
+		"x/y/t3.txt":      "triple content, the longest",
+		"same-size.txt":   "pair contenT",
+		"unique.txt":      "unique",
+		"tool.exe":        "unique",
+		"empty1.txt":      "",
+	}
+	for name, content := range files {
+		writeTestFile(t, filepath.Join(root, filepath.FromSlash(name)), content)
+	}
+	// A link to a duplicate is not a file of its own.
+	mustSymlink(t, filepath.Join(root, "t1.txt"), filepath.Join(root, "link.txt"))
+
+	report, err := findDuplicates(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []duplicateGroup{
+		{SHA256: sha256Hex("triple content, the longest"), Size: 27, Paths: []string{"t1.txt", "x/t2.txt", "x/y/t3.txt"}},
+		{SHA256: sha256Hex("pair content"), Size: 12, Paths: []string{"a/pair.txt", "b/pair-copy.txt"}},
+	}
+	if !reflect.DeepEqual(report.Groups, want) {
+		t.Errorf("groups %+v, want %+v", report.Groups, want)
+	}
+	if report.Truncated || report.Scanned != 8 {
+		t.Errorf("scanned %d, truncated %v; want 8 files of an allowed type", report.Scanned, report.Truncated)
+	}
+
+	// Past the cap, only the files scanned so far, in lexical order, are
+	// compared: the pair and empty1.txt, but not the triple.
+	editConfig(t, func(c *Config) { c.MaxDuplicateScan = 3 })
+	report, err = findDuplicates(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Truncated || report.Scanned != 3 || !reflect.DeepEqual(report.Groups, want[1:]) {
+		t.Errorf("capped scan: %+v", report)
+	}
+
+	for _, path := range []string{filepath.Join(root, "unique.txt"), filepath.Dir(root)} {
+		if _, err := findDuplicates(path); err == nil {
+			t.Errorf("find_duplicates %s succeeded", path)
+		}
+	}
+}
+
+func TestLineCount(t *testing.T) {
+	root := testRoot(t)
+	long := strings.Repeat("0123456789\n", 100000) + "tail"
+	tests := []struct {
+		content string
+		lines   int64
+	}{
+		{"", 0},
+		{"a\nb\n", 2},
+		{"a\nb", 2},
+		{"x", 1},
+		{"\n\n", 2},
+		{"a\r\nb\r\n", 2},
+		{long, 100001},
+	}
+	for i, tt := range tests {
+		path := filepath.Join(root, fmt.Sprintf("f%d.txt", i))
+		writeTestFile(t, path, tt.content)
+		got, err := countLines(path)
+		if err != nil {
+			t.Errorf("%.20q: %v", tt.content, err)
+			continue
+		}
+		if got.Lines != tt.lines || got.Size != int64(len(tt.content)) {
+			t.Errorf("%.20q: %+v, want %d lines of %d bytes", tt.content, got, tt.lines, len(tt.content))
+		}
+	}
+
+	// read_lines sees the same number of lines.
+	lines, err := readLines(filepath.Join(root, "f2.txt"), "1", "10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines.Lines) != 2 {
+		t.Errorf("read_lines returned %d lines of a file line_count counts 2 in", len(lines.Lines))
+	}
+
+	writeTestFile(t, filepath.Join(root, "tool.exe"), "x\n")
+	if err := os.Mkdir(filepath.Join(root, "dir.txt"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	editConfig(t, func(c *Config) { c.MaxFileSize = int64(len(long)) - 1 })
+	for name, tt := range map[string]struct{ path, code string }{
+		"too large": {filepath.Join(root, "f6.txt"), codeTooLarge},
+		"type":      {filepath.Join(root, "tool.exe"), codeTypeDenied},
+		"directory": {filepath.Join(root, "dir.txt"), codeIsDirectory},
+		"missing":   {filepath.Join(root, "missing.txt"), codeNotFound},
+		"outside":   {filepath.Join(filepath.Dir(root), "a.txt"), codePathDenied},
+	} {
+		if _, err := countLines(tt.path); errCode(err) != tt.code {
+			t.Errorf("%s: %v, want %s", name, err, tt.code)
+		}
+	}
+}
+
+func TestClientOpsAcquire(t *testing.T) {
+	c := &clientOps{counts: make(map[string]int)}
+	releaseA, err := c.Acquire("sub:u", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	releaseB, err := c.Acquire("sub:u", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Acquire("sub:u", 2)
+	if errCode(err) != codeTooManyOps || asOpError(err).Details["limit"] != "2" {
+		t.Fatalf("third operation: %v, want %s with limit 2", err, codeTooManyOps)
+	}
+
+	// Other clients, and operations nobody can be told apart by, proceed.
+	releaseV, err := c.Acquire("sub:v", 2)
+	if err != nil {
+		t.Fatalf("another client was refused: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := c.Acquire("", 2); err != nil {
+			t.Fatalf("uncounted operation refused: %v", err)
+		}
+		if _, err := c.Acquire("sub:w", 0); err != nil {
+			t.Fatalf("operation without a cap refused: %v", err)
+		}
+	}
+
+	// Releasing twice gives back one slot only.
+	releaseA()
+	releaseA()
+	releaseC, err := c.Acquire("sub:u", 2)
+	if err != nil {
+		t.Fatalf("after a release: %v", err)
+	}
+	if _, err := c.Acquire("sub:u", 2); errCode(err) != codeTooManyOps {
+		t.Fatalf("double release freed two slots: %v", err)
+	}
+	releaseB()
+	releaseC()
+	releaseV()
+	if len(c.counts) != 0 {
+		t.Errorf("counts left behind: %v", c.counts)
+	}
+}
+
+func TestClientOpsKey(t *testing.T) {
+	tests := []struct {
+		claims             jwt.MapClaims
+		credential, client string
+		want               string
+	}{
+		{jwt.MapClaims{"sub": "u"}, "abc", "cli", "sub:u"},
+		{jwt.MapClaims{}, "abc", "cli", "credential:abc"},
+		{jwt.MapClaims{"sub": ""}, "", "cli", "client:cli"},
+		{nil, "", "", ""},
+	}
+	for _, tt := range tests {
+		if got := clientOpsKey(tt.claims, tt.credential, tt.client); got != tt.want {
+			t.Errorf("clientOpsKey(%v, %q, %q) = %q, want %q", tt.claims, tt.credential, tt.client, got, tt.want)
+		}
+	}
+
+	// Two tokens without a subject are told apart by their hashes.
+	bg := context.Background()
+	a := credentialFrom(withCredential(bg, jwt.MapClaims{}, "Bearer one", ""))
+	b := credentialFrom(withCredential(bg, jwt.MapClaims{}, "Bearer two", ""))
+	k := credentialFrom(withCredential(bg, jwt.MapClaims{}, "", "one"))
+	if a == "" || a == b || a != k || strings.Contains(a, "one") {
+		t.Errorf("credential hashes %q, %q, %q", a, b, k)
+	}
+}
+
+func TestClientOpLimit(t *testing.T) {
+	testRoot(t)
+	editConfig(t, func(c *Config) {
+		c.MaxOpsPerClient = 2
+		c.RoleOpLimits = map[string]int{"batch": 5, "bulk": 3, "service": 0}
+	})
+	tests := []struct {
+		claims jwt.MapClaims
+		want   int
+	}{
+		{jwt.MapClaims{"sub": "u"}, 2},
+		{jwt.MapClaims{"role": "viewer"}, 2},
+		{jwt.MapClaims{"role": "bulk"}, 3},
+		{jwt.MapClaims{"roles": []interface{}{"bulk", "batch"}}, 5},
+		{jwt.MapClaims{"roles": []interface{}{"batch", "service"}}, 0},
+	}
+	for _, tt := range tests {
+		if got := clientOpLimit(tt.claims); got != tt.want {
+			t.Errorf("clientOpLimit(%v) = %d, want %d", tt.claims, got, tt.want)
+		}
+	}
+
+	for _, edit := range []func(c *Config){
+		func(c *Config) { c.MaxOpsPerClient = -1 },
+		func(c *Config) { c.RoleOpLimits = map[string]int{"": 1} },
+		func(c *Config) { c.RoleOpLimits = map[string]int{"batch": -1} },
+	} {
+		c := defaultConfig()
+		edit(&c)
+		if err := validateConfig(c); err == nil {
+			t.Errorf("validateConfig accepted %d / %v", c.MaxOpsPerClient, c.RoleOpLimits)
+		}
+	}
+}
+
+func TestClientCappedWhileOthersProceed(t *testing.T) {
+	root := testRoot(t)
+	path := filepath.Join(root, "slow.txt")
+	writeTestFile(t, path, "content")
+	editConfig(t, func(c *Config) { c.MaxOpsPerClient = 1 })
+
+	// u's one operation blocks behind a shared read that is held open.
+	release := holdSharedRead(t, "read", path, "content")
+	defer release()
+	u := jwt.MapClaims{"sub": "u"}
+	read := Operation{Action: "read_file", Parameters: map[string]string{"path": path}}
+	finished := make(chan int)
+	go func() { finished <- postOperation(t, u, read).Code }()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		clientSlots.mu.Lock()
+		n := clientSlots.counts["sub:u"]
+		clientSlots.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("u's operation never started")
+		}
+	}
+
+	list := Operation{Action: "list_files", Parameters: map[string]string{"path": root}}
+	rec := postOperation(t, u, list)
+	resp := decodeResponse(t, rec)
+	if rec.Code != http.StatusTooManyRequests || resp.Code != codeTooManyOps || resp.Details["limit"] != "1" || rec.Header().Get("Retry-After") != "1" {
+		t.Errorf("u's second operation: %d %+v, Retry-After %q", rec.Code, resp, rec.Header().Get("Retry-After"))
+	}
+	if rec := postOperation(t, jwt.MapClaims{"sub": "v"}, list); rec.Code != http.StatusOK {
+		t.Errorf("v was held back by u: %d %s", rec.Code, rec.Body)
+	}
+
+	// The cap covers the other entry points too.
+	if rec := getSearch(t, root, "content", "10"); rec.Code != http.StatusOK {
+		t.Errorf("search for another client: %d %s", rec.Code, rec.Body)
+	}
+	hold, err := clientSlots.Acquire("sub:tester", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := getSearch(t, root, "content", "10"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("search over the cap: %d %s", rec.Code, rec.Body)
+	}
+	hold()
+
+	release()
+	if code := <-finished; code != http.StatusOK {
+		t.Errorf("u's first operation: status %d", code)
+	}
+	if rec := postOperation(t, u, list); rec.Code != http.StatusOK {
+		t.Errorf("u after its operation ended: %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestValidateParameters(t *testing.T) {
+	tests := []struct {
+		name   string
+		params map[string]string
+		bad    string
+	}{
+		{"path at the limit", map[string]string{"path": strings.Repeat("a", 4096)}, ""},
+		{"path over the limit", map[string]string{"path": strings.Repeat("a", 4097)}, "path"},
+		{"pattern at the limit", map[string]string{"pattern": strings.Repeat("a", 1024)}, ""},
+		{"pattern over the limit", map[string]string{"pattern": strings.Repeat("a", 1025)}, "pattern"},
+		{"destination", map[string]string{"destination": strings.Repeat("a", 5000)}, "destination"},
+		{"numeric", map[string]string{"limit": strings.Repeat("9", 21)}, "limit"},
+		{"unlisted content", map[string]string{"content": strings.Repeat("a", 100_000)}, ""},
+	}
+	for _, tt := range tests {
+		err := validateParameters(Operation{Action: "test", Parameters: tt.params})
+		if tt.bad == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+			continue
+		}
+		e := asOpError(err)
+		if err == nil || e.Code != codeInvalidArgument || e.Details["parameter"] != tt.bad || e.Details["limit"] != strconv.Itoa(paramLimits[tt.bad]) {
+			t.Errorf("%s: %v, want %s over its limit", tt.name, err, tt.bad)
+		}
+	}
+}
+
+func TestOversizedParametersRefused(t *testing.T) {
+	root := testRoot(t)
+	writeTestFile(t, filepath.Join(root, "a.txt"), "TODO")
+	longPath := filepath.Join(root, strings.Repeat("a", 5000))
+	longPattern := strings.Repeat("(a+)+", 300)
+	tester := jwt.MapClaims{"sub": "tester"}
+
+	// wantRefused checks that rec is a 400 naming param.
+	wantRefused := func(name string, rec *httptest.ResponseRecorder, param string) {
+		t.Helper()
+		resp := decodeResponse(t, rec)
+		if rec.Code != http.StatusBadRequest || resp.Code != codeInvalidArgument || resp.Details["parameter"] != param {
+			t.Errorf("%s: %d %+v, want 400 naming %s", name, rec.Code, resp, param)
+		}
+	}
+
+	wantRefused("list_files", postOperation(t, tester, Operation{Action: "list_files", Parameters: map[string]string{"path": longPath}}), "path")
+	wantRefused("search operation", postOperation(t, tester, Operation{Action: "search", Parameters: map[string]string{"path": root, "pattern": longPattern}}), "pattern")
+	wantRefused("/api/search", getSearch(t, root, longPattern, "10").ResponseRecorder, "pattern")
+	wantRefused("/api/search max", getSearch(t, root, "TODO", strings.Repeat("9", 40)).ResponseRecorder, "max")
+	wantRefused("/api/file", getFile(t, http.MethodGet, longPath, ""), "path")
+	for _, endpoint := range []struct {
+		url     string
+		handler http.HandlerFunc
+	}{
+		{"/api/manifest?path=", manifestHandler},
+		{"/api/follow?path=", followHandler},
+	} {
+		req := withClaims(httptest.NewRequest(http.MethodGet, endpoint.url+url.QueryEscape(longPath), nil), tester)
+		rec := httptest.NewRecorder()
+		endpoint.handler(rec, req)
+		wantRefused(endpoint.url, rec, "path")
+	}
+
+	params, _ := json.Marshal(map[string]string{"path": longPath})
+	resp := decodeRPC(t, postRPC(t, tester, `{"jsonrpc":"2.0","method":"read_file","params":`+string(params)+`,"id":1}`))
+	if resp.Error == nil || resp.Error.Code != rpcInvalidParams || resp.Error.Data == nil || resp.Error.Data.Details["parameter"] != "path" {
+		t.Errorf("JSON-RPC: %+v", resp.Error)
+	}
+
+	// Parameters within their limits still work.
+	if rec := getSearch(t, root, "TODO", "10"); rec.Code != http.StatusOK {
+		t.Errorf("ordinary search: %d %s", rec.Code, rec.Body)
+	}
+	if rec := postOperation(t, tester, Operation{Action: "write_file", Parameters: map[string]string{"path": filepath.Join(root, "big.txt"), "content": strings.Repeat("a", 100_000)}}); rec.Code != http.StatusOK {
+		t.Errorf("write with long content: %d %s", rec.Code, rec.Body)
+	}
+}
+
+// slotsHeld returns how many MaxConcurrentOps slots are taken and how many
+// operations the per-client counts hold.
+func slotsHeld() (running, counted int) {
+	opSlots.mu.Lock()
+	running = opSlots.running
+	opSlots.mu.Unlock()
+	clientSlots.mu.Lock()
+	defer clientSlots.mu.Unlock()
+	for _, n := range clientSlots.counts {
+		counted += n
+	}
+	return running, counted
+}
+
+func TestRPCReleasesSlotsWhenClientLeaves(t *testing.T) {
+	root := testRoot(t)
+	editConfig(t, func(c *Config) {
+		c.MaxConcurrentOps = 1
+		c.MaxOpsPerClient = 1
+	})
+	body := `{"jsonrpc":"2.0","method":"list_files","params":{"path":` + strconv.Quote(root) + `},"id":1}`
+	claims := jwt.MapClaims{"sub": "leaver"}
+
+	// The client is gone by the time the operation is admitted, which a
+	// free slot does without looking at the context.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := withClaims(httptest.NewRequest(http.MethodPost, "/api/rpc", strings.NewReader(body)).WithContext(ctx), claims)
+	rpcHandler(httptest.NewRecorder(), req)
+	if running, counted := slotsHeld(); running != 0 || counted != 0 {
+		t.Fatalf("after the client left: %d slots and %d client operations held", running, counted)
+	}
+
+	if resp := decodeRPC(t, postRPC(t, claims, body)); resp.Error != nil {
+		t.Errorf("the client's next call: %+v", resp.Error)
+	}
+}
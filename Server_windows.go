@@ -0,0 +1,47 @@
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var procGetDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// Windows reports a full disk with its own error codes rather than ENOSPC.
+const (
+	errorHandleDiskFull syscall.Errno = 39
+	errorDiskFull       syscall.Errno = 112
+)
+
+func init() {
+	statDisk = windowsDisk
+	noSpaceErrors = append(noSpaceErrors, errorHandleDiskFull, errorDiskFull)
+	fsyncer = windowsSyncer{}
+}
+
+// windowsSyncer syncs files only: a directory cannot be opened for
+// flushing, and NTFS journals the rename that makes a write durable.
+type windowsSyncer struct{ osSyncer }
+
+func (windowsSyncer) SyncDir(string) error {
+	return nil
+}
+
+func windowsDisk(path string) (diskUsage, error) {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return diskUsage{}, err
+	}
+
+	var free, total, totalFree uint64
+	r, _, err := procGetDiskFreeSpaceEx.Call(
+		uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(&free)),
+		uintptr(unsafe.Pointer(&total)),
+		uintptr(unsafe.Pointer(&totalFree)),
+	)
+	if r == 0 {
+		return diskUsage{}, err
+	}
+	return diskUsage{Total: total, Free: free, Used: total - totalFree}, nil
+}